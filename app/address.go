@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Address is a postal address. Orders keep a copy of the addresses they are
+// placed with, so later changes elsewhere do not rewrite their history.
+type Address struct {
+	Name       string `json:"name"`
+	Company    string `json:"company,omitempty"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"` // state or province
+	PostalCode string `json:"postal_code,omitempty"`
+	Country    string `json:"country"` // ISO 3166-1 alpha-2
+	Phone      string `json:"phone,omitempty"`
+}
+
+// AddressKind tells the addresses of an order apart.
+type AddressKind string
+
+const (
+	AddressShipping AddressKind = "shipping"
+	AddressBilling  AddressKind = "billing"
+)
+
+// addressFormat is what the post of a country requires of an address.
+type addressFormat struct {
+	postalCode         *regexp.Regexp // nil for countries without postal codes
+	postalCodeOptional bool
+	region             bool // the state or province is required
+}
+
+// addressFormats lists the countries we ship to most. Others need no region,
+// and their postal code, when given, is only checked by postalCodeFallback.
+var addressFormats = map[string]addressFormat{
+	"AT": {postalCode: regexp.MustCompile(`^\d{4}$`)},
+	"AU": {postalCode: regexp.MustCompile(`^\d{4}$`), region: true},
+	"BE": {postalCode: regexp.MustCompile(`^\d{4}$`)},
+	"CA": {postalCode: regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`), region: true},
+	"CH": {postalCode: regexp.MustCompile(`^\d{4}$`)},
+	"DE": {postalCode: regexp.MustCompile(`^\d{5}$`)},
+	"DK": {postalCode: regexp.MustCompile(`^\d{4}$`)},
+	"ES": {postalCode: regexp.MustCompile(`^\d{5}$`)},
+	"FI": {postalCode: regexp.MustCompile(`^\d{5}$`)},
+	"FR": {postalCode: regexp.MustCompile(`^\d{5}$`)},
+	"GB": {postalCode: regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`)},
+	"GR": {postalCode: regexp.MustCompile(`^\d{3} ?\d{2}$`)},
+	"HK": {},
+	"IE": {postalCode: regexp.MustCompile(`^[A-Z]\d[\dW] ?[0-9AC-FHKNPRTV-Y]{4}$`), postalCodeOptional: true},
+	"IT": {postalCode: regexp.MustCompile(`^\d{5}$`)},
+	"JP": {postalCode: regexp.MustCompile(`^\d{3}-\d{4}$`)},
+	"LU": {postalCode: regexp.MustCompile(`^(L-)?\d{4}$`)},
+	"NL": {postalCode: regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`)},
+	"PL": {postalCode: regexp.MustCompile(`^\d{2}-\d{3}$`)},
+	"PT": {postalCode: regexp.MustCompile(`^\d{4}-\d{3}$`)},
+	"SE": {postalCode: regexp.MustCompile(`^\d{3} ?\d{2}$`)},
+	"US": {postalCode: regexp.MustCompile(`^\d{5}(-\d{4})?$`), region: true},
+}
+
+var postalCodeFallback = regexp.MustCompile(`^[A-Z\d][A-Z\d -]{1,9}$`)
+
+var spaces = regexp.MustCompile(`\s+`)
+
+// returns a copy with trimmed fields, an upper-cased country and postal code
+// and the postal code's runs of spaces collapsed.
+func (a Address) normalized() Address {
+	for _, f := range []*string{&a.Name, &a.Company, &a.Line1, &a.Line2, &a.City, &a.Region, &a.Phone} {
+		*f = strings.TrimSpace(*f)
+	}
+	a.Country = normalizeCountry(a.Country)
+	a.PostalCode = spaces.ReplaceAllString(strings.ToUpper(strings.TrimSpace(a.PostalCode)), " ")
+	return a
+}
+
+// validates the normalized address, reporting errors under the given field name.
+func (a Address) validate(field string) []FieldError {
+	a = a.normalized()
+	var fields []FieldError
+	required := func(name, value string) {
+		if value == "" {
+			fields = append(fields, FieldError{Field: field + "." + name, Message: "is required"})
+		}
+	}
+	required("name", a.Name)
+	required("line1", a.Line1)
+	required("city", a.City)
+	if !countryPattern.MatchString(a.Country) {
+		return append(fields, FieldError{Field: field + ".country", Message: "must be an ISO 3166-1 alpha-2 code"})
+	}
+
+	format, known := addressFormats[a.Country]
+	if format.region {
+		required("region", a.Region)
+	}
+	switch {
+	case !known:
+		if a.PostalCode != "" && !postalCodeFallback.MatchString(a.PostalCode) {
+			fields = append(fields, FieldError{Field: field + ".postal_code", Message: "is not a postal code"})
+		}
+	case format.postalCode == nil:
+		if a.PostalCode != "" {
+			fields = append(fields, FieldError{Field: field + ".postal_code", Message: fmt.Sprintf("is not used in %s", a.Country)})
+		}
+	case a.PostalCode == "":
+		if !format.postalCodeOptional {
+			required("postal_code", a.PostalCode)
+		}
+	case !format.postalCode.MatchString(a.PostalCode):
+		fields = append(fields, FieldError{Field: field + ".postal_code", Message: fmt.Sprintf("is not a valid postal code for %s", a.Country)})
+	}
+	return fields
+}
+
+// --- Order Address Database Functions ---
+
+// stores a copy of an address of an order.
+func InsertOrderAddress(executor TxExecutor, orderID string, kind AddressKind, a *Address) error {
+	_, err := executor.Exec("INSERT INTO order_addresses (order_id, kind, name, company, line1, line2, city, region, postal_code, country, phone) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+		orderID, string(kind), a.Name, a.Company, a.Line1, a.Line2, a.City, a.Region, a.PostalCode, a.Country, a.Phone)
+	if err != nil {
+		return fmt.Errorf("failed to insert order %s address: %w", kind, err)
+	}
+	return nil
+}
+
+// fetches the addresses of an order by kind; orders placed without
+// addresses have none.
+func GetOrderAddresses(executor Queryer, orderID string) (map[AddressKind]*Address, error) {
+	rows, err := executor.Query("SELECT kind, name, company, line1, line2, city, region, postal_code, country, phone FROM order_addresses WHERE order_id = $1", orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query order addresses: %w", err)
+	}
+	defer rows.Close()
+
+	addresses := make(map[AddressKind]*Address)
+	for rows.Next() {
+		var kind string
+		var a Address
+		if err := rows.Scan(&kind, &a.Name, &a.Company, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country, &a.Phone); err != nil {
+			return nil, fmt.Errorf("failed to scan order address row: %w", err)
+		}
+		addresses[AddressKind(kind)] = &a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during order addresses iteration: %w", err)
+	}
+	return addresses, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressValidate(t *testing.T) {
+	valid := []Address{
+		{Name: "Mario Rossi", Line1: "Via Roma 1", City: "Milano", PostalCode: "20121", Country: "it"},
+		{Name: "Jan de Vries", Line1: "Damrak 1", City: "Amsterdam", PostalCode: "1012 lg", Country: "NL"},
+		{Name: "Ana Silva", Line1: "Rua Augusta 1", City: "Lisboa", PostalCode: "1100-048", Country: "PT"},
+		{Name: "John Smith", Line1: "1 Main St", City: "Springfield", Region: "IL", PostalCode: "62701-1234", Country: "US"},
+		{Name: "Jane Doe", Line1: "10 Downing St", City: "London", PostalCode: "sw1a  2aa", Country: "GB"},
+		{Name: "Seán Murphy", Line1: "1 Main St", City: "Cork", Country: "IE"},
+		{Name: "Chan Tai Man", Line1: "1 Queen's Road", City: "Hong Kong", Country: "HK"},
+		{Name: "Ivan Horvat", Line1: "Ilica 1", City: "Zagreb", PostalCode: "10000", Country: "HR"},
+	}
+	for _, a := range valid {
+		assert.Empty(t, a.validate("address"), a)
+	}
+	assert.Equal(t, "SW1A 2AA", valid[4].normalized().PostalCode)
+
+	for a, field := range map[Address]string{
+		{Line1: "Via Roma 1", City: "Milano", PostalCode: "20121", Country: "IT"}:                            "address.name",
+		{Name: "Mario Rossi", Line1: "Via Roma 1", City: "Milano", Country: "IT"}:                            "address.postal_code",
+		{Name: "Mario Rossi", Line1: "Via Roma 1", City: "Milano", PostalCode: "2012", Country: "IT"}:        "address.postal_code",
+		{Name: "Jan de Vries", Line1: "Damrak 1", City: "Amsterdam", PostalCode: "10121", Country: "NL"}:     "address.postal_code",
+		{Name: "John Smith", Line1: "1 Main St", City: "Springfield", PostalCode: "62701", Country: "US"}:    "address.region",
+		{Name: "Chan Tai Man", Line1: "1 Queen's Road", City: "Hong Kong", PostalCode: "000", Country: "HK"}: "address.postal_code",
+		{Name: "Mario Rossi", Line1: "Via Roma 1", City: "Milano", PostalCode: "20121", Country: "Italy"}:    "address.country",
+	} {
+		fields := a.validate("address")
+		if assert.Len(t, fields, 1, a) {
+			assert.Equal(t, field, fields[0].Field, a)
+		}
+	}
+}
+
+func TestOrderAddresses(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	createTaxRule(t, router, `{"tax_category":"standard","country":"DE","rate":0.19,"valid_from":"2020-01-01T00:00:00Z"}`)
+
+	order := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}],
+		"shipping_address":{"name":" Erika Mustermann ","line1":"Heidestraße 17","city":"Köln","postal_code":"51147","country":"de"},
+		"billing_address":{"name":"Erika Mustermann","company":"Muster GmbH","line1":"Postfach 10 01 01","city":"Berlin","postal_code":"10115","country":"DE"}}`)
+	require.NotNil(t, order.ShippingAddress)
+	require.NotNil(t, order.BillingAddress)
+	assert.Equal(t, "Erika Mustermann", order.ShippingAddress.Name)
+	assert.Equal(t, "DE", order.ShippingAddress.Country)
+	assert.Equal(t, 0.19, *order.Items[0].VATRate) // taxed where it is shipped to
+
+	rr := doJSON(router, "GET", "/orders/"+order.OrderID, "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var stored OutgoingOrder
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stored))
+	assert.Equal(t, order.ShippingAddress, stored.ShippingAddress)
+	assert.Equal(t, order.BillingAddress, stored.BillingAddress)
+
+	anonymous := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}]}`)
+	assert.Nil(t, anonymous.ShippingAddress)
+	rr = doJSON(router, "GET", "/orders/"+anonymous.OrderID, "")
+	assert.NotContains(t, rr.Body.String(), "shipping_address")
+
+	rr = doJSON(router, "POST", "/order", `{"items":[{"product_id":2,"quantity":1}],"country":"IT",
+		"shipping_address":{"name":"Erika Mustermann","line1":"Heidestraße 17","city":"Köln","postal_code":"5114","country":"DE"},
+		"billing_address":{"name":"Erika Mustermann","city":"Berlin","postal_code":"10115","country":"DE"}}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	for _, field := range []string{"shipping_address.postal_code", "country", "billing_address.line1"} {
+		assert.Contains(t, rr.Body.String(), `"field":"`+field+`"`)
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// CartStatus is the lifecycle state of a cart.
+type CartStatus string
+
+const (
+	CartOpen       CartStatus = "open"
+	CartCheckedOut CartStatus = "checked_out"
+	CartExpired    CartStatus = "expired"
+)
+
+var (
+	// ErrCartExpired is returned for carts whose reservation has run out.
+	ErrCartExpired = errors.New("cart has expired")
+	// ErrCartCheckedOut is returned for carts already turned into an order.
+	ErrCartCheckedOut = errors.New("cart has already been checked out")
+	// ErrCartEmpty is returned when checking out a cart without items.
+	ErrCartEmpty = errors.New("cart is empty")
+)
+
+// CartTTL is how long a cart holds its stock after its last change; set from CART_TTL in main.
+var CartTTL = 15 * time.Minute
+
+// how many expired carts a sweep releases at most.
+const cartSweepBatch = 100
+
+// CartItem is a product held by a cart.
+type CartItem struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+// Cart is a row of the 'carts' table with its items. While open it holds the
+// stock of its items, until ExpiresAt.
+type Cart struct {
+	CartID    string     `json:"cart_id"`
+	Status    CartStatus `json:"status"`
+	Items     []CartItem `json:"items"`
+	OrderID   string     `json:"order_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
+
+// CartItemsRequest is the request body of POST /carts and PUT /carts/{id}/items:
+// the full content of the cart.
+type CartItemsRequest struct {
+	Items []CartItem `json:"items"`
+}
+
+// CheckoutRequest is the request body of POST /carts/{id}/checkout.
+type CheckoutRequest struct {
+	ShipTo *GeoPoint `json:"ship_to,omitempty"`
+}
+
+// checks the items and returns the quantity of each product, summing the
+// lines of the same product.
+func (req CartItemsRequest) quantities() (map[int]int, []FieldError) {
+	var fields []FieldError
+	quantities := make(map[int]int)
+	for i, item := range req.Items {
+		if item.ProductID <= 0 {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("items[%d].product_id", i), Message: "must be a positive integer"})
+		}
+		if item.Quantity <= 0 {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("items[%d].quantity", i), Message: fmt.Sprintf("Quantity for product %d must be positive", item.ProductID)})
+		} else if item.Quantity > maxItemQuantity {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("items[%d].quantity", i), Message: fmt.Sprintf("must be at most %d", maxItemQuantity)})
+		}
+		quantities[item.ProductID] += item.Quantity
+	}
+	return quantities, fields
+}
+
+// --- Cart Database Functions ---
+
+// inserts a new cart, without items.
+func InsertCart(tx TxExecutor, cart *Cart) error {
+	_, err := tx.Exec("INSERT INTO carts (cart_id, status, created_at, updated_at, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		cart.CartID, string(cart.Status), cart.CreatedAt, cart.UpdatedAt, cart.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert cart: %w", err)
+	}
+	return nil
+}
+
+func getCart(executor Queryer, cartID string, forUpdate bool) (*Cart, error) {
+	query := "SELECT cart_id, status, COALESCE(order_id, ''), created_at, updated_at, expires_at FROM carts WHERE cart_id = $1"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	var cart Cart
+	var status string
+	err := executor.QueryRow(query, cartID).Scan(&cart.CartID, &status, &cart.OrderID, &cart.CreatedAt, &cart.UpdatedAt, &cart.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("cart not found: %w", sql.ErrNoRows)
+		}
+		return nil, fmt.Errorf("failed to scan cart: %w", err)
+	}
+	cart.Status = CartStatus(status)
+	if cart.Items, err = GetCartItems(executor, cartID); err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// fetches a cart with its items.
+func GetCart(executor Queryer, cartID string) (*Cart, error) {
+	return getCart(executor, cartID, false)
+}
+
+// fetches a cart with its items, locking the cart row until the transaction
+// ends. Every change to a cart takes this lock first.
+func GetCartForUpdate(tx TxExecutor, cartID string) (*Cart, error) {
+	return getCart(tx, cartID, true)
+}
+
+// fetches the items of a cart by product ID.
+func GetCartItems(executor Queryer, cartID string) ([]CartItem, error) {
+	rows, err := executor.Query("SELECT product_id, quantity FROM cart_items WHERE cart_id = $1 ORDER BY product_id", cartID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cart items: %w", err)
+	}
+	defer rows.Close()
+
+	items := []CartItem{}
+	for rows.Next() {
+		var item CartItem
+		if err := rows.Scan(&item.ProductID, &item.Quantity); err != nil {
+			return nil, fmt.Errorf("failed to scan cart item row: %w", err)
+		}
+		items = append(items, item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during cart items iteration: %w", err)
+	}
+	return items, nil
+}
+
+// locks an open cart for a change. Carts past their expiry are refused even
+// before the sweeper has released them.
+func openCartForUpdate(tx TxExecutor, cartID string, now time.Time) (*Cart, error) {
+	cart, err := GetCartForUpdate(tx, cartID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cart.Status == CartCheckedOut:
+		return nil, ErrCartCheckedOut
+	case cart.Status == CartExpired, !now.Before(cart.ExpiresAt):
+		return nil, ErrCartExpired
+	}
+	return cart, nil
+}
+
+// SetCartItems replaces the items of an open cart with the given quantities,
+// by product ID, inside tx, and extends its reservation by CartTTL. Only the
+// products whose quantity changed have their hold released and taken again.
+func SetCartItems(tx TxExecutor, cartID string, quantities map[int]int, now time.Time) (*Cart, error) {
+	cart, err := openCartForUpdate(tx, cartID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[int]int)
+	for _, item := range cart.Items {
+		current[item.ProductID] = item.Quantity
+	}
+	changed := make(map[int]int)
+	for productID, qty := range current {
+		if quantities[productID] != qty {
+			changed[productID] = quantities[productID]
+		}
+	}
+	for productID, qty := range quantities {
+		if current[productID] != qty {
+			changed[productID] = qty
+			if _, err := GetProductByID(tx, productID); err != nil {
+				return nil, productError(err, productID)
+			}
+		}
+	}
+
+	if len(changed) > 0 {
+		// lock every product involved in ID order before releasing and taking
+		// again, so that carts and orders cannot deadlock
+		for _, productID := range slices.Sorted(maps.Keys(changed)) {
+			if _, err := GetProductStockForUpdate(tx, productID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return nil, err
+			}
+		}
+		changedIDs := slices.Collect(maps.Keys(changed))
+		if err := releaseStock(tx, StockMovement{Kind: MovementCartRelease, CartID: cartID, CreatedAt: now}, changedIDs); err != nil {
+			return nil, err
+		}
+		hold := make(map[int]int)
+		for productID, qty := range changed {
+			if qty > 0 {
+				hold[productID] = qty
+			}
+		}
+		if _, err := reserveStock(tx, hold, DefaultAllocationStrategy, nil, StockMovement{Kind: MovementCartHold, CartID: cartID, CreatedAt: now}); err != nil {
+			return nil, stockError(err)
+		}
+
+		if _, err := tx.Exec("DELETE FROM cart_items WHERE cart_id = $1", cartID); err != nil {
+			return nil, fmt.Errorf("failed to clear cart items: %w", err)
+		}
+		for _, productID := range slices.Sorted(maps.Keys(quantities)) {
+			if _, err := tx.Exec("INSERT INTO cart_items (cart_id, product_id, quantity) VALUES ($1, $2, $3)", cartID, productID, quantities[productID]); err != nil {
+				return nil, fmt.Errorf("failed to insert cart item: %w", err)
+			}
+		}
+	}
+
+	cart.UpdatedAt, cart.ExpiresAt = now, now.Add(CartTTL)
+	if _, err := tx.Exec("UPDATE carts SET updated_at = $1, expires_at = $2 WHERE cart_id = $3", cart.UpdatedAt, cart.ExpiresAt, cartID); err != nil {
+		return nil, fmt.Errorf("failed to update cart: %w", err)
+	}
+	return cart, nil
+}
+
+// CheckoutCart turns an open cart into an order inside tx. The cart's hold is
+// released and the order reserves the same units again, in the same
+// transaction, through CreateOrder.
+func CheckoutCart(tx TxExecutor, cartID string, shipTo *GeoPoint, now time.Time) (*OutgoingOrder, error) {
+	cart, err := openCartForUpdate(tx, cartID, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(cart.Items) == 0 {
+		return nil, ErrCartEmpty
+	}
+
+	if err := releaseStock(tx, StockMovement{Kind: MovementCartRelease, CartID: cartID, CreatedAt: now}, nil); err != nil {
+		return nil, err
+	}
+	incomingOrder := &IncomingOrder{ShipTo: shipTo}
+	for _, item := range cart.Items {
+		incomingOrder.Items = append(incomingOrder.Items, IncomingOrderItem{ProductID: item.ProductID, Quantity: item.Quantity})
+	}
+	order, err := CreateOrder(tx, incomingOrder, now)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE carts SET status = $1, order_id = $2, updated_at = $3 WHERE cart_id = $4", string(CartCheckedOut), order.OrderID, now, cartID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check out cart: %w", err)
+	}
+	return order, nil
+}
+
+// ExpireCart releases the hold of a cart past its expiry and marks it expired,
+// inside tx. It reports false if the cart is no longer open or was extended
+// in the meantime.
+func ExpireCart(tx TxExecutor, cartID string, now time.Time) (bool, error) {
+	cart, err := GetCartForUpdate(tx, cartID)
+	if err != nil {
+		return false, err
+	}
+	if cart.Status != CartOpen || now.Before(cart.ExpiresAt) {
+		return false, nil
+	}
+	if err := releaseStock(tx, StockMovement{Kind: MovementCartRelease, CartID: cartID, Note: "expired", CreatedAt: now}, nil); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE carts SET status = $1, updated_at = $2 WHERE cart_id = $3", string(CartExpired), now, cartID); err != nil {
+		return false, fmt.Errorf("failed to expire cart: %w", err)
+	}
+	return true, nil
+}
+
+// ExpireCarts releases the carts that expired before now, each in its own
+// transaction so that one failure does not hold back the others, and returns
+// how many it released.
+func ExpireCarts(executor DBExecutor, now time.Time) (int, error) {
+	rows, err := executor.Query("SELECT cart_id FROM carts WHERE status = $1 AND expires_at <= $2 ORDER BY expires_at LIMIT $3", string(CartOpen), now, cartSweepBatch)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query expired carts: %w", err)
+	}
+	var cartIDs []string
+	for rows.Next() {
+		var cartID string
+		if err := rows.Scan(&cartID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan expired cart: %w", err)
+		}
+		cartIDs = append(cartIDs, cartID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error during expired carts iteration: %w", err)
+	}
+
+	expired := 0
+	var errs []error
+	for _, cartID := range cartIDs {
+		ok, err := func() (bool, error) {
+			tx, err := executor.Begin()
+			if err != nil {
+				return false, err
+			}
+			defer tx.Rollback()
+			ok, err := ExpireCart(tx, cartID, now)
+			if err != nil || !ok {
+				return false, err
+			}
+			return true, tx.Commit()
+		}()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cart %s: %w", cartID, err))
+		} else if ok {
+			expired++
+		}
+	}
+	return expired, errors.Join(errs...)
+}
+
+// periodically releases expired carts until the process exits.
+func startCartSweeper(executor DBExecutor, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			n, err := ExpireCarts(executor, time.Now())
+			if err != nil {
+				log.Printf("cart sweeper: %v", err)
+			}
+			if n > 0 {
+				log.Printf("cart sweeper: released %d expired carts", n)
+			}
+		}
+	}()
+}
+
+// --- Cart HTTP Handlers ---
+
+// maps a cart lookup or write failure to the API error sent to the client.
+func cartError(err error, cartID string) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNotFound("Cart %s not found", cartID)
+	case errors.Is(err, ErrCartExpired):
+		return ErrConflict(CodeCartExpired, "Cart %s has expired", cartID)
+	case errors.Is(err, ErrCartCheckedOut):
+		return ErrConflict(CodeCartCheckedOut, "Cart %s has already been checked out", cartID)
+	case errors.Is(err, ErrCartEmpty):
+		return ErrValidation(FieldError{Field: "items", Message: "Cart must contain at least one item"})
+	}
+	return err
+}
+
+func writeCart(w http.ResponseWriter, executor Queryer, cartID string, status int) error {
+	cart, err := GetCart(executor, cartID)
+	if err != nil {
+		return cartError(err, cartID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status == http.StatusCreated {
+		w.Header().Set("Location", "/carts/"+cartID)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(cart)
+	return nil
+}
+
+// POST /carts, with an optional body holding the first items.
+func createCartHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CartItemsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		quantities, fields := req.quantities()
+		if len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		now := time.Now()
+		cart := &Cart{CartID: uuid.New().String(), Status: CartOpen, CreatedAt: now, UpdatedAt: now, ExpiresAt: now.Add(CartTTL)}
+		if err := InsertCart(tx, cart); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if _, err := SetCartItems(tx, cart.CartID, quantities, now); err != nil {
+			writeError(w, r, cartError(err, cart.CartID))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if err := writeCart(w, executor, cart.CartID, http.StatusCreated); err != nil {
+			writeError(w, r, err)
+		}
+	}
+}
+
+// GET /carts/{id}
+func getCartHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := writeCart(w, executor, mux.Vars(r)["id"], http.StatusOK); err != nil {
+			writeError(w, r, err)
+		}
+	}
+}
+
+// PUT /carts/{id}/items replaces the items of the cart.
+func setCartItemsHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cartID := mux.Vars(r)["id"]
+
+		var req CartItemsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		quantities, fields := req.quantities()
+		if len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := SetCartItems(tx, cartID, quantities, time.Now()); err != nil {
+			writeError(w, r, cartError(err, cartID))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if err := writeCart(w, executor, cartID, http.StatusOK); err != nil {
+			writeError(w, r, err)
+		}
+	}
+}
+
+// POST /carts/{id}/checkout
+func checkoutCartHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cartID := mux.Vars(r)["id"]
+
+		var req CheckoutRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		if req.ShipTo != nil {
+			if fields := req.ShipTo.validate("ship_to"); len(fields) > 0 {
+				writeError(w, r, ErrValidation(fields...))
+				return
+			}
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		order, err := CheckoutCart(tx, cartID, req.ShipTo, time.Now())
+		if err != nil {
+			writeError(w, r, cartError(err, cartID))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/orders/"+order.OrderID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(order)
+	}
+}
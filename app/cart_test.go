@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// creates a cart through the API and returns the decoded response.
+func createCart(t *testing.T, router http.Handler, body string) Cart {
+	t.Helper()
+	rr := doJSON(router, "POST", "/carts", body)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var cart Cart
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&cart))
+	return cart
+}
+
+func errorCode(t *testing.T, body []byte) ErrorCode {
+	t.Helper()
+	var envelope errorEnvelope
+	require.NoError(t, json.Unmarshal(body, &envelope))
+	return envelope.Error.Code
+}
+
+func TestCart_HoldsStockAndChecksOut(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	cart := createCart(t, router, `{"items":[{"product_id":1,"quantity":2}]}`)
+	assert.Equal(t, CartOpen, cart.Status)
+	assert.Equal(t, []CartItem{{ProductID: 1, Quantity: 2}}, cart.Items)
+	assert.WithinDuration(t, time.Now().Add(CartTTL), cart.ExpiresAt, time.Minute)
+	assert.Equal(t, sampleStock-2, getStockLevel(t, router, "1").Stock)
+
+	rr := doJSON(router, "PUT", "/carts/"+cart.CartID+"/items", `{"items":[{"product_id":2,"quantity":3},{"product_id":1,"quantity":1}]}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&cart))
+	assert.Equal(t, []CartItem{{ProductID: 1, Quantity: 1}, {ProductID: 2, Quantity: 3}}, cart.Items)
+	level := getStockLevel(t, router, "1")
+	assert.Equal(t, sampleStock-1, level.Stock)
+	assert.Equal(t, MovementCartHold, level.Movements[0].Kind)
+	assert.Equal(t, cart.CartID, level.Movements[0].CartID)
+	assert.Equal(t, sampleStock-3, getStockLevel(t, router, "2").Stock)
+
+	rr = doJSON(router, "POST", "/carts/"+cart.CartID+"/checkout", "")
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var order OutgoingOrder
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&order))
+	require.Len(t, order.Items, 2)
+	assert.Equal(t, StatusPending, order.Status)
+	assert.Equal(t, MustParseMoney("1739.96", DefaultCurrency), order.TotalOrderPrice)
+
+	// the order now holds the units the cart held
+	level = getStockLevel(t, router, "1")
+	assert.Equal(t, sampleStock-1, level.Stock)
+	assert.Equal(t, MovementOrder, level.Movements[0].Kind)
+	assert.Equal(t, sampleStock-3, getStockLevel(t, router, "2").Stock)
+
+	rr = doJSON(router, "GET", "/carts/"+cart.CartID, "")
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&cart))
+	assert.Equal(t, CartCheckedOut, cart.Status)
+	assert.Equal(t, order.OrderID, cart.OrderID)
+
+	rr = doJSON(router, "POST", "/carts/"+cart.CartID+"/checkout", "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, CodeCartCheckedOut, errorCode(t, rr.Body.Bytes()))
+	rr = doJSON(router, "PUT", "/carts/"+cart.CartID+"/items", `{"items":[]}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// the sweeper leaves checked out carts alone
+	n, err := ExpireCarts(&InMemoryDB{store: store}, time.Now().Add(2*CartTTL))
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Equal(t, sampleStock-1, getStockLevel(t, router, "1").Stock)
+}
+
+func TestCart_SweeperReleasesExpiredCarts(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	db := &InMemoryDB{store: store}
+
+	rr := doJSON(router, "PUT", "/products/3/stock", `{"stock":3,"note":"last units"}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	first := createCart(t, router, `{"items":[{"product_id":3,"quantity":2}]}`)
+
+	rr = doJSON(router, "POST", "/carts", `{"items":[{"product_id":3,"quantity":2}]}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, CodeInsufficientStock, errorCode(t, rr.Body.Bytes()))
+
+	n, err := ExpireCarts(db, time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, n, "the cart has not expired yet")
+
+	n, err = ExpireCarts(db, first.ExpiresAt)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	level := getStockLevel(t, router, "3")
+	assert.Equal(t, 3, level.Stock)
+	assert.Equal(t, MovementCartRelease, level.Movements[0].Kind)
+	assert.Equal(t, "expired", level.Movements[0].Note)
+
+	rr = doJSON(router, "GET", "/carts/"+first.CartID, "")
+	var cart Cart
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&cart))
+	assert.Equal(t, CartExpired, cart.Status)
+	rr = doJSON(router, "POST", "/carts/"+first.CartID+"/checkout", "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, CodeCartExpired, errorCode(t, rr.Body.Bytes()))
+
+	createCart(t, router, `{"items":[{"product_id":3,"quantity":2}]}`)
+	n, err = ExpireCarts(db, first.ExpiresAt)
+	require.NoError(t, err)
+	assert.Zero(t, n, "released carts are not released again")
+	assert.Equal(t, 1, getStockLevel(t, router, "3").Stock)
+}
+
+func TestCart_ExpiredButNotSweptCannotCheckOut(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	db := &InMemoryDB{store: store}
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, InsertCart(tx, &Cart{CartID: "stale", Status: CartOpen, CreatedAt: past, UpdatedAt: past, ExpiresAt: past.Add(CartTTL)}))
+	require.NoError(t, tx.Commit())
+
+	tx, err = db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+	_, err = CheckoutCart(tx, "stale", nil, time.Now())
+	assert.ErrorIs(t, err, ErrCartExpired)
+}
+
+func TestCart_CheckoutRacingTheSweeper(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	db := &InMemoryDB{store: store}
+
+	for range 20 {
+		cart := createCart(t, router, `{"items":[{"product_id":4,"quantity":1}]}`)
+		done := make(chan error)
+		go func() {
+			_, err := ExpireCarts(db, cart.ExpiresAt)
+			done <- err
+		}()
+		rr := doJSON(router, "POST", "/carts/"+cart.CartID+"/checkout", "")
+		require.NoError(t, <-done)
+
+		rr = doJSON(router, "GET", "/carts/"+cart.CartID, "")
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&cart))
+		assert.Contains(t, []CartStatus{CartCheckedOut, CartExpired}, cart.Status)
+	}
+	// every unit is either in an order or back in stock
+	var ordered int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM carts WHERE status = $1", string(CartCheckedOut)).Scan(&ordered))
+	assert.Equal(t, sampleStock-ordered, getStockLevel(t, router, "4").Stock)
+}
+
+func TestCart_Invalid(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	cart := createCart(t, router, "")
+	assert.Empty(t, cart.Items)
+	rr := doJSON(router, "POST", "/carts/"+cart.CartID+"/checkout", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"items"`)
+
+	for body, field := range map[string]string{
+		`{"items":[{"product_id":0,"quantity":1}]}`:     "items[0].product_id",
+		`{"items":[{"product_id":1,"quantity":0}]}`:     "items[0].quantity",
+		`{"items":[{"product_id":1,"quantity":10001}]}`: "items[0].quantity",
+	} {
+		rr = doJSON(router, "PUT", "/carts/"+cart.CartID+"/items", body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Contains(t, rr.Body.String(), `"field":"`+field+`"`, body)
+	}
+	rr = doJSON(router, "PUT", "/carts/"+cart.CartID+"/items", `{"items":[{"product_id":99,"quantity":1}]}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Product with ID 99 not found")
+
+	rr = doJSON(router, "GET", "/carts/nope", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = doJSON(router, "POST", "/carts/nope/checkout", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
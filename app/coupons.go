@@ -0,0 +1,582 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CouponKind tells how a coupon computes its discount.
+type CouponKind string
+
+const (
+	CouponPercentage  CouponKind = "percentage"   // Rate off the eligible items
+	CouponFixedAmount CouponKind = "fixed_amount" // Amount off the eligible items, spread across them
+	CouponFreeItem    CouponKind = "free_item"    // FreeQuantity units of ProductID for free
+)
+
+// couponCodePattern is what coupon codes look like once upper-cased.
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{1,32}$`)
+
+// ErrCouponNotApplicable is wrapped by CouponNotApplicableError.
+var ErrCouponNotApplicable = errors.New("coupon not applicable")
+
+// CouponNotApplicableError is returned when an order cannot use a coupon:
+// it is inactive, outside its validity window, used up, the order does not
+// reach its minimum spend or holds nothing it applies to.
+type CouponNotApplicableError struct {
+	Code   string
+	Reason string
+}
+
+func (e *CouponNotApplicableError) Error() string {
+	return fmt.Sprintf("coupon %s cannot be applied: %s", e.Code, e.Reason)
+}
+
+func (e *CouponNotApplicableError) Unwrap() error { return ErrCouponNotApplicable }
+
+// Coupon is a discount orders can claim by code. A coupon is scoped to the
+// items of one product or one category, or to the whole order when neither
+// is set; free item coupons are always scoped to their product.
+type Coupon struct {
+	Code         string     `json:"code"`
+	Kind         CouponKind `json:"kind"`
+	Rate         float64    `json:"rate,omitempty"`          // percentage, e.g. 0.1 for 10%
+	Amount       Money      `json:"amount"`                  // fixed_amount
+	FreeQuantity int        `json:"free_quantity,omitempty"` // free_item
+	MinSpend     Money      `json:"min_spend"`               // on the order subtotal, before discounts
+	ProductID    int        `json:"product_id,omitempty"`
+	Category     string     `json:"category,omitempty"`
+	ValidFrom    *time.Time `json:"valid_from,omitempty"`
+	ValidUntil   *time.Time `json:"valid_until,omitempty"`
+	MaxUses      int        `json:"max_uses,omitempty"` // 0 is unlimited
+	Uses         int        `json:"uses"`
+	Active       bool       `json:"active"`
+}
+
+// AppliedDiscount is a coupon as applied to an order.
+type AppliedDiscount struct {
+	Code   string     `json:"code"`
+	Kind   CouponKind `json:"kind"`
+	Amount Money      `json:"amount"`
+}
+
+// CouponInput is the request body for creating and replacing coupons. The
+// code is taken from the URL when replacing, and uses are never set by clients.
+type CouponInput struct {
+	Code         string     `json:"code"`
+	Kind         CouponKind `json:"kind"`
+	Rate         float64    `json:"rate"`
+	Amount       *Money     `json:"amount"`
+	FreeQuantity int        `json:"free_quantity"`
+	MinSpend     *Money     `json:"min_spend"`
+	ProductID    int        `json:"product_id"`
+	Category     string     `json:"category"`
+	ValidFrom    *time.Time `json:"valid_from"`
+	ValidUntil   *time.Time `json:"valid_until"`
+	MaxUses      int        `json:"max_uses"`
+	Active       *bool      `json:"active"`
+}
+
+// normalizes a coupon code as typed by a customer.
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// checks the input and turns it into the coupon to write.
+func (in CouponInput) toCoupon() (*Coupon, []FieldError) {
+	c := &Coupon{
+		Code:         normalizeCouponCode(in.Code),
+		Kind:         CouponKind(strings.ToLower(strings.TrimSpace(string(in.Kind)))),
+		Rate:         in.Rate,
+		Amount:       NewMoney(0, DefaultCurrency),
+		FreeQuantity: in.FreeQuantity,
+		MinSpend:     NewMoney(0, DefaultCurrency),
+		ProductID:    in.ProductID,
+		Category:     strings.ToLower(strings.TrimSpace(in.Category)),
+		ValidFrom:    in.ValidFrom,
+		ValidUntil:   in.ValidUntil,
+		MaxUses:      in.MaxUses,
+		Active:       in.Active == nil || *in.Active,
+	}
+	if in.Amount != nil {
+		c.Amount = *in.Amount
+	}
+	if in.MinSpend != nil {
+		c.MinSpend = *in.MinSpend
+	}
+
+	var fields []FieldError
+	if !couponCodePattern.MatchString(c.Code) {
+		fields = append(fields, FieldError{Field: "code", Message: "must be 1 to 32 letters, digits, '-' or '_'"})
+	}
+	switch c.Kind {
+	case CouponPercentage:
+		if c.Rate <= 0 || c.Rate > 1 {
+			fields = append(fields, FieldError{Field: "rate", Message: "must be greater than 0 and at most 1"})
+		}
+	case CouponFixedAmount:
+		if c.Amount.IsNegative() || c.Amount.IsZero() {
+			fields = append(fields, FieldError{Field: "amount", Message: "must be positive"})
+		}
+	case CouponFreeItem:
+		if c.FreeQuantity <= 0 {
+			fields = append(fields, FieldError{Field: "free_quantity", Message: "must be positive"})
+		}
+		if c.ProductID == 0 {
+			fields = append(fields, FieldError{Field: "product_id", Message: "is required for free_item coupons"})
+		}
+	default:
+		fields = append(fields, FieldError{Field: "kind", Message: "must be one of percentage, fixed_amount, free_item"})
+	}
+	if c.ProductID < 0 {
+		fields = append(fields, FieldError{Field: "product_id", Message: "must be positive"})
+	}
+	if c.ProductID != 0 && c.Category != "" {
+		fields = append(fields, FieldError{Field: "category", Message: "cannot be combined with product_id"})
+	}
+	if c.MinSpend.IsNegative() {
+		fields = append(fields, FieldError{Field: "min_spend", Message: "must not be negative"})
+	}
+	fields = append(fields, checkCatalogAmount("amount", c.Amount)...)
+	fields = append(fields, checkCatalogAmount("min_spend", c.MinSpend)...)
+	if c.ValidFrom != nil && c.ValidUntil != nil && !c.ValidUntil.After(*c.ValidFrom) {
+		fields = append(fields, FieldError{Field: "valid_until", Message: "must be after valid_from"})
+	}
+	if c.MaxUses < 0 {
+		fields = append(fields, FieldError{Field: "max_uses", Message: "must not be negative"})
+	}
+	return c, fields
+}
+
+// reports why the coupon cannot be used at now on an order worth subtotal,
+// or nil.
+func (c *Coupon) checkUsable(now time.Time, subtotal Money) error {
+	reason := ""
+	switch {
+	case !c.Active:
+		reason = "it is no longer active"
+	case c.ValidFrom != nil && now.Before(*c.ValidFrom):
+		reason = "it is not valid yet"
+	case c.ValidUntil != nil && !now.Before(*c.ValidUntil):
+		reason = "it has expired"
+	case c.MaxUses > 0 && c.Uses >= c.MaxUses:
+		reason = "it has been used up"
+	case subtotal.Cmp(c.MinSpend) < 0:
+		reason = fmt.Sprintf("the order does not reach the minimum spend of %s", c.MinSpend)
+	}
+	if reason != "" {
+		return &CouponNotApplicableError{Code: c.Code, Reason: reason}
+	}
+	return nil
+}
+
+// reports whether the coupon applies to a priced line.
+func (c *Coupon) appliesTo(line *PricedItem) bool {
+	switch {
+	case c.ProductID != 0:
+		return line.ProductID == c.ProductID
+	case c.Category != "":
+		return line.Category == c.Category
+	}
+	return true
+}
+
+// discounts the eligible lines, on what earlier coupons left of them, and
+// returns the discount granted. A line never goes below zero.
+func (c *Coupon) apply(lines []PricedItem) (AppliedDiscount, error) {
+	var eligible []*PricedItem
+	for i := range lines {
+		if c.appliesTo(&lines[i]) {
+			eligible = append(eligible, &lines[i])
+		}
+	}
+	if len(eligible) == 0 {
+		return AppliedDiscount{}, &CouponNotApplicableError{Code: c.Code, Reason: "the order holds no item it applies to"}
+	}
+
+	discounts := make([]Money, len(eligible))
+	switch c.Kind {
+	case CouponPercentage:
+		for i, line := range eligible {
+			discount, err := line.discounted().MulRate(c.Rate, DefaultRoundingMode)
+			if err != nil {
+				return AppliedDiscount{}, err
+			}
+			discounts[i] = discount
+		}
+	case CouponFixedAmount:
+		bases := make([]Money, len(eligible))
+		var base Money
+		for i, line := range eligible {
+			bases[i] = line.discounted()
+			base = base.Add(bases[i])
+		}
+		amount := c.Amount
+		if amount.Cmp(base) > 0 {
+			amount = base
+		}
+		discounts = prorate(amount, bases)
+	case CouponFreeItem:
+		free := c.FreeQuantity
+		for i, line := range eligible {
+			units := min(free, line.Quantity)
+			free -= units
+			discounts[i] = line.UnitPrice.Mul(int64(units))
+		}
+	}
+
+	applied := AppliedDiscount{Code: c.Code, Kind: c.Kind, Amount: NewMoney(0, eligible[0].LineTotal.Currency)}
+	for i, line := range eligible {
+		d := discounts[i]
+		if net := line.discounted(); d.Cmp(net) > 0 {
+			d = net
+		}
+		line.Discount = line.Discount.Add(d)
+		applied.Amount = applied.Amount.Add(d)
+	}
+	return applied, nil
+}
+
+// splits total across the weights in proportion to them, handing the minor
+// units left over by rounding down to the first lines.
+func prorate(total Money, weights []Money) []Money {
+	shares := make([]Money, len(weights))
+	var sum int64
+	for _, w := range weights {
+		sum += w.Amount
+	}
+	if sum == 0 {
+		for i := range shares {
+			shares[i] = NewMoney(0, total.Currency)
+		}
+		return shares
+	}
+	left := total.Amount
+	for i, w := range weights {
+		share := new(big.Int).Mul(big.NewInt(total.Amount), big.NewInt(w.Amount))
+		share.Quo(share, big.NewInt(sum))
+		shares[i] = NewMoney(share.Int64(), total.Currency)
+		left -= share.Int64()
+	}
+	for i := 0; left > 0; i = (i + 1) % len(shares) {
+		if shares[i].Amount < weights[i].Amount {
+			shares[i].Amount++
+			left--
+		}
+	}
+	return shares
+}
+
+// --- Coupon Database Functions ---
+
+const selectCouponSQL = "SELECT code, kind, rate, amount, free_quantity, min_spend, COALESCE(product_id, 0), category, valid_from, valid_until, COALESCE(max_uses, 0), uses, active FROM coupons"
+
+func scanCoupon(row RowLike) (*Coupon, error) {
+	var c Coupon
+	var kind string
+	var from, until sql.NullTime
+	err := row.Scan(&c.Code, &kind, &c.Rate, &c.Amount, &c.FreeQuantity, &c.MinSpend, &c.ProductID, &c.Category,
+		&from, &until, &c.MaxUses, &c.Uses, &c.Active)
+	if err != nil {
+		return nil, err
+	}
+	c.Kind = CouponKind(kind)
+	if from.Valid {
+		c.ValidFrom = &from.Time
+	}
+	if until.Valid {
+		c.ValidUntil = &until.Time
+	}
+	return &c, nil
+}
+
+// fetches a coupon by its code.
+func GetCouponByCode(executor Queryer, code string) (*Coupon, error) {
+	c, err := scanCoupon(executor.QueryRow(selectCouponSQL+" WHERE code = $1", code))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("coupon not found: %w", sql.ErrNoRows)
+		}
+		return nil, fmt.Errorf("failed to scan coupon: %w", err)
+	}
+	return c, nil
+}
+
+// fetches every coupon, ordered by code.
+func GetCoupons(executor Queryer) ([]Coupon, error) {
+	rows, err := executor.Query(selectCouponSQL + " ORDER BY code")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query coupons: %w", err)
+	}
+	defer rows.Close()
+
+	coupons := []Coupon{}
+	for rows.Next() {
+		c, err := scanCoupon(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan coupon row: %w", err)
+		}
+		coupons = append(coupons, *c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during coupons iteration: %w", err)
+	}
+	return coupons, nil
+}
+
+// the optional columns of a coupon are NULL when unset.
+func nullInt(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n != 0}
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
+
+// inserts a coupon. It returns a wrapped sql.ErrNoRows if the code is taken.
+func InsertCoupon(executor TxExecutor, c *Coupon, now time.Time) error {
+	var code string
+	err := executor.QueryRow("INSERT INTO coupons (code, kind, rate, amount, free_quantity, min_spend, product_id, category, valid_from, valid_until, max_uses, active, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) ON CONFLICT (code) DO NOTHING RETURNING code",
+		c.Code, string(c.Kind), c.Rate, c.Amount, c.FreeQuantity, c.MinSpend, nullInt(c.ProductID), c.Category,
+		nullTime(c.ValidFrom), nullTime(c.ValidUntil), nullInt(c.MaxUses), c.Active, now).Scan(&code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("coupon code %s is taken: %w", c.Code, sql.ErrNoRows)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert coupon: %w", err)
+	}
+	return nil
+}
+
+// overwrites every field of a coupon but its code and uses.
+func UpdateCoupon(executor TxExecutor, c *Coupon) error {
+	res, err := executor.Exec("UPDATE coupons SET kind = $1, rate = $2, amount = $3, free_quantity = $4, min_spend = $5, product_id = $6, category = $7, valid_from = $8, valid_until = $9, max_uses = $10, active = $11 WHERE code = $12",
+		string(c.Kind), c.Rate, c.Amount, c.FreeQuantity, c.MinSpend, nullInt(c.ProductID), c.Category,
+		nullTime(c.ValidFrom), nullTime(c.ValidUntil), nullInt(c.MaxUses), c.Active, c.Code)
+	if err != nil {
+		return fmt.Errorf("failed to update coupon: %w", err)
+	}
+	return requireRowAffected(res, "coupon not found")
+}
+
+// deactivates a coupon; it stays referenced by the orders that used it.
+func DeactivateCoupon(executor TxExecutor, code string) error {
+	res, err := executor.Exec("UPDATE coupons SET active = false WHERE code = $1", code)
+	if err != nil {
+		return fmt.Errorf("failed to deactivate coupon: %w", err)
+	}
+	return requireRowAffected(res, "coupon not found")
+}
+
+// counts one use of a coupon, unless its usage limit has been reached in the
+// meantime, in which case a *CouponNotApplicableError is returned.
+func RedeemCoupon(executor TxExecutor, code string) error {
+	res, err := executor.Exec("UPDATE coupons SET uses = uses + 1 WHERE code = $1 AND (max_uses IS NULL OR uses < max_uses)", code)
+	if err != nil {
+		return fmt.Errorf("failed to redeem coupon: %w", err)
+	}
+	if err := requireRowAffected(res, "coupon used up"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &CouponNotApplicableError{Code: code, Reason: "it has been used up"}
+		}
+		return err
+	}
+	return nil
+}
+
+// records the discounts applied to an order, in the order they were applied.
+func InsertOrderDiscounts(executor TxExecutor, orderID string, discounts []AppliedDiscount) error {
+	for i, d := range discounts {
+		_, err := executor.Exec("INSERT INTO order_discounts (order_id, position, coupon_code, kind, amount) VALUES ($1, $2, $3, $4, $5)",
+			orderID, i, d.Code, string(d.Kind), d.Amount)
+		if err != nil {
+			return fmt.Errorf("failed to insert order discount: %w", err)
+		}
+	}
+	return nil
+}
+
+// fetches the discounts applied to an order.
+func GetOrderDiscounts(executor Queryer, orderID string) ([]AppliedDiscount, error) {
+	rows, err := executor.Query("SELECT coupon_code, kind, amount FROM order_discounts WHERE order_id = $1 ORDER BY position", orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query order discounts: %w", err)
+	}
+	defer rows.Close()
+
+	var discounts []AppliedDiscount
+	for rows.Next() {
+		var d AppliedDiscount
+		var kind string
+		if err := rows.Scan(&d.Code, &kind, &d.Amount); err != nil {
+			return nil, fmt.Errorf("failed to scan order discount row: %w", err)
+		}
+		d.Kind = CouponKind(kind)
+		discounts = append(discounts, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during order discounts iteration: %w", err)
+	}
+	return discounts, nil
+}
+
+// --- Coupon HTTP Handlers ---
+
+// maps a coupon lookup or redemption failure to the API error sent to the client.
+func couponError(err error, code string) error {
+	var notApplicable *CouponNotApplicableError
+	if errors.As(err, &notApplicable) {
+		return ErrConflict(CodeCouponNotApplicable, "Coupon %s cannot be applied: %s", notApplicable.Code, notApplicable.Reason).
+			WithDetail("code", notApplicable.Code)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound("Coupon %s not found", code)
+	}
+	return err
+}
+
+// GET /coupons
+func getCouponsHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		coupons, err := GetCoupons(executor)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(coupons)
+	}
+}
+
+// GET /coupons/{code}
+func getCouponHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := normalizeCouponCode(mux.Vars(r)["code"])
+		coupon, err := GetCouponByCode(executor, code)
+		if err != nil {
+			writeError(w, r, couponError(err, code))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(coupon)
+	}
+}
+
+// POST /coupons
+func createCouponHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input CouponInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		coupon, fields := input.toCoupon()
+		if len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := InsertCoupon(tx, coupon, time.Now()); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				err = ErrConflict(CodeConflict, "A coupon with code %s already exists", coupon.Code)
+			}
+			writeError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/coupons/"+coupon.Code)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(coupon)
+	}
+}
+
+// PUT /coupons/{code} replaces every field of a coupon but its code and uses.
+func updateCouponHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := normalizeCouponCode(mux.Vars(r)["code"])
+		var input CouponInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		input.Code = code
+		coupon, fields := input.toCoupon()
+		if len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := UpdateCoupon(tx, coupon); err != nil {
+			writeError(w, r, couponError(err, code))
+			return
+		}
+		stored, err := GetCouponByCode(tx, code)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stored)
+	}
+}
+
+// DELETE /coupons/{code} deactivates a coupon.
+func deleteCouponHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := normalizeCouponCode(mux.Vars(r)["code"])
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := DeactivateCoupon(tx, code); err != nil {
+			writeError(w, r, couponError(err, code))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// creates a coupon through the API.
+func createCoupon(t *testing.T, router http.Handler, body string) Coupon {
+	t.Helper()
+	rr := doJSON(router, "POST", "/coupons", body)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var coupon Coupon
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&coupon))
+	return coupon
+}
+
+func TestCoupon_PercentageOnCategory(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	createCoupon(t, router, `{"code":"acc10","kind":"percentage","rate":0.1,"category":"Accessories"}`)
+	body := `{"items":[{"product_id":1,"quantity":1},{"product_id":2,"quantity":2}],"coupons":["ACC10"]}`
+
+	rr := doJSON(router, "POST", "/orders/quote", body)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var quote OrderQuote
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&quote))
+
+	// 10% of the two mice only, and the VAT of the mice on what is left of them
+	order := placeOrder(t, router, body)
+	assert.Equal(t, []AppliedDiscount{{Code: "ACC10", Kind: CouponPercentage, Amount: MustParseMoney("16.00", DefaultCurrency)}}, order.Discounts)
+	assert.Equal(t, MustParseMoney("1643.97", DefaultCurrency), order.TotalOrderPrice)
+	assert.Equal(t, MustParseMoney("361.68", DefaultCurrency), order.VATAmount)
+	assert.Equal(t, order.Discounts, quote.Discounts)
+	assert.Equal(t, order.TotalOrderPrice, quote.TotalOrderPrice)
+	assert.Equal(t, order.VATAmount, quote.VATAmount)
+
+	rr = doJSON(router, "GET", "/orders/"+order.OrderID, "")
+	var stored OutgoingOrder
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stored))
+	assert.Equal(t, order.Discounts, stored.Discounts)
+
+	// quotes do not count as uses
+	rr = doJSON(router, "GET", "/coupons/acc10", "")
+	var coupon Coupon
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&coupon))
+	assert.Equal(t, 1, coupon.Uses)
+}
+
+func TestCoupon_FixedAmountSpreadAcrossVATRates(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	createCoupon(t, router, `{"code":"FIX50","kind":"fixed_amount","amount":"50.00","min_spend":"200.00"}`)
+
+	// 17.36 comes off the mouse (22% VAT), 32.64 off the monitor (15% VAT)
+	order := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1},{"product_id":5,"quantity":1}],"coupons":["fix50"]}`)
+	assert.Equal(t, MustParseMoney("50.00", DefaultCurrency), order.Discounts[0].Amount)
+	assert.Equal(t, MustParseMoney("180.49", DefaultCurrency), order.TotalOrderPrice)
+	assert.Equal(t, MustParseMoney("31.46", DefaultCurrency), order.VATAmount)
+
+	rr := doJSON(router, "POST", "/order", `{"items":[{"product_id":2,"quantity":1}],"coupons":["FIX50"]}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, CodeCouponNotApplicable, errorCode(t, rr.Body.Bytes()))
+	assert.Contains(t, rr.Body.String(), "minimum spend of 200.00")
+}
+
+func TestCoupon_FreeItemWithUsageLimit(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	createCoupon(t, router, `{"code":"FREEMOUSE","kind":"free_item","product_id":2,"free_quantity":1,"max_uses":1}`)
+	body := `{"items":[{"product_id":2,"quantity":3}],"coupons":["FREEMOUSE"]}`
+
+	order := placeOrder(t, router, body)
+	assert.Equal(t, MustParseMoney("79.99", DefaultCurrency), order.Discounts[0].Amount)
+	assert.Equal(t, MustParseMoney("159.98", DefaultCurrency), order.TotalOrderPrice)
+
+	for _, path := range []string{"/order", "/orders/quote"} {
+		rr := doJSON(router, "POST", path, body)
+		assert.Equal(t, http.StatusConflict, rr.Code, path)
+		assert.Contains(t, rr.Body.String(), "used up", path)
+	}
+	// the rejected order took nothing out of stock
+	assert.Equal(t, sampleStock-3, getStockLevel(t, router, "2").Stock)
+}
+
+func TestCoupon_NotApplicable(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	createCoupon(t, router, `{"code":"OLD","kind":"percentage","rate":0.5,"valid_until":"2020-01-01T00:00:00Z"}`)
+	createCoupon(t, router, `{"code":"SOON","kind":"percentage","rate":0.5,"valid_from":"2999-01-01T00:00:00Z"}`)
+	createCoupon(t, router, `{"code":"GONE","kind":"percentage","rate":0.5}`)
+	createCoupon(t, router, `{"code":"MONITORS","kind":"percentage","rate":0.5,"category":"monitors"}`)
+	rr := doJSON(router, "DELETE", "/coupons/gone", "")
+	require.Equal(t, http.StatusNoContent, rr.Code)
+
+	for code, reason := range map[string]string{
+		"OLD":      "it has expired",
+		"SOON":     "it is not valid yet",
+		"GONE":     "it is no longer active",
+		"MONITORS": "the order holds no item it applies to",
+	} {
+		rr = doJSON(router, "POST", "/orders/quote", `{"items":[{"product_id":1,"quantity":1}],"coupons":["`+code+`"]}`)
+		assert.Equal(t, http.StatusConflict, rr.Code, code)
+		assert.Contains(t, rr.Body.String(), reason, code)
+	}
+
+	rr = doJSON(router, "POST", "/order", `{"items":[{"product_id":1,"quantity":1}],"coupons":["NOPE"]}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Coupon NOPE not found")
+
+	rr = doJSON(router, "POST", "/order", `{"items":[{"product_id":1,"quantity":1}],"coupons":["old","OLD",""]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"coupons[1]"`)
+	assert.Contains(t, rr.Body.String(), `"field":"coupons[2]"`)
+}
+
+func TestCouponAdmin(t *testing.T) {
+	store := NewInMemoryStore()
+	router := newOrdersRouter(store)
+	createCoupon(t, router, `{"code":"SUMMER","kind":"percentage","rate":0.2,"max_uses":100}`)
+
+	rr := doJSON(router, "POST", "/coupons", `{"code":"summer","kind":"percentage","rate":0.1}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = doJSON(router, "PUT", "/coupons/summer", `{"kind":"fixed_amount","amount":"5.00","category":"accessories","active":false}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var coupon Coupon
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&coupon))
+	assert.Equal(t, CouponFixedAmount, coupon.Kind)
+	assert.Equal(t, "accessories", coupon.Category)
+	assert.Zero(t, coupon.MaxUses)
+	assert.False(t, coupon.Active)
+
+	rr = doJSON(router, "PUT", "/coupons/winter", `{"kind":"percentage","rate":0.1}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = doJSON(router, "DELETE", "/coupons/winter", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	for body, field := range map[string]string{
+		`{"code":"a b","kind":"percentage","rate":0.1}`:                                                                        "code",
+		`{"code":"X","kind":"bogo"}`:                                                                                           "kind",
+		`{"code":"X","kind":"percentage","rate":1.5}`:                                                                          "rate",
+		`{"code":"X","kind":"fixed_amount","amount":0}`:                                                                        "amount",
+		`{"code":"X","kind":"free_item","free_quantity":1}`:                                                                    "product_id",
+		`{"code":"X","kind":"free_item","product_id":1}`:                                                                       "free_quantity",
+		`{"code":"X","kind":"percentage","rate":0.1,"product_id":1,"category":"a"}`:                                            "category",
+		`{"code":"X","kind":"percentage","rate":0.1,"min_spend":-1}`:                                                           "min_spend",
+		`{"code":"X","kind":"percentage","rate":0.1,"valid_from":"2030-01-01T00:00:00Z","valid_until":"2029-01-01T00:00:00Z"}`: "valid_until",
+	} {
+		rr = doJSON(router, "POST", "/coupons", body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Contains(t, rr.Body.String(), `"field":"`+field+`"`, body)
+	}
+
+	rr = doJSON(router, "GET", "/coupons", "")
+	var coupons []Coupon
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&coupons))
+	require.Len(t, coupons, 1)
+	assert.Equal(t, "SUMMER", coupons[0].Code)
+}
+
+func TestProrate(t *testing.T) {
+	eur := func(s string) Money { return MustParseMoney(s, DefaultCurrency) }
+	assert.Equal(t, []Money{eur("17.36"), eur("32.64")}, prorate(eur("50.00"), []Money{eur("79.99"), eur("150.50")}))
+	assert.Equal(t, []Money{eur("0.34"), eur("0.33"), eur("0.33")}, prorate(eur("1.00"), []Money{eur("1"), eur("1"), eur("1")}))
+	assert.Equal(t, []Money{eur("1.00"), eur("2.00")}, prorate(eur("3.00"), []Money{eur("1.00"), eur("2.00")}))
+}
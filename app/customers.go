@@ -0,0 +1,441 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Customer is a customer account. Deleted customers are kept for the orders
+// that reference them but are no longer returned.
+type Customer struct {
+	ID        int               `json:"id"`
+	Email     string            `json:"email"`
+	Name      string            `json:"name"`
+	Phone     string            `json:"phone,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Lifetime  *CustomerLifetime `json:"lifetime,omitempty"` // only on GET /customers/{id}
+}
+
+// CustomerLifetime aggregates the orders of a customer.
+type CustomerLifetime struct {
+	OrderCount int     `json:"order_count"` // every order, cancelled ones included
+	TotalSpent []Money `json:"total_spent"` // gross of the orders neither cancelled nor refunded, one amount per currency
+}
+
+// CustomerInput is the request body for creating and updating customers, with
+// the same PUT/PATCH semantics as ProductInput.
+type CustomerInput struct {
+	Email *string `json:"email"`
+	Name  *string `json:"name"`
+	Phone *string `json:"phone"` // optional
+}
+
+// applies the present fields of the input on top of c.
+func (in CustomerInput) applyTo(c *Customer) {
+	if in.Email != nil {
+		c.Email = strings.ToLower(strings.TrimSpace(*in.Email))
+	}
+	if in.Name != nil {
+		c.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.Phone != nil {
+		c.Phone = strings.TrimSpace(*in.Phone)
+	}
+}
+
+// reports the missing fields, for full create/replace requests.
+func (in CustomerInput) requireAll() []FieldError {
+	var fields []FieldError
+	if in.Email == nil {
+		fields = append(fields, FieldError{Field: "email", Message: "is required"})
+	}
+	if in.Name == nil {
+		fields = append(fields, FieldError{Field: "name", Message: "is required"})
+	}
+	return fields
+}
+
+// checks a customer before it is written.
+func validateCustomer(c *Customer) []FieldError {
+	var fields []FieldError
+	if addr, err := mail.ParseAddress(c.Email); err != nil || addr.Address != c.Email {
+		fields = append(fields, FieldError{Field: "email", Message: "must be an email address"})
+	}
+	if c.Name == "" {
+		fields = append(fields, FieldError{Field: "name", Message: "must not be empty"})
+	}
+	return fields
+}
+
+// --- Customer Database Functions ---
+
+const selectCustomerSQL = "SELECT id, email, name, phone, created_at, updated_at FROM customers"
+
+func scanCustomer(row RowLike) (*Customer, error) {
+	var c Customer
+	if err := row.Scan(&c.ID, &c.Email, &c.Name, &c.Phone, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// fetches a customer that is not deleted.
+func GetCustomerByID(executor Queryer, customerID int) (*Customer, error) {
+	c, err := scanCustomer(executor.QueryRow(selectCustomerSQL+" WHERE id = $1 AND deleted_at IS NULL", customerID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("customer not found: %w", sql.ErrNoRows)
+		}
+		return nil, fmt.Errorf("failed to scan customer: %w", err)
+	}
+	return c, nil
+}
+
+// fetches the customers that are not deleted, ordered by ID.
+func GetCustomers(executor Queryer) ([]Customer, error) {
+	rows, err := executor.Query(selectCustomerSQL + " WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query customers: %w", err)
+	}
+	defer rows.Close()
+
+	customers := []Customer{}
+	for rows.Next() {
+		c, err := scanCustomer(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan customer row: %w", err)
+		}
+		customers = append(customers, *c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during customers iteration: %w", err)
+	}
+	return customers, nil
+}
+
+// inserts a customer and sets its generated ID. It returns a wrapped
+// sql.ErrNoRows when another customer that is not deleted has the same email.
+func InsertCustomer(executor TxExecutor, c *Customer, now time.Time) error {
+	c.CreatedAt, c.UpdatedAt = now, now
+	err := executor.QueryRow("INSERT INTO customers (email, active_email, name, phone, created_at, updated_at) VALUES ($1, $1, $2, $3, $4, $4) ON CONFLICT (active_email) DO NOTHING RETURNING id",
+		c.Email, c.Name, c.Phone, now).Scan(&c.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("customer email taken: %w", sql.ErrNoRows)
+		}
+		return fmt.Errorf("failed to insert customer: %w", err)
+	}
+	return nil
+}
+
+// reports whether a customer other than customerID that is not deleted has email.
+func customerEmailTaken(executor Queryer, email string, customerID int) (bool, error) {
+	var id int
+	err := executor.QueryRow("SELECT id FROM customers WHERE active_email = $1 AND id <> $2", email, customerID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up customer email: %w", err)
+	}
+	return true, nil
+}
+
+// overwrites email, name and phone of a customer that is not deleted.
+func UpdateCustomer(executor TxExecutor, c *Customer, now time.Time) error {
+	res, err := executor.Exec("UPDATE customers SET email = $1, active_email = $1, name = $2, phone = $3, updated_at = $4 WHERE id = $5 AND deleted_at IS NULL",
+		c.Email, c.Name, c.Phone, now, c.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update customer: %w", err)
+	}
+	if err := requireRowAffected(res, "customer not found"); err != nil {
+		return err
+	}
+	c.UpdatedAt = now
+	return nil
+}
+
+// soft deletes a customer: its orders keep referencing it, and its email can
+// be used by a new customer.
+func DeleteCustomer(executor TxExecutor, customerID int, now time.Time) error {
+	res, err := executor.Exec("UPDATE customers SET deleted_at = $1, active_email = NULL, updated_at = $1 WHERE id = $2 AND deleted_at IS NULL", now, customerID)
+	if err != nil {
+		return fmt.Errorf("failed to delete customer: %w", err)
+	}
+	return requireRowAffected(res, "customer not found")
+}
+
+// computes the lifetime aggregates of a customer from its orders.
+func GetCustomerLifetime(executor Queryer, customerID int) (*CustomerLifetime, error) {
+	lifetime := &CustomerLifetime{TotalSpent: []Money{}}
+	if err := executor.QueryRow("SELECT COUNT(*) FROM orders WHERE customer_id = $1", customerID).Scan(&lifetime.OrderCount); err != nil {
+		return nil, fmt.Errorf("failed to count customer orders: %w", err)
+	}
+
+	rows, err := executor.Query("SELECT currency, SUM(total_price + vat_amount) FROM orders WHERE customer_id = $1 AND status <> $2 AND status <> $3 GROUP BY currency ORDER BY currency",
+		customerID, string(StatusCancelled), string(StatusRefunded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query customer spending: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var currency string
+		var spent Money
+		if err := rows.Scan(&currency, &spent); err != nil {
+			return nil, fmt.Errorf("failed to scan customer spending row: %w", err)
+		}
+		if spent, err = spent.Relabel(currency); err != nil {
+			return nil, fmt.Errorf("failed to read spending of customer %d: %w", customerID, err)
+		}
+		lifetime.TotalSpent = append(lifetime.TotalSpent, spent)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during customer spending iteration: %w", err)
+	}
+	return lifetime, nil
+}
+
+// attaches an order to the customer who placed it.
+func UpdateOrderCustomer(executor TxExecutor, orderID string, customerID int) error {
+	_, err := executor.Exec("UPDATE orders SET customer_id = $1 WHERE order_id = $2", customerID, orderID)
+	if err != nil {
+		return fmt.Errorf("failed to update order customer: %w", err)
+	}
+	return nil
+}
+
+// --- Customer HTTP Handlers ---
+
+// parses the {id} route variable of the customer routes.
+func customerIDFromRequest(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		return 0, ErrBadRequest("invalid customer ID %q", mux.Vars(r)["id"])
+	}
+	return id, nil
+}
+
+// maps a customer lookup or write failure to the API error sent to the client.
+func customerError(err error, customerID int) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound("Customer with ID %d not found", customerID)
+	}
+	return err
+}
+
+// GET /customers
+func getCustomersHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customers, err := GetCustomers(executor)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(customers)
+	}
+}
+
+// GET /customers/{id}, with the lifetime aggregates of the customer.
+func getCustomerHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerID, err := customerIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		customer, err := GetCustomerByID(executor, customerID)
+		if err != nil {
+			writeError(w, r, customerError(err, customerID))
+			return
+		}
+		if customer.Lifetime, err = GetCustomerLifetime(executor, customerID); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(customer)
+	}
+}
+
+// POST /customers
+func createCustomerHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input CustomerInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		if fields := input.requireAll(); len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		var customer Customer
+		input.applyTo(&customer)
+		if fields := validateCustomer(&customer); len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := InsertCustomer(tx, &customer, time.Now()); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				err = ErrConflict(CodeConflict, "A customer with email %s already exists", customer.Email)
+			}
+			writeError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", fmt.Sprintf("/customers/%d", customer.ID))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(customer)
+	}
+}
+
+// PUT and PATCH /customers/{id}. PUT replaces every field, PATCH merges the
+// fields present in the body into the stored customer.
+func updateCustomerHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerID, err := customerIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		var input CustomerInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		if r.Method == http.MethodPut {
+			if fields := input.requireAll(); len(fields) > 0 {
+				writeError(w, r, ErrValidation(fields...))
+				return
+			}
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		customer, err := GetCustomerByID(tx, customerID)
+		if err != nil {
+			writeError(w, r, customerError(err, customerID))
+			return
+		}
+
+		input.applyTo(customer)
+		if fields := validateCustomer(customer); len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+		taken, err := customerEmailTaken(tx, customer.Email, customerID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if taken {
+			writeError(w, r, ErrConflict(CodeConflict, "A customer with email %s already exists", customer.Email))
+			return
+		}
+
+		if err := UpdateCustomer(tx, customer, time.Now()); err != nil {
+			writeError(w, r, customerError(err, customerID))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(customer)
+	}
+}
+
+// DELETE /customers/{id} soft deletes the customer.
+func deleteCustomerHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerID, err := customerIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := DeleteCustomer(tx, customerID, time.Now()); err != nil {
+			writeError(w, r, customerError(err, customerID))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GET /customers/{id}/orders lists the orders of a customer, with the filters,
+// sort orders and cursors of GET /orders.
+func getCustomerOrdersHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerID, err := customerIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		filter, err := parseOrderListFilter(r.URL.Query())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		filter.CustomerID = &customerID
+
+		if _, err := GetCustomerByID(executor, customerID); err != nil {
+			writeError(w, r, customerError(err, customerID))
+			return
+		}
+		orders, nextCursor, err := ListOrders(executor, filter)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(OrderPage{Orders: orders, NextCursor: nextCursor})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// creates a customer through the API and returns the decoded response.
+func createCustomer(t *testing.T, router http.Handler, body string) Customer {
+	rr := doJSON(router, "POST", "/customers", body)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var customer Customer
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&customer))
+	return customer
+}
+
+func TestCustomers_CRUD(t *testing.T) {
+	store := NewInMemoryStore()
+	router := newOrdersRouter(store)
+
+	customer := createCustomer(t, router, `{"email":" Ada@Example.com ","name":"Ada Lovelace"}`)
+	assert.Equal(t, "ada@example.com", customer.Email)
+	path := fmt.Sprintf("/customers/%d", customer.ID)
+
+	rr := doJSON(router, "POST", "/customers", `{"email":"ADA@example.com","name":"Someone Else"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	rr = doJSON(router, "POST", "/customers", `{"email":"not an email","name":""}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"email"`)
+	assert.Contains(t, rr.Body.String(), `"field":"name"`)
+
+	rr = doJSON(router, "PATCH", path, `{"phone":"+39 02 1234567"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = doJSON(router, "PUT", path, `{"name":"Ada King"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = doJSON(router, "GET", path, "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var stored Customer
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stored))
+	assert.Equal(t, "Ada Lovelace", stored.Name)
+	assert.Equal(t, "+39 02 1234567", stored.Phone)
+	require.NotNil(t, stored.Lifetime)
+	assert.Zero(t, stored.Lifetime.OrderCount)
+	assert.Empty(t, stored.Lifetime.TotalSpent)
+
+	other := createCustomer(t, router, `{"email":"grace@example.com","name":"Grace Hopper"}`)
+	rr = doJSON(router, "PATCH", fmt.Sprintf("/customers/%d", other.ID), `{"email":"ada@example.com"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// a soft deleted customer is gone, and frees its email
+	rr = doJSON(router, "DELETE", path, "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	for _, method := range []string{"GET", "DELETE"} {
+		rr = doJSON(router, method, path, "")
+		assert.Equal(t, http.StatusNotFound, rr.Code, method)
+	}
+	rr = doJSON(router, "PATCH", path, `{"name":"Ada"}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = doJSON(router, "GET", "/customers", "")
+	var customers []Customer
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&customers))
+	require.Len(t, customers, 1)
+	assert.Equal(t, other.ID, customers[0].ID)
+
+	again := createCustomer(t, router, `{"email":"ada@example.com","name":"Ada Lovelace"}`)
+	assert.NotEqual(t, customer.ID, again.ID)
+}
+
+func TestCustomers_Orders(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	rr := doJSON(router, "POST", "/exchange-rates", `{"currency":"USD","rate":1.08,"valid_from":"2020-01-01T00:00:00Z"}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+	customer := createCustomer(t, router, `{"email":"ada@example.com","name":"Ada Lovelace"}`)
+	path := fmt.Sprintf("/customers/%d", customer.ID)
+	items := `"items":[{"product_id":2,"quantity":1}]`
+
+	var placed []OutgoingOrder
+	for i := 0; i < 3; i++ {
+		order := placeOrder(t, router, fmt.Sprintf(`{%s,"customer_id":%d}`, items, customer.ID))
+		assert.Equal(t, customer.ID, order.CustomerID)
+		placed = append(placed, order)
+	}
+	usd := placeOrder(t, router, fmt.Sprintf(`{%s,"customer_id":%d,"currency":"USD"}`, items, customer.ID))
+	placeOrder(t, router, fmt.Sprintf(`{%s}`, items))
+	rr = doJSON(router, "POST", "/orders/"+placed[2].OrderID+"/cancel", `{"reason":"changed mind"}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = doJSON(router, "GET", "/orders/"+placed[0].OrderID, "")
+	var stored OutgoingOrder
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stored))
+	assert.Equal(t, customer.ID, stored.CustomerID)
+
+	// history pages through the customer's orders only
+	rr = doJSON(router, "GET", path+"/orders?limit=3", "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var page OrderPage
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&page))
+	assert.Len(t, page.Orders, 3)
+	require.NotEmpty(t, page.NextCursor)
+	rr = doJSON(router, "GET", path+"/orders?limit=3&cursor="+page.NextCursor, "")
+	page = OrderPage{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&page))
+	assert.Len(t, page.Orders, 1)
+	assert.Empty(t, page.NextCursor)
+
+	rr = doJSON(router, "GET", path, "")
+	var withLifetime Customer
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&withLifetime))
+	require.NotNil(t, withLifetime.Lifetime)
+	assert.Equal(t, 4, withLifetime.Lifetime.OrderCount)
+	assert.Equal(t, []Money{
+		placed[0].TotalGross.Add(placed[1].TotalGross),
+		usd.TotalGross,
+	}, withLifetime.Lifetime.TotalSpent)
+
+	// orders for unknown or deleted customers are refused
+	rr = doJSON(router, "POST", "/order", fmt.Sprintf(`{%s,"customer_id":999}`, items))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = doJSON(router, "DELETE", path, "")
+	require.Equal(t, http.StatusNoContent, rr.Code)
+	rr = doJSON(router, "POST", "/order", fmt.Sprintf(`{%s,"customer_id":%d}`, items, customer.ID))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = doJSON(router, "GET", path+"/orders", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// the orders of a deleted customer keep referencing it
+	rr = doJSON(router, "GET", fmt.Sprintf("/orders?customer_id=%d", customer.ID), "")
+	page = OrderPage{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&page))
+	assert.Len(t, page.Orders, 4)
+}
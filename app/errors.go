@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ErrorCode is the machine-readable code of an API error. Clients should branch
+// on the code, never on the message.
+type ErrorCode string
+
+const (
+	CodeBadRequest           ErrorCode = "bad_request"
+	CodeValidationFailed     ErrorCode = "validation_failed"
+	CodeNotFound             ErrorCode = "not_found"
+	CodeMethodNotAllowed     ErrorCode = "method_not_allowed"
+	CodeConflict             ErrorCode = "conflict"
+	CodeInvalidTransition    ErrorCode = "invalid_status_transition"
+	CodeOrderNotCancellable  ErrorCode = "order_not_cancellable"
+	CodeIdempotencyKeyReused ErrorCode = "idempotency_key_reused"
+	CodeInsufficientStock    ErrorCode = "insufficient_stock"
+	CodeCartExpired          ErrorCode = "cart_expired"
+	CodeCartCheckedOut       ErrorCode = "cart_checked_out"
+	CodeCouponNotApplicable  ErrorCode = "coupon_not_applicable"
+	CodeOrderNotPayable      ErrorCode = "order_not_payable"
+	CodePaymentDeclined      ErrorCode = "payment_declined"
+	CodeInvalidPaymentState  ErrorCode = "invalid_payment_status"
+	CodePaymentProvider      ErrorCode = "payment_provider_error"
+	CodeInvalidSignature     ErrorCode = "invalid_signature"
+	CodeInternal             ErrorCode = "internal_error"
+)
+
+// RequestIDHeader carries the request ID in both directions.
+const RequestIDHeader = "X-Request-ID"
+
+// problemContentType is the RFC 7807 media type, served when the client asks for it.
+const problemContentType = "application/problem+json"
+
+// FieldError describes one invalid field of a request body or query string.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// APIError is the error returned by every handler. Cause is the underlying
+// error: it is logged for internal errors and never sent to the client.
+type APIError struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+	Details map[string]interface{}
+	Fields  []FieldError
+	Cause   error
+}
+
+func (e *APIError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Cause)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *APIError) Unwrap() error { return e.Cause }
+
+// WithDetail attaches a machine-readable detail to the error.
+func (e *APIError) WithDetail(key string, value interface{}) *APIError {
+	if e.Details == nil {
+		e.Details = make(map[string]interface{})
+	}
+	e.Details[key] = value
+	return e
+}
+
+// NewAPIError builds an error with a client-facing message.
+func NewAPIError(status int, code ErrorCode, format string, args ...interface{}) *APIError {
+	return &APIError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// ErrBadRequest is a malformed request, such as a body that is not valid JSON.
+func ErrBadRequest(format string, args ...interface{}) *APIError {
+	return NewAPIError(http.StatusBadRequest, CodeBadRequest, format, args...)
+}
+
+// ErrNotFound is a missing resource.
+func ErrNotFound(format string, args ...interface{}) *APIError {
+	return NewAPIError(http.StatusNotFound, CodeNotFound, format, args...)
+}
+
+// ErrConflict is a request that clashes with the current state of a resource.
+func ErrConflict(code ErrorCode, format string, args ...interface{}) *APIError {
+	return NewAPIError(http.StatusConflict, code, format, args...)
+}
+
+// ErrValidation reports per-field validation failures.
+func ErrValidation(fields ...FieldError) *APIError {
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    CodeValidationFailed,
+		Message: "The request contains invalid fields",
+		Fields:  fields,
+	}
+}
+
+// ErrInternal hides cause from the client behind a generic message.
+func ErrInternal(cause error) *APIError {
+	return &APIError{
+		Status:  http.StatusInternalServerError,
+		Code:    CodeInternal,
+		Message: "An internal error occurred",
+		Cause:   cause,
+	}
+}
+
+// errorEnvelope is the application/json error body.
+type errorEnvelope struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code      ErrorCode              `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Fields    []FieldError           `json:"fields,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+}
+
+// problemDetails is the RFC 7807 error body, with our code and fields as extension members.
+type problemDetails struct {
+	Type      string                 `json:"type"`
+	Title     string                 `json:"title"`
+	Status    int                    `json:"status"`
+	Detail    string                 `json:"detail"`
+	Instance  string                 `json:"instance,omitempty"`
+	Code      ErrorCode              `json:"code"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Errors    []FieldError           `json:"errors,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+}
+
+// writeError sends err to the client. Anything that is not an *APIError is an
+// internal error: it is logged with the request ID and replaced by a generic message.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = ErrInternal(err)
+	}
+	requestID := RequestIDFromContext(r.Context())
+	if apiErr.Status >= http.StatusInternalServerError {
+		log.Printf("request %s %s %s failed: %v", requestID, r.Method, r.URL.Path, apiErr)
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), problemContentType) {
+		w.Header().Set("Content-Type", problemContentType)
+		w.WriteHeader(apiErr.Status)
+		json.NewEncoder(w).Encode(problemDetails{
+			Type:      "urn:mytest:error:" + string(apiErr.Code),
+			Title:     http.StatusText(apiErr.Status),
+			Status:    apiErr.Status,
+			Detail:    apiErr.Message,
+			Instance:  r.URL.Path,
+			Code:      apiErr.Code,
+			Details:   apiErr.Details,
+			Errors:    apiErr.Fields,
+			RequestID: requestID,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(errorEnvelope{Error: errorBody{
+		Code:      apiErr.Code,
+		Message:   apiErr.Message,
+		Details:   apiErr.Details,
+		Fields:    apiErr.Fields,
+		RequestID: requestID,
+	}})
+}
+
+// --- Request IDs ---
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the ID assigned by requestIDMiddleware, if any.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDMiddleware tags every request with the client's X-Request-ID, or a
+// fresh one, and echoes it in the response so errors can be traced in the logs.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
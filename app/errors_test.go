@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteError_JSONEnvelope(t *testing.T) {
+	req := httptest.NewRequest("GET", "/products/7", nil)
+	rr := httptest.NewRecorder()
+	writeError(rr, req, ErrNotFound("Product with ID %d not found", 7).WithDetail("product_id", 7))
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error":{"code":"not_found","message":"Product with ID 7 not found","details":{"product_id":7}}}`, rr.Body.String())
+}
+
+func TestWriteError_ProblemJSON(t *testing.T) {
+	req := httptest.NewRequest("POST", "/products", nil)
+	req.Header.Set("Accept", "application/problem+json")
+	rr := httptest.NewRecorder()
+	writeError(rr, req, ErrValidation(FieldError{Field: "price", Message: "must not be negative"}))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "application/problem+json", rr.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{
+		"type": "urn:mytest:error:validation_failed",
+		"title": "Bad Request",
+		"status": 400,
+		"detail": "The request contains invalid fields",
+		"instance": "/products",
+		"code": "validation_failed",
+		"errors": [{"field": "price", "message": "must not be negative"}]
+	}`, rr.Body.String())
+}
+
+func TestWriteError_HidesInternalErrors(t *testing.T) {
+	req := httptest.NewRequest("GET", "/orders", nil)
+	rr := httptest.NewRecorder()
+	writeError(rr, req, errors.New(`pq: relation "orders" does not exist`))
+
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "pq:")
+	assert.Contains(t, rr.Body.String(), `"code":"internal_error"`)
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(requestIDMiddleware)
+	router.HandleFunc("/products/{id}", getProductHandler(&MockDB{})).Methods("GET")
+
+	req := httptest.NewRequest("GET", "/products/abc", nil)
+	req.Header.Set(RequestIDHeader, "req-42")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, "req-42", rr.Header().Get(RequestIDHeader))
+	var body errorEnvelope
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+	assert.Equal(t, CodeBadRequest, body.Error.Code)
+	assert.Equal(t, "req-42", body.Error.RequestID)
+
+	// without a client ID one is generated
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/products/abc", nil))
+	assert.NotEmpty(t, rr.Header().Get(RequestIDHeader))
+}
+
+func TestCreateOrderHandler_ValidationFields(t *testing.T) {
+	rr := doJSON(createOrderHandler(&MockDB{}), "POST", "/order", `{"items":[{"product_id":1,"quantity":0},{"product_id":0,"quantity":1}]}`)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var body errorEnvelope
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+	assert.Equal(t, CodeValidationFailed, body.Error.Code)
+	var fields []string
+	for _, f := range body.Error.Fields {
+		fields = append(fields, f.Field)
+	}
+	assert.Equal(t, []string{"items[0].quantity", "items[1].product_id"}, fields)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// currencyPattern matches ISO 4217 codes once upper-cased.
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// normalizes a currency code as sent by clients.
+func normalizeCurrency(currency string) string {
+	return strings.ToUpper(strings.TrimSpace(currency))
+}
+
+// ExchangeRate is the number of units of Currency one unit of DefaultCurrency
+// buys, from ValidFrom until the next rate of the same currency takes over.
+type ExchangeRate struct {
+	Currency  string    `json:"currency"`
+	Rate      float64   `json:"rate"`
+	ValidFrom time.Time `json:"valid_from"`
+}
+
+// ExchangeRateInput is the request body of POST /exchange-rates and an entry
+// of the EXCHANGE_RATES_FILE.
+type ExchangeRateInput struct {
+	Currency  string     `json:"currency"`
+	Rate      *float64   `json:"rate"`
+	ValidFrom *time.Time `json:"valid_from"` // defaults to now
+}
+
+// checks the input and turns it into the rate to write.
+func (in ExchangeRateInput) toExchangeRate(now time.Time) (*ExchangeRate, []FieldError) {
+	r := &ExchangeRate{Currency: normalizeCurrency(in.Currency), ValidFrom: now}
+	if in.ValidFrom != nil {
+		r.ValidFrom = *in.ValidFrom
+	}
+	var fields []FieldError
+	switch {
+	case !currencyPattern.MatchString(r.Currency):
+		fields = append(fields, FieldError{Field: "currency", Message: "must be an ISO 4217 code"})
+	case r.Currency == DefaultCurrency:
+		fields = append(fields, FieldError{Field: "currency", Message: fmt.Sprintf("%s is the catalog currency", DefaultCurrency)})
+	case currencyExponent(r.Currency) > 2:
+		fields = append(fields, FieldError{Field: "currency", Message: "amounts are stored with at most 2 decimal places"})
+	}
+	if in.Rate == nil {
+		fields = append(fields, FieldError{Field: "rate", Message: "is required"})
+	} else if r.Rate = *in.Rate; r.Rate <= 0 {
+		fields = append(fields, FieldError{Field: "rate", Message: "must be positive"})
+	}
+	return r, fields
+}
+
+// --- Exchange Rate Database Functions ---
+
+const selectExchangeRateSQL = "SELECT currency, rate, valid_from FROM exchange_rates"
+
+// fetches the rate of currency in force at at.
+func GetExchangeRate(executor Queryer, currency string, at time.Time) (*ExchangeRate, error) {
+	var r ExchangeRate
+	err := executor.QueryRow(selectExchangeRateSQL+" WHERE currency = $1 AND valid_from <= $2 ORDER BY valid_from DESC LIMIT 1", currency, at).
+		Scan(&r.Currency, &r.Rate, &r.ValidFrom)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("exchange rate not found: %w", sql.ErrNoRows)
+		}
+		return nil, fmt.Errorf("failed to scan exchange rate: %w", err)
+	}
+	return &r, nil
+}
+
+// fetches the rates of currency, or of every currency when it is empty,
+// ordered by currency and start.
+func GetExchangeRates(executor Queryer, currency string) ([]ExchangeRate, error) {
+	rows, err := executor.Query(selectExchangeRateSQL+" WHERE ($1 = '' OR currency = $1) ORDER BY currency, valid_from", currency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query exchange rates: %w", err)
+	}
+	defer rows.Close()
+
+	rates := []ExchangeRate{}
+	for rows.Next() {
+		var r ExchangeRate
+		if err := rows.Scan(&r.Currency, &r.Rate, &r.ValidFrom); err != nil {
+			return nil, fmt.Errorf("failed to scan exchange rate row: %w", err)
+		}
+		rates = append(rates, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during exchange rates iteration: %w", err)
+	}
+	return rates, nil
+}
+
+// writes a rate, replacing the rate of the same currency from the same time.
+// Orders keep the rate they were converted at.
+func SaveExchangeRate(executor TxExecutor, r *ExchangeRate, now time.Time) error {
+	_, err := executor.Exec("INSERT INTO exchange_rates (currency, rate, valid_from, created_at) VALUES ($1, $2, $3, $4) ON CONFLICT (currency, valid_from) DO UPDATE SET rate = EXCLUDED.rate, created_at = EXCLUDED.created_at",
+		r.Currency, r.Rate, r.ValidFrom, now)
+	if err != nil {
+		return fmt.Errorf("failed to save exchange rate: %w", err)
+	}
+	return nil
+}
+
+// LoadExchangeRates saves the rates of a JSON file holding an array of
+// ExchangeRateInput, all or none, and returns how many it saved.
+func LoadExchangeRates(executor DBExecutor, path string, now time.Time) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var inputs []ExchangeRateInput
+	if err := json.Unmarshal(data, &inputs); err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	rates := make([]*ExchangeRate, 0, len(inputs))
+	for i, in := range inputs {
+		r, fields := in.toExchangeRate(now)
+		if len(fields) > 0 {
+			return 0, fmt.Errorf("%s: entry %d: %s %s", path, i, fields[0].Field, fields[0].Message)
+		}
+		rates = append(rates, r)
+	}
+
+	tx, err := executor.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, r := range rates {
+		if err := SaveExchangeRate(tx, r, now); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(rates), nil
+}
+
+// --- Exchange Rate HTTP Handlers ---
+
+// GET /exchange-rates, optionally ?currency=USD
+func getExchangeRatesHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rates, err := GetExchangeRates(executor, normalizeCurrency(r.URL.Query().Get("currency")))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rates)
+	}
+}
+
+// POST /exchange-rates adds a rate, or replaces the rate of the same currency
+// from the same valid_from.
+func saveExchangeRateHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input ExchangeRateInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		now := time.Now()
+		rate, fields := input.toExchangeRate(now)
+		if len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+		if err := SaveExchangeRate(tx, rate, now); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rate)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchangeRates_OrderInCurrency(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	for _, body := range []string{
+		`{"currency":"usd","rate":1.08,"valid_from":"2020-01-01T00:00:00Z"}`,
+		`{"currency":"USD","rate":2,"valid_from":"2999-01-01T00:00:00Z"}`, // not in force yet
+	} {
+		rr := doJSON(router, "POST", "/exchange-rates", body)
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	order := placeOrder(t, router, `{"items":[{"product_id":1,"quantity":1},{"product_id":2,"quantity":2}],"currency":"usd"}`)
+	assert.Equal(t, "USD", order.Currency)
+	assert.Equal(t, 1.08, order.ExchangeRate)
+	assert.Equal(t, MustParseMoney("1619.99", "USD"), order.Items[0].Price) // 1499.99 EUR
+	assert.Equal(t, MustParseMoney("86.39", "USD"), order.Items[1].Price)   // 79.99 EUR
+	assert.Equal(t, MustParseMoney("1792.77", "USD"), order.TotalOrderPrice)
+	assert.Equal(t, MustParseMoney("394.41", "USD"), order.VATAmount)
+
+	rr := doJSON(router, "GET", "/orders/"+order.OrderID, "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"order_price":{"amount":1792.77,"currency":"USD"}`)
+	var stored OutgoingOrder
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stored))
+	assert.Equal(t, order.ExchangeRate, stored.ExchangeRate)
+	assert.Equal(t, order.TotalOrderPrice, stored.TotalOrderPrice)
+	assert.Equal(t, order.Items[1].Price, stored.Items[1].Price)
+	assert.Equal(t, order.VATBreakdown, stored.VATBreakdown)
+
+	rr = doJSON(router, "GET", "/orders", "")
+	var page OrderPage
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&page))
+	require.Len(t, page.Orders, 1)
+	assert.Equal(t, "USD", page.Orders[0].Currency)
+	assert.Equal(t, order.TotalOrderPrice, page.Orders[0].TotalOrderPrice)
+
+	// coupon amounts are converted too: 10.00 EUR off, from a spend of 50.00 EUR
+	createCoupon(t, router, `{"code":"TEN","kind":"fixed_amount","amount":10,"min_spend":50}`)
+	rr = doJSON(router, "POST", "/orders/quote", `{"items":[{"product_id":2,"quantity":1}],"coupons":["TEN"],"currency":"USD"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var quote OrderQuote
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&quote))
+	assert.Equal(t, MustParseMoney("10.80", "USD"), quote.Discounts[0].Amount)
+	assert.Equal(t, MustParseMoney("75.59", "USD"), quote.TotalOrderPrice)
+
+	// orders without a currency stay in the catalog currency
+	order = placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}]}`)
+	assert.Equal(t, DefaultCurrency, order.Currency)
+	assert.Equal(t, 1.0, order.ExchangeRate)
+	assert.Equal(t, MustParseMoney("79.99", DefaultCurrency), order.TotalOrderPrice)
+}
+
+func TestExchangeRates_Invalid(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	for body, field := range map[string]string{
+		`{"currency":"EUR","rate":1}`:    "currency",
+		`{"currency":"dollar","rate":1}`: "currency",
+		`{"currency":"BHD","rate":0.41}`: "currency",
+		`{"currency":"USD"}`:             "rate",
+		`{"currency":"USD","rate":0}`:    "rate",
+	} {
+		rr := doJSON(router, "POST", "/exchange-rates", body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Contains(t, rr.Body.String(), `"field":"`+field+`"`, body)
+	}
+
+	for _, body := range []string{
+		`{"items":[{"product_id":1,"quantity":1}],"currency":"GBP"}`, // no rate
+		`{"items":[{"product_id":1,"quantity":1}],"currency":"US"}`,
+	} {
+		rr := doJSON(router, "POST", "/order", body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Contains(t, rr.Body.String(), `"field":"currency"`, body)
+	}
+
+	// the catalog stays in the catalog currency, so orders never mix currencies
+	rr := doJSON(newProductsRouter(&InMemoryDB{store: store}), "PATCH", "/products/1", `{"price":{"amount":10,"currency":"USD"}}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"price"`)
+	usd := `{"amount":10,"currency":"USD"}`
+	for path, body := range map[string]string{
+		"/coupons":        `{"code":"usd","kind":"fixed_amount","amount":` + usd + `}`,
+		"/warehouses":     `{"code":"US","name":"US","unit_cost":` + usd + `}`,
+		"/shipping-zones": `{"name":"US","countries":["US"],"methods":[{"code":"std","name":"Std","kind":"flat","price":` + usd + `}]}`,
+	} {
+		rr = doJSON(router, "POST", path, body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, path)
+		assert.Contains(t, rr.Body.String(), "the catalog currency", path)
+	}
+}
+
+func TestLoadExchangeRates(t *testing.T) {
+	store := NewInMemoryStore()
+	db := &InMemoryDB{store: store}
+	dir := t.TempDir()
+	now := time.Now()
+
+	path := filepath.Join(dir, "rates.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"currency":"jpy","rate":160,"valid_from":"2024-01-01T00:00:00Z"},
+		{"currency":"JPY","rate":162.5,"valid_from":"2025-01-01T00:00:00Z"},
+		{"currency":"USD","rate":1.08}
+	]`), 0o600))
+	n, err := LoadExchangeRates(db, path, now)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	rates, err := GetExchangeRates(db, "JPY")
+	require.NoError(t, err)
+	require.Len(t, rates, 2)
+	rate, err := GetExchangeRate(db, "JPY", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, 160.0, rate.Rate)
+	rate, err = GetExchangeRate(db, "JPY", now)
+	require.NoError(t, err)
+	assert.Equal(t, 162.5, rate.Rate)
+
+	// a bad entry loads nothing
+	bad := filepath.Join(dir, "bad.json")
+	require.NoError(t, os.WriteFile(bad, []byte(`[{"currency":"CHF","rate":0.95},{"currency":"GBP","rate":-1}]`), 0o600))
+	_, err = LoadExchangeRates(db, bad, now)
+	assert.ErrorContains(t, err, "entry 1: rate must be positive")
+	rates, err = GetExchangeRates(db, "CHF")
+	require.NoError(t, err)
+	assert.Empty(t, rates)
+}
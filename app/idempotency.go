@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// IdempotencyKeyHeader is the request header clients use to make POST /order retry-safe.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const maxIdempotencyKeyLength = 255
+
+// saveIdempotencyKeySQL inserts a record, overwriting an existing one only if it has expired.
+const saveIdempotencyKeySQL = `INSERT INTO idempotency_keys (key, fingerprint, status_code, response_body, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (key) DO UPDATE SET fingerprint = EXCLUDED.fingerprint, status_code = EXCLUDED.status_code, response_body = EXCLUDED.response_body, created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at
+	WHERE idempotency_keys.expires_at <= EXCLUDED.created_at`
+
+// IdempotencyTTL is how long a stored response can be replayed; set from IDEMPOTENCY_TTL in main.
+var IdempotencyTTL = 24 * time.Hour
+
+// IdempotencyRecord is a row of the 'idempotency_keys' table: the response sent
+// for the first request carrying Key, and the fingerprint of that request's body.
+type IdempotencyRecord struct {
+	Key          string
+	Fingerprint  string
+	StatusCode   int
+	ResponseBody []byte
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+// requestFingerprint hashes the request body in canonical JSON form, so that
+// retries differing only in whitespace or key order are treated as the same request.
+func requestFingerprint(method, path string, body []byte) string {
+	canonical := body
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err == nil {
+		if b, err := json.Marshal(v); err == nil {
+			canonical = b
+		}
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", method, path)
+	h.Write(canonical)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writes a stored response back to the client.
+func replayIdempotentResponse(w http.ResponseWriter, rec *IdempotencyRecord) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(rec.StatusCode)
+	w.Write(rec.ResponseBody)
+}
+
+// answers a request whose key already has a stored response: the stored response
+// is replayed if the body matches the original one, otherwise it is a conflict.
+func answerIdempotentRetry(w http.ResponseWriter, r *http.Request, rec *IdempotencyRecord, fingerprint string) {
+	if rec.Fingerprint != fingerprint {
+		writeError(w, r, ErrConflict(CodeIdempotencyKeyReused, "Idempotency-Key has already been used with a different request body"))
+		return
+	}
+	replayIdempotentResponse(w, rec)
+}
+
+// --- Idempotency Key Database Functions ---
+
+// fetches the unexpired record stored for key, or nil if there is none.
+func GetIdempotencyRecord(executor Queryer, key string, now time.Time) (*IdempotencyRecord, error) {
+	var rec IdempotencyRecord
+	row := executor.QueryRow("SELECT key, fingerprint, status_code, response_body, created_at, expires_at FROM idempotency_keys WHERE key = $1 AND expires_at > $2", key, now)
+	err := row.Scan(&rec.Key, &rec.Fingerprint, &rec.StatusCode, &rec.ResponseBody, &rec.CreatedAt, &rec.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to scan idempotency key: %w", err)
+	}
+	return &rec, nil
+}
+
+// stores rec unless an unexpired record already exists for the same key, in which
+// case it returns false. Expired records are overwritten in place.
+func SaveIdempotencyRecord(executor TxExecutor, rec *IdempotencyRecord) (bool, error) {
+	res, err := executor.Exec(saveIdempotencyKeySQL,
+		rec.Key, rec.Fingerprint, rec.StatusCode, rec.ResponseBody, rec.CreatedAt, rec.ExpiresAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to save idempotency key: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	return n > 0, nil
+}
+
+// deletes every record that expired before now.
+func PurgeExpiredIdempotencyKeys(executor TxExecutor, now time.Time) (int64, error) {
+	res, err := executor.Exec("DELETE FROM idempotency_keys WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge idempotency keys: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// periodically purges expired idempotency keys until the process exits.
+func startIdempotencyJanitor(executor DBExecutor, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			tx, err := executor.Begin()
+			if err != nil {
+				log.Printf("idempotency janitor: %v", err)
+				continue
+			}
+			n, err := PurgeExpiredIdempotencyKeys(tx, time.Now())
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				tx.Rollback()
+				log.Printf("idempotency janitor: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("idempotency janitor: purged %d expired keys", n)
+			}
+		}
+	}()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postOrderWithKey(handler http.Handler, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/order", bytes.NewBufferString(body))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCreateOrderHandler_IdempotentReplay(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	handler := createOrderHandler(&InMemoryDB{store: store})
+
+	first := postOrderWithKey(handler, "retry-1", `{"items":[{"product_id":1,"quantity":1}]}`)
+	assert.Equal(t, http.StatusCreated, first.Code)
+
+	// same body, different formatting: replayed, no new order
+	second := postOrderWithKey(handler, "retry-1", `{ "items": [ {"quantity":1, "product_id":1} ] }`)
+	assert.Equal(t, http.StatusCreated, second.Code)
+	assert.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, 1, countRows(t, store, "orders"))
+
+	conflict := postOrderWithKey(handler, "retry-1", `{"items":[{"product_id":1,"quantity":2}]}`)
+	assert.Equal(t, http.StatusConflict, conflict.Code)
+	assert.Equal(t, 1, countRows(t, store, "orders"))
+
+	other := postOrderWithKey(handler, "retry-2", `{"items":[{"product_id":1,"quantity":1}]}`)
+	assert.Equal(t, http.StatusCreated, other.Code)
+	assert.Empty(t, other.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 2, countRows(t, store, "orders"))
+}
+
+func TestCreateOrderHandler_IdempotencyKeyExpires(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	handler := createOrderHandler(&InMemoryDB{store: store})
+
+	first := postOrderWithKey(handler, "old-key", `{"items":[{"product_id":1,"quantity":1}]}`)
+	assert.Equal(t, http.StatusCreated, first.Code)
+
+	mustExec(t, store, "UPDATE idempotency_keys SET expires_at = $1 WHERE key = $2", time.Now().Add(-time.Minute), "old-key")
+
+	// an expired key is free to be used again, even with another body
+	again := postOrderWithKey(handler, "old-key", `{"items":[{"product_id":2,"quantity":1}]}`)
+	assert.Equal(t, http.StatusCreated, again.Code)
+	assert.Empty(t, again.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 2, countRows(t, store, "orders"))
+	rec, err := GetIdempotencyRecord(&InMemoryDB{store: store}, "old-key", time.Now())
+	assert.NoError(t, err)
+	assert.NotNil(t, rec)
+}
+
+func TestPurgeExpiredIdempotencyKeys(t *testing.T) {
+	store := NewInMemoryStore()
+	now := time.Now()
+	mustExec(t, store, "INSERT INTO idempotency_keys (key, fingerprint, status_code, response_body, created_at, expires_at) VALUES ('expired', '', 201, '{}', $1, $2), ('live', '', 201, '{}', $1, $3)",
+		now.Add(-time.Hour), now.Add(-time.Second), now.Add(time.Hour))
+
+	tx, _ := (&InMemoryDB{store: store}).Begin()
+	n, err := PurgeExpiredIdempotencyKeys(tx, now)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, int64(1), n)
+	var key string
+	assert.NoError(t, (&InMemoryDB{store: store}).QueryRow("SELECT key FROM idempotency_keys").Scan(&key))
+	assert.Equal(t, "live", key)
+}
+
+func TestRequestFingerprint(t *testing.T) {
+	a := requestFingerprint("POST", "/order", []byte(`{"a":1,"b":[1,2]}`))
+	b := requestFingerprint("POST", "/order", []byte("{\n  \"b\": [1, 2],\n  \"a\": 1\n}"))
+	c := requestFingerprint("POST", "/order", []byte(`{"a":1,"b":[2,1]}`))
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, c)
+}
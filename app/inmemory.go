@@ -0,0 +1,879 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- In-Memory Store for Mocking a running DB ---
+
+// ErrSerializationFailure is returned by InMemoryTx.Commit when another
+// transaction committed a write to the same row after this one began, like
+// Postgres' "could not serialize access due to concurrent update".
+var ErrSerializationFailure = errors.New("could not serialize access due to concurrent update")
+
+// errTxAborted is returned for statements sent after a failed one, as Postgres does.
+var errTxAborted = errors.New("current transaction is aborted, commands ignored until end of transaction block")
+
+// implements sql.Result for the in-memory store.
+type InMemoryResult struct {
+	rowsAffected int64
+}
+
+func (r *InMemoryResult) LastInsertId() (int64, error) {
+	return 0, errors.New("LastInsertId is not supported in in-memory mock")
+}
+
+func (r *InMemoryResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+// memRow holds the values of a row in column order.
+type memRow []interface{}
+
+// memTable is a table of rows keyed by an internal row ID.
+type memTable struct {
+	schema *tableSchema
+	rows   map[int64]memRow
+}
+
+// returns the row IDs in insertion order.
+func (t *memTable) rowIDs() []int64 {
+	ids := slices.Collect(maps.Keys(t.rows))
+	slices.Sort(ids)
+	return ids
+}
+
+func (t *memTable) orderedRows() []memRow {
+	rows := make([]memRow, 0, len(t.rows))
+	for _, id := range t.rowIDs() {
+		rows = append(rows, t.rows[id])
+	}
+	return rows
+}
+
+// finds a row other than self holding the same primary or unique key as row;
+// it returns that row's ID and the clashing key, or a nil key. NULLs never clash.
+func (t *memTable) conflict(row memRow, self int64) (int64, []int) {
+	for _, key := range t.schema.uniqueKeys() {
+		if slices.ContainsFunc(key, func(i int) bool { return row[i] == nil }) {
+			continue
+		}
+		for id, other := range t.rows {
+			if id == self {
+				continue
+			}
+			same := true
+			for _, i := range key {
+				if other[i] == nil {
+					same = false
+					break
+				}
+				if c, err := compareValues(row[i], other[i]); err != nil || c != 0 {
+					same = false
+					break
+				}
+			}
+			if same {
+				return id, key
+			}
+		}
+	}
+	return 0, nil
+}
+
+// memState is one committed version of the in-memory tables. A published
+// state is never modified: commits build a new state that shares the tables
+// they did not touch, so transactions can read their snapshot without locks.
+type memState struct {
+	tables map[string]*memTable
+}
+
+// identifies a row of an in-memory table. Row ID 0 stands for the table itself.
+type rowKey struct {
+	table string
+	rowID int64
+}
+
+// holds data in memory for mock mode/ thread-safe.
+type InMemoryStore struct {
+	mu    sync.RWMutex
+	state *memState
+
+	// commit sequence number, and the commit that last wrote each row
+	seq      uint64
+	versions map[rowKey]uint64
+
+	// the commit that last changed each table, for DDL conflicts
+	tableSeq map[string]uint64
+
+	// sequences are not transactional, as in Postgres
+	lastRowID int64
+	sequences map[string]int64
+
+	// row and advisory locks, held until the owning transaction ends
+	lockMu     sync.Mutex
+	lockCond   *sync.Cond
+	lockOwners map[interface{}]*InMemoryTx
+}
+
+// creates and initializes an in-memory store
+func NewInMemoryStore() *InMemoryStore {
+	s := &InMemoryStore{
+		state:      &memState{tables: make(map[string]*memTable)},
+		versions:   make(map[rowKey]uint64),
+		tableSeq:   make(map[string]uint64),
+		sequences:  make(map[string]int64),
+		lockOwners: make(map[interface{}]*InMemoryTx),
+	}
+	s.lockCond = sync.NewCond(&s.lockMu)
+	migrations, err := embeddedMigrations()
+	if err == nil {
+		_, err = MigrateUp(&InMemoryDB{store: s}, migrations)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("in-memory schema: %v", err))
+	}
+	return s
+}
+
+// units in stock of each sample product.
+const sampleStock = 100
+
+// sample products
+func (s *InMemoryStore) Populate() {
+	products := []DBProduct{
+		{Name: "Laptop Pro", Price: MustParseMoney("1499.99", DefaultCurrency), VATRate: 0.22, Category: "computers",
+			WeightGrams: 2200, LengthMM: 400, WidthMM: 300, HeightMM: 60},
+		{Name: "Wireless Mouse", Price: MustParseMoney("79.99", DefaultCurrency), VATRate: 0.22, Category: "accessories",
+			WeightGrams: 150, LengthMM: 150, WidthMM: 100, HeightMM: 50},
+		{Name: "Mechanical Keyboard", Price: MustParseMoney("129.99", DefaultCurrency), VATRate: 0.22, Category: "accessories",
+			WeightGrams: 1100, LengthMM: 480, WidthMM: 170, HeightMM: 50},
+		{Name: "4K Monitor", Price: MustParseMoney("649.50", DefaultCurrency), VATRate: 0.22, Category: "monitors",
+			WeightGrams: 7500, LengthMM: 700, WidthMM: 480, HeightMM: 200},
+		{Name: "HD Monitor", Price: MustParseMoney("150.50", DefaultCurrency), VATRate: 0.15, Category: "monitors",
+			WeightGrams: 4000, LengthMM: 560, WidthMM: 400, HeightMM: 150},
+	}
+	tx := s.begin()
+	defer tx.Rollback()
+	for i := range products {
+		if err := InsertProduct(tx, &products[i]); err != nil {
+			panic(fmt.Sprintf("in-memory sample data: %v", err))
+		}
+		if _, err := AdjustStock(tx, products[i].ID, 0, sampleStock, "sample data", time.Now()); err != nil {
+			panic(fmt.Sprintf("in-memory sample data: %v", err))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		panic(fmt.Sprintf("in-memory sample data: %v", err))
+	}
+}
+
+// starts a transaction on the latest committed state.
+func (s *InMemoryStore) begin() *InMemoryTx {
+	s.mu.RLock()
+	state, seq := s.state, s.seq
+	s.mu.RUnlock()
+	return &InMemoryTx{
+		store:    s,
+		seq:      seq,
+		now:      time.Now(),
+		view:     &memState{tables: state.tables},
+		cloned:   make(map[string]bool),
+		writes:   make(map[rowKey]struct{}),
+		ddl:      make(map[string]bool),
+		lockedAt: make(map[rowKey]uint64),
+	}
+}
+
+// hands out the next value of a serial column.
+func (s *InMemoryStore) nextval(sequence string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sequences[sequence]++
+	return s.sequences[sequence]
+}
+
+func (s *InMemoryStore) nextRowID() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRowID++
+	return s.lastRowID
+}
+
+// mock implementation of DBExecutor that uses the in-memory store
+type InMemoryDB struct {
+	store *InMemoryStore
+}
+
+func (db *InMemoryDB) Begin() (TxExecutor, error) {
+	return db.store.begin(), nil
+}
+
+// outside a transaction every statement runs in its own, like in autocommit mode.
+func (db *InMemoryDB) run(query string, args []interface{}) (*memResult, error) {
+	tx := db.store.begin()
+	defer tx.Rollback()
+	res, err := tx.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return res, tx.Commit()
+}
+
+func (db *InMemoryDB) Query(query string, args ...interface{}) (RowsLike, error) {
+	res, err := db.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &InMemoryRows{data: res.rows}, nil
+}
+
+func (db *InMemoryDB) QueryRow(query string, args ...interface{}) RowLike {
+	return firstRow(db.run(query, args))
+}
+
+func (db *InMemoryDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	res, err := db.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &InMemoryResult{rowsAffected: res.affected}, nil
+}
+
+func firstRow(res *memResult, err error) RowLike {
+	if err != nil {
+		return &InMemoryRow{err: err}
+	}
+	if len(res.rows) == 0 {
+		return &InMemoryRow{err: sql.ErrNoRows}
+	}
+	return &InMemoryRow{data: res.rows[0]}
+}
+
+// mock implementation of TxExecutor. Reads see the snapshot taken at Begin
+// plus the transaction's own writes; writes go to a private copy of the
+// touched tables and are published atomically by Commit.
+type InMemoryTx struct {
+	store *InMemoryStore
+	seq   uint64    // commit sequence number of the snapshot
+	now   time.Time // start of the transaction, returned by now()
+
+	view      *memState
+	ownTables bool            // view.tables is a private copy
+	cloned    map[string]bool // tables of view already copied from the snapshot
+	writes    map[rowKey]struct{}
+	ddl       map[string]bool // tables created, altered or dropped in this transaction
+	failed    bool
+	done      bool
+
+	locks      []interface{}     // keys of the locks held
+	lockedAt   map[rowKey]uint64 // version at which a locked row was read again
+	waiting    bool              // blocked on the lock waitingFor
+	waitingFor interface{}
+}
+
+// parses and runs one statement. A failed statement aborts the transaction.
+func (tx *InMemoryTx) run(query string, args []interface{}) (*memResult, error) {
+	if tx.done {
+		return nil, sql.ErrTxDone
+	}
+	if tx.failed {
+		return nil, errTxAborted
+	}
+	res, err := tx.parseAndExecute(query, args)
+	if err != nil {
+		tx.failed = true
+		return nil, err
+	}
+	return res, nil
+}
+
+// a query without arguments may hold several statements, run in order like
+// Postgres' simple query protocol does; the result is that of the last one.
+func (tx *InMemoryTx) parseAndExecute(query string, args []interface{}) (*memResult, error) {
+	if len(args) == 0 && strings.Contains(query, ";") {
+		statements, err := splitStatements(query)
+		if err != nil {
+			return nil, err
+		}
+		if len(statements) != 1 {
+			res := &memResult{}
+			for _, stmt := range statements {
+				if res, err = tx.parseAndExecute(stmt, nil); err != nil {
+					return nil, err
+				}
+			}
+			return res, nil
+		}
+		query = statements[0]
+	}
+	stmt, err := parseSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	values, err := normalizeArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return tx.execute(stmt, values)
+}
+
+func (tx *InMemoryTx) Query(query string, args ...interface{}) (RowsLike, error) {
+	res, err := tx.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &InMemoryRows{data: res.rows}, nil
+}
+
+func (tx *InMemoryTx) QueryRow(query string, args ...interface{}) RowLike {
+	return firstRow(tx.run(query, args))
+}
+
+func (tx *InMemoryTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	res, err := tx.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &InMemoryResult{rowsAffected: res.affected}, nil
+}
+
+// Commit publishes the written rows on top of the latest committed state. It
+// fails with ErrSerializationFailure if one of them was committed by another
+// transaction since Begin, and with ErrUniqueViolation if a concurrent commit
+// took one of its keys; the transaction is rolled back either way.
+func (tx *InMemoryTx) Commit() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+	defer tx.store.unlockAll(tx)
+	if tx.failed {
+		return errTxAborted
+	}
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	s := tx.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range tx.writes {
+		switch {
+		case s.versions[key] > max(tx.seq, tx.lockedAt[key]),
+			key.rowID != 0 && s.versions[rowKey{table: key.table}] > tx.seq,
+			tx.ddl[key.table] && s.tableSeq[key.table] > tx.seq:
+			return fmt.Errorf("in-memory commit of %s row %d: %w", key.table, key.rowID, ErrSerializationFailure)
+		}
+	}
+
+	next := &memState{tables: maps.Clone(s.state.tables)}
+	for name := range tx.ddl {
+		if t, ok := tx.view.tables[name]; ok {
+			next.tables[name] = t
+		} else {
+			delete(next.tables, name)
+		}
+	}
+	touched := make(map[string]*memTable)
+	for key := range tx.writes {
+		if key.rowID == 0 || tx.ddl[key.table] {
+			continue
+		}
+		t := touched[key.table]
+		if t == nil {
+			current, ok := next.tables[key.table]
+			if !ok {
+				return fmt.Errorf("relation %q does not exist", key.table)
+			}
+			t = &memTable{schema: current.schema, rows: maps.Clone(current.rows)}
+			touched[key.table] = t
+			next.tables[key.table] = t
+		}
+		if row, ok := tx.view.tables[key.table].rows[key.rowID]; ok {
+			t.rows[key.rowID] = row
+		} else {
+			delete(t.rows, key.rowID)
+		}
+	}
+	// keys inserted by transactions that committed after our snapshot
+	for key := range tx.writes {
+		t := touched[key.table]
+		if t == nil {
+			continue
+		}
+		if row, ok := t.rows[key.rowID]; ok {
+			if _, clash := t.conflict(row, key.rowID); clash != nil {
+				return uniqueViolation(t.schema, clash, row)
+			}
+		}
+	}
+
+	s.seq++
+	for key := range tx.writes {
+		s.versions[key] = s.seq
+		s.tableSeq[key.table] = s.seq
+	}
+	s.state = next
+	return nil
+}
+
+// Rollback discards the private view.
+func (tx *InMemoryTx) Rollback() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+	tx.store.unlockAll(tx)
+	return nil
+}
+
+// moves the snapshot of a transaction that has not written anything yet to
+// the latest committed state, so that after waiting for a lock it sees what
+// the previous holder committed, as under Postgres' READ COMMITTED.
+func (tx *InMemoryTx) refreshSnapshot() {
+	if len(tx.writes) > 0 {
+		return
+	}
+	s := tx.store
+	s.mu.RLock()
+	tx.view, tx.seq = &memState{tables: s.state.tables}, s.seq
+	s.mu.RUnlock()
+	tx.ownTables = false
+	clear(tx.cloned)
+}
+
+// returns a table for reading.
+func (tx *InMemoryTx) table(name string) (*memTable, error) {
+	t, ok := tx.view.tables[name]
+	if !ok {
+		return nil, fmt.Errorf("relation %q does not exist", name)
+	}
+	return t, nil
+}
+
+// returns a table for writing, copying it into the view on first write.
+func (tx *InMemoryTx) writableTable(name string) (*memTable, error) {
+	t, err := tx.table(name)
+	if err != nil || tx.cloned[name] {
+		return t, err
+	}
+	t = &memTable{schema: t.schema, rows: maps.Clone(t.rows)}
+	tx.setTable(name, t)
+	return t, nil
+}
+
+// replaces a table of the view; nil drops it.
+func (tx *InMemoryTx) setTable(name string, t *memTable) {
+	if !tx.ownTables {
+		tx.view.tables = maps.Clone(tx.view.tables)
+		tx.ownTables = true
+	}
+	if t == nil {
+		delete(tx.view.tables, name)
+	} else {
+		tx.view.tables[name] = t
+	}
+	tx.cloned[name] = true
+}
+
+// replaces a table definition; the whole table is published on commit.
+func (tx *InMemoryTx) setTableDefinition(name string, t *memTable) {
+	tx.setTable(name, t)
+	tx.ddl[name] = true
+	tx.writes[rowKey{table: name}] = struct{}{}
+}
+
+func (tx *InMemoryTx) putRow(t *memTable, id int64, row memRow) {
+	t.rows[id] = row
+	tx.writes[rowKey{table: t.schema.name, rowID: id}] = struct{}{}
+}
+
+func (tx *InMemoryTx) deleteRow(t *memTable, id int64) {
+	delete(t.rows, id)
+	tx.writes[rowKey{table: t.schema.name, rowID: id}] = struct{}{}
+}
+
+func (tx *InMemoryTx) createTable(s *createTableStmt) error {
+	if _, ok := tx.view.tables[s.schema.name]; ok {
+		if s.ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("relation %q already exists", s.schema.name)
+	}
+	tx.setTableDefinition(s.schema.name, &memTable{schema: s.schema, rows: make(map[int64]memRow)})
+	return nil
+}
+
+// returns the table owning the named index.
+func (tx *InMemoryTx) indexTable(name string) *memTable {
+	for _, t := range tx.view.tables {
+		for _, idx := range t.schema.indexes {
+			if idx.name == name {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+func (tx *InMemoryTx) createIndex(s *createIndexStmt) error {
+	if tx.indexTable(s.index.name) != nil {
+		if s.ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("relation %q already exists", s.index.name)
+	}
+	t, err := tx.table(s.table)
+	if err != nil {
+		return err
+	}
+	index := s.index
+	if index.columns, err = t.schema.columnIndexes(s.columns); err != nil {
+		return err
+	}
+	schema := t.schema.clone()
+	schema.indexes = append(schema.indexes, index)
+	updated := &memTable{schema: schema, rows: t.rows}
+	if index.unique {
+		for id, row := range t.rows {
+			if _, clash := updated.conflict(row, id); clash != nil {
+				return fmt.Errorf("could not create unique index %q: %w", index.name, uniqueViolation(schema, clash, row))
+			}
+		}
+	}
+	tx.setTableDefinition(s.table, updated)
+	return nil
+}
+
+func (tx *InMemoryTx) drop(s *dropStmt) error {
+	for _, name := range s.names {
+		if s.index {
+			t := tx.indexTable(name)
+			if t == nil {
+				if s.ifExists {
+					continue
+				}
+				return fmt.Errorf("index %q does not exist", name)
+			}
+			schema := t.schema.clone()
+			schema.indexes = slices.DeleteFunc(schema.indexes, func(idx indexDef) bool { return idx.name == name })
+			tx.setTableDefinition(schema.name, &memTable{schema: schema, rows: t.rows})
+			continue
+		}
+		if _, ok := tx.view.tables[name]; !ok {
+			if s.ifExists {
+				continue
+			}
+			return fmt.Errorf("table %q does not exist", name)
+		}
+		tx.setTableDefinition(name, nil)
+	}
+	return nil
+}
+
+func (tx *InMemoryTx) alterTable(s *alterTableStmt) error {
+	t, err := tx.table(s.table)
+	if err != nil {
+		return err
+	}
+	schema := t.schema.clone()
+	rows := make(map[int64]memRow, len(t.rows))
+	for id, row := range t.rows {
+		rows[id] = slices.Clone(row)
+	}
+
+	for _, action := range s.actions {
+		if action.add != nil {
+			col := action.add.columns[0]
+			if schema.column(col.name) >= 0 {
+				if action.ifExists {
+					continue
+				}
+				return fmt.Errorf("column %q of relation %q already exists", col.name, schema.name)
+			}
+			pos := len(schema.columns)
+			schema.columns = append(schema.columns, col)
+			if action.add.primaryKey != nil {
+				if schema.primaryKey != nil {
+					return fmt.Errorf("multiple primary keys for table %q are not allowed", schema.name)
+				}
+				schema.primaryKey = []int{pos}
+			}
+			for range action.add.unique {
+				schema.unique = append(schema.unique, []int{pos})
+			}
+			schema.checks = append(schema.checks, action.add.checks...)
+			env := &evalEnv{tx: tx}
+			for _, id := range slices.Sorted(maps.Keys(rows)) {
+				var v interface{}
+				switch {
+				case col.serial:
+					v = tx.store.nextval(schema.name + "." + col.name)
+				case col.def != nil:
+					if v, err = env.eval(col.def); err != nil {
+						return err
+					}
+				}
+				if v, err = coerceValue(v, col.typ); err != nil {
+					return err
+				}
+				if v == nil && col.notNull {
+					return fmt.Errorf("column %q of relation %q contains null values", col.name, schema.name)
+				}
+				rows[id] = append(rows[id], v)
+			}
+			continue
+		}
+
+		pos := schema.column(action.drop)
+		if pos < 0 {
+			if action.ifExists {
+				continue
+			}
+			return fmt.Errorf("column %q of relation %q does not exist", action.drop, schema.name)
+		}
+		schema.dropColumn(pos)
+		for id, row := range rows {
+			rows[id] = slices.Delete(row, pos, pos+1)
+		}
+	}
+
+	tx.setTableDefinition(s.table, &memTable{schema: schema, rows: rows})
+	return nil
+}
+
+// --- Locks ---
+
+// the key of a pg_advisory_xact_lock.
+type advisoryLockKey int64
+
+// ErrDeadlock is returned when waiting for a lock would never end.
+var ErrDeadlock = errors.New("deadlock detected")
+
+// blocks until tx holds the lock on key, which it keeps until it ends. Instead
+// of waiting on a transaction that (transitively) waits on tx, it fails with ErrDeadlock.
+func (s *InMemoryStore) lock(tx *InMemoryTx, key interface{}) error {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	for {
+		owner, held := s.lockOwners[key]
+		if !held || owner == tx {
+			break
+		}
+		for t := owner; t != nil && t.waiting; {
+			next := s.lockOwners[t.waitingFor]
+			if next == tx {
+				return fmt.Errorf("%w: waiting for %v", ErrDeadlock, key)
+			}
+			t = next
+		}
+		tx.waiting, tx.waitingFor = true, key
+		s.lockCond.Wait()
+		tx.waiting, tx.waitingFor = false, nil
+	}
+	if _, held := s.lockOwners[key]; !held {
+		s.lockOwners[key] = tx
+		tx.locks = append(tx.locks, key)
+	}
+	return nil
+}
+
+// takes the lock on key only if it is free or already held by tx.
+func (s *InMemoryStore) tryLock(tx *InMemoryTx, key interface{}) bool {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	if owner, held := s.lockOwners[key]; held {
+		return owner == tx
+	}
+	s.lockOwners[key] = tx
+	tx.locks = append(tx.locks, key)
+	return true
+}
+
+func (s *InMemoryStore) unlockAll(tx *InMemoryTx) {
+	if len(tx.locks) == 0 {
+		return
+	}
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	for _, key := range tx.locks {
+		delete(s.lockOwners, key)
+	}
+	tx.locks = nil
+	s.lockCond.Broadcast()
+}
+
+// locks a row for SELECT ... FOR UPDATE and returns its latest committed
+// version, or nil if it has been deleted. Like Postgres under READ COMMITTED,
+// a row committed by another transaction after the snapshot is read again
+// instead of causing a serialization failure; changed reports whether it was.
+// Writes that do not lock rows still conflict at commit.
+func (tx *InMemoryTx) lockRow(table string, id int64) (memRow, bool, error) {
+	s := tx.store
+	key := rowKey{table: table, rowID: id}
+	if !s.tryLock(tx, key) {
+		if err := s.lock(tx, key); err != nil {
+			return nil, false, err
+		}
+	}
+
+	current := tx.view.tables[table].rows[id]
+	if _, written := tx.writes[key]; written {
+		return current, false, nil
+	}
+	s.mu.RLock()
+	version := s.versions[key]
+	var latest memRow
+	if t, ok := s.state.tables[table]; ok {
+		latest = t.rows[id]
+	}
+	s.mu.RUnlock()
+	if version <= max(tx.seq, tx.lockedAt[key]) {
+		return current, false, nil
+	}
+
+	t, err := tx.writableTable(table)
+	if err != nil {
+		return nil, false, err
+	}
+	if latest == nil {
+		delete(t.rows, id)
+	} else {
+		t.rows[id] = latest
+	}
+	tx.lockedAt[key] = version
+	return latest, true, nil
+}
+
+// implements pg_advisory_xact_lock.
+func (tx *InMemoryTx) advisoryLock(key int64) error {
+	s := tx.store
+	if s.tryLock(tx, advisoryLockKey(key)) {
+		return nil
+	}
+	if err := s.lock(tx, advisoryLockKey(key)); err != nil {
+		return err
+	}
+	tx.refreshSnapshot()
+	return nil
+}
+
+// mock implementation of RowLike.
+type InMemoryRow struct {
+	data []interface{}
+	err  error
+}
+
+func (r *InMemoryRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(dest) != len(r.data) {
+		return fmt.Errorf("scan error: expected %d dest values, got %d", len(r.data), len(dest))
+	}
+	for i, val := range r.data {
+		if err := scanValue(dest[i], val); err != nil {
+			return fmt.Errorf("scan error on column %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// stores a column value into a Scan destination, like database/sql does.
+func scanValue(dest, val interface{}) error {
+	if scanner, ok := dest.(sql.Scanner); ok {
+		return scanner.Scan(val)
+	}
+	if val == nil {
+		switch d := dest.(type) {
+		case *interface{}:
+			*d = nil
+		case *[]byte:
+			*d = nil
+		default:
+			return fmt.Errorf("converting NULL to %T is unsupported", dest)
+		}
+		return nil
+	}
+	switch d := dest.(type) {
+	case *string:
+		s, err := castValue(val, "text")
+		if err != nil {
+			return err
+		}
+		*d = s.(string)
+	case *int, *int64:
+		v, err := coerceValue(val, "integer")
+		if err != nil {
+			return err
+		}
+		if p, ok := d.(*int); ok {
+			*p = int(v.(int64))
+		} else {
+			*d.(*int64) = v.(int64)
+		}
+	case *float64:
+		v, err := coerceValue(val, "double precision")
+		if err != nil {
+			return err
+		}
+		*d = v.(float64)
+	case *bool:
+		b, ok := val.(bool)
+		if !ok {
+			return fmt.Errorf("cannot scan %T into *bool", val)
+		}
+		*d = b
+	case *time.Time:
+		t, ok := val.(time.Time)
+		if !ok {
+			return fmt.Errorf("cannot scan %T into *time.Time", val)
+		}
+		*d = t
+	case *[]byte:
+		switch v := val.(type) {
+		case []byte:
+			*d = slices.Clone(v)
+		case string:
+			*d = []byte(v)
+		default:
+			return fmt.Errorf("cannot scan %T into *[]byte", val)
+		}
+	case *interface{}:
+		*d = val
+	default:
+		return fmt.Errorf("unsupported type for scan: %T", dest)
+	}
+	return nil
+}
+
+// mock implementation of RowsLike.
+type InMemoryRows struct {
+	data         [][]interface{}
+	currentIndex int
+}
+
+func (r *InMemoryRows) Next() bool {
+	r.currentIndex++
+	return r.currentIndex <= len(r.data)
+}
+
+func (r *InMemoryRows) Scan(dest ...interface{}) error {
+	if r.currentIndex > len(r.data) || r.currentIndex == 0 {
+		return errors.New("scan called out of bounds or before Next")
+	}
+	rowData := r.data[r.currentIndex-1]
+	row := &InMemoryRow{data: rowData}
+	return row.Scan(dest...)
+}
+func (r *InMemoryRows) Close() error { return nil }
+func (r *InMemoryRows) Err() error   { return nil }
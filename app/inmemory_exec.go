@@ -0,0 +1,1417 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- SQL executor for the in-memory store ---
+//
+// Values are kept as int64, float64, Money, string, bool, time.Time, []byte or
+// nil (NULL). NUMERIC columns keep whatever numeric value was written, so a
+// Money amount comes back with its currency.
+
+// ErrUniqueViolation is returned when a write would duplicate a primary key or unique column.
+var ErrUniqueViolation = errors.New("duplicate key value violates unique constraint")
+
+// the rows produced by a statement, and the number of rows it processed.
+type memResult struct {
+	rows     [][]interface{}
+	affected int64
+}
+
+// runs a parsed statement inside tx.
+func (tx *InMemoryTx) execute(stmt memStmt, args []interface{}) (*memResult, error) {
+	env := &evalEnv{tx: tx, args: args}
+	switch s := stmt.(type) {
+	case *selectStmt:
+		rows, err := env.selectRows(s)
+		if err != nil {
+			return nil, err
+		}
+		return &memResult{rows: rows, affected: int64(len(rows))}, nil
+	case *insertStmt:
+		return env.insert(s)
+	case *updateStmt:
+		return env.update(s)
+	case *deleteStmt:
+		return env.delete(s)
+	case *createTableStmt:
+		return &memResult{}, tx.createTable(s)
+	case *createIndexStmt:
+		return &memResult{}, tx.createIndex(s)
+	case *dropStmt:
+		return &memResult{}, tx.drop(s)
+	case *alterTableStmt:
+		return &memResult{}, tx.alterTable(s)
+	}
+	return nil, fmt.Errorf("unsupported statement %T", stmt)
+}
+
+// converts query arguments to the value types used by the store.
+func normalizeArgs(args []interface{}) ([]interface{}, error) {
+	out := make([]interface{}, len(args))
+	for i, arg := range args {
+		v, err := normalizeValue(arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument $%d: %w", i+1, err)
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func normalizeValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil, int64, float64, Money, string, bool, time.Time:
+		return x, nil
+	case []byte:
+		return slices.Clone(x), nil
+	case driver.Valuer:
+		dv, err := x.Value()
+		if err != nil {
+			return nil, err
+		}
+		return normalizeValue(dv)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", v)
+}
+
+// --- Types ---
+
+// maps a column type to the kind of value stored in it.
+func typeFamily(typ string) string {
+	base := strings.Fields(typ)[0]
+	switch base {
+	case "integer", "int", "int2", "int4", "int8", "smallint", "bigint":
+		return "int"
+	case "numeric", "decimal":
+		return "numeric"
+	case "real", "float", "float4", "float8", "double":
+		return "float"
+	case "text", "varchar", "char", "character", "uuid", "citext":
+		return "text"
+	case "boolean", "bool":
+		return "bool"
+	case "timestamptz", "timestamp", "date":
+		return "time"
+	case "bytea":
+		return "bytes"
+	}
+	return ""
+}
+
+// converts a value written to a column of type typ.
+func coerceValue(v interface{}, typ string) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch typeFamily(typ) {
+	case "int":
+		switch x := v.(type) {
+		case int64:
+			return x, nil
+		case float64:
+			if x == float64(int64(x)) {
+				return int64(x), nil
+			}
+		case string:
+			if n, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64); err == nil {
+				return n, nil
+			}
+		}
+	case "numeric":
+		switch x := v.(type) {
+		case int64, float64, Money:
+			return x, nil
+		case string:
+			if m, err := ParseMoney(strings.TrimSpace(x), DefaultCurrency); err == nil {
+				return m, nil
+			}
+		}
+	case "float":
+		switch x := v.(type) {
+		case float64:
+			return x, nil
+		case int64, Money:
+			f, _ := toRat(x).Float64()
+			return f, nil
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(x), 64); err == nil {
+				return f, nil
+			}
+		}
+	case "text":
+		switch x := v.(type) {
+		case string:
+			return x, nil
+		case []byte:
+			return string(x), nil
+		}
+	case "bool":
+		switch x := v.(type) {
+		case bool:
+			return x, nil
+		case string:
+			if b, err := strconv.ParseBool(x); err == nil {
+				return b, nil
+			}
+		}
+	case "time":
+		switch x := v.(type) {
+		case time.Time:
+			return x, nil
+		case string:
+			if t, err := time.Parse(time.RFC3339Nano, x); err == nil {
+				return t, nil
+			}
+		}
+	case "bytes":
+		switch x := v.(type) {
+		case []byte:
+			return x, nil
+		case string:
+			return []byte(x), nil
+		}
+	default:
+		return v, nil
+	}
+	return nil, fmt.Errorf("invalid input value %v (%T) for type %s", v, v, typ)
+}
+
+// applies an explicit cast; unlike a column write any value can be cast to text.
+func castValue(v interface{}, typ string) (interface{}, error) {
+	if typeFamily(typ) == "text" {
+		switch x := v.(type) {
+		case int64:
+			return strconv.FormatInt(x, 10), nil
+		case float64:
+			return strconv.FormatFloat(x, 'f', -1, 64), nil
+		case Money:
+			return x.String(), nil
+		case bool:
+			return strconv.FormatBool(x), nil
+		case time.Time:
+			return x.Format(time.RFC3339Nano), nil
+		}
+	}
+	return coerceValue(v, typ)
+}
+
+func isNumeric(v interface{}) bool {
+	switch v.(type) {
+	case int64, float64, Money:
+		return true
+	}
+	return false
+}
+
+// returns the exact value of a number.
+func toRat(v interface{}) *big.Rat {
+	switch x := v.(type) {
+	case int64:
+		return new(big.Rat).SetInt64(x)
+	case float64:
+		r, _ := new(big.Rat).SetString(strconv.FormatFloat(x, 'f', -1, 64))
+		return r
+	case Money:
+		scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponent(x.Currency))), nil)
+		return new(big.Rat).SetFrac(big.NewInt(x.Amount), scale)
+	}
+	return nil
+}
+
+// compares two non-NULL values, returning -1, 0 or +1.
+func compareValues(a, b interface{}) (int, error) {
+	if isNumeric(a) && isNumeric(b) {
+		if x, ok := a.(int64); ok {
+			if y, ok := b.(int64); ok {
+				return cmpOrdered(x, y), nil
+			}
+		}
+		return toRat(a).Cmp(toRat(b)), nil
+	}
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y), nil
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0, nil
+			case !x:
+				return -1, nil
+			}
+			return 1, nil
+		}
+	case []byte:
+		if y, ok := b.([]byte); ok {
+			return bytes.Compare(x, y), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+}
+
+func cmpOrdered(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// evaluates an arithmetic operator. Integer operands stay integers; a Money
+// operand makes the result Money in its currency, rounded with DefaultRoundingMode.
+func arith(op string, a, b interface{}) (interface{}, error) {
+	if a == nil || b == nil {
+		return nil, nil
+	}
+	if op == "||" {
+		sa, err := castValue(a, "text")
+		if err != nil {
+			return nil, err
+		}
+		sb, err := castValue(b, "text")
+		if err != nil {
+			return nil, err
+		}
+		return sa.(string) + sb.(string), nil
+	}
+	if !isNumeric(a) || !isNumeric(b) {
+		return nil, fmt.Errorf("operator does not exist: %T %s %T", a, op, b)
+	}
+
+	x, xok := a.(int64)
+	y, yok := b.(int64)
+	if xok && yok {
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		case "/":
+			if y == 0 {
+				return nil, errors.New("division by zero")
+			}
+			return x / y, nil
+		}
+	}
+
+	ra, rb := toRat(a), toRat(b)
+	r := new(big.Rat)
+	switch op {
+	case "+":
+		r.Add(ra, rb)
+	case "-":
+		r.Sub(ra, rb)
+	case "*":
+		r.Mul(ra, rb)
+	case "/":
+		if rb.Sign() == 0 {
+			return nil, errors.New("division by zero")
+		}
+		r.Quo(ra, rb)
+	default:
+		return nil, fmt.Errorf("unsupported operator %s", op)
+	}
+
+	ma, aMoney := a.(Money)
+	mb, bMoney := b.(Money)
+	if aMoney || bMoney {
+		currency := ma.Currency
+		if !aMoney {
+			currency = mb.Currency
+		} else if bMoney && mb.Currency != "" && mb.Currency != currency {
+			return nil, fmt.Errorf("cannot combine amounts in %s and %s", ma.Currency, mb.Currency)
+		}
+		scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponent(currency))), nil)
+		r.Mul(r, new(big.Rat).SetInt(scale))
+		amount, err := roundRat(r, DefaultRoundingMode)
+		if err != nil {
+			return nil, err
+		}
+		return Money{Amount: amount, Currency: currency}, nil
+	}
+	f, _ := r.Float64()
+	return f, nil
+}
+
+// canonical text of a value, for grouping and DISTINCT.
+func valueKey(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case time.Time:
+		return "t:" + x.UTC().Format(time.RFC3339Nano)
+	case Money:
+		return "n:" + toRat(x).RatString()
+	case int64, float64:
+		return "n:" + toRat(x).RatString()
+	}
+	return fmt.Sprintf("%T:%v", v, v)
+}
+
+func rowKeyString(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = valueKey(v)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// --- Expression evaluation ---
+
+// evalEnv holds the statement arguments and the rows in scope, innermost last.
+type evalEnv struct {
+	tx     *InMemoryTx
+	args   []interface{}
+	scopes []*rowScope
+}
+
+// a row visible to column references under any of names.
+type rowScope struct {
+	names  []string
+	schema *tableSchema
+	row    memRow
+	group  []memRow // rows of the group, when aggregating
+}
+
+func (env *evalEnv) with(scope *rowScope) *evalEnv {
+	return &evalEnv{tx: env.tx, args: env.args, scopes: append(slices.Clip(env.scopes), scope)}
+}
+
+var aggregateFuncs = map[string]bool{"count": true, "sum": true, "min": true, "max": true}
+
+// reports whether e contains an aggregate call outside of subqueries.
+func hasAggregate(e memExpr) bool {
+	switch x := e.(type) {
+	case *funcExpr:
+		if aggregateFuncs[x.name] {
+			return true
+		}
+		return slices.ContainsFunc(x.args, hasAggregate)
+	case *castExpr:
+		return hasAggregate(x.expr)
+	case *unaryExpr:
+		return hasAggregate(x.expr)
+	case *binaryExpr:
+		return hasAggregate(x.left) || hasAggregate(x.right)
+	case *isNullExpr:
+		return hasAggregate(x.expr)
+	case *inExpr:
+		return hasAggregate(x.expr) || slices.ContainsFunc(x.list, hasAggregate)
+	case *tupleExpr:
+		return slices.ContainsFunc(x.items, hasAggregate)
+	}
+	return false
+}
+
+func isTrue(v interface{}) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
+
+func (env *evalEnv) eval(e memExpr) (interface{}, error) {
+	switch x := e.(type) {
+	case *literalExpr:
+		return x.value, nil
+	case *paramExpr:
+		if x.index >= len(env.args) {
+			return nil, fmt.Errorf("there is no parameter $%d", x.index+1)
+		}
+		return env.args[x.index], nil
+	case *columnExpr:
+		return env.column(x)
+	case *castExpr:
+		v, err := env.eval(x.expr)
+		if err != nil {
+			return nil, err
+		}
+		return castValue(v, x.typ)
+	case *unaryExpr:
+		v, err := env.eval(x.expr)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		if x.op == "not" {
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("argument of NOT must be boolean, not %T", v)
+			}
+			return !b, nil
+		}
+		return arith("-", int64(0), v)
+	case *binaryExpr:
+		return env.binary(x)
+	case *isNullExpr:
+		if t, ok := x.expr.(*tupleExpr); ok {
+			return env.tupleIsNull(t, x.not)
+		}
+		v, err := env.eval(x.expr)
+		if err != nil {
+			return nil, err
+		}
+		return (v == nil) != x.not, nil
+	case *inExpr:
+		return env.in(x)
+	case *existsExpr:
+		rows, err := env.selectRows(x.sub)
+		if err != nil {
+			return nil, err
+		}
+		return len(rows) > 0, nil
+	case *subqueryExpr:
+		rows, err := env.selectRows(x.sub)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(rows) == 0:
+			return nil, nil
+		case len(rows) > 1:
+			return nil, errors.New("more than one row returned by a subquery used as an expression")
+		}
+		return rows[0][0], nil
+	case *tupleExpr:
+		return nil, errors.New("row value used where a single value is expected")
+	case *funcExpr:
+		return env.call(x)
+	}
+	return nil, fmt.Errorf("unsupported expression %T", e)
+}
+
+func (env *evalEnv) column(c *columnExpr) (interface{}, error) {
+	for i := len(env.scopes) - 1; i >= 0; i-- {
+		scope := env.scopes[i]
+		if c.table != "" && !slices.Contains(scope.names, c.table) {
+			continue
+		}
+		if idx := scope.schema.column(c.name); idx >= 0 {
+			return scope.row[idx], nil
+		}
+		if c.table != "" {
+			return nil, fmt.Errorf("column %s.%s does not exist", c.table, c.name)
+		}
+	}
+	if c.table != "" {
+		return nil, fmt.Errorf("missing FROM-clause entry for table %q", c.table)
+	}
+	return nil, fmt.Errorf("column %q does not exist", c.name)
+}
+
+func (env *evalEnv) binary(x *binaryExpr) (interface{}, error) {
+	switch x.op {
+	case "and", "or":
+		l, err := env.eval(x.left)
+		if err != nil {
+			return nil, err
+		}
+		// short-circuit: false AND ..., true OR ...
+		if l != nil && isTrue(l) == (x.op == "or") {
+			return l, nil
+		}
+		r, err := env.eval(x.right)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil && isTrue(r) == (x.op == "or") {
+			return r, nil
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		return x.op == "and", nil
+	case "=", "<>", "<", "<=", ">", ">=":
+		c, err := env.compare(x.left, x.right)
+		if err != nil || c == nil {
+			return nil, err
+		}
+		switch x.op {
+		case "=":
+			return *c == 0, nil
+		case "<>":
+			return *c != 0, nil
+		case "<":
+			return *c < 0, nil
+		case "<=":
+			return *c <= 0, nil
+		case ">":
+			return *c > 0, nil
+		}
+		return *c >= 0, nil
+	}
+	l, err := env.eval(x.left)
+	if err != nil {
+		return nil, err
+	}
+	r, err := env.eval(x.right)
+	if err != nil {
+		return nil, err
+	}
+	return arith(x.op, l, r)
+}
+
+// compares two operands, which may both be row values; nil means NULL.
+func (env *evalEnv) compare(left, right memExpr) (*int, error) {
+	lt, lok := left.(*tupleExpr)
+	rt, rok := right.(*tupleExpr)
+	if lok != rok || (lok && len(lt.items) != len(rt.items)) {
+		return nil, errors.New("row comparison operands must have the same number of columns")
+	}
+	ls, rs := []memExpr{left}, []memExpr{right}
+	if lok {
+		ls, rs = lt.items, rt.items
+	}
+	// row values compare left to right; the first unequal pair decides
+	for i := range ls {
+		l, err := env.eval(ls[i])
+		if err != nil {
+			return nil, err
+		}
+		r, err := env.eval(rs[i])
+		if err != nil {
+			return nil, err
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		c, err := compareValues(l, r)
+		if err != nil {
+			return nil, err
+		}
+		if c != 0 || i == len(ls)-1 {
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (env *evalEnv) tupleIsNull(t *tupleExpr, not bool) (interface{}, error) {
+	for _, item := range t.items {
+		v, err := env.eval(item)
+		if err != nil {
+			return nil, err
+		}
+		if (v == nil) == not {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (env *evalEnv) in(x *inExpr) (interface{}, error) {
+	v, err := env.eval(x.expr)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []interface{}
+	if x.sub != nil {
+		rows, err := env.selectRows(x.sub)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			candidates = append(candidates, row[0])
+		}
+	} else {
+		for _, e := range x.list {
+			c, err := env.eval(e)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, c)
+		}
+	}
+	if v == nil {
+		if len(candidates) == 0 {
+			return x.not, nil
+		}
+		return nil, nil
+	}
+	sawNull := false
+	for _, c := range candidates {
+		if c == nil {
+			sawNull = true
+			continue
+		}
+		cmp, err := compareValues(v, c)
+		if err != nil {
+			return nil, err
+		}
+		if cmp == 0 {
+			return !x.not, nil
+		}
+	}
+	if sawNull {
+		return nil, nil
+	}
+	return x.not, nil
+}
+
+func (env *evalEnv) call(fn *funcExpr) (interface{}, error) {
+	if aggregateFuncs[fn.name] {
+		return env.aggregate(fn)
+	}
+	args := make([]interface{}, len(fn.args))
+	for i, a := range fn.args {
+		v, err := env.eval(a)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	arity := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("function %s expects %d arguments, got %d", fn.name, n, len(args))
+		}
+		return nil
+	}
+
+	switch fn.name {
+	case "now":
+		return env.tx.now, arity(0)
+	case "coalesce":
+		for _, v := range args {
+			if v != nil {
+				return v, nil
+			}
+		}
+		return nil, nil
+	case "nullif":
+		if err := arity(2); err != nil || args[0] == nil || args[1] == nil {
+			return args[0], err
+		}
+		c, err := compareValues(args[0], args[1])
+		if err != nil || c == 0 {
+			return nil, err
+		}
+		return args[0], nil
+	case "greatest", "least":
+		var best interface{}
+		for _, v := range args {
+			if v == nil {
+				continue
+			}
+			if best == nil {
+				best = v
+				continue
+			}
+			c, err := compareValues(v, best)
+			if err != nil {
+				return nil, err
+			}
+			if (fn.name == "greatest" && c > 0) || (fn.name == "least" && c < 0) {
+				best = v
+			}
+		}
+		return best, nil
+	case "lower", "upper":
+		if err := arity(1); err != nil || args[0] == nil {
+			return nil, err
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("function %s expects text, got %T", fn.name, args[0])
+		}
+		if fn.name == "lower" {
+			return strings.ToLower(s), nil
+		}
+		return strings.ToUpper(s), nil
+	case "abs":
+		if err := arity(1); err != nil || args[0] == nil {
+			return nil, err
+		}
+		c, err := compareValues(args[0], int64(0))
+		if err != nil || c >= 0 {
+			return args[0], err
+		}
+		return arith("-", int64(0), args[0])
+	case "pg_advisory_xact_lock", "pg_try_advisory_xact_lock":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		key, ok := args[0].(int64)
+		if !ok {
+			return nil, fmt.Errorf("function %s expects bigint, got %T", fn.name, args[0])
+		}
+		if fn.name == "pg_try_advisory_xact_lock" {
+			return env.tx.store.tryLock(env.tx, advisoryLockKey(key)), nil
+		}
+		return nil, env.tx.advisoryLock(key)
+	}
+	return nil, fmt.Errorf("function %s does not exist", fn.name)
+}
+
+// evaluates count, sum, min or max over the rows of the current group.
+func (env *evalEnv) aggregate(fn *funcExpr) (interface{}, error) {
+	var scope *rowScope
+	if n := len(env.scopes); n > 0 {
+		scope = env.scopes[n-1]
+	}
+	if scope == nil || scope.group == nil {
+		return nil, fmt.Errorf("aggregate function %s is not allowed here", fn.name)
+	}
+	if fn.star {
+		if fn.name != "count" {
+			return nil, fmt.Errorf("%s(*) is not supported", fn.name)
+		}
+		return int64(len(scope.group)), nil
+	}
+	if len(fn.args) != 1 {
+		return nil, fmt.Errorf("aggregate function %s expects 1 argument", fn.name)
+	}
+
+	outer := env.scopes[:len(env.scopes)-1]
+	var count int64
+	var acc interface{}
+	for _, row := range scope.group {
+		rowEnv := &evalEnv{tx: env.tx, args: env.args, scopes: append(slices.Clip(outer), &rowScope{names: scope.names, schema: scope.schema, row: row})}
+		v, err := rowEnv.eval(fn.args[0])
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		count++
+		switch {
+		case acc == nil:
+			acc = v
+		case fn.name == "sum":
+			if acc, err = arith("+", acc, v); err != nil {
+				return nil, err
+			}
+		case fn.name == "min" || fn.name == "max":
+			c, err := compareValues(v, acc)
+			if err != nil {
+				return nil, err
+			}
+			if (fn.name == "min" && c < 0) || (fn.name == "max" && c > 0) {
+				acc = v
+			}
+		}
+	}
+	if fn.name == "count" {
+		return count, nil
+	}
+	return acc, nil
+}
+
+// --- Statements ---
+
+// a projected output row, with the environment its expressions were evaluated in.
+type outputRow struct {
+	env    *evalEnv
+	values []interface{}
+}
+
+func (env *evalEnv) selectRows(s *selectStmt) ([][]interface{}, error) {
+	schema := &tableSchema{}
+	var names []string
+	var t *memTable
+	rows := []memRow{{}}
+	if s.from != nil {
+		var err error
+		if t, err = env.tx.table(s.from.name); err != nil {
+			return nil, err
+		}
+		schema, names, rows = t.schema, []string{s.from.name, s.from.alias}, t.orderedRows()
+	}
+	rowEnv := func(row memRow, group []memRow) *evalEnv {
+		return env.with(&rowScope{names: names, schema: schema, row: row, group: group})
+	}
+	matches := func(row memRow) (bool, error) {
+		if s.where == nil {
+			return true, nil
+		}
+		v, err := rowEnv(row, nil).eval(s.where)
+		return isTrue(v), err
+	}
+
+	aggregate := len(s.groupBy) > 0 || s.having != nil
+	for _, item := range s.items {
+		aggregate = aggregate || (!item.star && hasAggregate(item.expr))
+	}
+	if s.forUpdate && (aggregate || s.distinct) {
+		return nil, errors.New("FOR UPDATE is not allowed with DISTINCT, GROUP BY or aggregate functions")
+	}
+
+	var matched []memRow
+	if s.forUpdate && t != nil {
+		// lock every matching row; a row changed by the previous holder of its
+		// lock is read again at its latest version and must still match
+		for _, id := range t.rowIDs() {
+			if ok, err := matches(t.rows[id]); err != nil || !ok {
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			row, changed, err := env.tx.lockRow(t.schema.name, id)
+			if err != nil {
+				return nil, err
+			}
+			if row == nil {
+				continue
+			}
+			if changed {
+				if ok, err := matches(row); err != nil || !ok {
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+			}
+			matched = append(matched, row)
+		}
+	} else {
+		for _, row := range rows {
+			ok, err := matches(row)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matched = append(matched, row)
+			}
+		}
+	}
+
+	var out []outputRow
+	emit := func(e *evalEnv) error {
+		var values []interface{}
+		for _, item := range s.items {
+			if item.star {
+				if s.from == nil {
+					return errors.New("SELECT * with no tables specified is not valid")
+				}
+				values = append(values, e.scopes[len(e.scopes)-1].row...)
+				continue
+			}
+			v, err := e.eval(item.expr)
+			if err != nil {
+				return err
+			}
+			values = append(values, v)
+		}
+		out = append(out, outputRow{env: e, values: values})
+		return nil
+	}
+
+	if aggregate {
+		groups, err := groupRows(matched, s.groupBy, func(row memRow) *evalEnv { return rowEnv(row, nil) })
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			first := make(memRow, len(schema.columns))
+			if len(group) > 0 {
+				first = group[0]
+			}
+			e := rowEnv(first, group)
+			if s.having != nil {
+				v, err := e.eval(s.having)
+				if err != nil {
+					return nil, err
+				}
+				if !isTrue(v) {
+					continue
+				}
+			}
+			if err := emit(e); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		for _, row := range matched {
+			if err := emit(rowEnv(row, nil)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(s.orderBy) > 0 {
+		if err := sortOutput(out, s); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([][]interface{}, 0, len(out))
+	seen := make(map[string]bool)
+	for _, o := range out {
+		if s.distinct {
+			key := rowKeyString(o.values)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		result = append(result, o.values)
+	}
+
+	if s.offset != nil {
+		n, err := env.count(s.offset, "OFFSET")
+		if err != nil {
+			return nil, err
+		}
+		if n >= 0 {
+			result = result[min(n, len(result)):]
+		}
+	}
+	if s.limit != nil {
+		n, err := env.count(s.limit, "LIMIT")
+		if err != nil {
+			return nil, err
+		}
+		if n >= 0 && n < len(result) {
+			result = result[:n]
+		}
+	}
+	return result, nil
+}
+
+// splits rows into groups by the GROUP BY expressions, in order of first appearance.
+// Without GROUP BY all rows form a single group, even when there are none.
+func groupRows(rows []memRow, by []memExpr, rowEnv func(memRow) *evalEnv) ([][]memRow, error) {
+	if len(by) == 0 {
+		return [][]memRow{append([]memRow{}, rows...)}, nil
+	}
+	var groups [][]memRow
+	index := make(map[string]int)
+	for _, row := range rows {
+		e := rowEnv(row)
+		key := make([]interface{}, len(by))
+		for i, expr := range by {
+			v, err := e.eval(expr)
+			if err != nil {
+				return nil, err
+			}
+			key[i] = v
+		}
+		k := rowKeyString(key)
+		if i, ok := index[k]; ok {
+			groups[i] = append(groups[i], row)
+			continue
+		}
+		index[k] = len(groups)
+		groups = append(groups, []memRow{row})
+	}
+	return groups, nil
+}
+
+// sorts the output rows by ORDER BY. A bare name matching an output column
+// alias, or a column position, refers to the output column.
+func sortOutput(out []outputRow, s *selectStmt) error {
+	outputIndex := func(e memExpr) int {
+		switch x := e.(type) {
+		case *literalExpr:
+			if n, ok := x.value.(int64); ok && n >= 1 && int(n) <= len(s.items) {
+				return int(n) - 1
+			}
+		case *columnExpr:
+			if x.table != "" {
+				return -1
+			}
+			for i, item := range s.items {
+				if item.alias == x.name {
+					return i
+				}
+			}
+		}
+		return -1
+	}
+
+	keys := make([][]interface{}, len(out))
+	for i, o := range out {
+		keys[i] = make([]interface{}, len(s.orderBy))
+		for j, item := range s.orderBy {
+			if idx := outputIndex(item.expr); idx >= 0 && !slices.ContainsFunc(s.items, func(it selectItem) bool { return it.star }) {
+				keys[i][j] = o.values[idx]
+				continue
+			}
+			v, err := o.env.eval(item.expr)
+			if err != nil {
+				return err
+			}
+			keys[i][j] = v
+		}
+	}
+
+	var sortErr error
+	perm := make([]int, len(out))
+	for i := range perm {
+		perm[i] = i
+	}
+	sort.SliceStable(perm, func(a, b int) bool {
+		ka, kb := keys[perm[a]], keys[perm[b]]
+		for j, item := range s.orderBy {
+			va, vb := ka[j], kb[j]
+			var c int
+			switch {
+			case va == nil && vb == nil:
+				continue
+			case va == nil || vb == nil:
+				// the NULL goes first only with NULLS FIRST
+				return (va == nil) == item.nullsFirst
+			default:
+				var err error
+				if c, err = compareValues(va, vb); err != nil {
+					sortErr = err
+					return false
+				}
+			}
+			if c == 0 {
+				continue
+			}
+			if item.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	if sortErr != nil {
+		return sortErr
+	}
+	sorted := make([]outputRow, len(out))
+	for i, p := range perm {
+		sorted[i] = out[p]
+	}
+	copy(out, sorted)
+	return nil
+}
+
+// evaluates a LIMIT or OFFSET; -1 means none (NULL).
+func (env *evalEnv) count(e memExpr, clause string) (int, error) {
+	v, err := env.eval(e)
+	if err != nil || v == nil {
+		return -1, err
+	}
+	n, ok := v.(int64)
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %v", clause, v)
+	}
+	return int(n), nil
+}
+
+// evaluates a RETURNING list against a written row.
+func (env *evalEnv) returning(items []selectItem, ref tableRef, schema *tableSchema, row memRow) ([]interface{}, error) {
+	e := env.with(&rowScope{names: []string{ref.name, ref.alias}, schema: schema, row: row})
+	var values []interface{}
+	for _, item := range items {
+		if item.star {
+			values = append(values, row...)
+			continue
+		}
+		v, err := e.eval(item.expr)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (env *evalEnv) insert(s *insertStmt) (*memResult, error) {
+	rows := s.rows
+	if s.query != nil {
+		values, err := env.selectRows(s.query)
+		if err != nil {
+			return nil, err
+		}
+		rows = make([][]memExpr, len(values))
+		for i, row := range values {
+			for _, v := range row {
+				rows[i] = append(rows[i], &literalExpr{value: v})
+			}
+		}
+	}
+
+	t, err := env.tx.writableTable(s.table.name)
+	if err != nil {
+		return nil, err
+	}
+	schema := t.schema
+
+	cols := make([]int, 0, len(schema.columns))
+	if s.columns == nil {
+		for i := range schema.columns {
+			cols = append(cols, i)
+		}
+	} else {
+		for _, name := range s.columns {
+			idx := schema.column(name)
+			if idx < 0 {
+				return nil, fmt.Errorf("column %q of relation %q does not exist", name, schema.name)
+			}
+			cols = append(cols, idx)
+		}
+	}
+
+	res := &memResult{}
+	for _, exprs := range rows {
+		if len(exprs) != len(cols) {
+			return nil, errors.New("INSERT has a different number of expressions than target columns")
+		}
+		row := make(memRow, len(schema.columns))
+		given := make([]bool, len(schema.columns))
+		for i, e := range exprs {
+			if e == nil {
+				continue
+			}
+			v, err := env.eval(e)
+			if err != nil {
+				return nil, err
+			}
+			row[cols[i]], given[cols[i]] = v, true
+		}
+		for i, col := range schema.columns {
+			if given[i] {
+				continue
+			}
+			switch {
+			case col.serial:
+				row[i] = env.tx.store.nextval(schema.name + "." + col.name)
+			case col.def != nil:
+				v, err := (&evalEnv{tx: env.tx}).eval(col.def)
+				if err != nil {
+					return nil, err
+				}
+				row[i] = v
+			}
+		}
+		if row, err = env.checkRow(schema, row); err != nil {
+			return nil, err
+		}
+
+		conflictID, key := t.conflict(row, 0)
+		if key == nil {
+			id := env.tx.store.nextRowID()
+			env.tx.putRow(t, id, row)
+			if err := env.appendReturning(res, s.returning, s.table, schema, row); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		oc := s.onConflict
+		if oc == nil || (oc.columns != nil && !sameColumns(schema, oc.columns, key)) {
+			return nil, uniqueViolation(schema, key, row)
+		}
+		if oc.doNothing {
+			continue
+		}
+		existing := t.rows[conflictID]
+		e := env.with(&rowScope{names: []string{"excluded"}, schema: schema, row: row}).
+			with(&rowScope{names: []string{s.table.name, s.table.alias}, schema: schema, row: existing})
+		if oc.where != nil {
+			v, err := e.eval(oc.where)
+			if err != nil {
+				return nil, err
+			}
+			if !isTrue(v) {
+				continue
+			}
+		}
+		updated, err := env.applySet(e, schema, existing, oc.set)
+		if err != nil {
+			return nil, err
+		}
+		if _, other := t.conflict(updated, conflictID); other != nil {
+			return nil, uniqueViolation(schema, other, updated)
+		}
+		env.tx.putRow(t, conflictID, updated)
+		if err := env.appendReturning(res, s.returning, s.table, schema, updated); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (env *evalEnv) appendReturning(res *memResult, items []selectItem, ref tableRef, schema *tableSchema, row memRow) error {
+	res.affected++
+	if items == nil {
+		return nil
+	}
+	values, err := env.returning(items, ref, schema, row)
+	if err != nil {
+		return err
+	}
+	res.rows = append(res.rows, values)
+	return nil
+}
+
+// evaluates SET clauses against the old row in e and returns the checked new row.
+func (env *evalEnv) applySet(e *evalEnv, schema *tableSchema, old memRow, set []setClause) (memRow, error) {
+	row := slices.Clone(old)
+	for _, sc := range set {
+		idx := schema.column(sc.column)
+		if idx < 0 {
+			return nil, fmt.Errorf("column %q of relation %q does not exist", sc.column, schema.name)
+		}
+		v, err := e.eval(sc.expr)
+		if err != nil {
+			return nil, err
+		}
+		row[idx] = v
+	}
+	return env.checkRow(schema, row)
+}
+
+func (env *evalEnv) update(s *updateStmt) (*memResult, error) {
+	t, err := env.tx.writableTable(s.table.name)
+	if err != nil {
+		return nil, err
+	}
+	schema := t.schema
+	names := []string{s.table.name, s.table.alias}
+
+	// every row is matched and computed against the state before the update
+	type change struct {
+		id  int64
+		row memRow
+	}
+	var changes []change
+	for _, id := range t.rowIDs() {
+		old := t.rows[id]
+		e := env.with(&rowScope{names: names, schema: schema, row: old})
+		if s.where != nil {
+			v, err := e.eval(s.where)
+			if err != nil {
+				return nil, err
+			}
+			if !isTrue(v) {
+				continue
+			}
+		}
+		row, err := env.applySet(e, schema, old, s.set)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change{id: id, row: row})
+	}
+
+	res := &memResult{}
+	for _, c := range changes {
+		if _, key := t.conflict(c.row, c.id); key != nil {
+			return nil, uniqueViolation(schema, key, c.row)
+		}
+		env.tx.putRow(t, c.id, c.row)
+		if err := env.appendReturning(res, s.returning, s.table, schema, c.row); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (env *evalEnv) delete(s *deleteStmt) (*memResult, error) {
+	t, err := env.tx.writableTable(s.table.name)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{s.table.name, s.table.alias}
+
+	var ids []int64
+	for _, id := range t.rowIDs() {
+		if s.where != nil {
+			v, err := env.with(&rowScope{names: names, schema: t.schema, row: t.rows[id]}).eval(s.where)
+			if err != nil {
+				return nil, err
+			}
+			if !isTrue(v) {
+				continue
+			}
+		}
+		ids = append(ids, id)
+	}
+
+	res := &memResult{}
+	for _, id := range ids {
+		old := t.rows[id]
+		env.tx.deleteRow(t, id)
+		if err := env.appendReturning(res, s.returning, s.table, t.schema, old); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// converts the values of a row to the column types and enforces NOT NULL and CHECK.
+func (env *evalEnv) checkRow(schema *tableSchema, row memRow) (memRow, error) {
+	for i, col := range schema.columns {
+		v, err := coerceValue(row[i], col.typ)
+		if err != nil {
+			return nil, fmt.Errorf("column %q of relation %q: %w", col.name, schema.name, err)
+		}
+		if v == nil && col.notNull {
+			return nil, fmt.Errorf("null value in column %q of relation %q violates not-null constraint", col.name, schema.name)
+		}
+		row[i] = v
+	}
+	e := &evalEnv{tx: env.tx, scopes: []*rowScope{{names: []string{schema.name}, schema: schema, row: row}}}
+	for _, check := range schema.checks {
+		v, err := e.eval(check)
+		if err != nil {
+			return nil, err
+		}
+		if b, ok := v.(bool); ok && !b {
+			return nil, fmt.Errorf("new row for relation %q violates check constraint", schema.name)
+		}
+	}
+	return row, nil
+}
+
+// reports whether the ON CONFLICT target names exactly the columns of key.
+func sameColumns(schema *tableSchema, names []string, key []int) bool {
+	if len(names) != len(key) {
+		return false
+	}
+	for _, name := range names {
+		if !slices.Contains(key, schema.column(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func uniqueViolation(schema *tableSchema, key []int, row memRow) error {
+	cols := make([]string, len(key))
+	vals := make([]string, len(key))
+	for i, idx := range key {
+		cols[i] = schema.columns[idx].name
+		vals[i] = fmt.Sprint(row[idx])
+	}
+	return fmt.Errorf("%w: key (%s)=(%s) already exists in %q", ErrUniqueViolation,
+		strings.Join(cols, ", "), strings.Join(vals, ", "), schema.name)
+}
@@ -0,0 +1,1428 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// --- SQL parser for the in-memory store ---
+//
+// The in-memory store understands the subset of Postgres SQL the service
+// uses: SELECT (WHERE, GROUP BY, ORDER BY, LIMIT/OFFSET, FOR UPDATE, IN/EXISTS
+// subqueries), INSERT (multi-row VALUES or SELECT, ON CONFLICT, RETURNING),
+// UPDATE and DELETE (RETURNING), and the DDL of the migrations: CREATE/DROP
+// TABLE, CREATE/DROP INDEX and ALTER TABLE ADD/DROP COLUMN. Queries reference
+// a single table; joins are not supported.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokParam
+	tokOp
+)
+
+type token struct {
+	kind   tokenKind
+	text   string // identifiers are lower-cased unless quoted
+	quoted bool
+	pos    int
+}
+
+// splits a statement into tokens, dropping whitespace and comments.
+func lexSQL(src string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "--"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated /* comment at position %d", i)
+			}
+			i += end + 4
+		case isIdentStart(c):
+			start := i
+			for i < len(src) && isIdentPart(src[i]) {
+				i++
+			}
+			toks = append(toks, token{kind: tokIdent, text: strings.ToLower(src[start:i]), pos: start})
+		case c == '"':
+			end := strings.IndexByte(src[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted identifier at position %d", i)
+			}
+			toks = append(toks, token{kind: tokIdent, text: src[i+1 : i+1+end], quoted: true, pos: i})
+			i += end + 2
+		case isDigit(c) || (c == '.' && i+1 < len(src) && isDigit(src[i+1])):
+			start := i
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[start:i], pos: start})
+		case c == '\'':
+			var sb strings.Builder
+			start := i
+			i++
+			for {
+				if i >= len(src) {
+					return nil, fmt.Errorf("unterminated string literal at position %d", start)
+				}
+				if src[i] == '\'' {
+					if i+1 < len(src) && src[i+1] == '\'' {
+						sb.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			toks = append(toks, token{kind: tokString, text: sb.String(), pos: start})
+		case c == '$':
+			start := i
+			i++
+			for i < len(src) && isDigit(src[i]) {
+				i++
+			}
+			if i == start+1 {
+				return nil, fmt.Errorf("syntax error at position %d: expected parameter number after $", start)
+			}
+			toks = append(toks, token{kind: tokParam, text: src[start+1 : i], pos: start})
+		default:
+			op := ""
+			for _, candidate := range []string{"::", "<=", ">=", "<>", "!=", "||"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				if !strings.ContainsRune("(),.;*+-/=<>[]", rune(c)) {
+					return nil, fmt.Errorf("syntax error at position %d: unexpected character %q", i, c)
+				}
+				op = string(c)
+			}
+			toks = append(toks, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool { return isIdentStart(c) || isDigit(c) }
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// reservedWords cannot be used as bare column aliases or identifiers.
+var reservedWords = map[string]bool{
+	"select": true, "from": true, "where": true, "group": true, "by": true, "having": true,
+	"order": true, "limit": true, "offset": true, "for": true, "and": true, "or": true,
+	"not": true, "is": true, "null": true, "in": true, "as": true, "on": true,
+	"returning": true, "values": true, "set": true, "insert": true, "into": true,
+	"update": true, "delete": true, "asc": true, "desc": true, "nulls": true,
+	"true": true, "false": true, "exists": true, "distinct": true, "join": true,
+	"like": true, "between": true, "case": true, "when": true, "then": true,
+	"else": true, "end": true, "default": true,
+}
+
+// --- Syntax tree ---
+
+type memStmt interface{}
+
+type selectStmt struct {
+	distinct  bool
+	items     []selectItem
+	from      *tableRef
+	where     memExpr
+	groupBy   []memExpr
+	having    memExpr
+	orderBy   []orderItem
+	limit     memExpr
+	offset    memExpr
+	forUpdate bool
+}
+
+type selectItem struct {
+	expr  memExpr
+	star  bool
+	alias string
+}
+
+type tableRef struct {
+	name  string
+	alias string
+}
+
+type orderItem struct {
+	expr       memExpr
+	desc       bool
+	nullsFirst bool
+}
+
+type insertStmt struct {
+	table      tableRef
+	columns    []string
+	rows       [][]memExpr // nil entries stand for DEFAULT
+	query      *selectStmt // INSERT ... SELECT, instead of rows
+	onConflict *onConflictClause
+	returning  []selectItem
+}
+
+type onConflictClause struct {
+	columns   []string
+	doNothing bool
+	set       []setClause
+	where     memExpr
+}
+
+type setClause struct {
+	column string
+	expr   memExpr
+}
+
+type updateStmt struct {
+	table     tableRef
+	set       []setClause
+	where     memExpr
+	returning []selectItem
+}
+
+type deleteStmt struct {
+	table     tableRef
+	where     memExpr
+	returning []selectItem
+}
+
+type createTableStmt struct {
+	ifNotExists bool
+	schema      *tableSchema
+}
+
+type createIndexStmt struct {
+	ifNotExists bool
+	index       indexDef
+	table       string
+	columns     []string
+}
+
+type dropStmt struct {
+	index    bool // DROP INDEX rather than DROP TABLE
+	ifExists bool
+	names    []string
+}
+
+type alterTableStmt struct {
+	table   string
+	actions []alterAction
+}
+
+// one ADD COLUMN or DROP COLUMN action; column constraints are parsed into
+// schema as if the new column were its only one.
+type alterAction struct {
+	add      *tableSchema
+	drop     string
+	ifExists bool // IF NOT EXISTS for ADD, IF EXISTS for DROP
+}
+
+// tableSchema describes an in-memory table. Foreign keys are parsed but not enforced.
+type tableSchema struct {
+	name       string
+	columns    []columnDef
+	primaryKey []int
+	unique     [][]int
+	checks     []memExpr
+	indexes    []indexDef
+}
+
+// indexDef is a named index; only unique ones have an effect in memory.
+type indexDef struct {
+	name    string
+	columns []int
+	unique  bool
+}
+
+type columnDef struct {
+	name    string
+	typ     string
+	notNull bool
+	serial  bool
+	def     memExpr
+}
+
+// returns the position of a column, or -1.
+func (s *tableSchema) column(name string) int {
+	for i, c := range s.columns {
+		if c.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// returns the primary key followed by the unique constraints and indexes.
+func (s *tableSchema) uniqueKeys() [][]int {
+	var keys [][]int
+	if s.primaryKey != nil {
+		keys = append(keys, s.primaryKey)
+	}
+	keys = append(keys, s.unique...)
+	for _, idx := range s.indexes {
+		if idx.unique {
+			keys = append(keys, idx.columns)
+		}
+	}
+	return keys
+}
+
+// returns a copy that can be altered without affecting s.
+func (s *tableSchema) clone() *tableSchema {
+	c := *s
+	c.columns = slices.Clone(s.columns)
+	c.unique = slices.Clone(s.unique)
+	c.checks = slices.Clone(s.checks)
+	c.indexes = slices.Clone(s.indexes)
+	return &c
+}
+
+// removes the column at pos together with the keys, indexes and checks using it.
+func (s *tableSchema) dropColumn(pos int) {
+	name := s.columns[pos].name
+	s.columns = slices.Delete(s.columns, pos, pos+1)
+	shift := func(key []int) []int {
+		if slices.Contains(key, pos) {
+			return nil
+		}
+		out := make([]int, len(key))
+		for i, c := range key {
+			if out[i] = c; c > pos {
+				out[i]--
+			}
+		}
+		return out
+	}
+	s.primaryKey = shift(s.primaryKey)
+	var unique [][]int
+	for _, key := range s.unique {
+		if key = shift(key); key != nil {
+			unique = append(unique, key)
+		}
+	}
+	s.unique = unique
+	var indexes []indexDef
+	for _, idx := range s.indexes {
+		if idx.columns = shift(idx.columns); idx.columns != nil {
+			indexes = append(indexes, idx)
+		}
+	}
+	s.indexes = indexes
+	s.checks = slices.DeleteFunc(s.checks, func(e memExpr) bool { return referencesColumn(e, name) })
+}
+
+// reports whether an expression mentions the named column.
+func referencesColumn(e memExpr, name string) bool {
+	switch e := e.(type) {
+	case *columnExpr:
+		return e.name == name
+	case *castExpr:
+		return referencesColumn(e.expr, name)
+	case *unaryExpr:
+		return referencesColumn(e.expr, name)
+	case *binaryExpr:
+		return referencesColumn(e.left, name) || referencesColumn(e.right, name)
+	case *isNullExpr:
+		return referencesColumn(e.expr, name)
+	case *inExpr:
+		return referencesColumn(e.expr, name) || slices.ContainsFunc(e.list, func(e memExpr) bool { return referencesColumn(e, name) })
+	case *tupleExpr:
+		return slices.ContainsFunc(e.items, func(e memExpr) bool { return referencesColumn(e, name) })
+	case *funcExpr:
+		return slices.ContainsFunc(e.args, func(e memExpr) bool { return referencesColumn(e, name) })
+	}
+	return false
+}
+
+type memExpr interface{}
+
+type (
+	literalExpr struct{ value interface{} }
+	paramExpr   struct{ index int } // 0-based
+	columnExpr  struct{ table, name string }
+	castExpr    struct {
+		expr memExpr
+		typ  string
+	}
+	unaryExpr struct {
+		op   string
+		expr memExpr
+	}
+	binaryExpr struct {
+		op          string
+		left, right memExpr
+	}
+	isNullExpr struct {
+		expr memExpr
+		not  bool
+	}
+	inExpr struct {
+		expr memExpr
+		list []memExpr
+		sub  *selectStmt
+		not  bool
+	}
+	existsExpr   struct{ sub *selectStmt }
+	subqueryExpr struct{ sub *selectStmt }
+	tupleExpr    struct{ items []memExpr }
+	funcExpr     struct {
+		name string
+		args []memExpr
+		star bool
+	}
+)
+
+// splits a script into statements at the semicolons outside strings and comments.
+func splitStatements(script string) ([]string, error) {
+	toks, err := lexSQL(script)
+	if err != nil {
+		return nil, err
+	}
+	var statements []string
+	start := 0
+	for _, tok := range toks {
+		if tok.kind != tokEOF && (tok.kind != tokOp || tok.text != ";") {
+			continue
+		}
+		if stmt := strings.TrimSpace(script[start:tok.pos]); stmt != "" && !onlyComments(stmt) {
+			statements = append(statements, stmt)
+		}
+		start = tok.pos + 1
+	}
+	return statements, nil
+}
+
+func onlyComments(stmt string) bool {
+	toks, err := lexSQL(stmt)
+	return err == nil && len(toks) == 1
+}
+
+// parsed statements by SQL text; the service sends the same few statements over and over.
+var parsedStatements sync.Map
+
+// parses a single statement, using the cache when possible.
+func parseSQL(query string) (memStmt, error) {
+	if stmt, ok := parsedStatements.Load(query); ok {
+		return stmt, nil
+	}
+	toks, err := lexSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	stmt, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	p.acceptOp(";")
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected input after end of statement")
+	}
+	parsedStatements.Store(query, stmt)
+	return stmt, nil
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) peekAt(n int) token {
+	if p.i+n >= len(p.toks) {
+		return p.toks[len(p.toks)-1]
+	}
+	return p.toks[p.i+n]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	near := t.text
+	if t.kind == tokEOF {
+		near = "end of input"
+	}
+	return fmt.Errorf("syntax error at or near %q: %s", near, fmt.Sprintf(format, args...))
+}
+
+// reports whether the next tokens are the given keywords.
+func (p *parser) isKeyword(kws ...string) bool {
+	for n, kw := range kws {
+		t := p.peekAt(n)
+		if t.kind != tokIdent || t.quoted || t.text != kw {
+			return false
+		}
+	}
+	return true
+}
+
+// consumes the keywords if the next tokens match them.
+func (p *parser) acceptKeyword(kws ...string) bool {
+	if !p.isKeyword(kws...) {
+		return false
+	}
+	p.i += len(kws)
+	return true
+}
+
+func (p *parser) expectKeyword(kws ...string) error {
+	if !p.acceptKeyword(kws...) {
+		return p.errorf("expected %s", strings.ToUpper(strings.Join(kws, " ")))
+	}
+	return nil
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+func (p *parser) acceptOp(op string) bool {
+	if !p.isOp(op) {
+		return false
+	}
+	p.i++
+	return true
+}
+
+func (p *parser) expectOp(op string) error {
+	if !p.acceptOp(op) {
+		return p.errorf("expected %q", op)
+	}
+	return nil
+}
+
+// parses an identifier; reserved words are only accepted when quoted.
+func (p *parser) ident() (string, error) {
+	t := p.peek()
+	if t.kind != tokIdent || (!t.quoted && reservedWords[t.text]) {
+		return "", p.errorf("expected identifier")
+	}
+	p.i++
+	return t.text, nil
+}
+
+func (p *parser) identList() ([]string, error) {
+	if err := p.expectOp("("); err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.acceptOp(",") {
+			break
+		}
+	}
+	return names, p.expectOp(")")
+}
+
+func (p *parser) statement() (memStmt, error) {
+	switch {
+	case p.isKeyword("select"):
+		return p.selectStatement()
+	case p.isKeyword("insert"):
+		return p.insertStatement()
+	case p.isKeyword("update"):
+		return p.updateStatement()
+	case p.isKeyword("delete"):
+		return p.deleteStatement()
+	case p.isKeyword("create", "table"):
+		return p.createTableStatement()
+	case p.isKeyword("create", "index"), p.isKeyword("create", "unique", "index"):
+		return p.createIndexStatement()
+	case p.isKeyword("drop", "table"), p.isKeyword("drop", "index"):
+		return p.dropStatement()
+	case p.isKeyword("alter", "table"):
+		return p.alterTableStatement()
+	}
+	return nil, p.errorf("unsupported statement")
+}
+
+func (p *parser) selectStatement() (*selectStmt, error) {
+	if err := p.expectKeyword("select"); err != nil {
+		return nil, err
+	}
+	stmt := &selectStmt{distinct: p.acceptKeyword("distinct")}
+	items, err := p.selectItems()
+	if err != nil {
+		return nil, err
+	}
+	stmt.items = items
+
+	if p.acceptKeyword("from") {
+		ref, err := p.tableRef()
+		if err != nil {
+			return nil, err
+		}
+		stmt.from = &ref
+	}
+	if p.acceptKeyword("where") {
+		if stmt.where, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("group", "by") {
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.groupBy = append(stmt.groupBy, e)
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("having") {
+		if stmt.having, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("order", "by") {
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			item := orderItem{expr: e}
+			if p.acceptKeyword("desc") {
+				item.desc = true
+			} else {
+				p.acceptKeyword("asc")
+			}
+			// Postgres sorts NULLs as if larger than any value
+			item.nullsFirst = item.desc
+			if p.acceptKeyword("nulls", "first") {
+				item.nullsFirst = true
+			} else if p.acceptKeyword("nulls", "last") {
+				item.nullsFirst = false
+			}
+			stmt.orderBy = append(stmt.orderBy, item)
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+	}
+	for {
+		switch {
+		case p.acceptKeyword("limit"):
+			if stmt.limit, err = p.expr(); err != nil {
+				return nil, err
+			}
+			continue
+		case p.acceptKeyword("offset"):
+			if stmt.offset, err = p.expr(); err != nil {
+				return nil, err
+			}
+			continue
+		case p.acceptKeyword("for", "update"):
+			stmt.forUpdate = true
+			continue
+		}
+		break
+	}
+	return stmt, nil
+}
+
+func (p *parser) selectItems() ([]selectItem, error) {
+	var items []selectItem
+	for {
+		if p.acceptOp("*") {
+			items = append(items, selectItem{star: true})
+		} else {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			item := selectItem{expr: e}
+			if p.acceptKeyword("as") {
+				if item.alias, err = p.ident(); err != nil {
+					return nil, err
+				}
+			} else if t := p.peek(); t.kind == tokIdent && (t.quoted || !reservedWords[t.text]) {
+				item.alias = p.next().text
+			}
+			items = append(items, item)
+		}
+		if !p.acceptOp(",") {
+			return items, nil
+		}
+	}
+}
+
+func (p *parser) tableRef() (tableRef, error) {
+	name, err := p.ident()
+	if err != nil {
+		return tableRef{}, err
+	}
+	ref := tableRef{name: name, alias: name}
+	if p.acceptKeyword("as") {
+		if ref.alias, err = p.ident(); err != nil {
+			return tableRef{}, err
+		}
+	} else if t := p.peek(); t.kind == tokIdent && (t.quoted || !reservedWords[t.text]) {
+		ref.alias = p.next().text
+	}
+	return ref, nil
+}
+
+func (p *parser) returning() ([]selectItem, error) {
+	if !p.acceptKeyword("returning") {
+		return nil, nil
+	}
+	return p.selectItems()
+}
+
+func (p *parser) insertStatement() (*insertStmt, error) {
+	if err := p.expectKeyword("insert", "into"); err != nil {
+		return nil, err
+	}
+	ref, err := p.tableRef()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &insertStmt{table: ref}
+	if p.isOp("(") {
+		if stmt.columns, err = p.identList(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isKeyword("select") {
+		if stmt.query, err = p.selectStatement(); err != nil {
+			return nil, err
+		}
+	} else if err := p.expectKeyword("values"); err != nil {
+		return nil, err
+	}
+	for stmt.query == nil {
+		if err := p.expectOp("("); err != nil {
+			return nil, err
+		}
+		var row []memExpr
+		for {
+			if p.acceptKeyword("default") {
+				row = append(row, nil)
+			} else {
+				e, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				row = append(row, e)
+			}
+			if !p.acceptOp(",") {
+				break
+			}
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		stmt.rows = append(stmt.rows, row)
+		if !p.acceptOp(",") {
+			break
+		}
+	}
+
+	if p.acceptKeyword("on", "conflict") {
+		oc := &onConflictClause{}
+		if p.isOp("(") {
+			if oc.columns, err = p.identList(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expectKeyword("do"); err != nil {
+			return nil, err
+		}
+		if p.acceptKeyword("nothing") {
+			oc.doNothing = true
+		} else {
+			if err := p.expectKeyword("update", "set"); err != nil {
+				return nil, err
+			}
+			if oc.set, err = p.setClauses(); err != nil {
+				return nil, err
+			}
+			if p.acceptKeyword("where") {
+				if oc.where, err = p.expr(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		stmt.onConflict = oc
+	}
+	stmt.returning, err = p.returning()
+	return stmt, err
+}
+
+func (p *parser) setClauses() ([]setClause, error) {
+	var set []setClause
+	for {
+		col, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectOp("="); err != nil {
+			return nil, err
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, setClause{column: col, expr: e})
+		if !p.acceptOp(",") {
+			return set, nil
+		}
+	}
+}
+
+func (p *parser) updateStatement() (*updateStmt, error) {
+	if err := p.expectKeyword("update"); err != nil {
+		return nil, err
+	}
+	ref, err := p.tableRef()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &updateStmt{table: ref}
+	if err := p.expectKeyword("set"); err != nil {
+		return nil, err
+	}
+	if stmt.set, err = p.setClauses(); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("where") {
+		if stmt.where, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	stmt.returning, err = p.returning()
+	return stmt, err
+}
+
+func (p *parser) deleteStatement() (*deleteStmt, error) {
+	if err := p.expectKeyword("delete", "from"); err != nil {
+		return nil, err
+	}
+	ref, err := p.tableRef()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &deleteStmt{table: ref}
+	if p.acceptKeyword("where") {
+		if stmt.where, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	stmt.returning, err = p.returning()
+	return stmt, err
+}
+
+func (p *parser) createTableStatement() (*createTableStmt, error) {
+	if err := p.expectKeyword("create", "table"); err != nil {
+		return nil, err
+	}
+	stmt := &createTableStmt{ifNotExists: p.acceptKeyword("if", "not", "exists")}
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	schema := &tableSchema{name: name}
+	if err := p.expectOp("("); err != nil {
+		return nil, err
+	}
+	// table constraints name their columns, which may be defined later on
+	var pending []func() error
+	for {
+		if p.acceptKeyword("constraint") { // the constraint name is not kept
+			if _, err := p.ident(); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case p.acceptKeyword("primary", "key"):
+			cols, err := p.identList()
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, func() error {
+				idx, err := schema.columnIndexes(cols)
+				schema.primaryKey = idx
+				return err
+			})
+		case p.acceptKeyword("unique"):
+			cols, err := p.identList()
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, func() error {
+				idx, err := schema.columnIndexes(cols)
+				schema.unique = append(schema.unique, idx)
+				return err
+			})
+		case p.acceptKeyword("check"):
+			e, err := p.parenExpr()
+			if err != nil {
+				return nil, err
+			}
+			schema.checks = append(schema.checks, e)
+		case p.acceptKeyword("foreign", "key"):
+			if _, err := p.identList(); err != nil {
+				return nil, err
+			}
+			if err := p.references(); err != nil {
+				return nil, err
+			}
+		default:
+			if err := p.columnDefinition(schema); err != nil {
+				return nil, err
+			}
+		}
+		if !p.acceptOp(",") {
+			break
+		}
+	}
+	if err := p.expectOp(")"); err != nil {
+		return nil, err
+	}
+	for _, fn := range pending {
+		if err := fn(); err != nil {
+			return nil, err
+		}
+	}
+	stmt.schema = schema
+	return stmt, nil
+}
+
+func (p *parser) createIndexStatement() (*createIndexStmt, error) {
+	if err := p.expectKeyword("create"); err != nil {
+		return nil, err
+	}
+	stmt := &createIndexStmt{}
+	stmt.index.unique = p.acceptKeyword("unique")
+	if err := p.expectKeyword("index"); err != nil {
+		return nil, err
+	}
+	stmt.ifNotExists = p.acceptKeyword("if", "not", "exists")
+	var err error
+	if stmt.index.name, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("on"); err != nil {
+		return nil, err
+	}
+	if stmt.table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	stmt.columns, err = p.identList()
+	return stmt, err
+}
+
+func (p *parser) dropStatement() (*dropStmt, error) {
+	if err := p.expectKeyword("drop"); err != nil {
+		return nil, err
+	}
+	stmt := &dropStmt{index: p.acceptKeyword("index")}
+	if !stmt.index {
+		if err := p.expectKeyword("table"); err != nil {
+			return nil, err
+		}
+	}
+	stmt.ifExists = p.acceptKeyword("if", "exists")
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		stmt.names = append(stmt.names, name)
+		if !p.acceptOp(",") {
+			break
+		}
+	}
+	// without foreign keys there is nothing to cascade to
+	if !p.acceptKeyword("cascade") {
+		p.acceptKeyword("restrict")
+	}
+	return stmt, nil
+}
+
+func (p *parser) alterTableStatement() (*alterTableStmt, error) {
+	if err := p.expectKeyword("alter", "table"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &alterTableStmt{table: table}
+	for {
+		var action alterAction
+		switch {
+		case p.acceptKeyword("add"):
+			p.acceptKeyword("column")
+			action.ifExists = p.acceptKeyword("if", "not", "exists")
+			action.add = &tableSchema{name: table}
+			if err := p.columnDefinition(action.add); err != nil {
+				return nil, err
+			}
+		case p.acceptKeyword("drop"):
+			p.acceptKeyword("column")
+			action.ifExists = p.acceptKeyword("if", "exists")
+			if action.drop, err = p.ident(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, p.errorf("expected ADD or DROP")
+		}
+		stmt.actions = append(stmt.actions, action)
+		if !p.acceptOp(",") {
+			return stmt, nil
+		}
+	}
+}
+
+// resolves constraint column names to positions.
+func (s *tableSchema) columnIndexes(names []string) ([]int, error) {
+	idx := make([]int, len(names))
+	for i, name := range names {
+		if idx[i] = s.column(name); idx[i] < 0 {
+			return nil, fmt.Errorf("column %q named in key does not exist", name)
+		}
+	}
+	return idx, nil
+}
+
+func (p *parser) columnDefinition(schema *tableSchema) error {
+	name, err := p.ident()
+	if err != nil {
+		return err
+	}
+	typ, err := p.typeName()
+	if err != nil {
+		return err
+	}
+	col := columnDef{name: name, typ: typ}
+	switch typ {
+	case "serial", "bigserial", "smallserial":
+		col.typ, col.serial, col.notNull = "integer", true, true
+	}
+	pos := len(schema.columns)
+	for {
+		if p.acceptKeyword("constraint") {
+			if _, err := p.ident(); err != nil {
+				return err
+			}
+		}
+		switch {
+		case p.acceptKeyword("primary", "key"):
+			schema.primaryKey = []int{pos}
+			col.notNull = true
+		case p.acceptKeyword("not", "null"):
+			col.notNull = true
+		case p.acceptKeyword("null"):
+		case p.acceptKeyword("unique"):
+			schema.unique = append(schema.unique, []int{pos})
+		case p.acceptKeyword("default"):
+			if col.def, err = p.unary(); err != nil {
+				return err
+			}
+		case p.acceptKeyword("check"):
+			e, err := p.parenExpr()
+			if err != nil {
+				return err
+			}
+			schema.checks = append(schema.checks, e)
+		case p.isKeyword("references"):
+			if err := p.references(); err != nil {
+				return err
+			}
+		default:
+			schema.columns = append(schema.columns, col)
+			return nil
+		}
+	}
+}
+
+// skips a REFERENCES clause.
+func (p *parser) references() error {
+	if err := p.expectKeyword("references"); err != nil {
+		return err
+	}
+	if _, err := p.ident(); err != nil {
+		return err
+	}
+	if p.isOp("(") {
+		if _, err := p.identList(); err != nil {
+			return err
+		}
+	}
+	for p.acceptKeyword("on", "delete") || p.acceptKeyword("on", "update") {
+		switch {
+		case p.acceptKeyword("cascade"), p.acceptKeyword("restrict"),
+			p.acceptKeyword("set", "null"), p.acceptKeyword("set", "default"),
+			p.acceptKeyword("no", "action"):
+		default:
+			return p.errorf("expected referential action")
+		}
+	}
+	return nil
+}
+
+// parses a type name such as "integer", "numeric(12, 2)" or "timestamp with time zone".
+func (p *parser) typeName() (string, error) {
+	t := p.peek()
+	if t.kind != tokIdent {
+		return "", p.errorf("expected type name")
+	}
+	words := []string{p.next().text}
+	for p.isKeyword("precision") || p.isKeyword("varying") || p.isKeyword("with") ||
+		p.isKeyword("without") || p.isKeyword("time") || p.isKeyword("zone") {
+		words = append(words, p.next().text)
+	}
+	if p.acceptOp("(") {
+		for !p.acceptOp(")") {
+			if p.next().kind == tokEOF {
+				return "", p.errorf("unterminated type modifier")
+			}
+		}
+	}
+	if p.acceptOp("[") {
+		if err := p.expectOp("]"); err != nil {
+			return "", err
+		}
+		words = append(words, "[]")
+	}
+	return strings.Join(words, " "), nil
+}
+
+// --- Expressions, from lowest to highest precedence ---
+
+func (p *parser) expr() (memExpr, error) { return p.or() }
+
+func (p *parser) parenExpr() (memExpr, error) {
+	if err := p.expectOp("("); err != nil {
+		return nil, err
+	}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return e, p.expectOp(")")
+}
+
+func (p *parser) or() (memExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (memExpr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("and") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) not() (memExpr, error) {
+	if p.acceptKeyword("not") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: "not", expr: e}, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (memExpr, error) {
+	left, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.acceptKeyword("is"):
+			not := p.acceptKeyword("not")
+			if err := p.expectKeyword("null"); err != nil {
+				return nil, err
+			}
+			left = &isNullExpr{expr: left, not: not}
+		case p.isKeyword("in") || p.isKeyword("not", "in"):
+			not := p.acceptKeyword("not")
+			p.acceptKeyword("in")
+			in := &inExpr{expr: left, not: not}
+			if err := p.expectOp("("); err != nil {
+				return nil, err
+			}
+			if p.isKeyword("select") {
+				if in.sub, err = p.selectStatement(); err != nil {
+					return nil, err
+				}
+			} else {
+				for {
+					e, err := p.expr()
+					if err != nil {
+						return nil, err
+					}
+					in.list = append(in.list, e)
+					if !p.acceptOp(",") {
+						break
+					}
+				}
+			}
+			if err := p.expectOp(")"); err != nil {
+				return nil, err
+			}
+			left = in
+		default:
+			t := p.peek()
+			if t.kind != tokOp {
+				return left, nil
+			}
+			op := t.text
+			switch op {
+			case "=", "<>", "!=", "<", "<=", ">", ">=":
+			default:
+				return left, nil
+			}
+			p.next()
+			if op == "!=" {
+				op = "<>"
+			}
+			right, err := p.additive()
+			if err != nil {
+				return nil, err
+			}
+			left = &binaryExpr{op: op, left: left, right: right}
+		}
+	}
+}
+
+func (p *parser) additive() (memExpr, error) {
+	left, err := p.multiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+") || p.isOp("-") || p.isOp("||") {
+		op := p.next().text
+		right, err := p.multiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) multiplicative() (memExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*") || p.isOp("/") {
+		op := p.next().text
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (memExpr, error) {
+	if p.acceptOp("-") {
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: "-", expr: e}, nil
+	}
+	e, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("::") {
+		typ, err := p.typeName()
+		if err != nil {
+			return nil, err
+		}
+		e = &castExpr{expr: e, typ: typ}
+	}
+	return e, nil
+}
+
+func (p *parser) primary() (memExpr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNumber:
+		p.next()
+		if strings.Contains(t.text, ".") {
+			f, err := strconv.ParseFloat(t.text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q", t.text)
+			}
+			return &literalExpr{value: f}, nil
+		}
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return &literalExpr{value: n}, nil
+	case tokString:
+		p.next()
+		return &literalExpr{value: t.text}, nil
+	case tokParam:
+		p.next()
+		n, err := strconv.Atoi(t.text)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid parameter $%s", t.text)
+		}
+		return &paramExpr{index: n - 1}, nil
+	case tokOp:
+		if t.text != "(" {
+			break
+		}
+		p.next()
+		if p.isKeyword("select") {
+			sub, err := p.selectStatement()
+			if err != nil {
+				return nil, err
+			}
+			return &subqueryExpr{sub: sub}, p.expectOp(")")
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.isOp(",") {
+			tuple := &tupleExpr{items: []memExpr{e}}
+			for p.acceptOp(",") {
+				item, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				tuple.items = append(tuple.items, item)
+			}
+			e = tuple
+		}
+		return e, p.expectOp(")")
+	case tokIdent:
+		if !t.quoted {
+			switch t.text {
+			case "null":
+				p.next()
+				return &literalExpr{value: nil}, nil
+			case "true", "false":
+				p.next()
+				return &literalExpr{value: t.text == "true"}, nil
+			case "current_timestamp":
+				p.next()
+				return &funcExpr{name: "now"}, nil
+			case "exists":
+				p.next()
+				if err := p.expectOp("("); err != nil {
+					return nil, err
+				}
+				sub, err := p.selectStatement()
+				if err != nil {
+					return nil, err
+				}
+				return &existsExpr{sub: sub}, p.expectOp(")")
+			}
+		}
+		if next := p.peekAt(1); next.kind == tokOp && next.text == "(" {
+			return p.function()
+		}
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if p.acceptOp(".") {
+			col, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			return &columnExpr{table: name, name: col}, nil
+		}
+		return &columnExpr{name: name}, nil
+	}
+	return nil, p.errorf("unexpected token")
+}
+
+func (p *parser) function() (memExpr, error) {
+	fn := &funcExpr{name: p.next().text}
+	p.next() // (
+	if p.acceptOp("*") {
+		fn.star = true
+		return fn, p.expectOp(")")
+	}
+	if p.acceptOp(")") {
+		return fn, nil
+	}
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		fn.args = append(fn.args, e)
+		if !p.acceptOp(",") {
+			break
+		}
+	}
+	return fn, p.expectOp(")")
+}
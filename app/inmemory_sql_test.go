@@ -0,0 +1,197 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a store with a small table to run statements against.
+func newSQLTestDB(t *testing.T) *InMemoryDB {
+	store := NewInMemoryStore()
+	mustExec(t, store, `CREATE TABLE items (
+		id SERIAL PRIMARY KEY,
+		sku TEXT NOT NULL UNIQUE,
+		qty INTEGER NOT NULL DEFAULT 0 CHECK (qty >= 0),
+		price NUMERIC(12, 2),
+		added_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	mustExec(t, store, "INSERT INTO items (sku, qty, price) VALUES ('a', 5, $1), ('b', 0, NULL), ('c', 12, $2), ('d', 5, $3)",
+		MustParseMoney("2.50", DefaultCurrency), MustParseMoney("10.00", DefaultCurrency), MustParseMoney("1.25", DefaultCurrency))
+	return &InMemoryDB{store: store}
+}
+
+// runs a query and returns the first column of every row.
+func queryColumn(t *testing.T, db *InMemoryDB, query string, args ...interface{}) []interface{} {
+	t.Helper()
+	rows, err := db.Query(query, args...)
+	require.NoError(t, err)
+	var out []interface{}
+	for rows.Next() {
+		var v interface{}
+		require.NoError(t, rows.Scan(&v))
+		out = append(out, v)
+	}
+	return out
+}
+
+func TestInMemorySQL_Select(t *testing.T) {
+	db := newSQLTestDB(t)
+
+	assert.Equal(t, []interface{}{"c", "a", "d"},
+		queryColumn(t, db, "SELECT sku FROM items WHERE qty >= $1 ORDER BY qty DESC, sku", 1))
+	assert.Equal(t, []interface{}{"d"},
+		queryColumn(t, db, "select SKU from ITEMS i where i.qty = 5 order by i.sku desc limit 1"))
+	assert.Equal(t, []interface{}{"a", "c"},
+		queryColumn(t, db, "SELECT sku FROM items WHERE price > 2 ORDER BY 1"))
+	// NULLs sort last ascending, and never match a comparison
+	assert.Equal(t, []interface{}{"d", "a", "c", "b"},
+		queryColumn(t, db, "SELECT sku FROM items ORDER BY price"))
+	assert.Equal(t, []interface{}{"b"},
+		queryColumn(t, db, "SELECT sku FROM items WHERE price IS NULL OR price < 0"))
+	assert.Equal(t, []interface{}{"a", "d"},
+		queryColumn(t, db, "SELECT sku FROM items WHERE sku IN ('a', 'd', 'z') AND NOT (qty <> 5)"))
+	assert.Equal(t, []interface{}{"c", "d"},
+		queryColumn(t, db, "SELECT sku FROM items WHERE (qty, sku) > ($1, $2) ORDER BY sku", 5, "a"))
+	assert.Equal(t, []interface{}{"b", "c"},
+		queryColumn(t, db, "SELECT sku FROM items WHERE qty NOT IN (SELECT qty FROM items WHERE sku = 'a') ORDER BY sku"))
+	assert.Equal(t, []interface{}{"0"},
+		queryColumn(t, db, "SELECT COALESCE(price::text, '0') FROM items WHERE sku = 'b'"))
+	assert.Equal(t, []interface{}{"c", "d"},
+		queryColumn(t, db, "SELECT sku FROM items ORDER BY id LIMIT 2 OFFSET 2"))
+}
+
+func TestInMemorySQL_Aggregates(t *testing.T) {
+	db := newSQLTestDB(t)
+
+	var count, total int
+	var sum Money
+	require.NoError(t, db.QueryRow("SELECT COUNT(*), SUM(qty), SUM(price * qty) FROM items").Scan(&count, &total, &sum))
+	assert.Equal(t, 4, count)
+	assert.Equal(t, 22, total)
+	assert.Equal(t, MustParseMoney("138.75", DefaultCurrency), sum)
+
+	rows, err := db.Query("SELECT qty, COUNT(*) AS n FROM items GROUP BY qty HAVING COUNT(*) > 1 OR qty = 0 ORDER BY n DESC, qty")
+	require.NoError(t, err)
+	var got [][2]int
+	for rows.Next() {
+		var qty, n int
+		require.NoError(t, rows.Scan(&qty, &n))
+		got = append(got, [2]int{qty, n})
+	}
+	assert.Equal(t, [][2]int{{5, 2}, {0, 1}}, got)
+}
+
+func TestInMemorySQL_WritesAndReturning(t *testing.T) {
+	db := newSQLTestDB(t)
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	var id int
+	var addedAt time.Time
+	require.NoError(t, tx.QueryRow("INSERT INTO items (sku) VALUES ($1) RETURNING id, added_at", "e").Scan(&id, &addedAt))
+	assert.Equal(t, 5, id)
+	assert.False(t, addedAt.IsZero())
+
+	var qty int
+	require.NoError(t, tx.QueryRow("UPDATE items SET qty = qty - $1 WHERE sku = $2 AND qty >= $1 RETURNING qty", 2, "a").Scan(&qty))
+	assert.Equal(t, 3, qty)
+
+	res, err := tx.Exec("UPDATE items SET qty = qty - $1 WHERE sku = $2 AND qty >= $1", 99, "a")
+	require.NoError(t, err)
+	n, _ := res.RowsAffected()
+	assert.Equal(t, int64(0), n)
+
+	res, err = tx.Exec("DELETE FROM items WHERE qty = 0")
+	require.NoError(t, err)
+	n, _ = res.RowsAffected()
+	assert.Equal(t, int64(2), n)
+	require.NoError(t, tx.Commit())
+
+	assert.Equal(t, []interface{}{"a", "c", "d"}, queryColumn(t, db, "SELECT sku FROM items ORDER BY sku"))
+}
+
+func TestInMemorySQL_OnConflict(t *testing.T) {
+	db := newSQLTestDB(t)
+	upsert := "INSERT INTO items (sku, qty) VALUES ($1, $2) ON CONFLICT (sku) DO UPDATE SET qty = items.qty + EXCLUDED.qty WHERE items.qty < 10"
+
+	res, err := db.Exec(upsert, "a", 3)
+	require.NoError(t, err)
+	n, _ := res.RowsAffected()
+	assert.Equal(t, int64(1), n)
+	res, err = db.Exec(upsert, "c", 3) // the WHERE clause skips the update
+	require.NoError(t, err)
+	n, _ = res.RowsAffected()
+	assert.Equal(t, int64(0), n)
+	_, err = db.Exec("INSERT INTO items (sku) VALUES ('d') ON CONFLICT DO NOTHING")
+	require.NoError(t, err)
+
+	assert.Equal(t, []interface{}{int64(8), int64(12), int64(5)}, queryColumn(t, db, "SELECT qty FROM items WHERE sku IN ('a', 'c', 'd') ORDER BY sku"))
+}
+
+func TestInMemorySQL_Constraints(t *testing.T) {
+	db := newSQLTestDB(t)
+
+	_, err := db.Exec("INSERT INTO items (sku) VALUES ('a')")
+	assert.ErrorIs(t, err, ErrUniqueViolation)
+	_, err = db.Exec("INSERT INTO items (sku, qty) VALUES ('x', -1)")
+	assert.ErrorContains(t, err, "check constraint")
+	_, err = db.Exec("INSERT INTO items (qty) VALUES (1)")
+	assert.ErrorContains(t, err, "not-null")
+	_, err = db.Exec("INSERT INTO items (sku, qty) VALUES ('x', 'many')")
+	assert.ErrorContains(t, err, "invalid input value")
+
+	// a failed statement aborts the transaction
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec("UPDATE items SET sku = 'a' WHERE sku = 'b'")
+	assert.ErrorIs(t, err, ErrUniqueViolation)
+	_, err = tx.Exec("DELETE FROM items")
+	assert.ErrorIs(t, err, errTxAborted)
+	assert.Error(t, tx.Commit())
+	assert.Len(t, queryColumn(t, db, "SELECT sku FROM items"), 4)
+}
+
+func TestInMemorySQL_ConcurrentInsertOfSameKey(t *testing.T) {
+	db := newSQLTestDB(t)
+	first, err := db.Begin()
+	require.NoError(t, err)
+	second, err := db.Begin()
+	require.NoError(t, err)
+
+	_, err = first.Exec("INSERT INTO items (sku) VALUES ('new')")
+	require.NoError(t, err)
+	_, err = second.Exec("INSERT INTO items (sku) VALUES ('new')")
+	require.NoError(t, err)
+
+	require.NoError(t, first.Commit())
+	assert.ErrorIs(t, second.Commit(), ErrUniqueViolation)
+}
+
+func TestInMemorySQL_Errors(t *testing.T) {
+	db := newSQLTestDB(t)
+
+	for query, msg := range map[string]string{
+		"SELECT sku FROM nowhere":             `relation "nowhere" does not exist`,
+		"SELECT nope FROM items":              `column "nope" does not exist`,
+		"SELECT sku FROM items WHERE":         "syntax error",
+		"SELECT sku FROM items WHERE id = $2": "there is no parameter $2",
+		"SELECT sku FROM items; DROP x":       "syntax error",
+		"SELECT 'unterminated FROM items":     "unterminated string",
+	} {
+		_, err := db.Query(query, 1)
+		assert.ErrorContains(t, err, msg, query)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	statements, err := splitStatements(`-- leading comment; not a statement
+CREATE TABLE a (note TEXT DEFAULT 'x;y');
+/* block ; comment */
+DROP TABLE b;
+-- trailing comment`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-- leading comment; not a statement\nCREATE TABLE a (note TEXT DEFAULT 'x;y')", "/* block ; comment */\nDROP TABLE b"}, statements)
+}
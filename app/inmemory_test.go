@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runs a statement in its own transaction.
+func mustExec(t *testing.T, store *InMemoryStore, query string, args ...interface{}) {
+	t.Helper()
+	_, err := (&InMemoryDB{store: store}).Exec(query, args...)
+	require.NoError(t, err)
+}
+
+func countRows(t *testing.T, store *InMemoryStore, table string) int {
+	t.Helper()
+	var n int
+	require.NoError(t, (&InMemoryDB{store: store}).QueryRow("SELECT COUNT(*) FROM "+table).Scan(&n))
+	return n
+}
+
+func TestCreateOrderHandler_FailureLeavesNoPartialOrder(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+
+	rr := doJSON(createOrderHandler(&InMemoryDB{store: store}), "POST", "/order", `{"items":[{"product_id":1,"quantity":1},{"product_id":99,"quantity":1}]}`)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, 0, countRows(t, store, "orders"))
+	assert.Equal(t, 0, countRows(t, store, "order_items"))
+	assert.Equal(t, 0, countRows(t, store, "order_status_history"))
+}
+
+func TestInMemoryTx_RollbackDiscardsWrites(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	db := &InMemoryDB{store: store}
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	require.NoError(t, DeleteProduct(tx, 1))
+	product := DBProduct{Name: "Dock", Price: MustParseMoney("99.00", DefaultCurrency), VATRate: 0.22}
+	require.NoError(t, InsertProduct(tx, &product))
+
+	// the transaction sees its own writes
+	_, err = GetProductByID(tx, 1)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	_, err = GetProductByID(tx, product.ID)
+	assert.NoError(t, err)
+
+	require.NoError(t, tx.Rollback())
+	assert.ErrorIs(t, tx.Commit(), sql.ErrTxDone)
+	assert.Equal(t, 5, countRows(t, store, "products"))
+	_, err = GetProductByID(db, 1)
+	assert.NoError(t, err)
+}
+
+func TestInMemoryTx_SnapshotIsolation(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	db := &InMemoryDB{store: store}
+
+	reader, err := db.Begin()
+	require.NoError(t, err)
+	writer, err := db.Begin()
+	require.NoError(t, err)
+
+	product, err := GetProductByID(writer, 2)
+	require.NoError(t, err)
+	product.Name = "Silent Mouse"
+	require.NoError(t, UpdateProduct(writer, product))
+
+	// uncommitted writes are invisible outside the transaction
+	committed, err := GetProductByID(db, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "Wireless Mouse", committed.Name)
+
+	require.NoError(t, writer.Commit())
+	committed, err = GetProductByID(db, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "Silent Mouse", committed.Name)
+
+	// a transaction keeps reading the snapshot taken when it began
+	seen, err := GetProductByID(reader, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "Wireless Mouse", seen.Name)
+	require.NoError(t, reader.Commit())
+}
+
+func TestInMemoryTx_ConcurrentWriteFailsToCommit(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	db := &InMemoryDB{store: store}
+
+	first, err := db.Begin()
+	require.NoError(t, err)
+	second, err := db.Begin()
+	require.NoError(t, err)
+
+	require.NoError(t, DeleteProduct(first, 3))
+	require.NoError(t, DeleteProduct(second, 3))
+	// writes to other rows do not conflict
+	require.NoError(t, DeleteProduct(second, 4))
+
+	require.NoError(t, first.Commit())
+	assert.ErrorIs(t, second.Commit(), ErrSerializationFailure)
+	_, err = GetProductByID(db, 3)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	_, err = GetProductByID(db, 4)
+	assert.NoError(t, err)
+}
+
+func TestInMemoryTx_SelectForUpdateWaitsAndRereads(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	db := &InMemoryDB{store: store}
+
+	first, err := db.Begin()
+	require.NoError(t, err)
+	second, err := db.Begin()
+	require.NoError(t, err)
+	// second has written elsewhere, so only the locked row can be read again
+	_, err = second.Exec("UPDATE products SET name = 'Desk Lamp' WHERE id = 5")
+	require.NoError(t, err)
+
+	stock, err := GetProductStockForUpdate(first, 1)
+	require.NoError(t, err)
+	_, err = first.Exec("UPDATE products SET stock = $1 WHERE id = 1", stock-10)
+	require.NoError(t, err)
+
+	locked := make(chan int)
+	go func() {
+		stock, err := GetProductStockForUpdate(second, 1)
+		assert.NoError(t, err)
+		locked <- stock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the row was locked twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+	require.NoError(t, first.Commit())
+
+	stock = <-locked
+	assert.Equal(t, sampleStock-10, stock, "the committed stock is read again")
+	_, err = second.Exec("UPDATE products SET stock = $1 WHERE id = 1", stock-1)
+	require.NoError(t, err)
+	require.NoError(t, second.Commit())
+	stock, err = GetProductStock(db, 1)
+	require.NoError(t, err)
+	assert.Equal(t, sampleStock-11, stock)
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrInsufficientStock is wrapped by InsufficientStockError.
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// InsufficientStockError is returned when an order asks for more units of a
+// product than are in stock.
+type InsufficientStockError struct {
+	ProductID int
+	Requested int
+	Available int
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock for product %d: %d requested, %d available", e.ProductID, e.Requested, e.Available)
+}
+
+func (e *InsufficientStockError) Unwrap() error { return ErrInsufficientStock }
+
+// StockMovementKind tells what changed a stock level.
+type StockMovementKind string
+
+const (
+	MovementOrder        StockMovementKind = "order"
+	MovementCancellation StockMovementKind = "cancellation"
+	MovementAdjustment   StockMovementKind = "adjustment"
+	MovementCartHold     StockMovementKind = "cart_hold"
+	MovementCartRelease  StockMovementKind = "cart_release"
+)
+
+// StockMovement is a row of the 'stock_movements' table, the audit trail of a
+// product's stock level.
+type StockMovement struct {
+	ID          int64             `json:"id"`
+	ProductID   int               `json:"-"`
+	WarehouseID int               `json:"warehouse_id,omitempty"`
+	Kind        StockMovementKind `json:"kind"`
+	Delta       int               `json:"delta"`
+	StockAfter  int               `json:"stock_after"`
+	OrderID     string            `json:"order_id,omitempty"`
+	CartID      string            `json:"cart_id,omitempty"`
+	Note        string            `json:"note,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// WarehouseStock is what one warehouse holds of a product.
+type WarehouseStock struct {
+	WarehouseID int    `json:"warehouse_id"`
+	Code        string `json:"code"`
+	Stock       int    `json:"stock"`
+}
+
+// StockLevel is the response body of GET and PUT /products/{id}/stock. Stock
+// is the total over all warehouses.
+type StockLevel struct {
+	ProductID  int              `json:"product_id"`
+	Stock      int              `json:"stock"`
+	Warehouses []WarehouseStock `json:"warehouses"`
+	Movements  []StockMovement  `json:"movements"`
+}
+
+// StockAdjustment is the request body of PUT /products/{id}/stock: the new
+// stock level of a warehouse, the main one if WarehouseID is not set, after a
+// recount or a delivery, and why it changed.
+type StockAdjustment struct {
+	WarehouseID int    `json:"warehouse_id"`
+	Stock       *int   `json:"stock"`
+	Note        string `json:"note"`
+}
+
+// how many movements GET /products/{id}/stock returns, newest first.
+const stockMovementsShown = 50
+
+// --- Inventory Database Functions ---
+
+// reads the stock of a product, locking its row until the transaction ends.
+func GetProductStockForUpdate(tx TxExecutor, productID int) (int, error) {
+	var stock int
+	err := tx.QueryRow("SELECT stock FROM products WHERE id = $1 FOR UPDATE", productID).Scan(&stock)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("product not found: %w", sql.ErrNoRows)
+		}
+		return 0, fmt.Errorf("failed to read product stock: %w", err)
+	}
+	return stock, nil
+}
+
+// reads the stock of a product without locking it.
+func GetProductStock(executor Queryer, productID int) (int, error) {
+	var stock int
+	err := executor.QueryRow("SELECT stock FROM products WHERE id = $1", productID).Scan(&stock)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("product not found: %w", sql.ErrNoRows)
+		}
+		return 0, fmt.Errorf("failed to read product stock: %w", err)
+	}
+	return stock, nil
+}
+
+// records a stock change in the 'stock_movements' table.
+func InsertStockMovement(tx TxExecutor, m *StockMovement) error {
+	_, err := tx.Exec("INSERT INTO stock_movements (product_id, warehouse_id, kind, delta, stock_after, order_id, cart_id, note, created_at) VALUES ($1, NULLIF($2, 0), $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8, $9)",
+		m.ProductID, m.WarehouseID, string(m.Kind), m.Delta, m.StockAfter, m.OrderID, m.CartID, m.Note, m.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert stock movement: %w", err)
+	}
+	return nil
+}
+
+// fetches the latest stock movements of a product, newest first.
+func GetStockMovements(executor Queryer, productID, limit int) ([]StockMovement, error) {
+	rows, err := executor.Query("SELECT id, COALESCE(warehouse_id, 0), kind, delta, stock_after, COALESCE(order_id, ''), COALESCE(cart_id, ''), note, created_at FROM stock_movements WHERE product_id = $1 ORDER BY id DESC LIMIT $2", productID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stock movements: %w", err)
+	}
+	defer rows.Close()
+
+	movements := []StockMovement{}
+	for rows.Next() {
+		m := StockMovement{ProductID: productID}
+		var kind string
+		if err := rows.Scan(&m.ID, &m.WarehouseID, &kind, &m.Delta, &m.StockAfter, &m.OrderID, &m.CartID, &m.Note, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan stock movement row: %w", err)
+		}
+		m.Kind = StockMovementKind(kind)
+		movements = append(movements, m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during stock movements iteration: %w", err)
+	}
+	return movements, nil
+}
+
+// reads what each warehouse holds of a product, by warehouse ID. With
+// forUpdate the rows stay locked until the transaction ends.
+func getWarehouseStock(executor Queryer, productID int, forUpdate bool) (map[int]int, error) {
+	query := "SELECT warehouse_id, stock FROM warehouse_stock WHERE product_id = $1 ORDER BY warehouse_id"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	rows, err := executor.Query(query, productID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query warehouse stock: %w", err)
+	}
+	defer rows.Close()
+
+	levels := make(map[int]int)
+	for rows.Next() {
+		var warehouseID, stock int
+		if err := rows.Scan(&warehouseID, &stock); err != nil {
+			return nil, fmt.Errorf("failed to scan warehouse stock row: %w", err)
+		}
+		levels[warehouseID] = stock
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during warehouse stock iteration: %w", err)
+	}
+	return levels, nil
+}
+
+// productStock is the stock of a product locked by a transaction: the total,
+// kept in products.stock, and what each warehouse holds.
+type productStock struct {
+	productID   int
+	total       int
+	byWarehouse map[int]int
+}
+
+// locks the stock of a product until the transaction ends. The product row is
+// locked first, so it serializes every change to the product's stock.
+func lockProductStock(tx TxExecutor, productID int) (*productStock, error) {
+	total, err := GetProductStockForUpdate(tx, productID)
+	if err != nil {
+		return nil, err
+	}
+	levels, err := getWarehouseStock(tx, productID, true)
+	if err != nil {
+		return nil, err
+	}
+	return &productStock{productID: productID, total: total, byWarehouse: levels}, nil
+}
+
+// changes the stock held in one warehouse by delta, keeping the product total
+// in step, and records the movement.
+func (ps *productStock) move(tx TxExecutor, warehouseID, delta int, m StockMovement) (*StockMovement, error) {
+	level, known := ps.byWarehouse[warehouseID]
+	var err error
+	if known {
+		_, err = tx.Exec("UPDATE warehouse_stock SET stock = $1 WHERE warehouse_id = $2 AND product_id = $3", level+delta, warehouseID, ps.productID)
+	} else {
+		_, err = tx.Exec("INSERT INTO warehouse_stock (warehouse_id, product_id, stock) VALUES ($1, $2, $3)", warehouseID, ps.productID, level+delta)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update warehouse stock: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE products SET stock = $1 WHERE id = $2", ps.total+delta, ps.productID); err != nil {
+		return nil, fmt.Errorf("failed to update product stock: %w", err)
+	}
+	ps.total += delta
+	ps.byWarehouse[warehouseID] = level + delta
+
+	m.ProductID, m.WarehouseID, m.Delta, m.StockAfter = ps.productID, warehouseID, delta, ps.total
+	if err := InsertStockMovement(tx, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ReserveStock takes the ordered quantities, by product ID, out of the stock of
+// the active warehouses inside the order's transaction, and returns where each
+// product ships from as picked by strategy. Products are locked in ID order so
+// that concurrent orders cannot deadlock; if the active warehouses hold fewer
+// units of a product than requested nothing is reserved and an
+// *InsufficientStockError is returned. The allocations keep the strategy's
+// order, the order in which the lines of a product are served.
+func ReserveStock(tx TxExecutor, orderID string, quantities map[int]int, strategy AllocationStrategy, destination *GeoPoint, now time.Time) ([]Allocation, error) {
+	return reserveStock(tx, quantities, strategy, destination, StockMovement{Kind: MovementOrder, OrderID: orderID, CreatedAt: now})
+}
+
+// takes quantities out of stock like ReserveStock, recording the movements
+// from the hold template, which names the order or cart holding the units.
+func reserveStock(tx TxExecutor, quantities map[int]int, strategy AllocationStrategy, destination *GeoPoint, hold StockMovement) ([]Allocation, error) {
+	warehouses, err := GetWarehouses(tx, true)
+	if err != nil {
+		return nil, err
+	}
+	req := AllocationRequest{
+		Quantities:  quantities,
+		Warehouses:  warehouses,
+		Stock:       make(map[int]map[int]int),
+		Destination: destination,
+	}
+	locked := make(map[int]*productStock)
+	for _, productID := range slices.Sorted(maps.Keys(quantities)) {
+		ps, err := lockProductStock(tx, productID)
+		if err != nil {
+			return nil, err
+		}
+		available, total := make(map[int]int), 0
+		for _, w := range warehouses {
+			if n := ps.byWarehouse[w.ID]; n > 0 {
+				available[w.ID] = n
+				total += n
+			}
+		}
+		if qty := quantities[productID]; total < qty {
+			return nil, &InsufficientStockError{ProductID: productID, Requested: qty, Available: total}
+		}
+		req.Stock[productID] = available
+		locked[productID] = ps
+	}
+
+	allocations, err := strategy.Allocate(req)
+	if err == nil {
+		err = checkAllocations(req, allocations)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("allocation strategy %s: %w", strategy.Name(), err)
+	}
+	for _, a := range allocations {
+		if _, err := locked[a.ProductID].move(tx, a.WarehouseID, -a.Quantity, hold); err != nil {
+			return nil, err
+		}
+	}
+	return allocations, nil
+}
+
+// ReleaseOrderStock puts back what an order still holds in each warehouse, as
+// recorded by its stock movements, so releasing twice does nothing. Movements
+// from before warehouses existed go back to the main warehouse.
+func ReleaseOrderStock(tx TxExecutor, orderID string, now time.Time) error {
+	return releaseStock(tx, StockMovement{Kind: MovementCancellation, OrderID: orderID, CreatedAt: now}, nil)
+}
+
+// puts back what the order or cart named by the release template still holds,
+// like ReleaseOrderStock; with productIDs set, only of those products.
+func releaseStock(tx TxExecutor, release StockMovement, productIDs []int) error {
+	holder, holderID := "order_id", release.OrderID
+	if release.CartID != "" {
+		holder, holderID = "cart_id", release.CartID
+	}
+	rows, err := tx.Query("SELECT product_id, warehouse_id, SUM(delta) FROM stock_movements WHERE "+holder+" = $1 GROUP BY product_id, warehouse_id", holderID)
+	if err != nil {
+		return fmt.Errorf("failed to query held stock movements: %w", err)
+	}
+	held := make(map[int]map[int]int)
+	var unassigned bool
+	for rows.Next() {
+		var productID, delta int
+		var warehouseID sql.NullInt64
+		if err := rows.Scan(&productID, &warehouseID, &delta); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan held stock movement: %w", err)
+		}
+		if delta < 0 && (productIDs == nil || slices.Contains(productIDs, productID)) {
+			if held[productID] == nil {
+				held[productID] = make(map[int]int)
+			}
+			held[productID][int(warehouseID.Int64)] += -delta
+			unassigned = unassigned || !warehouseID.Valid
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error during held stock movements iteration: %w", err)
+	}
+
+	if unassigned {
+		mainID, err := mainWarehouseID(tx)
+		if err != nil {
+			return err
+		}
+		for _, byWarehouse := range held {
+			if n, ok := byWarehouse[0]; ok {
+				delete(byWarehouse, 0)
+				byWarehouse[mainID] += n
+			}
+		}
+	}
+
+	for _, productID := range slices.Sorted(maps.Keys(held)) {
+		ps, err := lockProductStock(tx, productID)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue // the product has been deleted since
+		}
+		if err != nil {
+			return err
+		}
+		for _, warehouseID := range slices.Sorted(maps.Keys(held[productID])) {
+			if _, err := ps.move(tx, warehouseID, held[productID][warehouseID], release); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AdjustStock sets what a warehouse holds of a product to level, recording the
+// difference; a zero warehouseID means the main warehouse. It returns nil if
+// the level did not change.
+func AdjustStock(tx TxExecutor, productID, warehouseID, level int, note string, now time.Time) (*StockMovement, error) {
+	ps, err := lockProductStock(tx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if warehouseID == 0 {
+		if warehouseID, err = mainWarehouseID(tx); err != nil {
+			return nil, err
+		}
+	}
+	current := ps.byWarehouse[warehouseID]
+	if current == level {
+		return nil, nil
+	}
+	return ps.move(tx, warehouseID, level-current, StockMovement{Kind: MovementAdjustment, Note: note, CreatedAt: now})
+}
+
+// --- Inventory HTTP Handlers ---
+
+// maps an insufficient stock failure to the API error sent to the client.
+func stockError(err error) error {
+	var insufficient *InsufficientStockError
+	if errors.As(err, &insufficient) {
+		return ErrConflict(CodeInsufficientStock, "Insufficient stock for product %d: %d requested, %d available",
+			insufficient.ProductID, insufficient.Requested, insufficient.Available).
+			WithDetail("product_id", insufficient.ProductID).
+			WithDetail("requested", insufficient.Requested).
+			WithDetail("available", insufficient.Available)
+	}
+	return err
+}
+
+func writeStockLevel(w http.ResponseWriter, executor Queryer, productID int) error {
+	stock, err := GetProductStock(executor, productID)
+	if err != nil {
+		return productError(err, productID)
+	}
+	levels, err := getWarehouseStock(executor, productID, false)
+	if err != nil {
+		return err
+	}
+	warehouses, err := GetWarehouses(executor, false)
+	if err != nil {
+		return err
+	}
+	byWarehouse := []WarehouseStock{}
+	for _, wh := range warehouses {
+		if level, ok := levels[wh.ID]; ok {
+			byWarehouse = append(byWarehouse, WarehouseStock{WarehouseID: wh.ID, Code: wh.Code, Stock: level})
+		}
+	}
+	movements, err := GetStockMovements(executor, productID, stockMovementsShown)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StockLevel{ProductID: productID, Stock: stock, Warehouses: byWarehouse, Movements: movements})
+	return nil
+}
+
+// GET /products/{id}/stock
+func getStockHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, err := productIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := writeStockLevel(w, executor, productID); err != nil {
+			writeError(w, r, err)
+		}
+	}
+}
+
+// PUT /products/{id}/stock
+func adjustStockHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, err := productIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		var req StockAdjustment
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		req.Note = strings.TrimSpace(req.Note)
+		var fields []FieldError
+		if req.Stock == nil {
+			fields = append(fields, FieldError{Field: "stock", Message: "is required"})
+		} else if *req.Stock < 0 {
+			fields = append(fields, FieldError{Field: "stock", Message: "must not be negative"})
+		}
+		if req.Note == "" {
+			fields = append(fields, FieldError{Field: "note", Message: "is required"})
+		}
+		if req.WarehouseID < 0 {
+			fields = append(fields, FieldError{Field: "warehouse_id", Message: "must be a positive integer"})
+		}
+		if len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if req.WarehouseID != 0 {
+			if _, err := GetWarehouseByID(tx, req.WarehouseID); err != nil {
+				writeError(w, r, warehouseError(err, req.WarehouseID))
+				return
+			}
+		}
+		if _, err := AdjustStock(tx, productID, req.WarehouseID, *req.Stock, req.Note, time.Now()); err != nil {
+			writeError(w, r, productError(err, productID))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if err := writeStockLevel(w, executor, productID); err != nil {
+			writeError(w, r, err)
+		}
+	}
+}
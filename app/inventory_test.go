@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getStockLevel(t *testing.T, router http.Handler, productID string) StockLevel {
+	t.Helper()
+	rr := doJSON(router, "GET", "/products/"+productID+"/stock", "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var level StockLevel
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&level))
+	return level
+}
+
+func TestCreateOrder_ReservesStock(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	order := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":3},{"product_id":2,"quantity":4}]}`)
+	level := getStockLevel(t, router, "2")
+	assert.Equal(t, sampleStock-7, level.Stock)
+	require.NotEmpty(t, level.Movements)
+	assert.Equal(t, MovementOrder, level.Movements[0].Kind)
+	assert.Equal(t, -7, level.Movements[0].Delta)
+	assert.Equal(t, order.OrderID, level.Movements[0].OrderID)
+
+	// cancelling puts the units back, once
+	rr := doJSON(router, "POST", "/orders/"+order.OrderID+"/cancel", `{"reason":"changed mind"}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	level = getStockLevel(t, router, "2")
+	assert.Equal(t, sampleStock, level.Stock)
+	assert.Equal(t, MovementCancellation, level.Movements[0].Kind)
+	assert.Equal(t, 7, level.Movements[0].Delta)
+	tx, err := (&InMemoryDB{store: store}).Begin()
+	require.NoError(t, err)
+	require.NoError(t, ReleaseOrderStock(tx, order.OrderID, time.Now()))
+	require.NoError(t, tx.Commit())
+	assert.Equal(t, sampleStock, getStockLevel(t, router, "2").Stock)
+}
+
+func TestCreateOrder_InsufficientStock(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	rr := doJSON(router, "PUT", "/products/3/stock", `{"stock":2,"note":"recount"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	rr = doJSON(router, "POST", "/order", `{"items":[{"product_id":1,"quantity":1},{"product_id":3,"quantity":5}]}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	var body struct {
+		Error struct {
+			Code    ErrorCode              `json:"code"`
+			Details map[string]interface{} `json:"details"`
+		} `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+	assert.Equal(t, CodeInsufficientStock, body.Error.Code)
+	assert.Equal(t, map[string]interface{}{"product_id": 3.0, "requested": 5.0, "available": 2.0}, body.Error.Details)
+
+	// nothing was taken, not even from the product in stock
+	assert.Equal(t, 0, countRows(t, store, "orders"))
+	assert.Equal(t, sampleStock, getStockLevel(t, router, "1").Stock)
+	assert.Equal(t, 2, getStockLevel(t, router, "3").Stock)
+}
+
+func TestAdjustStockHandler(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	rr := doJSON(router, "PUT", "/products/4/stock", `{"stock":130,"note":"delivery"}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var level StockLevel
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&level))
+	assert.Equal(t, 130, level.Stock)
+	require.Len(t, level.Movements, 2, "the sample stock and the delivery")
+	assert.Equal(t, StockMovement{ID: level.Movements[0].ID, WarehouseID: 1, Kind: MovementAdjustment, Delta: 30, StockAfter: 130, Note: "delivery", CreatedAt: level.Movements[0].CreatedAt}, level.Movements[0])
+
+	for body, field := range map[string]string{
+		`{"note":"x"}`:             "stock",
+		`{"stock":-1,"note":"x"}`:  "stock",
+		`{"stock":1}`:              "note",
+		`{"stock":1,"note":"   "}`: "note",
+	} {
+		rr = doJSON(router, "PUT", "/products/4/stock", body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Contains(t, rr.Body.String(), `"field":"`+field+`"`, body)
+	}
+	rr = doJSON(router, "PUT", "/products/99/stock", `{"stock":1,"note":"x"}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = doJSON(router, "GET", "/products/99/stock", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestCreateOrder_ConcurrentOrdersNeverOversell(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	rr := doJSON(router, "PUT", "/products/5/stock", `{"stock":5,"note":"last units"}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- doJSON(router, "POST", "/order", `{"items":[{"product_id":5,"quantity":1}]}`).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		if code == http.StatusCreated {
+			created++
+		} else {
+			assert.Equal(t, http.StatusConflict, code)
+		}
+	}
+	assert.Equal(t, 5, created)
+	assert.Equal(t, 0, getStockLevel(t, router, "5").Stock)
+}
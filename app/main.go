@@ -5,11 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math"
 	"net/http"
 	"os"
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,18 +21,32 @@ import (
 
 // simulated catalog product for API request/response.
 type Product struct {
-	ID      int     `json:"id"`
-	Name    string  `json:"name"`
-	Price   float64 `json:"price"`
-	VATRate float64 `json:"vat_rate"` // VAT rate, e.g., 0.22 for 22%
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Price       Money     `json:"price"`
+	VATRate     float64   `json:"vat_rate"` // VAT rate, e.g., 0.22 for 22%, where no tax rule applies
+	Category    string    `json:"category,omitempty"`
+	TaxCategory string    `json:"tax_category"`
+	PriceMode   PriceMode `json:"price_mode,omitempty"` // missing when DefaultPriceMode applies
+	WeightGrams int       `json:"weight_grams,omitempty"`
+	LengthMM    int       `json:"length_mm,omitempty"` // dimensions of the packed unit
+	WidthMM     int       `json:"width_mm,omitempty"`
+	HeightMM    int       `json:"height_mm,omitempty"`
 }
 
 // DBProduct 'products' table in the database.
 type DBProduct struct {
-	ID      int
-	Name    string
-	Price   float64
-	VATRate float64
+	ID          int
+	Name        string
+	Price       Money
+	VATRate     float64
+	Category    string
+	TaxCategory string
+	PriceMode   PriceMode // "" follows DefaultPriceMode
+	WeightGrams int
+	LengthMM    int
+	WidthMM     int
+	HeightMM    int
 }
 
 // IncomingOrderItem represents an item in request body.
@@ -43,31 +57,77 @@ type IncomingOrderItem struct {
 
 // item in the response body
 type OutgoingOrderItem struct {
-	ProductID int     `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
-	ItemVAT   float64 `json:"vat"`
+	ProductID        int          `json:"product_id"`
+	Quantity         int          `json:"quantity"`
+	Price            Money        `json:"price"`                        // gross when price_includes_vat
+	PriceIncludesVAT bool         `json:"price_includes_vat,omitempty"` // the price is VAT inclusive
+	ItemVAT          Money        `json:"vat"`                          // the VAT of the whole line; the items add up to order_vat
+	VATRate          *float64     `json:"vat_rate,omitempty"`           // missing on items priced before tax rules
+	TaxRuleID        int          `json:"tax_rule_id,omitempty"`        // missing when the product's own rate applied
+	LineNet          *Money       `json:"line_net,omitempty"`           // the discounted line before VAT; missing on items priced before price modes
+	LineGross        *Money       `json:"line_gross,omitempty"`         // line_net plus its VAT
+	Allocations      []Allocation `json:"allocations,omitempty"`        // the warehouses the item ships from
 }
 
 // order structure
 type IncomingOrder struct {
-	Items []IncomingOrderItem `json:"items"` // A list of items in the order
+	Items   []IncomingOrderItem `json:"items"`             // A list of items in the order
+	ShipTo  *GeoPoint           `json:"ship_to,omitempty"` // used by the nearest allocation strategy
+	Coupons []string            `json:"coupons,omitempty"` // codes, applied in this order
+	Country string              `json:"country,omitempty"` // destination, selects the tax rules; DefaultCountry if missing
+	VATID   string              `json:"vat_id,omitempty"`  // the EU VAT number of a business buyer
+
+	Currency string `json:"currency,omitempty"` // the currency to price the order in; DefaultCurrency if missing
+
+	CustomerID int `json:"customer_id,omitempty"` // the customer placing the order; anonymous if missing
+
+	ShippingAddress *Address `json:"shipping_address,omitempty"` // its country is the destination when country is missing
+	BillingAddress  *Address `json:"billing_address,omitempty"`
+	ShippingMethod  string   `json:"shipping_method,omitempty"` // a method of the destination's shipping zone; no shipping if missing
 }
 
 // order structure as returned in the response body,
 type OutgoingOrder struct {
 	OrderID         string              `json:"order_id"`
-	TotalOrderPrice float64             `json:"order_price"`
-	VATAmount       float64             `json:"order_vat"`
+	Status          OrderStatus         `json:"status"`
+	CustomerID      int                 `json:"customer_id,omitempty"`
+	Currency        string              `json:"currency"`
+	ExchangeRate    float64             `json:"exchange_rate"` // from DefaultCurrency, as applied when the order was priced
+	TotalOrderPrice Money               `json:"order_price"`
+	VATAmount       Money               `json:"order_vat"`
+	TotalGross      Money               `json:"order_gross"`
+	VATBreakdown    []VATSummary        `json:"vat_breakdown,omitempty"`
 	Items           []OutgoingOrderItem `json:"items"`
+	Shipping        *ShippingLine       `json:"shipping,omitempty"`
+	Discounts       []AppliedDiscount   `json:"discounts,omitempty"`
+	BuyerVATID      string              `json:"buyer_vat_id,omitempty"`
+	ReverseCharge   bool                `json:"reverse_charge,omitempty"`
+	VATNote         string              `json:"vat_note,omitempty"`
+	ShippingAddress *Address            `json:"shipping_address,omitempty"` // as given when the order was placed
+	BillingAddress  *Address            `json:"billing_address,omitempty"`
+	CancelReason    string              `json:"cancel_reason,omitempty"`
+	CancelledAt     *time.Time          `json:"cancelled_at,omitempty"`
 }
 
 // a row in the 'orders' table.
 type OrderRecord struct {
 	OrderID    string
-	TotalPrice float64
-	VATAmount  float64
+	TotalPrice Money
+	VATAmount  Money
+	Status     OrderStatus
 	CreatedAt  time.Time
+
+	CancelReason string
+	CancelledAt  sql.NullTime
+
+	BuyerVATID    string
+	ReverseCharge bool
+	VATNote       string
+
+	Currency     string
+	ExchangeRate float64 // snapshot of the rate from DefaultCurrency the order was priced at
+
+	CustomerID int // 0 for anonymous orders
 }
 
 // a row in the 'order_items' table.
@@ -76,8 +136,16 @@ type OrderItemRecord struct {
 	OrderID   string
 	ProductID int
 	Quantity  int
-	UnitPrice float64
-	ItemVAT   float64
+	UnitPrice Money
+	ItemVAT   Money
+	VATRate   float64 // as resolved when the order was priced
+	TaxRuleID int     // 0 when the product's own rate applied
+
+	PriceIncludesVAT bool
+	LineNet          Money
+	LineGross        Money
+
+	Allocations []Allocation // rows of 'order_item_allocations'
 }
 
 // RowLike abstracts the behavior of *sql.Row.
@@ -93,6 +161,13 @@ type RowsLike interface {
 	Err() error
 }
 
+// Queryer is the read-only subset shared by DBExecutor and TxExecutor, for lookups
+// that may run either inside or outside a transaction.
+type Queryer interface {
+	QueryRow(query string, args ...interface{}) RowLike
+	Query(query string, args ...interface{}) (RowsLike, error)
+}
+
 // TxExecutor defines the methods needed from a transaction for our functions.
 type TxExecutor interface {
 	QueryRow(query string, args ...interface{}) RowLike
@@ -142,288 +217,155 @@ func (db *sqlDBAdapter) Exec(query string, args ...interface{}) (sql.Result, err
 	return db.DB.Exec(query, args...)
 }
 
-// --- In-Memory Store for Mocking a running DB ---
-
-// implements sql.Result for the in-memory store.
-type InMemoryResult struct {
-	rowsAffected int64
-}
-
-func (r *InMemoryResult) LastInsertId() (int64, error) {
-	return 0, errors.New("LastInsertId is not supported in in-memory mock")
-}
-
-func (r *InMemoryResult) RowsAffected() (int64, error) {
-	return r.rowsAffected, nil
-}
-
-// holds data in memory for mock mode/ thread-safe.
-type InMemoryStore struct {
-	mu         sync.RWMutex
-	products   map[int]DBProduct
-	orders     map[string]OrderRecord
-	orderItems map[string][]OrderItemRecord
-	nextItemID int
-}
-
-// creates and initializes an in-memory store
-func NewInMemoryStore() *InMemoryStore {
-	return &InMemoryStore{
-		products:   make(map[int]DBProduct),
-		orders:     make(map[string]OrderRecord),
-		orderItems: make(map[string][]OrderItemRecord),
-		nextItemID: 1,
+func main() {
+	if mode, err := ParseRoundingMode(os.Getenv("ROUNDING_MODE")); err != nil {
+		log.Fatalf("Invalid ROUNDING_MODE: %v", err)
+	} else {
+		DefaultRoundingMode = mode
 	}
-}
-
-// sample products
-func (s *InMemoryStore) Populate() {
-	s.products[1] = DBProduct{ID: 1, Name: "Laptop Pro", Price: 1499.99, VATRate: 0.22}
-	s.products[2] = DBProduct{ID: 2, Name: "Wireless Mouse", Price: 79.99, VATRate: 0.22}
-	s.products[3] = DBProduct{ID: 3, Name: "Mechanical Keyboard", Price: 129.99, VATRate: 0.22}
-	s.products[4] = DBProduct{ID: 4, Name: "4K Monitor", Price: 649.50, VATRate: 0.22}
-	s.products[5] = DBProduct{ID: 5, Name: "HD Monitor", Price: 150.50, VATRate: 0.15}
-}
-
-// mock implementation of DBExecutor that uses the in-memory store
-type InMemoryDB struct {
-	store *InMemoryStore
-}
-
-func (db *InMemoryDB) Begin() (TxExecutor, error) {
-	return &InMemoryTx{store: db.store}, nil
-}
-
-func (db *InMemoryDB) Query(query string, args ...interface{}) (RowsLike, error) {
-	db.store.mu.RLock()
-	defer db.store.mu.RUnlock()
-
-	if query == "SELECT id, name, price, vat_rate FROM products" {
-		rows := &InMemoryRows{}
-		for _, p := range db.store.products {
-			rows.data = append(rows.data, []interface{}{p.ID, p.Name, p.Price, p.VATRate})
-		}
-		return rows, nil
+	if strategy, err := ParseAllocationStrategy(os.Getenv("ALLOCATION_STRATEGY")); err != nil {
+		log.Fatalf("Invalid ALLOCATION_STRATEGY: %v", err)
+	} else {
+		DefaultAllocationStrategy = strategy
 	}
-	if query == "SELECT product_id, quantity, unit_price, item_vat FROM order_items WHERE order_id = $1" {
-		orderID := args[0].(string)
-		rows := &InMemoryRows{}
-		if items, ok := db.store.orderItems[orderID]; ok {
-			for _, item := range items {
-				rows.data = append(rows.data, []interface{}{item.ProductID, item.Quantity, item.UnitPrice, item.ItemVAT})
-			}
+	if country := os.Getenv("DEFAULT_COUNTRY"); country != "" {
+		if DefaultCountry = normalizeCountry(country); !countryPattern.MatchString(DefaultCountry) {
+			log.Fatalf("Invalid DEFAULT_COUNTRY %q: must be an ISO 3166-1 alpha-2 code such as IT", country)
 		}
-		return rows, nil
 	}
-	return nil, fmt.Errorf("in-memory mock for DB.Query not implemented: %s", query)
-}
-
-func (db *InMemoryDB) QueryRow(query string, args ...interface{}) RowLike {
-	db.store.mu.RLock()
-	defer db.store.mu.RUnlock()
-
-	if query == "SELECT order_id, total_price, vat_amount, created_at FROM orders WHERE order_id = $1" {
-		orderID := args[0].(string)
-		if order, ok := db.store.orders[orderID]; ok {
-			return &InMemoryRow{data: []interface{}{order.OrderID, order.TotalPrice, order.VATAmount, order.CreatedAt}, err: nil}
+	if country := os.Getenv("SELLER_COUNTRY"); country != "" {
+		if SellerCountry = normalizeCountry(country); !euCountries[SellerCountry] {
+			log.Fatalf("Invalid SELLER_COUNTRY %q: must be the ISO 3166-1 alpha-2 code of an EU member state", country)
 		}
-		return &InMemoryRow{err: sql.ErrNoRows}
 	}
-
-	return &InMemoryRow{err: fmt.Errorf("in-memory mock for DB.QueryRow not implemented: %s", query)}
-}
-
-func (db *InMemoryDB) Exec(query string, args ...interface{}) (sql.Result, error) {
-	return nil, errors.New("exec should be called on a transaction, not directly on the DB")
-}
-
-// mock implementation of TxExecutor.
-type InMemoryTx struct {
-	store *InMemoryStore
-}
-
-func (tx *InMemoryTx) Commit() error   { return nil } // No-op for in-memory
-func (tx *InMemoryTx) Rollback() error { return nil } // No-op for in-memory
-
-func (tx *InMemoryTx) Query(query string, args ...interface{}) (RowsLike, error) {
-	// Delegate to the main DB query method for simplicity
-	return (&InMemoryDB{store: tx.store}).Query(query, args...)
-}
-
-func (tx *InMemoryTx) QueryRow(query string, args ...interface{}) RowLike {
-	tx.store.mu.Lock()
-	defer tx.store.mu.Unlock()
-
-	if query == "SELECT id, name, price, vat_rate FROM products WHERE id = $1" {
-		productID := args[0].(int)
-		if p, ok := tx.store.products[productID]; ok {
-			return &InMemoryRow{data: []interface{}{p.ID, p.Name, p.Price, p.VATRate}, err: nil}
-		}
-		return &InMemoryRow{err: sql.ErrNoRows}
+	if mode, err := ParsePriceMode(os.Getenv("PRICE_MODE")); err != nil {
+		log.Fatalf("Invalid PRICE_MODE: %v", err)
+	} else {
+		DefaultPriceMode = mode
 	}
-
-	sqlStatement := `
-	INSERT INTO order_items (order_id, product_id, quantity, unit_price, item_vat)
-	VALUES ($1, $2, $3, $4, $5)
-	RETURNING item_id;`
-	if query == sqlStatement {
-		orderID := args[0].(string)
-		item := OrderItemRecord{
-			ItemID:    tx.store.nextItemID,
-			OrderID:   orderID,
-			ProductID: args[1].(int),
-			Quantity:  args[2].(int),
-			UnitPrice: args[3].(float64),
-			ItemVAT:   args[4].(float64),
-		}
-		tx.store.orderItems[orderID] = append(tx.store.orderItems[orderID], item)
-		tx.store.nextItemID++
-		return &InMemoryRow{data: []interface{}{item.ItemID}, err: nil}
+	if policy, err := ParseVATRounding(os.Getenv("VAT_ROUNDING")); err != nil {
+		log.Fatalf("Invalid VAT_ROUNDING: %v", err)
+	} else {
+		DefaultVATRounding = policy
 	}
-
-	return &InMemoryRow{err: fmt.Errorf("in-memory mock for Tx.QueryRow not implemented: %s", query)}
-}
-
-func (tx *InMemoryTx) Exec(query string, args ...interface{}) (sql.Result, error) {
-	tx.store.mu.Lock()
-	defer tx.store.mu.Unlock()
-
-	if query == "INSERT INTO orders (order_id, total_price, vat_amount, created_at) VALUES ($1, $2, $3, $4)" {
-		order := OrderRecord{
-			OrderID:    args[0].(string),
-			TotalPrice: args[1].(float64),
-			VATAmount:  args[2].(float64),
-			CreatedAt:  args[3].(time.Time),
+	if ttl := os.Getenv("IDEMPOTENCY_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid IDEMPOTENCY_TTL %q: must be a positive duration such as 24h", ttl)
 		}
-		tx.store.orders[order.OrderID] = order
-		return &InMemoryResult{rowsAffected: 1}, nil
+		IdempotencyTTL = d
 	}
-
-	if query == "UPDATE orders SET total_price = $1, vat_amount = $2 WHERE order_id = $3" {
-		orderID := args[2].(string)
-		if order, ok := tx.store.orders[orderID]; ok {
-			order.TotalPrice = args[0].(float64)
-			order.VATAmount = args[1].(float64)
-			tx.store.orders[orderID] = order
-			return &InMemoryResult{rowsAffected: 1}, nil
+	if ttl := os.Getenv("CART_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid CART_TTL %q: must be a positive duration such as 15m", ttl)
 		}
-		return nil, fmt.Errorf("order not found for update: %s", orderID)
-	}
-
-	return nil, fmt.Errorf("in-memory mock for Exec not implemented: %s", query)
-}
-
-// mock implementation of RowLike.
-type InMemoryRow struct {
-	data []interface{}
-	err  error
-}
-
-func (r *InMemoryRow) Scan(dest ...interface{}) error {
-	if r.err != nil {
-		return r.err
+		CartTTL = d
 	}
-	if len(dest) != len(r.data) {
-		return fmt.Errorf("scan error: expected %d dest values, got %d", len(r.data), len(dest))
+	payments, err := NewPaymentProvider(os.Getenv("PAYMENT_PROVIDER"))
+	if err != nil {
+		log.Fatalf("Invalid PAYMENT_PROVIDER: %v", err)
 	}
-	for i, val := range r.data {
-		switch d := dest[i].(type) {
-		case *string:
-			*d = val.(string)
-		case *float64:
-			*d = val.(float64)
-		case *int:
-			*d = val.(int)
-		case *time.Time:
-			*d = val.(time.Time)
-		default:
-			return fmt.Errorf("unsupported type for scan: %T", d)
+	PaymentWebhookSecret = os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	if tolerance := os.Getenv("PAYMENT_WEBHOOK_TOLERANCE"); tolerance != "" {
+		d, err := time.ParseDuration(tolerance)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid PAYMENT_WEBHOOK_TOLERANCE %q: must be a positive duration such as 5m", tolerance)
 		}
+		PaymentWebhookTolerance = d
 	}
-	return nil
-}
 
-// mock implementation of RowsLike.
-type InMemoryRows struct {
-	data         [][]interface{}
-	currentIndex int
-}
+	dbExecutor, closeDB := connectDatabase()
+	defer closeDB()
 
-func (r *InMemoryRows) Next() bool {
-	r.currentIndex++
-	return r.currentIndex <= len(r.data)
-}
-
-func (r *InMemoryRows) Scan(dest ...interface{}) error {
-	if r.currentIndex > len(r.data) || r.currentIndex == 0 {
-		return errors.New("scan called out of bounds or before Next")
+	// `mytest migrate up|down [n]|status` manages the schema and exits.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(dbExecutor, os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
 	}
-	rowData := r.data[r.currentIndex-1]
-	row := &InMemoryRow{data: rowData}
-	return row.Scan(dest...)
-}
-func (r *InMemoryRows) Close() error { return nil }
-func (r *InMemoryRows) Err() error   { return nil }
-
-func main() {
-	var dbExecutor DBExecutor
-
-	// Check for mock mode, required by the testing workflow.
-	if os.Getenv("DB_HOST") == "mock" {
-		log.Println("--- RUNNING IN MOCK DATABASE MODE (STATEFUL) ---")
-		store := NewInMemoryStore()
-		store.Populate()
-		dbExecutor = &InMemoryDB{store: store}
-	} else {
-		log.Println("--- RUNNING IN LIVE DATABASE MODE ---")
-		// Retrieve database connection details from environment variables.
-		dbHost := os.Getenv("DB_HOST")
-		dbName := os.Getenv("DB_NAME")
-		dbUser := os.Getenv("DB_USER")
-		dbPassword := os.Getenv("DB_PASSWORD")
-
-		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
-			dbHost, dbUser, dbPassword, dbName)
-
-		var err error
-		var db *sql.DB
-
-		for i := 0; i < 10; i++ {
-			db, err = sql.Open("postgres", connStr)
-			if err != nil {
-				log.Printf("Error opening database: %v. Retrying in 5 seconds...", err)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-			err = db.Ping()
-			if err != nil {
-				log.Printf("Error connecting to the database: %v. Retrying in 5 seconds...", err)
-				db.Close()
-				time.Sleep(5 * time.Second)
-				continue
+	if autoMigrate, _ := strconv.ParseBool(os.Getenv("AUTO_MIGRATE")); autoMigrate {
+		migrations, err := embeddedMigrations()
+		if err == nil {
+			var done []Migration
+			done, err = MigrateUp(dbExecutor, migrations)
+			for _, m := range done {
+				log.Printf("Applied migration %04d_%s", m.Version, m.Name)
 			}
-			log.Println("Successfully connected to the database!")
-			break
 		}
-
 		if err != nil {
-			log.Fatalf("Could not connect to the database after multiple retries: %v", err)
+			log.Fatalf("Could not migrate the database: %v", err)
 		}
-		defer db.Close()
+	}
 
-		// Wrap the real DB connection in our adapter.
-		dbExecutor = &sqlDBAdapter{db}
+	if path := os.Getenv("EXCHANGE_RATES_FILE"); path != "" {
+		n, err := LoadExchangeRates(dbExecutor, path, time.Now())
+		if err != nil {
+			log.Fatalf("Could not load exchange rates: %v", err)
+		}
+		log.Printf("Loaded %d exchange rates from %s", n, path)
 	}
 
+	startIdempotencyJanitor(dbExecutor, time.Hour)
+	startCartSweeper(dbExecutor, time.Minute)
+
 	router := mux.NewRouter()
 
 	// API Routes - Pass the chosen executor (real or mock) to the handlers.
-	router.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	router.NotFoundHandler = requestIDMiddleware(http.HandlerFunc(notFoundHandler))
+	router.MethodNotAllowedHandler = requestIDMiddleware(http.HandlerFunc(methodNotAllowedHandler))
+	router.Use(requestIDMiddleware)
 
 	router.HandleFunc("/", homeHandler).Methods("GET")
 	router.HandleFunc("/products", getProductsHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/products", createProductHandler(dbExecutor)).Methods("POST")
+	router.HandleFunc("/products/{id}", getProductHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/products/{id}", updateProductHandler(dbExecutor)).Methods("PUT", "PATCH")
+	router.HandleFunc("/products/{id}", deleteProductHandler(dbExecutor)).Methods("DELETE")
+	router.HandleFunc("/products/{id}/stock", getStockHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/products/{id}/stock", adjustStockHandler(dbExecutor)).Methods("PUT")
+	router.HandleFunc("/warehouses", getWarehousesHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/warehouses", createWarehouseHandler(dbExecutor)).Methods("POST")
+	router.HandleFunc("/tax-rules", getTaxRulesHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/tax-rules", saveTaxRuleHandler(dbExecutor)).Methods("POST")
+	router.HandleFunc("/tax-rules/{id}", getTaxRuleHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/tax-rules/{id}", saveTaxRuleHandler(dbExecutor)).Methods("PUT")
+	router.HandleFunc("/shipping-zones", getShippingZonesHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/shipping-zones", saveShippingZoneHandler(dbExecutor)).Methods("POST")
+	router.HandleFunc("/shipping-zones/{id}", getShippingZoneHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/shipping-zones/{id}", saveShippingZoneHandler(dbExecutor)).Methods("PUT")
+	router.HandleFunc("/exchange-rates", getExchangeRatesHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/exchange-rates", saveExchangeRateHandler(dbExecutor)).Methods("POST")
+	router.HandleFunc("/customers", getCustomersHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/customers", createCustomerHandler(dbExecutor)).Methods("POST")
+	router.HandleFunc("/customers/{id}", getCustomerHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/customers/{id}", updateCustomerHandler(dbExecutor)).Methods("PUT", "PATCH")
+	router.HandleFunc("/customers/{id}", deleteCustomerHandler(dbExecutor)).Methods("DELETE")
+	router.HandleFunc("/customers/{id}/orders", getCustomerOrdersHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/coupons", getCouponsHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/coupons", createCouponHandler(dbExecutor)).Methods("POST")
+	router.HandleFunc("/coupons/{code}", getCouponHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/coupons/{code}", updateCouponHandler(dbExecutor)).Methods("PUT")
+	router.HandleFunc("/coupons/{code}", deleteCouponHandler(dbExecutor)).Methods("DELETE")
+	router.HandleFunc("/carts", createCartHandler(dbExecutor)).Methods("POST")
+	router.HandleFunc("/carts/{id}", getCartHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/carts/{id}/items", setCartItemsHandler(dbExecutor)).Methods("PUT")
+	router.HandleFunc("/carts/{id}/checkout", checkoutCartHandler(dbExecutor)).Methods("POST")
 	router.HandleFunc("/order", createOrderHandler(dbExecutor)).Methods("POST")
+	router.HandleFunc("/orders", listOrdersHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/orders/quote", quoteOrderHandler(dbExecutor)).Methods("POST")
 	router.HandleFunc("/orders/{id}", getOrderHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/orders/{id}/transitions", transitionOrderHandler(dbExecutor, payments)).Methods("POST")
+	router.HandleFunc("/orders/{id}/cancel", cancelOrderHandler(dbExecutor, payments)).Methods("POST")
+	router.HandleFunc("/orders/{id}/transitions", getOrderHistoryHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/orders/{id}/payments", createPaymentHandler(dbExecutor, payments)).Methods("POST")
+	router.HandleFunc("/orders/{id}/payments", getOrderPaymentsHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/payments/{id}", getPaymentHandler(dbExecutor)).Methods("GET")
+	router.HandleFunc("/payments/{id}/capture", capturePaymentHandler(dbExecutor, payments)).Methods("POST")
+	router.HandleFunc("/payments/{id}/void", voidPaymentHandler(dbExecutor, payments)).Methods("POST")
+	router.HandleFunc("/payments/{id}/refund", refundPaymentHandler(dbExecutor, payments)).Methods("POST")
+	router.HandleFunc("/webhooks/payments", paymentWebhookHandler(dbExecutor, payments)).Methods("POST")
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -434,6 +376,56 @@ func main() {
 	log.Fatal(http.ListenAndServe(":"+port, router))
 }
 
+// returns the in-memory store in mock mode, otherwise a connection to Postgres
+// made from the DB_* variables, and a function closing it.
+func connectDatabase() (DBExecutor, func()) {
+	// Check for mock mode, required by the testing workflow.
+	if os.Getenv("DB_HOST") == "mock" {
+		log.Println("--- RUNNING IN MOCK DATABASE MODE (STATEFUL) ---")
+		store := NewInMemoryStore()
+		store.Populate()
+		return &InMemoryDB{store: store}, func() {}
+	}
+
+	log.Println("--- RUNNING IN LIVE DATABASE MODE ---")
+	// Retrieve database connection details from environment variables.
+	dbHost := os.Getenv("DB_HOST")
+	dbName := os.Getenv("DB_NAME")
+	dbUser := os.Getenv("DB_USER")
+	dbPassword := os.Getenv("DB_PASSWORD")
+
+	connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+		dbHost, dbUser, dbPassword, dbName)
+
+	var err error
+	var db *sql.DB
+
+	for i := 0; i < 10; i++ {
+		db, err = sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error opening database: %v. Retrying in 5 seconds...", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		err = db.Ping()
+		if err != nil {
+			log.Printf("Error connecting to the database: %v. Retrying in 5 seconds...", err)
+			db.Close()
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		log.Println("Successfully connected to the database!")
+		break
+	}
+
+	if err != nil {
+		log.Fatalf("Could not connect to the database after multiple retries: %v", err)
+	}
+
+	// Wrap the real DB connection in our adapter.
+	return &sqlDBAdapter{db}, func() { db.Close() }
+}
+
 // responds to the root URL with a welcome message.
 func homeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -442,76 +434,73 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 
 // all requests to undefined routes.
 func notFoundHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusNotFound)
-	json.NewEncoder(w).Encode(map[string]string{"error": "Not Found"})
+	writeError(w, r, ErrNotFound("Not Found"))
+}
+
+// requests to defined routes with an unsupported method.
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, NewAPIError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method %s is not allowed on %s", r.Method, r.URL.Path))
 }
 
-// --- Product Database Functions ---
+// --- Order Database Functions ---
 
-// fetches a single product from the 'products' table by its ID
-func GetProductByID(executor TxExecutor, productID int) (*DBProduct, error) {
-	var product DBProduct
-	row := executor.QueryRow("SELECT id, name, price, vat_rate FROM products WHERE id = $1", productID)
-	err := row.Scan(&product.ID, &product.Name, &product.Price, &product.VATRate)
+// inserts a new order record into the 'orders' table, together with the
+// first entry of its status history
+func InsertOrder(executor TxExecutor, order *OrderRecord) error {
+	if order.Status == "" {
+		order.Status = StatusPending
+	}
+	_, err := executor.Exec("INSERT INTO orders (order_id, total_price, vat_amount, status, created_at) VALUES ($1, $2, $3, $4, $5)",
+		order.OrderID, order.TotalPrice, order.VATAmount, string(order.Status), order.CreatedAt)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			// Wrapping the error is good practice to provide more context.
-			return nil, fmt.Errorf("product not found: %w", sql.ErrNoRows)
-		}
-		return nil, fmt.Errorf("failed to scan product: %w", err)
+		return fmt.Errorf("failed to insert order: %w", err)
 	}
-	return &product, nil
+	return InsertOrderStatusChange(executor, &OrderStatusChange{
+		OrderID:   order.OrderID,
+		ToStatus:  order.Status,
+		ChangedAt: order.CreatedAt,
+	})
 }
 
-// fetches all products from the 'products' table
-func GetAllProducts(executor DBExecutor) ([]DBProduct, error) {
-	rows, err := executor.Query("SELECT id, name, price, vat_rate FROM products")
+// updates the total_price and vat_amount for an existing order
+func UpdateOrderTotals(executor TxExecutor, orderID string, totalPrice, vatAmount Money) error {
+	_, err := executor.Exec("UPDATE orders SET total_price = $1, vat_amount = $2 WHERE order_id = $3",
+		totalPrice, vatAmount, orderID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query products: %w", err)
-	}
-	defer rows.Close()
-
-	var products []DBProduct
-	for rows.Next() {
-		var product DBProduct
-		if err := rows.Scan(&product.ID, &product.Name, &product.Price, &product.VATRate); err != nil {
-			return nil, fmt.Errorf("failed to scan product row: %w", err)
-		}
-		products = append(products, product)
-	}
-
-	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("error during products iteration: %w", err)
+		return fmt.Errorf("failed to update order totals: %w", err)
 	}
-	return products, nil
+	return nil
 }
 
-// inserts a new order record into the 'orders' table
-func InsertOrder(executor TxExecutor, order *OrderRecord) error {
-	_, err := executor.Exec("INSERT INTO orders (order_id, total_price, vat_amount, created_at) VALUES ($1, $2, $3, $4)",
-		order.OrderID, order.TotalPrice, order.VATAmount, order.CreatedAt)
+// records the buyer's VAT number of an order and whether it is invoiced with
+// reverse charge, with the note printed on it.
+func UpdateOrderBuyer(executor TxExecutor, orderID, vatID string, reverseCharge bool, vatNote string) error {
+	_, err := executor.Exec("UPDATE orders SET buyer_vat_id = $1, reverse_charge = $2, vat_note = $3 WHERE order_id = $4",
+		vatID, reverseCharge, vatNote, orderID)
 	if err != nil {
-		return fmt.Errorf("failed to insert order: %w", err)
+		return fmt.Errorf("failed to update order buyer: %w", err)
 	}
 	return nil
 }
 
-// updates the total_price and vat_amount for an existing order
-func UpdateOrderTotals(executor TxExecutor, orderID string, totalPrice, vatAmount float64) error {
-	_, err := executor.Exec("UPDATE orders SET total_price = $1, vat_amount = $2 WHERE order_id = $3",
-		toFixed(totalPrice, 2), toFixed(vatAmount, 2), orderID)
+// records the currency of an order priced in another one than
+// DefaultCurrency, and the exchange rate it was converted at.
+func UpdateOrderCurrency(executor TxExecutor, orderID, currency string, exchangeRate float64) error {
+	_, err := executor.Exec("UPDATE orders SET currency = $1, exchange_rate = $2 WHERE order_id = $3", currency, exchangeRate, orderID)
 	if err != nil {
-		return fmt.Errorf("failed to update order totals: %w", err)
+		return fmt.Errorf("failed to update order currency: %w", err)
 	}
 	return nil
 }
 
 // fetches a complete order by its ID, including its items.
-func GetOrderByID(executor DBExecutor, orderID string) (*OutgoingOrder, error) {
+func GetOrderByID(executor Queryer, orderID string) (*OutgoingOrder, error) {
 	var orderRecord OrderRecord
-	row := executor.QueryRow("SELECT order_id, total_price, vat_amount, created_at FROM orders WHERE order_id = $1", orderID)
-	err := row.Scan(&orderRecord.OrderID, &orderRecord.TotalPrice, &orderRecord.VATAmount, &orderRecord.CreatedAt)
+	var status string
+	row := executor.QueryRow("SELECT order_id, total_price, vat_amount, status, created_at, COALESCE(cancel_reason, ''), cancelled_at, COALESCE(buyer_vat_id, ''), reverse_charge, vat_note, currency, exchange_rate, COALESCE(customer_id, 0) FROM orders WHERE order_id = $1", orderID)
+	err := row.Scan(&orderRecord.OrderID, &orderRecord.TotalPrice, &orderRecord.VATAmount, &status, &orderRecord.CreatedAt,
+		&orderRecord.CancelReason, &orderRecord.CancelledAt, &orderRecord.BuyerVATID, &orderRecord.ReverseCharge, &orderRecord.VATNote,
+		&orderRecord.Currency, &orderRecord.ExchangeRate, &orderRecord.CustomerID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			// Wrapping the error is good practice to provide more context.
@@ -519,187 +508,456 @@ func GetOrderByID(executor DBExecutor, orderID string) (*OutgoingOrder, error) {
 		}
 		return nil, fmt.Errorf("failed to scan order: %w", err)
 	}
+	orderRecord.Status = OrderStatus(status)
 
 	items, err := GetOrderItemsByOrderID(executor, orderID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get order items for order %s: %w", orderID, err)
 	}
+	discounts, err := GetOrderDiscounts(executor, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get discounts for order %s: %w", orderID, err)
+	}
+	addresses, err := GetOrderAddresses(executor, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get addresses for order %s: %w", orderID, err)
+	}
+	shipping, err := GetOrderShipping(executor, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shipping of order %s: %w", orderID, err)
+	}
 
 	outgoingOrder := &OutgoingOrder{
 		OrderID:         orderRecord.OrderID,
+		Status:          orderRecord.Status,
+		CustomerID:      orderRecord.CustomerID,
+		Currency:        orderRecord.Currency,
+		ExchangeRate:    orderRecord.ExchangeRate,
 		TotalOrderPrice: orderRecord.TotalPrice,
 		VATAmount:       orderRecord.VATAmount,
+		TotalGross:      orderRecord.TotalPrice.Add(orderRecord.VATAmount),
 		Items:           items,
+		Shipping:        shipping,
+		Discounts:       discounts,
+		BuyerVATID:      orderRecord.BuyerVATID,
+		ReverseCharge:   orderRecord.ReverseCharge,
+		VATNote:         orderRecord.VATNote,
+		ShippingAddress: addresses[AddressShipping],
+		BillingAddress:  addresses[AddressBilling],
+		CancelReason:    orderRecord.CancelReason,
 	}
+	if orderRecord.CancelledAt.Valid {
+		outgoingOrder.CancelledAt = &orderRecord.CancelledAt.Time
+	}
+	if err := outgoingOrder.relabel(); err != nil {
+		return nil, err
+	}
+	outgoingOrder.VATBreakdown = vatBreakdown(outgoingOrder.Items, outgoingOrder.Shipping)
 	return outgoingOrder, nil
 }
 
+// relabels the amounts of an order read back from the database, which come
+// back in DefaultCurrency, with the currency of the order.
+func (o *OutgoingOrder) relabel() error {
+	amounts := []*Money{&o.TotalOrderPrice, &o.VATAmount, &o.TotalGross}
+	for i := range o.Items {
+		item := &o.Items[i]
+		amounts = append(amounts, &item.Price, &item.ItemVAT)
+		if item.LineNet != nil {
+			amounts = append(amounts, item.LineNet, item.LineGross)
+		}
+	}
+	if o.Shipping != nil {
+		amounts = append(amounts, &o.Shipping.Price, &o.Shipping.VAT, &o.Shipping.Net, &o.Shipping.Gross)
+	}
+	for i := range o.Discounts {
+		amounts = append(amounts, &o.Discounts[i].Amount)
+	}
+	for _, m := range amounts {
+		relabeled, err := m.Relabel(o.Currency)
+		if err != nil {
+			return fmt.Errorf("failed to read amount of order %s: %w", o.OrderID, err)
+		}
+		*m = relabeled
+	}
+	return nil
+}
+
 // --- Order Item Database Functions ---
 
 // inserts a new order item record into the 'order_items' table.
 func InsertOrderItem(executor TxExecutor, item *OrderItemRecord) (int, error) {
 	var itemID int
 	sqlStatement := `
-	INSERT INTO order_items (order_id, product_id, quantity, unit_price, item_vat)
-	VALUES ($1, $2, $3, $4, $5)
+	INSERT INTO order_items (order_id, product_id, quantity, unit_price, item_vat, vat_rate, tax_rule_id, price_includes_vat, line_net, line_gross)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	RETURNING item_id;`
 
-	err := executor.QueryRow(sqlStatement, item.OrderID, item.ProductID, item.Quantity, item.UnitPrice, item.ItemVAT).Scan(&itemID)
+	err := executor.QueryRow(sqlStatement, item.OrderID, item.ProductID, item.Quantity, item.UnitPrice, item.ItemVAT,
+		item.VATRate, nullInt(item.TaxRuleID), item.PriceIncludesVAT, item.LineNet, item.LineGross).Scan(&itemID)
 	if err != nil {
 		return 0, fmt.Errorf("failed to insert order item: %w", err)
 	}
 	return itemID, nil
 }
 
-// GetOrderItemsByOrderID fetches all items for a given order ID.
-func GetOrderItemsByOrderID(executor DBExecutor, orderID string) ([]OutgoingOrderItem, error) {
-	rows, err := executor.Query("SELECT product_id, quantity, unit_price, item_vat FROM order_items WHERE order_id = $1", orderID)
+// records the warehouses an order item ships from.
+func InsertOrderItemAllocations(executor TxExecutor, item *OrderItemRecord) error {
+	for _, a := range item.Allocations {
+		_, err := executor.Exec("INSERT INTO order_item_allocations (item_id, order_id, warehouse_id, quantity) VALUES ($1, $2, $3, $4)",
+			item.ItemID, item.OrderID, a.WarehouseID, a.Quantity)
+		if err != nil {
+			return fmt.Errorf("failed to insert order item allocation: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetOrderItemsByOrderID fetches all items for a given order ID, with the
+// warehouses they ship from.
+func GetOrderItemsByOrderID(executor Queryer, orderID string) ([]OutgoingOrderItem, error) {
+	rows, err := executor.Query("SELECT item_id, product_id, quantity, unit_price, item_vat, vat_rate, COALESCE(tax_rule_id, 0), price_includes_vat, line_net, line_gross FROM order_items WHERE order_id = $1 ORDER BY item_id", orderID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query order items: %w", err)
 	}
 	defer rows.Close()
 
 	var items []OutgoingOrderItem
+	itemIndex := make(map[int]int)
 	for rows.Next() {
+		var itemID int
 		var item OutgoingOrderItem
-		if err := rows.Scan(&item.ProductID, &item.Quantity, &item.Price, &item.ItemVAT); err != nil {
+		var rate sql.NullFloat64
+		var lineNet, lineGross NullMoney
+		if err := rows.Scan(&itemID, &item.ProductID, &item.Quantity, &item.Price, &item.ItemVAT, &rate, &item.TaxRuleID,
+			&item.PriceIncludesVAT, &lineNet, &lineGross); err != nil {
 			return nil, fmt.Errorf("failed to scan order item row: %w", err)
 		}
+		if rate.Valid {
+			item.VATRate = &rate.Float64
+		}
+		if lineNet.Valid && lineGross.Valid {
+			item.LineNet, item.LineGross = &lineNet.Money, &lineGross.Money
+		}
+		itemIndex[itemID] = len(items)
 		items = append(items, item)
 	}
-
 	if err = rows.Err(); err != nil {
 		return nil, fmt.Errorf("error during order items iteration: %w", err)
 	}
+	rows.Close()
+
+	allocRows, err := executor.Query("SELECT item_id, warehouse_id, quantity FROM order_item_allocations WHERE order_id = $1 ORDER BY item_id, warehouse_id", orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query order item allocations: %w", err)
+	}
+	defer allocRows.Close()
+	for allocRows.Next() {
+		var itemID int
+		var a Allocation
+		if err := allocRows.Scan(&itemID, &a.WarehouseID, &a.Quantity); err != nil {
+			return nil, fmt.Errorf("failed to scan order item allocation row: %w", err)
+		}
+		if i, ok := itemIndex[itemID]; ok {
+			a.ProductID = items[i].ProductID
+			items[i].Allocations = append(items[i].Allocations, a)
+		}
+	}
+	if err = allocRows.Err(); err != nil {
+		return nil, fmt.Errorf("error during order item allocations iteration: %w", err)
+	}
 	return items, nil
 }
 
+// --- Order Placement ---
+
+// CreateOrder places an order inside tx: it prices the items with PriceOrder,
+// redeems the coupons, records the order and its items and reserves their
+// stock. It is shared by POST /order and the checkout of carts. Failures are
+// returned as the API errors sent to the client.
+func CreateOrder(tx TxExecutor, incomingOrder *IncomingOrder, now time.Time) (*OutgoingOrder, error) {
+	if incomingOrder.CustomerID != 0 {
+		if _, err := GetCustomerByID(tx, incomingOrder.CustomerID); err != nil {
+			return nil, customerError(err, incomingOrder.CustomerID)
+		}
+	}
+
+	orderID := uuid.New().String()
+	orderRecord := &OrderRecord{
+		OrderID:    orderID,
+		TotalPrice: NewMoney(0, DefaultCurrency),
+		VATAmount:  NewMoney(0, DefaultCurrency),
+		Status:     StatusPending,
+		CreatedAt:  now,
+	}
+	if err := InsertOrder(tx, orderRecord); err != nil {
+		return nil, err
+	}
+
+	priced, err := PriceOrder(tx, incomingOrder, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range priced.Discounts {
+		if err := RedeemCoupon(tx, d.Code); err != nil {
+			return nil, couponError(err, d.Code)
+		}
+	}
+	if err := InsertOrderDiscounts(tx, orderID, priced.Discounts); err != nil {
+		return nil, err
+	}
+	if priced.BuyerVATID != "" {
+		if err := UpdateOrderBuyer(tx, orderID, priced.BuyerVATID, priced.ReverseCharge, priced.VATNote); err != nil {
+			return nil, err
+		}
+	}
+	if incomingOrder.CustomerID != 0 {
+		if err := UpdateOrderCustomer(tx, orderID, incomingOrder.CustomerID); err != nil {
+			return nil, err
+		}
+	}
+	addresses := map[AddressKind]*Address{AddressShipping: incomingOrder.ShippingAddress, AddressBilling: incomingOrder.BillingAddress}
+	for _, kind := range []AddressKind{AddressShipping, AddressBilling} {
+		if addresses[kind] == nil {
+			continue
+		}
+		snapshot := addresses[kind].normalized()
+		if err := InsertOrderAddress(tx, orderID, kind, &snapshot); err != nil {
+			return nil, err
+		}
+		addresses[kind] = &snapshot
+	}
+	if priced.Currency != DefaultCurrency {
+		if err := UpdateOrderCurrency(tx, orderID, priced.Currency, priced.ExchangeRate); err != nil {
+			return nil, err
+		}
+	}
+	outgoingItems, shipping := priced.outgoingItems(), priced.shippingLine()
+	if shipping != nil {
+		if err := InsertOrderShipping(tx, orderID, shipping); err != nil {
+			return nil, err
+		}
+	}
+	itemRecords := make([]*OrderItemRecord, 0, len(priced.Items))
+	for _, line := range priced.Items {
+		orderItemRecord := &OrderItemRecord{
+			OrderID:   orderID,
+			ProductID: line.ProductID,
+			Quantity:  line.Quantity,
+			UnitPrice: line.UnitPrice,
+			ItemVAT:   line.ItemVAT,
+			VATRate:   line.VATRate,
+			TaxRuleID: line.TaxRuleID,
+
+			PriceIncludesVAT: line.PriceIncludesVAT,
+			LineNet:          line.Net,
+			LineGross:        line.Gross,
+		}
+		if orderItemRecord.ItemID, err = InsertOrderItem(tx, orderItemRecord); err != nil {
+			return nil, err
+		}
+		itemRecords = append(itemRecords, orderItemRecord)
+	}
+
+	// the same product may appear on several lines
+	quantities := make(map[int]int)
+	for _, item := range incomingOrder.Items {
+		quantities[item.ProductID] += item.Quantity
+	}
+	allocations, err := ReserveStock(tx, orderID, quantities, DefaultAllocationStrategy, incomingOrder.ShipTo, now)
+	if err != nil {
+		return nil, stockError(err)
+	}
+	splitAllocations(itemRecords, allocations)
+	for i, item := range itemRecords {
+		if err := InsertOrderItemAllocations(tx, item); err != nil {
+			return nil, err
+		}
+		outgoingItems[i].Allocations = item.Allocations
+	}
+
+	if err := UpdateOrderTotals(tx, orderID, priced.Total, priced.VAT); err != nil {
+		return nil, err
+	}
+
+	return &OutgoingOrder{
+		OrderID:         orderID,
+		Status:          orderRecord.Status,
+		CustomerID:      incomingOrder.CustomerID,
+		Currency:        priced.Currency,
+		ExchangeRate:    priced.ExchangeRate,
+		TotalOrderPrice: priced.Total,
+		VATAmount:       priced.VAT,
+		TotalGross:      priced.Gross,
+		VATBreakdown:    vatBreakdown(outgoingItems, shipping),
+		Items:           outgoingItems,
+		Shipping:        shipping,
+		Discounts:       priced.Discounts,
+		BuyerVATID:      priced.BuyerVATID,
+		ReverseCharge:   priced.ReverseCharge,
+		VATNote:         priced.VATNote,
+		ShippingAddress: addresses[AddressShipping],
+		BillingAddress:  addresses[AddressBilling],
+	}, nil
+}
+
 // --- HTTP Handlers ---
 
-// returns an http.HandlerFunc that uses the provided DBExecutor. for manual tests
-func getProductsHandler(executor DBExecutor) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		products, err := GetAllProducts(executor)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to retrieve products: %v", err), http.StatusInternalServerError)
-			return
+// the most units of a product one order or cart line may hold, which keeps
+// totals and weights well within range.
+const maxItemQuantity = 10000
+
+// checks the shape of an order request before anything is looked up.
+func validateIncomingOrder(order *IncomingOrder) []FieldError {
+	if len(order.Items) == 0 {
+		return []FieldError{{Field: "items", Message: "Order must contain at least one item"}}
+	}
+	var fields []FieldError
+	for i, item := range order.Items {
+		if item.ProductID <= 0 {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("items[%d].product_id", i), Message: "must be a positive integer"})
 		}
-		publicProducts := []Product{}
-		for _, p := range products {
-			publicProducts = append(publicProducts, Product{
-				ID:      p.ID,
-				Name:    p.Name,
-				Price:   p.Price,
-				VATRate: p.VATRate,
-			})
+		if item.Quantity <= 0 {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("items[%d].quantity", i), Message: fmt.Sprintf("Quantity for product %d must be positive", item.ProductID)})
+		} else if item.Quantity > maxItemQuantity {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("items[%d].quantity", i), Message: fmt.Sprintf("must be at most %d", maxItemQuantity)})
 		}
-		if publicProducts == nil {
-			publicProducts = []Product{}
+	}
+	if order.ShipTo != nil {
+		fields = append(fields, order.ShipTo.validate("ship_to")...)
+	}
+	if order.Country != "" && !countryPattern.MatchString(normalizeCountry(order.Country)) {
+		fields = append(fields, FieldError{Field: "country", Message: "must be an ISO 3166-1 alpha-2 code"})
+	}
+	if order.ShippingAddress != nil {
+		fields = append(fields, order.ShippingAddress.validate("shipping_address")...)
+		if order.Country != "" && normalizeCountry(order.Country) != normalizeCountry(order.ShippingAddress.Country) {
+			fields = append(fields, FieldError{Field: "country", Message: "does not match shipping_address.country"})
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(publicProducts)
 	}
+	if order.BillingAddress != nil {
+		fields = append(fields, order.BillingAddress.validate("billing_address")...)
+	}
+	if order.CustomerID < 0 {
+		fields = append(fields, FieldError{Field: "customer_id", Message: "must be a positive integer"})
+	}
+	if order.Currency != "" && !currencyPattern.MatchString(normalizeCurrency(order.Currency)) {
+		fields = append(fields, FieldError{Field: "currency", Message: "must be an ISO 4217 code"})
+	}
+	if order.VATID != "" {
+		if _, err := ParseVATID(order.VATID); err != nil {
+			fields = append(fields, FieldError{Field: "vat_id", Message: err.Error()})
+		}
+	}
+	seen := make(map[string]bool)
+	for i, code := range order.Coupons {
+		code = normalizeCouponCode(code)
+		switch {
+		case code == "":
+			fields = append(fields, FieldError{Field: fmt.Sprintf("coupons[%d]", i), Message: "must not be empty"})
+		case seen[code]:
+			fields = append(fields, FieldError{Field: fmt.Sprintf("coupons[%d]", i), Message: fmt.Sprintf("coupon %s is given twice", code)})
+		}
+		seen[code] = true
+	}
+	return fields
 }
 
 // returns an http.HandlerFunc that uses the provided DBExecutor.
 func createOrderHandler(executor DBExecutor) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var incomingOrder IncomingOrder
-		if err := json.NewDecoder(r.Body).Decode(&incomingOrder); err != nil {
-			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
 			return
 		}
 
-		if len(incomingOrder.Items) == 0 {
-			http.Error(w, "Order must contain at least one item", http.StatusBadRequest)
+		// A retried request carrying the same Idempotency-Key gets the original response.
+		idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+		var fingerprint string
+		if idempotencyKey != "" {
+			if len(idempotencyKey) > maxIdempotencyKeyLength {
+				writeError(w, r, ErrBadRequest("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength))
+				return
+			}
+			fingerprint = requestFingerprint(r.Method, r.URL.Path, body)
+			rec, err := GetIdempotencyRecord(executor, idempotencyKey, time.Now())
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			if rec != nil {
+				answerIdempotentRetry(w, r, rec, fingerprint)
+				return
+			}
+		}
+
+		var incomingOrder IncomingOrder
+		if err := json.Unmarshal(body, &incomingOrder); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		if fields := validateIncomingOrder(&incomingOrder); len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
 			return
 		}
 
 		tx, err := executor.Begin()
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to begin transaction: %v", err), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		defer tx.Rollback() // Rollback is a safeguard
 
-		orderID := uuid.New().String()
-		var totalOrderPrice float64
-		var vatAmount float64
-		outgoingItems := []OutgoingOrderItem{}
-
-		orderRecord := &OrderRecord{
-			OrderID:    orderID,
-			TotalPrice: 0.0,
-			VATAmount:  0.0,
-			CreatedAt:  time.Now(),
+		now := time.Now()
+		outgoingOrder, err := CreateOrder(tx, &incomingOrder, now)
+		if err != nil {
+			writeError(w, r, err)
+			return
 		}
-		if err := InsertOrder(tx, orderRecord); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to insert order: %v", err), http.StatusInternalServerError)
+		responseBody, err := json.Marshal(outgoingOrder)
+		if err != nil {
+			writeError(w, r, err)
 			return
 		}
-
-		for _, item := range incomingOrder.Items {
-			product, err := GetProductByID(tx, item.ProductID)
-			if err != nil {
-				if errors.Is(err, sql.ErrNoRows) {
-					http.Error(w, fmt.Sprintf("Product with ID %d not found", item.ProductID), http.StatusNotFound)
-				} else {
-					http.Error(w, fmt.Sprintf("Database error fetching product %d: %v", item.ProductID, err), http.StatusInternalServerError)
-				}
-				return
+		responseBody = append(responseBody, '\n')
+
+		if idempotencyKey != "" {
+			// stored in the order's transaction, so the key exists if and only if the order does
+			rec := &IdempotencyRecord{
+				Key:          idempotencyKey,
+				Fingerprint:  fingerprint,
+				StatusCode:   http.StatusCreated,
+				ResponseBody: responseBody,
+				CreatedAt:    now,
+				ExpiresAt:    now.Add(IdempotencyTTL),
 			}
-
-			if item.Quantity <= 0 {
-				http.Error(w, fmt.Sprintf("Quantity for product %d must be positive", item.ProductID), http.StatusBadRequest)
+			saved, err := SaveIdempotencyRecord(tx, rec)
+			if err != nil {
+				writeError(w, r, err)
 				return
 			}
-
-			itemTotalPrice := product.Price * float64(item.Quantity)
-			itemVAT := product.Price * product.VATRate
-
-			totalOrderPrice += itemTotalPrice
-			vatAmount += itemVAT * float64(item.Quantity)
-
-			outgoingItems = append(outgoingItems, OutgoingOrderItem{
-				ProductID: item.ProductID,
-				Quantity:  item.Quantity,
-				Price:     product.Price,
-				ItemVAT:   toFixed(itemVAT, 2),
-			})
-
-			orderItemRecord := &OrderItemRecord{
-				OrderID:   orderID,
-				ProductID: item.ProductID,
-				Quantity:  item.Quantity,
-				UnitPrice: product.Price,
-				ItemVAT:   toFixed(itemVAT, 2),
-			}
-			if _, err := InsertOrderItem(tx, orderItemRecord); err != nil {
-				http.Error(w, fmt.Sprintf("Failed to insert order item: %v", err), http.StatusInternalServerError)
+			if !saved {
+				// a concurrent request with the same key committed first: drop this order
+				tx.Rollback()
+				existing, err := GetIdempotencyRecord(executor, idempotencyKey, time.Now())
+				if err != nil || existing == nil {
+					writeError(w, r, ErrConflict(CodeConflict, "A request with this Idempotency-Key is already being processed"))
+					return
+				}
+				answerIdempotentRetry(w, r, existing, fingerprint)
 				return
 			}
 		}
 
-		if err := UpdateOrderTotals(tx, orderID, totalOrderPrice, vatAmount); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to update order totals: %v", err), http.StatusInternalServerError)
-			return
-		}
-
 		if err := tx.Commit(); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to commit transaction: %v", err), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 
-		outgoingOrder := OutgoingOrder{
-			OrderID:         orderID,
-			TotalOrderPrice: toFixed(totalOrderPrice, 2),
-			VATAmount:       toFixed(vatAmount, 2),
-			Items:           outgoingItems,
-		}
-
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(outgoingOrder)
+		w.Write(responseBody)
 	}
 }
 
@@ -711,11 +969,7 @@ func getOrderHandler(executor DBExecutor) http.HandlerFunc {
 
 		order, err := GetOrderByID(executor, orderID)
 		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				http.Error(w, "Order not found", http.StatusNotFound)
-			} else {
-				http.Error(w, fmt.Sprintf("Failed to retrieve order: %v", err), http.StatusInternalServerError)
-			}
+			writeError(w, r, orderError(err))
 			return
 		}
 
@@ -723,13 +977,3 @@ func getOrderHandler(executor DBExecutor) http.HandlerFunc {
 		json.NewEncoder(w).Encode(order)
 	}
 }
-
-// float helpers for currency formatting
-func round(num float64) int {
-	return int(num + math.Copysign(0.5, num))
-}
-
-func toFixed(num float64, precision int) float64 {
-	output := math.Pow(10, float64(precision))
-	return float64(round(num*output)) / output
-}
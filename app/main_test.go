@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/gorilla/mux"
@@ -113,39 +114,91 @@ func TestCreateOrderHandler_Success(t *testing.T) {
 
 	mockResult := new(MockResult)
 	mockResult.On("RowsAffected").Return(int64(1), nil)
-	mockTx.On("Exec", "INSERT INTO orders (order_id, total_price, vat_amount, created_at) VALUES ($1, $2, $3, $4)", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(mockResult, nil).Once()
+	mockTx.On("Exec", "INSERT INTO orders (order_id, total_price, vat_amount, status, created_at) VALUES ($1, $2, $3, $4, $5)", mock.Anything, mock.Anything, mock.Anything, "pending", mock.Anything).Return(mockResult, nil).Once()
+	mockTx.On("Exec", "INSERT INTO order_status_history (order_id, from_status, to_status, note, changed_at) VALUES ($1, $2, $3, $4, $5)", mock.Anything, "", "pending", "", mock.Anything).Return(mockResult, nil).Once()
+
+	// no tax rules: the products' own rates apply
+	mockTaxRules := &MockRows{}
+	mockTaxRules.On("Next").Return(false)
+	mockTaxRules.On("Close").Return(nil)
+	mockTaxRules.On("Err").Return(nil)
+	mockTx.On("Query", mock.MatchedBy(func(q string) bool { return strings.HasPrefix(q, "SELECT id, tax_category") }), "IT", mock.Anything).Return(mockTaxRules, nil).Once()
 
 	mockRow1 := &MockRow{}
-	mockRow1.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+	mockRow1.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
 		*(args.Get(0).(*int)) = 1
 		*(args.Get(1).(*string)) = "Laptop Pro"
-		*(args.Get(2).(*float64)) = 1200.00
+		*(args.Get(2).(*Money)) = MustParseMoney("1200.00", DefaultCurrency)
 		*(args.Get(3).(*float64)) = 0.22
 	}).Return(nil)
-	mockTx.On("QueryRow", "SELECT id, name, price, vat_rate FROM products WHERE id = $1", 1).Return(mockRow1)
+	mockTx.On("QueryRow", "SELECT id, name, price, vat_rate, category, tax_category, price_mode, weight_grams, length_mm, width_mm, height_mm FROM products WHERE id = $1", 1).Return(mockRow1)
 
 	// Mock GetProductByID for the second product.
 	mockRow2 := &MockRow{}
-	mockRow2.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+	mockRow2.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
 		*(args.Get(0).(*int)) = 2
 		*(args.Get(1).(*string)) = "Keyboard"
-		*(args.Get(2).(*float64)) = 150.00
+		*(args.Get(2).(*Money)) = MustParseMoney("150.00", DefaultCurrency)
 		*(args.Get(3).(*float64)) = 0.22
 	}).Return(nil)
-	mockTx.On("QueryRow", "SELECT id, name, price, vat_rate FROM products WHERE id = $1", 2).Return(mockRow2)
+	mockTx.On("QueryRow", "SELECT id, name, price, vat_rate, category, tax_category, price_mode, weight_grams, length_mm, width_mm, height_mm FROM products WHERE id = $1", 2).Return(mockRow2)
 
 	mockItemRow := &MockRow{}
 	mockItemRow.On("Scan", mock.Anything).Run(func(args mock.Arguments) {
 		*(args.Get(0).(*int)) = 1 // Return some item ID
 	}).Return(nil)
 	insertItemSQL := `
-	INSERT INTO order_items (order_id, product_id, quantity, unit_price, item_vat)
-	VALUES ($1, $2, $3, $4, $5)
+	INSERT INTO order_items (order_id, product_id, quantity, unit_price, item_vat, vat_rate, tax_rule_id, price_includes_vat, line_net, line_gross)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	RETURNING item_id;`
-	mockTx.On("QueryRow", insertItemSQL, mock.Anything, 1, 1, 1200.00, 264.0).Return(mockItemRow).Once()
-	mockTx.On("QueryRow", insertItemSQL, mock.Anything, 2, 2, 150.00, 66.0).Return(mockItemRow).Once()
+	mockTx.On("QueryRow", insertItemSQL, mock.Anything, 1, 1, MustParseMoney("1200.00", DefaultCurrency), MustParseMoney("264.00", DefaultCurrency), 0.22, sql.NullInt64{},
+		false, MustParseMoney("1200.00", DefaultCurrency), MustParseMoney("1464.00", DefaultCurrency)).Return(mockItemRow).Once()
+	mockTx.On("QueryRow", insertItemSQL, mock.Anything, 2, 2, MustParseMoney("150.00", DefaultCurrency), MustParseMoney("66.00", DefaultCurrency), 0.22, sql.NullInt64{},
+		false, MustParseMoney("300.00", DefaultCurrency), MustParseMoney("366.00", DefaultCurrency)).Return(mockItemRow).Once()
+
+	// stock reservation: both products have 10 units, all in the main warehouse
+	mockWarehouses := &MockRows{}
+	mockWarehouses.On("Next").Return(true).Once()
+	mockWarehouses.On("Next").Return(false)
+	mockWarehouses.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*(args.Get(0).(*int)) = 1
+		*(args.Get(1).(*string)) = "MAIN"
+		*(args.Get(6).(*Money)) = MustParseMoney("0", DefaultCurrency)
+		*(args.Get(7).(*bool)) = true
+	}).Return(nil)
+	mockWarehouses.On("Close").Return(nil)
+	mockWarehouses.On("Err").Return(nil)
+	mockTx.On("Query", mock.MatchedBy(func(q string) bool { return strings.HasPrefix(q, "SELECT id, code, name") }), true).Return(mockWarehouses, nil).Once()
 
-	mockTx.On("Exec", "UPDATE orders SET total_price = $1, vat_amount = $2 WHERE order_id = $3", 1500.00, 330.00, mock.Anything).Return(mockResult, nil).Once()
+	mockStockRow := &MockRow{}
+	mockStockRow.On("Scan", mock.Anything).Run(func(args mock.Arguments) {
+		*(args.Get(0).(*int)) = 10
+	}).Return(nil)
+	warehouseStockSQL := "SELECT warehouse_id, stock FROM warehouse_stock WHERE product_id = $1 ORDER BY warehouse_id FOR UPDATE"
+	for _, productID := range []int{1, 2} {
+		mockTx.On("QueryRow", "SELECT stock FROM products WHERE id = $1 FOR UPDATE", productID).Return(mockStockRow).Once()
+
+		mockLevels := &MockRows{}
+		mockLevels.On("Next").Return(true).Once()
+		mockLevels.On("Next").Return(false)
+		mockLevels.On("Scan", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			*(args.Get(0).(*int)) = 1
+			*(args.Get(1).(*int)) = 10
+		}).Return(nil)
+		mockLevels.On("Close").Return(nil)
+		mockLevels.On("Err").Return(nil)
+		mockTx.On("Query", warehouseStockSQL, productID).Return(mockLevels, nil).Once()
+	}
+	mockTx.On("Exec", "UPDATE warehouse_stock SET stock = $1 WHERE warehouse_id = $2 AND product_id = $3", 9, 1, 1).Return(mockResult, nil).Once()
+	mockTx.On("Exec", "UPDATE warehouse_stock SET stock = $1 WHERE warehouse_id = $2 AND product_id = $3", 8, 1, 2).Return(mockResult, nil).Once()
+	mockTx.On("Exec", "UPDATE products SET stock = $1 WHERE id = $2", 9, 1).Return(mockResult, nil).Once()
+	mockTx.On("Exec", "UPDATE products SET stock = $1 WHERE id = $2", 8, 2).Return(mockResult, nil).Once()
+	mockTx.On("Exec", mock.MatchedBy(func(q string) bool { return strings.HasPrefix(q, "INSERT INTO stock_movements") }),
+		mock.Anything, 1, "order", mock.Anything, mock.Anything, mock.Anything, "", "", mock.Anything).Return(mockResult, nil).Twice()
+	mockTx.On("Exec", "INSERT INTO order_item_allocations (item_id, order_id, warehouse_id, quantity) VALUES ($1, $2, $3, $4)",
+		1, mock.Anything, 1, mock.Anything).Return(mockResult, nil).Twice()
+
+	mockTx.On("Exec", "UPDATE orders SET total_price = $1, vat_amount = $2 WHERE order_id = $3", MustParseMoney("1500.00", DefaultCurrency), MustParseMoney("330.00", DefaultCurrency), mock.Anything).Return(mockResult, nil).Once()
 
 	orderPayload := IncomingOrder{
 		Items: []IncomingOrderItem{
@@ -164,9 +217,11 @@ func TestCreateOrderHandler_Success(t *testing.T) {
 	err := json.NewDecoder(rr.Body).Decode(&responseOrder)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, responseOrder.OrderID)
-	assert.InDelta(t, 1500.00, responseOrder.TotalOrderPrice, 0.001)
-	assert.InDelta(t, 330.00, responseOrder.VATAmount, 0.001)
+	assert.Equal(t, MustParseMoney("1500.00", DefaultCurrency), responseOrder.TotalOrderPrice)
+	assert.Equal(t, MustParseMoney("330.00", DefaultCurrency), responseOrder.VATAmount)
+	assert.Equal(t, StatusPending, responseOrder.Status)
 	assert.Len(t, responseOrder.Items, 2)
+	assert.Equal(t, []Allocation{{WarehouseID: 1, Quantity: 2}}, responseOrder.Items[1].Allocations)
 
 	mockDB.AssertExpectations(t)
 	mockTx.AssertExpectations(t)
@@ -177,7 +232,7 @@ func TestGetProductsHandler_Success(t *testing.T) {
 	mockRows := &MockRows{}
 
 	// This test will now use the testify/mock objects from main.go
-	mockDB.On("Query", "SELECT id, name, price, vat_rate FROM products").Return(mockRows, nil)
+	mockDB.On("Query", "SELECT id, name, price, vat_rate, category, tax_category, price_mode, weight_grams, length_mm, width_mm, height_mm FROM products").Return(mockRows, nil)
 	mockRows.On("Next").Return(false) // No rows
 	mockRows.On("Close").Return(nil)
 	mockRows.On("Err").Return(nil)
@@ -198,9 +253,9 @@ func TestGetOrderHandler_NotFound(t *testing.T) {
 	mockDB := &MockDB{}
 	mockRow := &MockRow{}
 
-	mockRow.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(sql.ErrNoRows)
+	mockRow.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(sql.ErrNoRows)
 
-	mockDB.On("QueryRow", "SELECT order_id, total_price, vat_amount, created_at FROM orders WHERE order_id = $1", "nonexistent-order").Return(mockRow)
+	mockDB.On("QueryRow", "SELECT order_id, total_price, vat_amount, status, created_at, COALESCE(cancel_reason, ''), cancelled_at, COALESCE(buyer_vat_id, ''), reverse_charge, vat_note, currency, exchange_rate, COALESCE(customer_id, 0) FROM orders WHERE order_id = $1", "nonexistent-order").Return(mockRow)
 
 	req := httptest.NewRequest("GET", "/orders/nonexistent-order", nil)
 	rr := httptest.NewRecorder()
@@ -225,11 +280,17 @@ func TestCreateOrderHandler_ProductNotFound(t *testing.T) {
 
 	mockResult := new(MockResult)
 	mockResult.On("RowsAffected").Return(int64(1), nil)
-	mockTx.On("Exec", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(mockResult, nil).Once()
+	mockTx.On("Exec", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(mockResult, nil).Twice()
+
+	mockTaxRules := &MockRows{}
+	mockTaxRules.On("Next").Return(false)
+	mockTaxRules.On("Close").Return(nil)
+	mockTaxRules.On("Err").Return(nil)
+	mockTx.On("Query", mock.MatchedBy(func(q string) bool { return strings.HasPrefix(q, "SELECT id, tax_category") }), "IT", mock.Anything).Return(mockTaxRules, nil).Once()
 
 	mockRow := new(MockRow)
-	mockRow.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(sql.ErrNoRows)
-	mockTx.On("QueryRow", "SELECT id, name, price, vat_rate FROM products WHERE id = $1", 999).Return(mockRow)
+	mockRow.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(sql.ErrNoRows)
+	mockTx.On("QueryRow", "SELECT id, name, price, vat_rate, category, tax_category, price_mode, weight_grams, length_mm, width_mm, height_mm FROM products WHERE id = $1", 999).Return(mockRow)
 
 	// not existing product
 	orderPayload := IncomingOrder{
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"cmp"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Schema Migrations ---
+//
+// Migrations are embedded SQL scripts named NNNN_name.up.sql and
+// NNNN_name.down.sql. The applied versions are recorded in schema_migrations;
+// every run holds a transaction-level advisory lock, so instances starting at
+// the same time apply each migration once.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the pg_advisory_xact_lock key serializing migration runs.
+const migrationLockKey int64 = 0x6d79746573746d67 // "mytestmg"
+
+const createMigrationsTableSQL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is one versioned schema change and the script undoing it.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus reports whether a migration has been applied, and when.
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+}
+
+// reads the migrations at the root of fsys, sorted by version. Every version
+// needs both an up and a down script.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		m := migrationFileName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_create_table.up.sql", entry.Name())
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version", entry.Name())
+		}
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if strings.TrimSpace(mig.Up) == "" || strings.TrimSpace(mig.Down) == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down script", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return cmp.Compare(a.Version, b.Version) })
+	return migrations, nil
+}
+
+// the migrations shipped with the binary.
+var embeddedMigrations = sync.OnceValues(func() ([]Migration, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return LoadMigrations(sub)
+})
+
+// starts a migration run: takes the advisory lock and makes sure the tracking
+// table exists, then returns the applied versions.
+func beginMigrations(db DBExecutor) (TxExecutor, map[int64]MigrationStatus, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	applied, err := func() (map[int64]MigrationStatus, error) {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockKey); err != nil {
+			return nil, fmt.Errorf("failed to take the migration lock: %w", err)
+		}
+		if _, err := tx.Exec(createMigrationsTableSQL); err != nil {
+			return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+		}
+		rows, err := tx.Query("SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		applied := make(map[int64]MigrationStatus)
+		for rows.Next() {
+			var st MigrationStatus
+			var at time.Time
+			if err := rows.Scan(&st.Version, &st.Name, &at); err != nil {
+				return nil, err
+			}
+			st.AppliedAt = &at
+			applied[st.Version] = st
+		}
+		return applied, rows.Err()
+	}()
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	return tx, applied, nil
+}
+
+// runs a migration script. It is sent whole: Postgres runs the statements of
+// a query without arguments one after the other, and so does the in-memory
+// store.
+func runScript(tx TxExecutor, script string) error {
+	_, err := tx.Exec(script)
+	return err
+}
+
+// applies the pending migrations in version order, all in one transaction, and
+// returns the ones applied.
+func MigrateUp(db DBExecutor, migrations []Migration) ([]Migration, error) {
+	tx, applied, err := beginMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var done []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := runScript(tx, m.Up); err != nil {
+			return nil, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name); err != nil {
+			return nil, err
+		}
+		done = append(done, m)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// reverts the last steps applied migrations, newest first, in one transaction,
+// and returns the ones reverted.
+func MigrateDown(db DBExecutor, migrations []Migration, steps int) ([]Migration, error) {
+	tx, applied, err := beginMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	versions := slices.Sorted(maps.Keys(applied))
+	slices.Reverse(versions)
+	var done []Migration
+	for _, v := range versions[:min(steps, len(versions))] {
+		i := slices.IndexFunc(migrations, func(m Migration) bool { return m.Version == v })
+		if i < 0 {
+			return nil, fmt.Errorf("migration %04d_%s is applied but unknown to this binary", v, applied[v].Name)
+		}
+		m := migrations[i]
+		if err := runScript(tx, m.Down); err != nil {
+			return nil, fmt.Errorf("reverting migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec("DELETE FROM schema_migrations WHERE version = $1", m.Version); err != nil {
+			return nil, err
+		}
+		done = append(done, m)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// lists the known migrations and any applied version unknown to this binary.
+func MigrationStatuses(db DBExecutor, migrations []Migration) ([]MigrationStatus, error) {
+	tx, applied, err := beginMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		st, ok := applied[m.Version]
+		if !ok {
+			st = MigrationStatus{Version: m.Version, Name: m.Name}
+		}
+		statuses = append(statuses, st)
+		delete(applied, m.Version)
+	}
+	for _, st := range applied {
+		statuses = append(statuses, st)
+	}
+	slices.SortFunc(statuses, func(a, b MigrationStatus) int { return cmp.Compare(a.Version, b.Version) })
+	return statuses, tx.Commit()
+}
+
+// runs `mytest migrate up|down [n]|status` with the embedded migrations.
+func runMigrateCommand(db DBExecutor, args []string, out io.Writer) error {
+	migrations, err := embeddedMigrations()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: mytest migrate up|down [n]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: mytest migrate up")
+		}
+		done, err := MigrateUp(db, migrations)
+		if err != nil {
+			return err
+		}
+		for _, m := range done {
+			fmt.Fprintf(out, "applied %04d_%s\n", m.Version, m.Name)
+		}
+		if len(done) == 0 {
+			fmt.Fprintln(out, "schema is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 2 {
+			return fmt.Errorf("usage: mytest migrate down [n]")
+		}
+		if len(args) == 2 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps <= 0 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		done, err := MigrateDown(db, migrations, steps)
+		if err != nil {
+			return err
+		}
+		for _, m := range done {
+			fmt.Fprintf(out, "reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if len(done) == 0 {
+			fmt.Fprintln(out, "no migrations to revert")
+		}
+	case "status":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: mytest migrate status")
+		}
+		statuses, err := MigrationStatuses(db, migrations)
+		if err != nil {
+			return err
+		}
+		for _, st := range statuses {
+			state := "pending"
+			if st.AppliedAt != nil {
+				state = "applied " + st.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%04d_%s\t%s\n", st.Version, st.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q: use up, down [n] or status", args[0])
+	}
+	return nil
+}
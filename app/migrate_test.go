@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations(fstest.MapFS{
+		"0002_add_sku.up.sql":     {Data: []byte("ALTER TABLE widgets ADD COLUMN sku TEXT;")},
+		"0002_add_sku.down.sql":   {Data: []byte("ALTER TABLE widgets DROP COLUMN sku;")},
+		"0001_widgets.up.sql":     {Data: []byte("CREATE TABLE widgets (id SERIAL PRIMARY KEY);")},
+		"0001_widgets.down.sql":   {Data: []byte("DROP TABLE widgets;")},
+		"README.md":               {Data: []byte("ignored")},
+		"0003_no_down.up.sql.bak": {Data: []byte("ignored")},
+	})
+	require.NoError(t, err)
+	require.Len(t, migrations, 2)
+	assert.Equal(t, int64(1), migrations[0].Version)
+	assert.Equal(t, "widgets", migrations[0].Name)
+	assert.Equal(t, "add_sku", migrations[1].Name)
+
+	_, err = LoadMigrations(fstest.MapFS{"0001_widgets.up.sql": {Data: []byte("SELECT 1")}})
+	assert.ErrorContains(t, err, "needs both an up and a down script")
+	_, err = LoadMigrations(fstest.MapFS{"widgets.up.sql": {Data: []byte("SELECT 1")}})
+	assert.ErrorContains(t, err, "name must look like")
+}
+
+func TestMigrateUpDownStatus(t *testing.T) {
+	db := &InMemoryDB{store: NewInMemoryStore()}
+	// versions after those of the embedded migrations the store starts with
+	migrations, err := LoadMigrations(fstest.MapFS{
+		"0101_widgets.up.sql":   {Data: []byte("CREATE TABLE widgets (id SERIAL PRIMARY KEY, name TEXT NOT NULL);\nINSERT INTO widgets (name) VALUES ('first');")},
+		"0101_widgets.down.sql": {Data: []byte("DROP TABLE widgets;")},
+		"0102_add_sku.up.sql":   {Data: []byte("ALTER TABLE widgets ADD COLUMN sku TEXT NOT NULL DEFAULT 'none';\nCREATE UNIQUE INDEX widgets_sku_idx ON widgets (sku);")},
+		"0102_add_sku.down.sql": {Data: []byte("DROP INDEX widgets_sku_idx;\nALTER TABLE widgets DROP COLUMN sku;")},
+	})
+	require.NoError(t, err)
+
+	done, err := MigrateUp(db, migrations)
+	require.NoError(t, err)
+	assert.Len(t, done, 2)
+	var sku string
+	require.NoError(t, db.QueryRow("SELECT sku FROM widgets WHERE name = 'first'").Scan(&sku))
+	assert.Equal(t, "none", sku)
+	_, err = db.Exec("INSERT INTO widgets (name) VALUES ('second')")
+	assert.ErrorIs(t, err, ErrUniqueViolation, "the unique index applies")
+
+	done, err = MigrateUp(db, migrations)
+	require.NoError(t, err)
+	assert.Empty(t, done)
+
+	done, err = MigrateDown(db, migrations, 1)
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+	assert.Equal(t, "add_sku", done[0].Name)
+	_, err = db.Exec("INSERT INTO widgets (name) VALUES ('second')")
+	assert.NoError(t, err)
+	_, err = db.Query("SELECT sku FROM widgets")
+	assert.ErrorContains(t, err, `column "sku" does not exist`)
+
+	statuses, err := MigrationStatuses(db, migrations)
+	require.NoError(t, err)
+	embedded, err := embeddedMigrations()
+	require.NoError(t, err)
+	require.Len(t, statuses, len(embedded)+2, "the embedded migrations are listed as unknown")
+	widgets, addSKU := statuses[len(statuses)-2], statuses[len(statuses)-1]
+	assert.Equal(t, "widgets", widgets.Name)
+	assert.NotNil(t, widgets.AppliedAt)
+	assert.Nil(t, addSKU.AppliedAt)
+
+	// a failing migration leaves nothing behind
+	broken := append(migrations[:1:1], Migration{Version: 102, Name: "broken", Up: "ALTER TABLE widgets ADD COLUMN code TEXT; SELECT nope FROM widgets;", Down: "SELECT 1"})
+	_, err = MigrateUp(db, broken)
+	assert.ErrorContains(t, err, "migration 0102_broken")
+	_, err = db.Query("SELECT code FROM widgets")
+	assert.ErrorContains(t, err, `column "code" does not exist`)
+}
+
+func TestEmbeddedMigrations_RoundTrip(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	db := &InMemoryDB{store: store}
+	migrations, err := embeddedMigrations()
+	require.NoError(t, err)
+
+	done, err := MigrateDown(db, migrations, len(migrations))
+	require.NoError(t, err)
+	assert.Len(t, done, len(migrations))
+	_, err = db.Query("SELECT id FROM products")
+	assert.ErrorContains(t, err, "does not exist")
+
+	_, err = MigrateUp(db, migrations)
+	require.NoError(t, err)
+	assert.Equal(t, 0, countRows(t, store, "products"))
+}
+
+func TestEmbeddedMigrations_PreMigrationSchema(t *testing.T) {
+	db := &InMemoryDB{store: NewInMemoryStore()}
+	migrations, err := embeddedMigrations()
+	require.NoError(t, err)
+	_, err = MigrateDown(db, migrations, len(migrations))
+	require.NoError(t, err)
+
+	// the tables as the service created them before it had migrations
+	_, err = db.Exec(`CREATE TABLE products (id SERIAL PRIMARY KEY, name TEXT NOT NULL, price NUMERIC(12, 2) NOT NULL, vat_rate NUMERIC(5, 4) NOT NULL);
+CREATE TABLE orders (order_id TEXT PRIMARY KEY, total_price NUMERIC(12, 2) NOT NULL, vat_amount NUMERIC(12, 2) NOT NULL, created_at TIMESTAMPTZ NOT NULL);
+CREATE TABLE order_items (item_id SERIAL PRIMARY KEY, order_id TEXT NOT NULL REFERENCES orders (order_id), product_id INTEGER NOT NULL, quantity INTEGER NOT NULL, unit_price NUMERIC(12, 2) NOT NULL, item_vat NUMERIC(12, 2) NOT NULL);
+INSERT INTO orders (order_id, total_price, vat_amount, created_at) VALUES ('legacy', 10, 2.2, now());`)
+	require.NoError(t, err)
+
+	done, err := MigrateUp(db, migrations)
+	require.NoError(t, err)
+	assert.Len(t, done, len(migrations))
+	var status string
+	require.NoError(t, db.QueryRow("SELECT status FROM orders WHERE order_id = 'legacy'").Scan(&status))
+	assert.Equal(t, "pending", status)
+}
+
+func TestRunMigrateCommand(t *testing.T) {
+	db := &InMemoryDB{store: NewInMemoryStore()}
+	migrations, err := embeddedMigrations()
+	require.NoError(t, err)
+	last := migrations[len(migrations)-1]
+	var out bytes.Buffer
+
+	require.NoError(t, runMigrateCommand(db, []string{"up"}, &out))
+	assert.Equal(t, "schema is up to date\n", out.String())
+
+	out.Reset()
+	require.NoError(t, runMigrateCommand(db, []string{"down", "1"}, &out))
+	assert.Equal(t, fmt.Sprintf("reverted %04d_%s\n", last.Version, last.Name), out.String())
+
+	out.Reset()
+	require.NoError(t, runMigrateCommand(db, []string{"status"}, &out))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, len(migrations))
+	assert.Regexp(t, `^0001_initial_schema\tapplied \S+$`, lines[0])
+	assert.Equal(t, fmt.Sprintf("%04d_%s\tpending", last.Version, last.Name), lines[len(lines)-1])
+
+	assert.ErrorContains(t, runMigrateCommand(db, []string{"down", "zero"}, &out), "invalid number of steps")
+	assert.ErrorContains(t, runMigrateCommand(db, []string{"sideways"}, &out), "unknown migrate command")
+}
+
+func TestAdvisoryLock_SerializesTransactions(t *testing.T) {
+	db := &InMemoryDB{store: NewInMemoryStore()}
+	first, err := db.Begin()
+	require.NoError(t, err)
+	_, err = first.Exec("SELECT pg_advisory_xact_lock($1)", 42)
+	require.NoError(t, err)
+
+	var free bool
+	require.NoError(t, db.QueryRow("SELECT pg_try_advisory_xact_lock($1)", 42).Scan(&free))
+	assert.False(t, free)
+
+	acquired := make(chan error)
+	go func() {
+		second, err := db.Begin()
+		if err == nil {
+			_, err = second.Exec("SELECT pg_advisory_xact_lock($1)", 42)
+			second.Rollback()
+		}
+		acquired <- err
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("the lock was taken while held by another transaction")
+	case <-time.After(20 * time.Millisecond):
+	}
+	require.NoError(t, first.Commit())
+	assert.NoError(t, <-acquired)
+}
+
+func TestAdvisoryLock_DetectsDeadlock(t *testing.T) {
+	db := &InMemoryDB{store: NewInMemoryStore()}
+	first, err := db.Begin()
+	require.NoError(t, err)
+	second, err := db.Begin()
+	require.NoError(t, err)
+	_, err = first.Exec("SELECT pg_advisory_xact_lock(1)")
+	require.NoError(t, err)
+	_, err = second.Exec("SELECT pg_advisory_xact_lock(2)")
+	require.NoError(t, err)
+
+	blocked := make(chan error)
+	go func() {
+		_, err := first.Exec("SELECT pg_advisory_xact_lock(2)")
+		blocked <- err
+	}()
+	// wait until first is queued behind second
+	require.Eventually(t, func() bool {
+		db.store.lockMu.Lock()
+		defer db.store.lockMu.Unlock()
+		return first.(*InMemoryTx).waiting
+	}, time.Second, time.Millisecond)
+
+	_, err = second.Exec("SELECT pg_advisory_xact_lock(1)")
+	assert.ErrorIs(t, err, ErrDeadlock)
+	require.NoError(t, second.Rollback())
+	assert.NoError(t, <-blocked)
+	require.NoError(t, first.Commit())
+}
@@ -0,0 +1,48 @@
+-- products, orders and their items, and the history of order status changes.
+-- Databases set up before migrations existed already hold products, orders
+-- and order_items, so those are only created when missing and given the
+-- columns they lacked.
+CREATE TABLE IF NOT EXISTS products (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	price NUMERIC(12, 2) NOT NULL,
+	vat_rate NUMERIC(5, 4) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+	order_id TEXT PRIMARY KEY,
+	total_price NUMERIC(12, 2) NOT NULL DEFAULT 0,
+	vat_amount NUMERIC(12, 2) NOT NULL DEFAULT 0,
+	status TEXT NOT NULL DEFAULT 'pending',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	cancel_reason TEXT,
+	cancelled_at TIMESTAMPTZ
+);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'pending';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS cancel_reason TEXT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS orders_created_at_idx ON orders (created_at, order_id);
+
+CREATE TABLE IF NOT EXISTS order_items (
+	item_id SERIAL PRIMARY KEY,
+	order_id TEXT NOT NULL REFERENCES orders (order_id),
+	product_id INTEGER NOT NULL,
+	quantity INTEGER NOT NULL CHECK (quantity > 0),
+	unit_price NUMERIC(12, 2) NOT NULL,
+	item_vat NUMERIC(12, 2) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_items_order_id_idx ON order_items (order_id);
+
+CREATE TABLE order_status_history (
+	id BIGSERIAL PRIMARY KEY,
+	order_id TEXT NOT NULL REFERENCES orders (order_id),
+	from_status TEXT NOT NULL DEFAULT '',
+	to_status TEXT NOT NULL,
+	note TEXT NOT NULL DEFAULT '',
+	changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX order_status_history_order_id_idx ON order_status_history (order_id, changed_at);
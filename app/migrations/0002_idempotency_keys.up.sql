@@ -0,0 +1,11 @@
+-- responses stored for the Idempotency-Key header of POST /order
+CREATE TABLE idempotency_keys (
+	key TEXT PRIMARY KEY,
+	fingerprint TEXT NOT NULL,
+	status_code INTEGER NOT NULL,
+	response_body BYTEA NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
@@ -0,0 +1,17 @@
+-- stock levels, taken by orders and adjusted through /products/{id}/stock, with
+-- every change recorded in stock_movements
+ALTER TABLE products ADD COLUMN stock INTEGER NOT NULL DEFAULT 0 CHECK (stock >= 0);
+
+CREATE TABLE stock_movements (
+	id BIGSERIAL PRIMARY KEY,
+	product_id INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	delta INTEGER NOT NULL,
+	stock_after INTEGER NOT NULL,
+	order_id TEXT REFERENCES orders (order_id),
+	note TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX stock_movements_product_id_idx ON stock_movements (product_id, created_at);
+CREATE INDEX stock_movements_order_id_idx ON stock_movements (order_id);
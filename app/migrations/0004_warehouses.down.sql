@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS order_item_allocations;
+ALTER TABLE stock_movements DROP COLUMN IF EXISTS warehouse_id;
+DROP TABLE IF EXISTS warehouse_stock;
+DROP TABLE IF EXISTS warehouses;
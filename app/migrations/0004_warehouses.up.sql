@@ -0,0 +1,39 @@
+-- warehouses and the stock each holds; products.stock stays the total over
+-- all warehouses. Orders record which warehouses each item is shipped from.
+CREATE TABLE warehouses (
+	id SERIAL PRIMARY KEY,
+	code TEXT NOT NULL UNIQUE,
+	name TEXT NOT NULL,
+	country TEXT NOT NULL DEFAULT '',
+	latitude FLOAT8,
+	longitude FLOAT8,
+	unit_cost NUMERIC(12, 2) NOT NULL DEFAULT 0 CHECK (unit_cost >= 0),
+	active BOOLEAN NOT NULL DEFAULT true,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE warehouse_stock (
+	warehouse_id INTEGER NOT NULL REFERENCES warehouses (id),
+	product_id INTEGER NOT NULL,
+	stock INTEGER NOT NULL DEFAULT 0 CHECK (stock >= 0),
+	PRIMARY KEY (warehouse_id, product_id)
+);
+
+CREATE INDEX warehouse_stock_product_id_idx ON warehouse_stock (product_id);
+
+-- the existing stock moves to the main warehouse
+INSERT INTO warehouses (code, name) VALUES ('MAIN', 'Main warehouse');
+INSERT INTO warehouse_stock (warehouse_id, product_id, stock)
+	SELECT (SELECT id FROM warehouses WHERE code = 'MAIN'), id, stock FROM products WHERE stock > 0;
+
+ALTER TABLE stock_movements ADD COLUMN warehouse_id INTEGER REFERENCES warehouses (id);
+
+CREATE TABLE order_item_allocations (
+	item_id INTEGER NOT NULL REFERENCES order_items (item_id),
+	order_id TEXT NOT NULL REFERENCES orders (order_id),
+	warehouse_id INTEGER NOT NULL REFERENCES warehouses (id),
+	quantity INTEGER NOT NULL CHECK (quantity > 0),
+	PRIMARY KEY (item_id, warehouse_id)
+);
+
+CREATE INDEX order_item_allocations_order_id_idx ON order_item_allocations (order_id);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS stock_movements_cart_id_idx;
+ALTER TABLE stock_movements DROP COLUMN IF EXISTS cart_id;
+DROP TABLE IF EXISTS cart_items;
+DROP TABLE IF EXISTS carts;
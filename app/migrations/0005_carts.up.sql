@@ -0,0 +1,22 @@
+-- server-side carts holding stock until they expire or are checked out; the
+-- stock a cart holds is recorded by stock movements carrying its cart_id
+CREATE TABLE carts (
+	cart_id TEXT PRIMARY KEY,
+	status TEXT NOT NULL DEFAULT 'open',
+	order_id TEXT REFERENCES orders (order_id),
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX carts_status_expires_at_idx ON carts (status, expires_at);
+
+CREATE TABLE cart_items (
+	cart_id TEXT NOT NULL REFERENCES carts (cart_id),
+	product_id INTEGER NOT NULL,
+	quantity INTEGER NOT NULL CHECK (quantity > 0),
+	PRIMARY KEY (cart_id, product_id)
+);
+
+ALTER TABLE stock_movements ADD COLUMN cart_id TEXT REFERENCES carts (cart_id);
+CREATE INDEX stock_movements_cart_id_idx ON stock_movements (cart_id);
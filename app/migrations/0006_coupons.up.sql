@@ -0,0 +1,29 @@
+-- discount coupons, the category products are scoped by, and the discounts
+-- applied to each order
+ALTER TABLE products ADD COLUMN category TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE coupons (
+	code TEXT PRIMARY KEY,
+	kind TEXT NOT NULL,
+	rate NUMERIC(5, 4) NOT NULL DEFAULT 0,
+	amount NUMERIC(12, 2) NOT NULL DEFAULT 0,
+	free_quantity INTEGER NOT NULL DEFAULT 0,
+	min_spend NUMERIC(12, 2) NOT NULL DEFAULT 0,
+	product_id INTEGER,
+	category TEXT NOT NULL DEFAULT '',
+	valid_from TIMESTAMPTZ,
+	valid_until TIMESTAMPTZ,
+	max_uses INTEGER,
+	uses INTEGER NOT NULL DEFAULT 0 CHECK (uses >= 0),
+	active BOOLEAN NOT NULL DEFAULT true,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE order_discounts (
+	order_id TEXT NOT NULL REFERENCES orders (order_id),
+	position INTEGER NOT NULL,
+	coupon_code TEXT NOT NULL REFERENCES coupons (code),
+	kind TEXT NOT NULL,
+	amount NUMERIC(12, 2) NOT NULL,
+	PRIMARY KEY (order_id, position)
+);
@@ -0,0 +1,5 @@
+ALTER TABLE order_items DROP COLUMN IF EXISTS tax_rule_id;
+ALTER TABLE order_items DROP COLUMN IF EXISTS vat_rate;
+DROP INDEX IF EXISTS tax_rules_lookup_idx;
+DROP TABLE IF EXISTS tax_rules;
+ALTER TABLE products DROP COLUMN IF EXISTS tax_category;
@@ -0,0 +1,19 @@
+-- VAT rules by tax category and destination country, and the rate and rule
+-- each order item was priced with; items priced before the rules have neither
+ALTER TABLE products ADD COLUMN tax_category TEXT NOT NULL DEFAULT 'standard';
+
+CREATE TABLE tax_rules (
+	id SERIAL PRIMARY KEY,
+	tax_category TEXT NOT NULL,
+	country TEXT NOT NULL DEFAULT '',
+	rate NUMERIC(5, 4) NOT NULL CHECK (rate >= 0 AND rate <= 1),
+	description TEXT NOT NULL DEFAULT '',
+	valid_from TIMESTAMPTZ NOT NULL,
+	valid_until TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX tax_rules_lookup_idx ON tax_rules (country, tax_category, valid_from);
+
+ALTER TABLE order_items ADD COLUMN vat_rate NUMERIC(5, 4);
+ALTER TABLE order_items ADD COLUMN tax_rule_id INTEGER REFERENCES tax_rules (id);
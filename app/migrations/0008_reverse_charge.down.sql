@@ -0,0 +1,3 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS vat_note;
+ALTER TABLE orders DROP COLUMN IF EXISTS reverse_charge;
+ALTER TABLE orders DROP COLUMN IF EXISTS buyer_vat_id;
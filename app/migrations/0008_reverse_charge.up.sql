@@ -0,0 +1,4 @@
+-- the buyer's VAT number and the reverse charge treatment of B2B orders
+ALTER TABLE orders ADD COLUMN buyer_vat_id TEXT;
+ALTER TABLE orders ADD COLUMN reverse_charge BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE orders ADD COLUMN vat_note TEXT NOT NULL DEFAULT '';
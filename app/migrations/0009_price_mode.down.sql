@@ -0,0 +1,4 @@
+ALTER TABLE order_items DROP COLUMN IF EXISTS line_gross;
+ALTER TABLE order_items DROP COLUMN IF EXISTS line_net;
+ALTER TABLE order_items DROP COLUMN IF EXISTS price_includes_vat;
+ALTER TABLE products DROP COLUMN IF EXISTS price_mode;
@@ -0,0 +1,7 @@
+-- products priced VAT included, and the net and gross total of each order
+-- item; items created before have neither
+ALTER TABLE products ADD COLUMN price_mode TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE order_items ADD COLUMN price_includes_vat BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE order_items ADD COLUMN line_net NUMERIC(12, 2);
+ALTER TABLE order_items ADD COLUMN line_gross NUMERIC(12, 2);
@@ -0,0 +1,13 @@
+-- exchange rates from the catalog currency, and the currency each order is
+-- priced in with the rate it was converted at; orders created before are in
+-- the catalog currency
+CREATE TABLE exchange_rates (
+	currency TEXT NOT NULL,
+	rate NUMERIC(18, 8) NOT NULL CHECK (rate > 0),
+	valid_from TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (currency, valid_from)
+);
+
+ALTER TABLE orders ADD COLUMN currency TEXT NOT NULL DEFAULT 'EUR';
+ALTER TABLE orders ADD COLUMN exchange_rate NUMERIC(18, 8) NOT NULL DEFAULT 1;
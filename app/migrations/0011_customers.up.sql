@@ -0,0 +1,16 @@
+-- customer accounts, soft deleted, and the customer each order belongs to;
+-- active_email holds the email of customers not deleted so that it stays
+-- unique among them and is freed by a deletion
+CREATE TABLE customers (
+	id SERIAL PRIMARY KEY,
+	email TEXT NOT NULL,
+	active_email TEXT UNIQUE,
+	name TEXT NOT NULL,
+	phone TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL,
+	deleted_at TIMESTAMPTZ
+);
+
+ALTER TABLE orders ADD COLUMN customer_id INTEGER REFERENCES customers (id);
+CREATE INDEX orders_customer_idx ON orders (customer_id, created_at);
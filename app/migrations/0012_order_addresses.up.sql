@@ -0,0 +1,16 @@
+-- the shipping and billing addresses of an order, copied when it is placed
+-- and never updated
+CREATE TABLE order_addresses (
+	order_id TEXT NOT NULL REFERENCES orders (order_id),
+	kind TEXT NOT NULL CHECK (kind IN ('shipping', 'billing')),
+	name TEXT NOT NULL,
+	company TEXT NOT NULL DEFAULT '',
+	line1 TEXT NOT NULL,
+	line2 TEXT NOT NULL DEFAULT '',
+	city TEXT NOT NULL,
+	region TEXT NOT NULL DEFAULT '',
+	postal_code TEXT NOT NULL DEFAULT '',
+	country TEXT NOT NULL,
+	phone TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (order_id, kind)
+);
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS order_shipping;
+DROP TABLE IF EXISTS shipping_method_bands;
+DROP TABLE IF EXISTS shipping_methods;
+DROP TABLE IF EXISTS shipping_zone_countries;
+DROP TABLE IF EXISTS shipping_zones;
+ALTER TABLE products DROP COLUMN IF EXISTS height_mm;
+ALTER TABLE products DROP COLUMN IF EXISTS width_mm;
+ALTER TABLE products DROP COLUMN IF EXISTS length_mm;
+ALTER TABLE products DROP COLUMN IF EXISTS weight_grams;
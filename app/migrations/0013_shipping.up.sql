@@ -0,0 +1,56 @@
+-- the shipping weight and packed size of products, the shipping zones with
+-- the countries they cover and the rates of their methods, and the shipping
+-- line of orders
+ALTER TABLE products ADD COLUMN weight_grams INTEGER NOT NULL DEFAULT 0 CHECK (weight_grams >= 0);
+ALTER TABLE products ADD COLUMN length_mm INTEGER NOT NULL DEFAULT 0 CHECK (length_mm >= 0);
+ALTER TABLE products ADD COLUMN width_mm INTEGER NOT NULL DEFAULT 0 CHECK (width_mm >= 0);
+ALTER TABLE products ADD COLUMN height_mm INTEGER NOT NULL DEFAULT 0 CHECK (height_mm >= 0);
+
+CREATE TABLE shipping_zones (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+-- a country belongs to one zone at most; '' stands for the countries of no
+-- other zone
+CREATE TABLE shipping_zone_countries (
+	country TEXT PRIMARY KEY,
+	zone_id INTEGER NOT NULL REFERENCES shipping_zones (id)
+);
+
+CREATE TABLE shipping_methods (
+	zone_id INTEGER NOT NULL REFERENCES shipping_zones (id),
+	code TEXT NOT NULL,
+	name TEXT NOT NULL,
+	kind TEXT NOT NULL CHECK (kind IN ('flat', 'weight')),
+	price NUMERIC(12, 2) NOT NULL DEFAULT 0 CHECK (price >= 0),
+	free_over NUMERIC(12, 2),
+	vat_rate NUMERIC(5, 4) NOT NULL,
+	tax_category TEXT NOT NULL DEFAULT 'standard',
+	position INTEGER NOT NULL,
+	PRIMARY KEY (zone_id, code)
+);
+
+-- the price of a weight method up to each weight
+CREATE TABLE shipping_method_bands (
+	zone_id INTEGER NOT NULL REFERENCES shipping_zones (id),
+	code TEXT NOT NULL,
+	up_to_grams INTEGER NOT NULL CHECK (up_to_grams > 0),
+	price NUMERIC(12, 2) NOT NULL CHECK (price >= 0),
+	PRIMARY KEY (zone_id, code, up_to_grams)
+);
+
+CREATE TABLE order_shipping (
+	order_id TEXT PRIMARY KEY REFERENCES orders (order_id),
+	method TEXT NOT NULL,
+	name TEXT NOT NULL,
+	weight_grams INTEGER NOT NULL,
+	price NUMERIC(12, 2) NOT NULL,
+	price_includes_vat BOOLEAN NOT NULL DEFAULT false,
+	vat_rate NUMERIC(5, 4) NOT NULL,
+	tax_rule_id INTEGER REFERENCES tax_rules (id),
+	vat NUMERIC(12, 2) NOT NULL,
+	net NUMERIC(12, 2) NOT NULL,
+	gross NUMERIC(12, 2) NOT NULL
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS payments_reference_idx;
+DROP INDEX IF EXISTS payments_order_idx;
+DROP TABLE IF EXISTS payments;
@@ -0,0 +1,19 @@
+-- the payments collected for orders through a payment provider, which knows
+-- them by their reference
+CREATE TABLE payments (
+	id SERIAL PRIMARY KEY,
+	order_id TEXT NOT NULL REFERENCES orders (order_id),
+	provider TEXT NOT NULL,
+	reference TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL CHECK (status IN ('authorized', 'captured', 'voided', 'refunded', 'failed')),
+	amount NUMERIC(12, 2) NOT NULL CHECK (amount >= 0),
+	captured_amount NUMERIC(12, 2) NOT NULL DEFAULT 0,
+	refunded_amount NUMERIC(12, 2) NOT NULL DEFAULT 0,
+	currency TEXT NOT NULL,
+	failure_reason TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX payments_order_idx ON payments (order_id);
+CREATE INDEX payments_reference_idx ON payments (provider, reference);
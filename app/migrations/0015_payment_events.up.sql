@@ -0,0 +1,10 @@
+-- the webhook events received from payment providers, kept so that a
+-- redelivered event is not applied twice
+CREATE TABLE payment_events (
+	provider TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	type TEXT NOT NULL,
+	payment_id INTEGER REFERENCES payments (id),
+	received_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (provider, event_id)
+);
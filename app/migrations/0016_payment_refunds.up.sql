@@ -0,0 +1,9 @@
+-- the refunds of payments, by the ID the provider gave them, so that a refund
+-- reported again by a webhook is not counted twice
+CREATE TABLE payment_refunds (
+	payment_id INTEGER NOT NULL REFERENCES payments (id),
+	refund_id TEXT NOT NULL,
+	amount NUMERIC(12, 2) NOT NULL CHECK (amount > 0),
+	created_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (payment_id, refund_id)
+);
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the ISO 4217 code used for catalog prices and for amounts
+// read back from the database.
+const DefaultCurrency = "EUR"
+
+// reports an amount of the catalog (prices, costs, coupon amounts) given in another currency than
+// DefaultCurrency, as orders are converted from it, never the catalog, or too large to be stored.
+func checkCatalogAmount(field string, m Money) []FieldError {
+	if m.Currency != DefaultCurrency {
+		return []FieldError{{Field: field, Message: fmt.Sprintf("must be in %s, the catalog currency", DefaultCurrency)}}
+	}
+	if m.CheckStorable() != nil {
+		return []FieldError{{Field: field, Message: "is too large"}}
+	}
+	return nil
+}
+
+// RoundingMode selects how amounts that fall between two minor units are rounded.
+type RoundingMode int
+
+const (
+	// RoundHalfUp rounds halves away from zero (1.005 -> 1.01, -1.005 -> -1.01).
+	RoundHalfUp RoundingMode = iota
+	// RoundHalfEven rounds halves to the nearest even minor unit (banker's rounding).
+	RoundHalfEven
+)
+
+// DefaultRoundingMode is used by the order pipeline; set from ROUNDING_MODE in main.
+var DefaultRoundingMode = RoundHalfUp
+
+// ParseRoundingMode maps a configuration value to a RoundingMode.
+func ParseRoundingMode(s string) (RoundingMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "half-up", "half_up", "halfup":
+		return RoundHalfUp, nil
+	case "half-even", "half_even", "halfeven", "bankers":
+		return RoundHalfEven, nil
+	}
+	return RoundHalfUp, fmt.Errorf("unknown rounding mode %q", s)
+}
+
+func (m RoundingMode) String() string {
+	if m == RoundHalfEven {
+		return "half-even"
+	}
+	return "half-up"
+}
+
+// number of decimal digits of the minor unit for the currencies we handle,
+// anything not listed uses 2.
+var currencyExponents = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"HUF": 2,
+	"BHD": 3,
+	"KWD": 3,
+}
+
+func currencyExponent(currency string) int {
+	if exp, ok := currencyExponents[currency]; ok {
+		return exp
+	}
+	return 2
+}
+
+// Money is an exact monetary amount held as an integer number of minor units
+// (e.g. cents) of Currency. The zero value is zero in no particular currency and
+// can be used as an accumulator.
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// NewMoney builds a Money from minor units.
+func NewMoney(minor int64, currency string) Money {
+	return Money{Amount: minor, Currency: currency}
+}
+
+// ParseMoney parses an exact decimal string such as "1499.99" or "-0.5".
+// More fractional digits than the currency allows is an error, never a rounding.
+func ParseMoney(s, currency string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Money{}, errors.New("empty money value")
+	}
+	exp := currencyExponent(currency)
+
+	neg := false
+	switch s[0] {
+	case '-':
+		neg = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+	intPart, fracPart, hasDot := strings.Cut(s, ".")
+	if intPart == "" || (hasDot && fracPart == "") {
+		return Money{}, fmt.Errorf("invalid money value %q", s)
+	}
+	if len(fracPart) > exp {
+		// trailing zeros beyond the minor unit are harmless (NUMERIC(12,4) columns, etc.)
+		if strings.TrimRight(fracPart[exp:], "0") != "" {
+			return Money{}, fmt.Errorf("money value %q has more than %d decimal places", s, exp)
+		}
+		fracPart = fracPart[:exp]
+	}
+	fracPart += strings.Repeat("0", exp-len(fracPart))
+	for _, r := range intPart + fracPart {
+		if r < '0' || r > '9' {
+			return Money{}, fmt.Errorf("invalid money value %q", s)
+		}
+	}
+	minor, err := strconv.ParseInt(intPart+fracPart, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("money value %q out of range: %w", s, err)
+	}
+	if neg {
+		minor = -minor
+	}
+	return Money{Amount: minor, Currency: currency}, nil
+}
+
+// MustParseMoney is ParseMoney for literals known to be valid.
+func MustParseMoney(s, currency string) Money {
+	m, err := ParseMoney(s, currency)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func (m Money) currencyOr(other Money) string {
+	if m.Currency != "" {
+		return m.Currency
+	}
+	return other.Currency
+}
+
+// ErrMoneyOverflow is returned for an amount that does not fit in an int64
+// number of minor units.
+var ErrMoneyOverflow = errors.New("money: amount out of range")
+
+func (m Money) mustMatch(other Money) {
+	if m.Currency != "" && other.Currency != "" && m.Currency != other.Currency {
+		panic(fmt.Sprintf("money: currency mismatch %s vs %s", m.Currency, other.Currency))
+	}
+}
+
+// Add returns m + other. A zero-value Money adopts the other operand's currency.
+// It panics on overflow; amounts that come from a request go through CheckedAdd.
+func (m Money) Add(other Money) Money {
+	return mustFit(m.CheckedAdd(other))
+}
+
+// Sub returns m - other. It panics on overflow.
+func (m Money) Sub(other Money) Money {
+	return mustFit(m.CheckedSub(other))
+}
+
+// Mul returns m multiplied by an integer quantity. It panics on overflow;
+// quantities that come from a request go through CheckedMul.
+func (m Money) Mul(qty int64) Money {
+	return mustFit(m.CheckedMul(qty))
+}
+
+// CheckedAdd returns m + other, or ErrMoneyOverflow if the sum does not fit.
+func (m Money) CheckedAdd(other Money) (Money, error) {
+	m.mustMatch(other)
+	sum := m.Amount + other.Amount
+	if (sum > m.Amount) != (other.Amount > 0) {
+		return Money{}, fmt.Errorf("%w: %s + %s", ErrMoneyOverflow, m, other)
+	}
+	return Money{Amount: sum, Currency: m.currencyOr(other)}, nil
+}
+
+// CheckedSub returns m - other, or ErrMoneyOverflow if the difference does not fit.
+func (m Money) CheckedSub(other Money) (Money, error) {
+	m.mustMatch(other)
+	diff := m.Amount - other.Amount
+	if (diff < m.Amount) != (other.Amount > 0) {
+		return Money{}, fmt.Errorf("%w: %s - %s", ErrMoneyOverflow, m, other)
+	}
+	return Money{Amount: diff, Currency: m.currencyOr(other)}, nil
+}
+
+// CheckedMul returns m * qty, or ErrMoneyOverflow if the product does not fit.
+func (m Money) CheckedMul(qty int64) (Money, error) {
+	product := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(qty))
+	if !product.IsInt64() {
+		return Money{}, fmt.Errorf("%w: %s * %d", ErrMoneyOverflow, m, qty)
+	}
+	return Money{Amount: product.Int64(), Currency: m.Currency}, nil
+}
+
+// MulRate returns m * rate rounded to the minor unit. The rate is taken at its
+// shortest decimal representation (0.22 is exactly 22/100, not the nearest float).
+func (m Money) MulRate(rate float64, mode RoundingMode) (Money, error) {
+	return m.rounded(m.rateRat(rate), m.Currency, mode)
+}
+
+// IncludedVAT returns the VAT at rate contained in the gross amount m, that
+// is m * rate / (1 + rate), rounded to the minor unit.
+func (m Money) IncludedVAT(rate float64, mode RoundingMode) (Money, error) {
+	return m.rounded(m.includedRat(rate), m.Currency, mode)
+}
+
+// Convert returns m in currency at rate, the units of currency one unit of
+// m's currency buys, rounded to the minor unit of currency.
+func (m Money) Convert(currency string, rate float64, mode RoundingMode) (Money, error) {
+	r := m.rateRat(rate)
+	shift := currencyExponent(currency) - currencyExponent(m.Currency)
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(max(shift, -shift))), nil))
+	if shift > 0 {
+		r.Mul(r, scale)
+	} else {
+		r.Quo(r, scale)
+	}
+	return m.rounded(r, currency, mode)
+}
+
+// r rounded to a Money of currency, or ErrMoneyOverflow naming m as the
+// operand the result came from.
+func (m Money) rounded(r *big.Rat, currency string, mode RoundingMode) (Money, error) {
+	amount, err := roundRat(r, mode)
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: computed from %s", err, m)
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// storedIntegerDigits is how many digits before the decimal point the
+// NUMERIC(12, 2) columns amounts are stored in can hold.
+const storedIntegerDigits = 10
+
+// CheckStorable returns ErrMoneyOverflow for an amount too large for the
+// columns amounts are stored in, which hold less than Money does.
+func (m Money) CheckStorable() error {
+	limit := int64(1)
+	for range storedIntegerDigits + currencyExponent(m.Currency) {
+		limit *= 10
+	}
+	if m.Amount >= limit || m.Amount <= -limit {
+		return fmt.Errorf("%w: %s does not fit in %d digits before the point", ErrMoneyOverflow, m, storedIntegerDigits)
+	}
+	return nil
+}
+
+// mustFit unwraps the result of a checked operation, panicking on overflow like
+// a currency mismatch does.
+func mustFit(m Money, err error) Money {
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Relabel returns the decimal amount of m as an amount of currency. Amounts
+// read from NUMERIC columns come back in DefaultCurrency and are relabeled with
+// the currency stored next to them.
+func (m Money) Relabel(currency string) (Money, error) {
+	if m.Currency == currency {
+		return m, nil
+	}
+	return ParseMoney(m.String(), currency)
+}
+
+// the exact m * rate in minor units, before rounding.
+func (m Money) rateRat(rate float64) *big.Rat {
+	r := ratFromRate(rate)
+	return r.Mul(r, new(big.Rat).SetInt64(m.Amount))
+}
+
+// the exact m * rate / (1 + rate) in minor units, before rounding.
+func (m Money) includedRat(rate float64) *big.Rat {
+	r := ratFromRate(rate)
+	onePlus := new(big.Rat).Add(r, big.NewRat(1, 1))
+	r.Mul(r, new(big.Rat).SetInt64(m.Amount))
+	return r.Quo(r, onePlus)
+}
+
+// ratFromRate converts a rate at its shortest decimal representation.
+func ratFromRate(rate float64) *big.Rat {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(rate, 'f', -1, 64))
+	if !ok {
+		panic(fmt.Sprintf("money: invalid rate %v", rate))
+	}
+	return r
+}
+
+// roundRat rounds r to an integer according to mode, or returns
+// ErrMoneyOverflow if the result does not fit in an int64.
+func roundRat(r *big.Rat, mode RoundingMode) (int64, error) {
+	num, den := r.Num(), r.Denom()
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() == 0 {
+		return checkedInt64(q)
+	}
+	// compare 2*|rem| with den to decide the direction
+	twice := new(big.Int).Abs(rem)
+	twice.Lsh(twice, 1)
+	cmp := twice.Cmp(den)
+	away := cmp > 0 || (cmp == 0 && (mode == RoundHalfUp || q.Bit(0) == 1))
+	if away {
+		if num.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return checkedInt64(q)
+}
+
+func checkedInt64(i *big.Int) (int64, error) {
+	if !i.IsInt64() {
+		return 0, ErrMoneyOverflow
+	}
+	return i.Int64(), nil
+}
+
+// IsZero reports whether the amount is zero.
+func (m Money) IsZero() bool { return m.Amount == 0 }
+
+// IsNegative reports whether the amount is below zero.
+func (m Money) IsNegative() bool { return m.Amount < 0 }
+
+// Cmp compares two amounts of the same currency, returning -1, 0 or +1.
+func (m Money) Cmp(other Money) int {
+	m.mustMatch(other)
+	switch {
+	case m.Amount < other.Amount:
+		return -1
+	case m.Amount > other.Amount:
+		return 1
+	}
+	return 0
+}
+
+// String renders the exact decimal amount without currency, e.g. "1499.99".
+func (m Money) String() string {
+	exp := currencyExponent(m.Currency)
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+	}
+	digits := strconv.FormatUint(absInt64(amount), 10)
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+func absInt64(v int64) uint64 {
+	if v < 0 {
+		return uint64(-(v + 1)) + 1
+	}
+	return uint64(v)
+}
+
+// MarshalJSON writes {"amount": 1500.00, "currency": "EUR"}: the amount as a
+// JSON number with exactly the currency's decimal places, so clients see
+// 1500.00 rather than 1500 or 1499.9899999, and the currency, DefaultCurrency
+// for the zero value.
+func (m Money) MarshalJSON() ([]byte, error) {
+	currency := m.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	return []byte(fmt.Sprintf(`{"amount":%s,"currency":%q}`, m.String(), currency)), nil
+}
+
+// UnmarshalJSON accepts the object written by MarshalJSON, or a JSON number or
+// numeric string in the destination's currency, DefaultCurrency if it has none.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := strings.TrimSpace(string(data))
+	if s == "null" {
+		return nil
+	}
+	currency := m.Currency
+	if strings.HasPrefix(s, "{") {
+		var obj struct {
+			Amount   json.RawMessage `json:"amount"`
+			Currency string          `json:"currency"`
+		}
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		if obj.Amount == nil {
+			return errors.New("money object without an amount")
+		}
+		s = string(obj.Amount)
+		if obj.Currency != "" {
+			currency = strings.ToUpper(obj.Currency)
+		}
+	}
+	if unq, err := strconv.Unquote(s); err == nil {
+		s = unq
+	}
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	parsed, err := ParseMoney(s, currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Value stores the amount as an exact decimal string, suitable for NUMERIC columns.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan reads a NUMERIC column. Amounts come back in DefaultCurrency unless the
+// destination already carries a currency.
+func (m *Money) Scan(src interface{}) error {
+	currency := m.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	var s string
+	switch v := src.(type) {
+	case Money:
+		*m = v
+		return nil
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		*m = Money{Currency: currency}
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+	parsed, err := ParseMoney(s, currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// NullMoney is a Money read from a nullable NUMERIC column.
+type NullMoney struct {
+	Money Money
+	Valid bool // Valid is true if the column is not NULL
+}
+
+// Scan reads a nullable NUMERIC column like Money.Scan.
+func (n *NullMoney) Scan(src interface{}) error {
+	if src == nil {
+		*n = NullMoney{}
+		return nil
+	}
+	n.Valid = true
+	return n.Money.Scan(src)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	m, err := ParseMoney("1499.99", "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(149999), m.Amount)
+
+	m, err = ParseMoney("-0.5", "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-50), m.Amount)
+
+	m, err = ParseMoney("12.3400", "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1234), m.Amount)
+
+	_, err = ParseMoney("1.005", "EUR")
+	assert.Error(t, err)
+	_, err = ParseMoney("1.2.3", "EUR")
+	assert.Error(t, err)
+	_, err = ParseMoney("99999999999999999999", "EUR")
+	assert.Error(t, err)
+}
+
+func TestMoneyString(t *testing.T) {
+	assert.Equal(t, "1500.00", NewMoney(150000, "EUR").String())
+	assert.Equal(t, "0.05", NewMoney(5, "EUR").String())
+	assert.Equal(t, "-0.05", NewMoney(-5, "EUR").String())
+	assert.Equal(t, "1500", NewMoney(1500, "JPY").String())
+}
+
+func TestMoneyMulRate_RoundingModes(t *testing.T) {
+	// 0.25 * 0.10 = 0.025 -> tie between 0.02 and 0.03
+	m := MustParseMoney("0.25", "EUR")
+	assert.Equal(t, int64(3), mustFit(m.MulRate(0.10, RoundHalfUp)).Amount)
+	assert.Equal(t, int64(2), mustFit(m.MulRate(0.10, RoundHalfEven)).Amount)
+
+	neg := MustParseMoney("-0.25", "EUR")
+	assert.Equal(t, int64(-3), mustFit(neg.MulRate(0.10, RoundHalfUp)).Amount)
+	assert.Equal(t, int64(-2), mustFit(neg.MulRate(0.10, RoundHalfEven)).Amount)
+
+	// 0.22 must behave as exactly 22/100
+	assert.Equal(t, MustParseMoney("33.00", "EUR"), mustFit(MustParseMoney("150.00", "EUR").MulRate(0.22, RoundHalfUp)))
+}
+
+func TestMoneyIncludedVAT(t *testing.T) {
+	assert.Equal(t, MustParseMoney("22.00", "EUR"), mustFit(MustParseMoney("122.00", "EUR").IncludedVAT(0.22, RoundHalfUp)))
+	assert.Equal(t, MustParseMoney("1.80", "EUR"), mustFit(MustParseMoney("9.99", "EUR").IncludedVAT(0.22, RoundHalfUp)))
+
+	// 0.05 at 100% holds 0.025 of VAT
+	m := MustParseMoney("0.05", "EUR")
+	assert.Equal(t, int64(3), mustFit(m.IncludedVAT(1, RoundHalfUp)).Amount)
+	assert.Equal(t, int64(2), mustFit(m.IncludedVAT(1, RoundHalfEven)).Amount)
+}
+
+func TestMoneyMul_LargeAmounts(t *testing.T) {
+	m := MustParseMoney("99999999999.99", "EUR").Mul(1000)
+	assert.Equal(t, "99999999999990.00", m.String())
+}
+
+func TestMoney_Overflow(t *testing.T) {
+	m := MustParseMoney("1169.99", "EUR")
+	_, err := m.CheckedMul(9e15)
+	assert.ErrorIs(t, err, ErrMoneyOverflow)
+	_, err = m.CheckedMul(-9e15)
+	assert.ErrorIs(t, err, ErrMoneyOverflow)
+	product, err := m.CheckedMul(1000)
+	assert.NoError(t, err)
+	assert.Equal(t, MustParseMoney("1169990.00", "EUR"), product)
+
+	largest := NewMoney(math.MaxInt64, "EUR")
+	_, err = largest.CheckedAdd(NewMoney(1, "EUR"))
+	assert.ErrorIs(t, err, ErrMoneyOverflow)
+	_, err = NewMoney(math.MinInt64, "EUR").CheckedSub(NewMoney(1, "EUR"))
+	assert.ErrorIs(t, err, ErrMoneyOverflow)
+	sum, err := largest.CheckedAdd(NewMoney(-1, "EUR"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64-1), sum.Amount)
+	assert.Panics(t, func() { largest.Add(NewMoney(1, "EUR")) })
+
+	// rounding rejects results past int64 instead of wrapping them
+	_, err = largest.Convert("JPY", 162, RoundHalfUp)
+	assert.ErrorIs(t, err, ErrMoneyOverflow)
+	_, err = largest.MulRate(1.5, RoundHalfUp)
+	assert.ErrorIs(t, err, ErrMoneyOverflow)
+}
+
+func TestMoney_CheckStorable(t *testing.T) {
+	assert.NoError(t, MustParseMoney("9999999999.99", "EUR").CheckStorable())
+	assert.NoError(t, MustParseMoney("-9999999999.99", "EUR").CheckStorable())
+	assert.NoError(t, MustParseMoney("9999999999", "JPY").CheckStorable())
+	assert.ErrorIs(t, MustParseMoney("10000000000.00", "EUR").CheckStorable(), ErrMoneyOverflow)
+	assert.ErrorIs(t, MustParseMoney("-10000000000.00", "EUR").CheckStorable(), ErrMoneyOverflow)
+	assert.ErrorIs(t, MustParseMoney("10000000000", "JPY").CheckStorable(), ErrMoneyOverflow)
+}
+
+func TestMoneyJSON(t *testing.T) {
+	data, err := json.Marshal(struct {
+		Price Money `json:"price"`
+	}{MustParseMoney("10.10", "EUR")})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"price":{"amount":10.10,"currency":"EUR"}}`, string(data))
+	assert.Contains(t, string(data), "10.10")
+
+	var in struct {
+		A Money `json:"a"`
+		B Money `json:"b"`
+		C Money `json:"c"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(`{"a":0.1,"b":"2.30","c":{"amount":1500,"currency":"jpy"}}`), &in))
+	assert.Equal(t, MustParseMoney("0.10", DefaultCurrency), in.A)
+	assert.Equal(t, MustParseMoney("2.30", DefaultCurrency), in.B)
+	assert.Equal(t, MustParseMoney("1500", "JPY"), in.C)
+	assert.Error(t, json.Unmarshal([]byte(`{"a":{"currency":"EUR"}}`), &in))
+}
+
+func TestMoneyConvert(t *testing.T) {
+	eur := MustParseMoney("1499.99", "EUR")
+	assert.Equal(t, MustParseMoney("1622.99", "USD"), mustFit(eur.Convert("USD", 1.082, RoundHalfUp))) // 1622.98918
+	assert.Equal(t, MustParseMoney("242998", "JPY"), mustFit(eur.Convert("JPY", 162, RoundHalfUp)))    // 242998.38
+	assert.Equal(t, MustParseMoney("9.26", "EUR"), mustFit(MustParseMoney("1500", "JPY").Convert("EUR", 1.0/162, RoundHalfUp)))
+
+	relabeled, err := MustParseMoney("1500.00", DefaultCurrency).Relabel("JPY")
+	assert.NoError(t, err)
+	assert.Equal(t, MustParseMoney("1500", "JPY"), relabeled)
+	_, err = MustParseMoney("0.50", DefaultCurrency).Relabel("JPY")
+	assert.Error(t, err)
+}
+
+func TestMoneyScan(t *testing.T) {
+	var m Money
+	assert.NoError(t, m.Scan([]byte("649.50")))
+	assert.Equal(t, MustParseMoney("649.50", DefaultCurrency), m)
+	v, err := m.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "649.50", v)
+}
+
+func TestParseRoundingMode(t *testing.T) {
+	mode, err := ParseRoundingMode("half-even")
+	assert.NoError(t, err)
+	assert.Equal(t, RoundHalfEven, mode)
+	mode, err = ParseRoundingMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, RoundHalfUp, mode)
+	_, err = ParseRoundingMode("down")
+	assert.Error(t, err)
+}
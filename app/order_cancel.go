@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrOrderNotCancellable is returned when an order has left the warehouse or is already closed.
+var ErrOrderNotCancellable = errors.New("order cannot be cancelled")
+
+// CancelRequest is the request body of POST /orders/{id}/cancel.
+type CancelRequest struct {
+	Reason string `json:"reason"`
+}
+
+// CancelOrder cancels an order inside tx: it moves the order to the cancelled
+// status, stores the reason and time of the cancellation and puts the order's
+// items back in stock. Its payments are released by ReleaseOrderPayments once
+// tx has committed. Orders that have been shipped, cancelled or refunded are
+// rejected with ErrOrderNotCancellable.
+func CancelOrder(tx TxExecutor, orderID, reason string, now time.Time) error {
+	status, err := GetOrderStatusForUpdate(tx, orderID)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case StatusShipped, StatusDelivered:
+		return fmt.Errorf("%w: order has already been shipped", ErrOrderNotCancellable)
+	case StatusCancelled, StatusRefunded:
+		return fmt.Errorf("%w: order is already %s", ErrOrderNotCancellable, status)
+	}
+
+	if _, err := TransitionOrder(tx, orderID, StatusCancelled, reason, now); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE orders SET cancel_reason = $1, cancelled_at = $2 WHERE order_id = $3", reason, now, orderID)
+	if err != nil {
+		return fmt.Errorf("failed to record order cancellation: %w", err)
+	}
+	return ReleaseOrderStock(tx, orderID, now)
+}
+
+// releases the payments of an order whose cancellation has committed. The
+// order stays cancelled when a payment cannot be released; the error says
+// so, and the payment is left to POST /payments/{id}/void or refund.
+func releaseCancelledOrderPayments(executor DBExecutor, provider PaymentProvider, orderID string) error {
+	if err := ReleaseOrderPayments(executor, provider, orderID, time.Now()); err != nil {
+		return paymentError(fmt.Errorf("order %s was cancelled, but not all of its payments were released: %w", orderID, err))
+	}
+	return nil
+}
+
+// --- Order Cancellation HTTP Handlers ---
+
+// POST /orders/{id}/cancel
+func cancelOrderHandler(executor DBExecutor, provider PaymentProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID := mux.Vars(r)["id"]
+
+		var req CancelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+		if req.Reason == "" {
+			writeError(w, r, ErrValidation(FieldError{Field: "reason", Message: "is required"}))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := CancelOrder(tx, orderID, req.Reason, time.Now()); err != nil {
+			writeError(w, r, orderError(err))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := releaseCancelledOrderPayments(executor, provider, orderID); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		order, err := GetOrderByID(executor, orderID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(order)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelOrderHandler_InMemory(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	order := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":3}]}`)
+
+	rr := doJSON(router, "POST", "/orders/"+order.OrderID+"/cancel", `{"reason":""}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = doJSON(router, "POST", "/orders/"+order.OrderID+"/cancel", `{"reason":"customer changed their mind"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var cancelled OutgoingOrder
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&cancelled))
+	assert.Equal(t, StatusCancelled, cancelled.Status)
+	assert.Equal(t, "customer changed their mind", cancelled.CancelReason)
+	assert.NotNil(t, cancelled.CancelledAt)
+	assert.Equal(t, order.TotalOrderPrice, cancelled.TotalOrderPrice)
+
+	rr = doJSON(router, "POST", "/orders/"+order.OrderID+"/cancel", `{"reason":"again"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = doJSON(router, "POST", "/orders/missing/cancel", `{"reason":"x"}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestCancelOrderHandler_RejectsShippedOrders(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	order := placeOrder(t, router, `{"items":[{"product_id":1,"quantity":1}]}`)
+	createPayment(t, router, order.OrderID, `{"source":"tok_visa"}`)
+	for _, status := range []string{"fulfilled", "shipped"} {
+		rr := doJSON(router, "POST", "/orders/"+order.OrderID+"/transitions", `{"status":"`+status+`"}`)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	rr := doJSON(router, "POST", "/orders/"+order.OrderID+"/cancel", `{"reason":"too late"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "already been shipped")
+	stored, err := GetOrderByID(&InMemoryDB{store: store}, order.OrderID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusShipped, stored.Status)
+	assert.Nil(t, stored.CancelledAt)
+}
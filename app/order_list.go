@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultOrderPageSize = 20
+	maxOrderPageSize     = 100
+)
+
+// OrderSortField is a column GET /orders can be sorted on.
+type OrderSortField string
+
+const (
+	OrderSortCreatedAt OrderSortField = "created_at"
+	OrderSortTotal     OrderSortField = "total"
+)
+
+// OrderSummary is an order as listed by GET /orders, without its items.
+type OrderSummary struct {
+	OrderID         string      `json:"order_id"`
+	Status          OrderStatus `json:"status"`
+	Currency        string      `json:"currency"`
+	TotalOrderPrice Money       `json:"order_price"`
+	VATAmount       Money       `json:"order_vat"`
+	CreatedAt       time.Time   `json:"created_at"`
+}
+
+// OrderPage is the response body of GET /orders.
+type OrderPage struct {
+	Orders     []OrderSummary `json:"orders"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// OrderListFilter holds the filters, ordering and page position of an order listing.
+// Nil and empty filters are not applied. Totals are only comparable within
+// one currency, so filtering or sorting by total requires Currency.
+type OrderListFilter struct {
+	CreatedFrom *time.Time // inclusive
+	CreatedTo   *time.Time // exclusive
+	Currency    string
+	MinTotal    *Money
+	MaxTotal    *Money
+	ProductID   *int
+	CustomerID  *int
+	SortBy      OrderSortField
+	Descending  bool
+	Limit       int
+	After       *orderCursor
+}
+
+// orderCursor is the keyset position after the last order of a page. It is
+// handed to clients base64-encoded and must be treated as opaque by them.
+type orderCursor struct {
+	SortBy     OrderSortField `json:"s"`
+	Descending bool           `json:"d"`
+	Value      string         `json:"v"`
+	OrderID    string         `json:"o"`
+}
+
+func (c orderCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeOrderCursor(s string) (*orderCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	var c orderCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.OrderID == "" {
+		return nil, errors.New("malformed cursor")
+	}
+	return &c, nil
+}
+
+// the key value the cursor points at, typed for the sort column; totals are
+// in currency.
+func (c orderCursor) keyValue(currency string) (interface{}, error) {
+	if c.SortBy == OrderSortTotal {
+		return ParseMoney(c.Value, currency)
+	}
+	return time.Parse(time.RFC3339Nano, c.Value)
+}
+
+func cursorAfter(o OrderSummary, sortBy OrderSortField, desc bool) orderCursor {
+	c := orderCursor{SortBy: sortBy, Descending: desc, OrderID: o.OrderID}
+	if sortBy == OrderSortTotal {
+		c.Value = o.TotalOrderPrice.String()
+	} else {
+		c.Value = o.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return c
+}
+
+// listOrdersQuery builds the listing statement for one sort column and direction.
+// Every filter is a nullable parameter so the statement text only varies with the
+// ordering: $1/$2 created_at range, $3/$4 total range, $5 product, $6/$7 cursor, $8 limit,
+// $9 customer, $10 currency.
+func listOrdersQuery(sortBy OrderSortField, desc bool) string {
+	col, cast := "created_at", "timestamptz"
+	if sortBy == OrderSortTotal {
+		col, cast = "total_price", "numeric"
+	}
+	dir, cmp := "ASC", ">"
+	if desc {
+		dir, cmp = "DESC", "<"
+	}
+	return "SELECT order_id, total_price, vat_amount, status, created_at, currency FROM orders" +
+		" WHERE ($1::timestamptz IS NULL OR created_at >= $1)" +
+		" AND ($2::timestamptz IS NULL OR created_at < $2)" +
+		" AND ($3::numeric IS NULL OR total_price >= $3)" +
+		" AND ($4::numeric IS NULL OR total_price <= $4)" +
+		" AND ($5::integer IS NULL OR order_id IN (SELECT order_id FROM order_items WHERE product_id = $5))" +
+		" AND ($9::integer IS NULL OR customer_id = $9)" +
+		" AND ($10::text IS NULL OR currency = $10)" +
+		fmt.Sprintf(" AND ($6::%s IS NULL OR (%s, order_id) %s ($6, $7))", cast, col, cmp) +
+		fmt.Sprintf(" ORDER BY %s %s, order_id %s LIMIT $8", col, dir, dir)
+}
+
+// --- Order Listing Database Functions ---
+
+// fetches one page of orders matching the filter. The next cursor is empty on the last page.
+func ListOrders(executor Queryer, filter OrderListFilter) ([]OrderSummary, string, error) {
+	if filter.SortBy == "" {
+		filter.SortBy = OrderSortCreatedAt
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultOrderPageSize
+	}
+
+	args := make([]interface{}, 10)
+	if filter.CreatedFrom != nil {
+		args[0] = *filter.CreatedFrom
+	}
+	if filter.CreatedTo != nil {
+		args[1] = *filter.CreatedTo
+	}
+	if filter.MinTotal != nil {
+		args[2] = *filter.MinTotal
+	}
+	if filter.MaxTotal != nil {
+		args[3] = *filter.MaxTotal
+	}
+	if filter.ProductID != nil {
+		args[4] = *filter.ProductID
+	}
+	if filter.After != nil {
+		key, err := filter.After.keyValue(filter.Currency)
+		if err != nil {
+			return nil, "", fmt.Errorf("malformed cursor: %w", err)
+		}
+		args[5] = key
+		args[6] = filter.After.OrderID
+	}
+	if filter.CustomerID != nil {
+		args[8] = *filter.CustomerID
+	}
+	if filter.Currency != "" {
+		args[9] = filter.Currency
+	}
+	// one extra row tells whether there is a next page
+	args[7] = filter.Limit + 1
+
+	rows, err := executor.Query(listOrdersQuery(filter.SortBy, filter.Descending), args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query orders: %w", err)
+	}
+	defer rows.Close()
+
+	orders := []OrderSummary{}
+	for rows.Next() {
+		var o OrderSummary
+		var status string
+		if err := rows.Scan(&o.OrderID, &o.TotalOrderPrice, &o.VATAmount, &status, &o.CreatedAt, &o.Currency); err != nil {
+			return nil, "", fmt.Errorf("failed to scan order row: %w", err)
+		}
+		o.Status = OrderStatus(status)
+		if o.TotalOrderPrice, err = o.TotalOrderPrice.Relabel(o.Currency); err != nil {
+			return nil, "", fmt.Errorf("failed to read total of order %s: %w", o.OrderID, err)
+		}
+		if o.VATAmount, err = o.VATAmount.Relabel(o.Currency); err != nil {
+			return nil, "", fmt.Errorf("failed to read VAT of order %s: %w", o.OrderID, err)
+		}
+		orders = append(orders, o)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("error during orders iteration: %w", err)
+	}
+
+	nextCursor := ""
+	if len(orders) > filter.Limit {
+		orders = orders[:filter.Limit]
+		nextCursor = cursorAfter(orders[len(orders)-1], filter.SortBy, filter.Descending).encode()
+	}
+	return orders, nextCursor, nil
+}
+
+// parses the GET /orders query string into a filter.
+func parseOrderListFilter(q url.Values) (OrderListFilter, error) {
+	filter := OrderListFilter{SortBy: OrderSortCreatedAt, Descending: true, Limit: defaultOrderPageSize}
+
+	for _, bound := range []struct {
+		name string
+		dst  **time.Time
+	}{{"created_from", &filter.CreatedFrom}, {"created_to", &filter.CreatedTo}} {
+		if v := q.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, ErrValidation(FieldError{Field: bound.name, Message: "must be an RFC 3339 timestamp"})
+			}
+			*bound.dst = &t
+		}
+	}
+	if v := q.Get("currency"); v != "" {
+		filter.Currency = normalizeCurrency(v)
+		if !currencyPattern.MatchString(filter.Currency) {
+			return filter, ErrValidation(FieldError{Field: "currency", Message: "must be an ISO 4217 code"})
+		}
+	}
+	for _, bound := range []struct {
+		name string
+		dst  **Money
+	}{{"min_total", &filter.MinTotal}, {"max_total", &filter.MaxTotal}} {
+		if v := q.Get(bound.name); v != "" {
+			if filter.Currency == "" {
+				return filter, ErrValidation(FieldError{Field: "currency", Message: "is required to filter by total"})
+			}
+			m, err := ParseMoney(v, filter.Currency)
+			if err != nil {
+				return filter, ErrValidation(FieldError{Field: bound.name, Message: err.Error()})
+			}
+			*bound.dst = &m
+		}
+	}
+	if v := q.Get("product_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			return filter, ErrValidation(FieldError{Field: "product_id", Message: "must be a positive integer"})
+		}
+		filter.ProductID = &id
+	}
+	if v := q.Get("customer_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			return filter, ErrValidation(FieldError{Field: "customer_id", Message: "must be a positive integer"})
+		}
+		filter.CustomerID = &id
+	}
+
+	// sort=created_at|-created_at|total|-total, a leading '-' means descending
+	if v := q.Get("sort"); v != "" {
+		filter.Descending = v[0] == '-'
+		if filter.Descending {
+			v = v[1:]
+		}
+		switch OrderSortField(v) {
+		case OrderSortTotal:
+			if filter.Currency == "" {
+				return filter, ErrValidation(FieldError{Field: "currency", Message: "is required to sort by total"})
+			}
+			filter.SortBy = OrderSortTotal
+		case OrderSortCreatedAt:
+			filter.SortBy = OrderSortCreatedAt
+		default:
+			return filter, ErrValidation(FieldError{Field: "sort", Message: fmt.Sprintf("cannot sort by %q", v)})
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxOrderPageSize {
+			return filter, ErrValidation(FieldError{Field: "limit", Message: fmt.Sprintf("must be between 1 and %d", maxOrderPageSize)})
+		}
+		filter.Limit = limit
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeOrderCursor(v)
+		if err != nil {
+			return filter, ErrValidation(FieldError{Field: "cursor", Message: err.Error()})
+		}
+		if c.SortBy != filter.SortBy || c.Descending != filter.Descending {
+			return filter, ErrValidation(FieldError{Field: "cursor", Message: "does not match the requested sort order"})
+		}
+		if _, err := c.keyValue(filter.Currency); err != nil {
+			return filter, ErrValidation(FieldError{Field: "cursor", Message: "malformed cursor"})
+		}
+		filter.After = c
+	}
+	return filter, nil
+}
+
+// --- Order Listing HTTP Handlers ---
+
+// GET /orders
+func listOrdersHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseOrderListFilter(r.URL.Query())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		orders, nextCursor, err := ListOrders(executor, filter)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(OrderPage{Orders: orders, NextCursor: nextCursor})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seeds n orders, order i created i hours after base with total (n-i)*10.00,
+// every even order containing product 1.
+func seedOrders(t *testing.T, store *InMemoryStore, n int, base time.Time) {
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("order-%02d", i)
+		mustExec(t, store, "INSERT INTO orders (order_id, total_price, vat_amount, created_at) VALUES ($1, $2, $3, $4)",
+			id, NewMoney(int64(n-i)*1000, DefaultCurrency), NewMoney(0, DefaultCurrency), base.Add(time.Duration(i)*time.Hour))
+		productID := 2
+		if i%2 == 0 {
+			productID = 1
+		}
+		mustExec(t, store, "INSERT INTO order_items (order_id, product_id, quantity, unit_price, item_vat) VALUES ($1, $2, 1, 0, 0)", id, productID)
+	}
+}
+
+func listOrders(t *testing.T, router *mux.Router, query string) (int, OrderPage) {
+	rr := doJSON(router, "GET", "/orders?"+query, "")
+	var page OrderPage
+	if rr.Code == http.StatusOK {
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&page))
+	}
+	return rr.Code, page
+}
+
+func TestListOrdersHandler_CursorPagination(t *testing.T) {
+	store := NewInMemoryStore()
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	seedOrders(t, store, 5, base)
+	router := mux.NewRouter()
+	router.HandleFunc("/orders", listOrdersHandler(&InMemoryDB{store: store})).Methods("GET")
+
+	var seen []string
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		code, page := listOrders(t, router, "sort=created_at&limit=2&cursor="+cursor)
+		assert.Equal(t, http.StatusOK, code)
+		for _, o := range page.Orders {
+			seen = append(seen, o.OrderID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	assert.Equal(t, []string{"order-00", "order-01", "order-02", "order-03", "order-04"}, seen)
+
+	// newest first is the default
+	code, page := listOrders(t, router, "limit=1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "order-04", page.Orders[0].OrderID)
+}
+
+func TestListOrdersHandler_Filters(t *testing.T) {
+	store := NewInMemoryStore()
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	seedOrders(t, store, 6, base)
+	router := mux.NewRouter()
+	router.HandleFunc("/orders", listOrdersHandler(&InMemoryDB{store: store})).Methods("GET")
+
+	code, page := listOrders(t, router, "product_id=1&sort=-total&currency=eur")
+	assert.Equal(t, http.StatusOK, code)
+	var ids []string
+	for _, o := range page.Orders {
+		ids = append(ids, o.OrderID)
+	}
+	assert.Equal(t, []string{"order-00", "order-02", "order-04"}, ids)
+
+	code, page = listOrders(t, router, "min_total=20.00&max_total=40&created_from=2026-01-01T03:00:00Z&sort=total&currency=EUR")
+	assert.Equal(t, http.StatusOK, code)
+	ids = nil
+	for _, o := range page.Orders {
+		ids = append(ids, o.OrderID)
+	}
+	assert.Equal(t, []string{"order-04", "order-03"}, ids)
+	assert.Empty(t, page.NextCursor)
+
+	// totals are only compared within the currency asked for
+	mustExec(t, store, "INSERT INTO orders (order_id, total_price, vat_amount, currency, created_at) VALUES ($1, $2, $3, $4, $5)",
+		"order-jpy", NewMoney(12918, "JPY"), NewMoney(0, "JPY"), "JPY", base)
+	code, page = listOrders(t, router, "min_total=55&currency=EUR")
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, page.Orders, 1)
+	assert.Equal(t, "order-00", page.Orders[0].OrderID)
+	code, page = listOrders(t, router, "sort=-total&currency=JPY")
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, page.Orders, 1)
+	assert.Equal(t, MustParseMoney("12918", "JPY"), page.Orders[0].TotalOrderPrice)
+}
+
+func TestListOrdersHandler_BadParameters(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/orders", listOrdersHandler(&MockDB{})).Methods("GET")
+
+	for _, q := range []string{
+		"sort=name",
+		"limit=1000",
+		"created_from=yesterday",
+		"min_total=abc&currency=EUR",
+		"min_total=10",
+		"sort=-total",
+		"currency=euro",
+		"cursor=not-a-cursor",
+		"sort=total&currency=EUR&cursor=" + orderCursor{SortBy: OrderSortCreatedAt, Value: "2026-01-01T00:00:00Z", OrderID: "x"}.encode(),
+	} {
+		code, _ := listOrders(t, router, q)
+		assert.Equal(t, http.StatusBadRequest, code, q)
+	}
+}
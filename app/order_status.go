@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OrderStatus is the lifecycle state of an order.
+type OrderStatus string
+
+const (
+	StatusPending   OrderStatus = "pending"
+	StatusPaid      OrderStatus = "paid"
+	StatusFulfilled OrderStatus = "fulfilled"
+	StatusShipped   OrderStatus = "shipped"
+	StatusDelivered OrderStatus = "delivered"
+	StatusCancelled OrderStatus = "cancelled"
+	StatusRefunded  OrderStatus = "refunded"
+)
+
+// orderTransitions lists, for every status, the statuses an order may move to.
+// Statuses without an entry are terminal.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	StatusPending:   {StatusPaid, StatusCancelled},
+	StatusPaid:      {StatusFulfilled, StatusCancelled, StatusRefunded},
+	StatusFulfilled: {StatusShipped, StatusCancelled},
+	StatusShipped:   {StatusDelivered},
+	StatusDelivered: {StatusRefunded},
+	StatusCancelled: {StatusRefunded},
+}
+
+// setByPayments reports whether an order reaches status s through its payments
+// alone: capturing one marks it paid and refunding them in full refunds it.
+func setByPayments(s OrderStatus) bool {
+	return s == StatusPaid || s == StatusRefunded
+}
+
+// ErrInvalidTransition is returned when the transition table does not allow a status change.
+var ErrInvalidTransition = errors.New("invalid order status transition")
+
+// Valid reports whether s is one of the known statuses.
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case StatusPending, StatusPaid, StatusFulfilled, StatusShipped,
+		StatusDelivered, StatusCancelled, StatusRefunded:
+		return true
+	}
+	return false
+}
+
+// CanTransition reports whether an order in status from may move to status to.
+func CanTransition(from, to OrderStatus) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderStatusChange is a row of the 'order_status_history' table. FromStatus is
+// empty for the entry written when the order is created.
+type OrderStatusChange struct {
+	OrderID    string      `json:"-"`
+	FromStatus OrderStatus `json:"from,omitempty"`
+	ToStatus   OrderStatus `json:"to"`
+	Note       string      `json:"note,omitempty"`
+	ChangedAt  time.Time   `json:"changed_at"`
+}
+
+// TransitionRequest is the request body of POST /orders/{id}/transitions.
+type TransitionRequest struct {
+	Status OrderStatus `json:"status"`
+	Note   string      `json:"note"`
+}
+
+// --- Order Status Database Functions ---
+
+// reads the current status of an order, locking the row until the transaction ends.
+func GetOrderStatusForUpdate(executor TxExecutor, orderID string) (OrderStatus, error) {
+	var status string
+	err := executor.QueryRow("SELECT status FROM orders WHERE order_id = $1 FOR UPDATE", orderID).Scan(&status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("order not found: %w", sql.ErrNoRows)
+		}
+		return "", fmt.Errorf("failed to read order status: %w", err)
+	}
+	return OrderStatus(status), nil
+}
+
+// records a status change in the 'order_status_history' table.
+func InsertOrderStatusChange(executor TxExecutor, change *OrderStatusChange) error {
+	_, err := executor.Exec("INSERT INTO order_status_history (order_id, from_status, to_status, note, changed_at) VALUES ($1, $2, $3, $4, $5)",
+		change.OrderID, string(change.FromStatus), string(change.ToStatus), change.Note, change.ChangedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert order status change: %w", err)
+	}
+	return nil
+}
+
+// fetches the status history of an order, oldest first.
+func GetOrderStatusHistory(executor Queryer, orderID string) ([]OrderStatusChange, error) {
+	rows, err := executor.Query("SELECT from_status, to_status, note, changed_at FROM order_status_history WHERE order_id = $1 ORDER BY changed_at, id", orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query order status history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []OrderStatusChange{}
+	for rows.Next() {
+		var from, to string
+		change := OrderStatusChange{OrderID: orderID}
+		if err := rows.Scan(&from, &to, &change.Note, &change.ChangedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan order status history row: %w", err)
+		}
+		change.FromStatus, change.ToStatus = OrderStatus(from), OrderStatus(to)
+		history = append(history, change)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during order status history iteration: %w", err)
+	}
+	return history, nil
+}
+
+// TransitionOrder moves an order to a new status inside tx, enforcing the
+// transition table and appending to the status history. It returns the change
+// written, or an error wrapping ErrInvalidTransition or sql.ErrNoRows.
+func TransitionOrder(tx TxExecutor, orderID string, to OrderStatus, note string, now time.Time) (*OrderStatusChange, error) {
+	from, err := GetOrderStatusForUpdate(tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !CanTransition(from, to) {
+		return nil, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+
+	res, err := tx.Exec("UPDATE orders SET status = $1 WHERE order_id = $2 AND status = $3", string(to), orderID, string(from))
+	if err != nil {
+		return nil, fmt.Errorf("failed to update order status: %w", err)
+	}
+	if err := requireRowAffected(res, "order not found"); err != nil {
+		return nil, err
+	}
+
+	change := &OrderStatusChange{OrderID: orderID, FromStatus: from, ToStatus: to, Note: note, ChangedAt: now}
+	if err := InsertOrderStatusChange(tx, change); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// --- Order Status HTTP Handlers ---
+
+// maps an order lookup or lifecycle failure to the API error sent to the client.
+func orderError(err error) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNotFound("Order not found")
+	case errors.Is(err, ErrInvalidTransition):
+		return ErrConflict(CodeInvalidTransition, "%s", err.Error())
+	case errors.Is(err, ErrOrderNotCancellable):
+		return ErrConflict(CodeOrderNotCancellable, "%s", err.Error())
+	}
+	return err
+}
+
+// POST /orders/{id}/transitions
+func transitionOrderHandler(executor DBExecutor, provider PaymentProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID := mux.Vars(r)["id"]
+
+		var req TransitionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		if !req.Status.Valid() {
+			writeError(w, r, ErrValidation(FieldError{Field: "status", Message: fmt.Sprintf("unknown order status %q", req.Status)}))
+			return
+		}
+		if setByPayments(req.Status) {
+			writeError(w, r, ErrConflict(CodeInvalidTransition, "orders become %s through their payments", req.Status))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if req.Status == StatusCancelled {
+			// cancellations also record their reason on the order
+			err = CancelOrder(tx, orderID, req.Note, time.Now())
+		} else {
+			_, err = TransitionOrder(tx, orderID, req.Status, req.Note, time.Now())
+		}
+		if err != nil {
+			writeError(w, r, orderError(err))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if req.Status == StatusCancelled {
+			if err := releaseCancelledOrderPayments(executor, provider, orderID); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+
+		order, err := GetOrderByID(executor, orderID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(order)
+	}
+}
+
+// GET /orders/{id}/transitions
+func getOrderHistoryHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID := mux.Vars(r)["id"]
+
+		if _, err := GetOrderByID(executor, orderID); err != nil {
+			writeError(w, r, orderError(err))
+			return
+		}
+
+		history, err := GetOrderStatusHistory(executor, orderID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(history)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanTransition(t *testing.T) {
+	assert.True(t, CanTransition(StatusPending, StatusPaid))
+	assert.True(t, CanTransition(StatusPaid, StatusFulfilled))
+	assert.True(t, CanTransition(StatusShipped, StatusDelivered))
+	assert.True(t, CanTransition(StatusDelivered, StatusRefunded))
+
+	assert.False(t, CanTransition(StatusPending, StatusShipped))
+	assert.False(t, CanTransition(StatusShipped, StatusCancelled))
+	assert.False(t, CanTransition(StatusRefunded, StatusPaid))
+	assert.False(t, CanTransition(StatusPaid, StatusPaid))
+}
+
+// newOrdersRouter wires the order routes on an in-memory store with the sample catalog.
+func newOrdersRouter(store *InMemoryStore) *mux.Router {
+	executor := &InMemoryDB{store: store}
+	payments := NewFakePaymentProvider()
+	router := mux.NewRouter()
+	router.HandleFunc("/order", createOrderHandler(executor)).Methods("POST")
+	router.HandleFunc("/orders", listOrdersHandler(executor)).Methods("GET")
+	router.HandleFunc("/orders/quote", quoteOrderHandler(executor)).Methods("POST")
+	router.HandleFunc("/orders/{id}", getOrderHandler(executor)).Methods("GET")
+	router.HandleFunc("/orders/{id}/transitions", transitionOrderHandler(executor, payments)).Methods("POST")
+	router.HandleFunc("/orders/{id}/transitions", getOrderHistoryHandler(executor)).Methods("GET")
+	router.HandleFunc("/orders/{id}/cancel", cancelOrderHandler(executor, payments)).Methods("POST")
+	router.HandleFunc("/orders/{id}/payments", createPaymentHandler(executor, payments)).Methods("POST")
+	router.HandleFunc("/orders/{id}/payments", getOrderPaymentsHandler(executor)).Methods("GET")
+	router.HandleFunc("/payments/{id}", getPaymentHandler(executor)).Methods("GET")
+	router.HandleFunc("/payments/{id}/capture", capturePaymentHandler(executor, payments)).Methods("POST")
+	router.HandleFunc("/payments/{id}/void", voidPaymentHandler(executor, payments)).Methods("POST")
+	router.HandleFunc("/payments/{id}/refund", refundPaymentHandler(executor, payments)).Methods("POST")
+	router.HandleFunc("/webhooks/payments", paymentWebhookHandler(executor, payments)).Methods("POST")
+	router.HandleFunc("/products/{id}/stock", getStockHandler(executor)).Methods("GET")
+	router.HandleFunc("/products/{id}/stock", adjustStockHandler(executor)).Methods("PUT")
+	router.HandleFunc("/warehouses", getWarehousesHandler(executor)).Methods("GET")
+	router.HandleFunc("/warehouses", createWarehouseHandler(executor)).Methods("POST")
+	router.HandleFunc("/tax-rules", getTaxRulesHandler(executor)).Methods("GET")
+	router.HandleFunc("/tax-rules", saveTaxRuleHandler(executor)).Methods("POST")
+	router.HandleFunc("/tax-rules/{id}", getTaxRuleHandler(executor)).Methods("GET")
+	router.HandleFunc("/tax-rules/{id}", saveTaxRuleHandler(executor)).Methods("PUT")
+	router.HandleFunc("/shipping-zones", getShippingZonesHandler(executor)).Methods("GET")
+	router.HandleFunc("/shipping-zones", saveShippingZoneHandler(executor)).Methods("POST")
+	router.HandleFunc("/shipping-zones/{id}", getShippingZoneHandler(executor)).Methods("GET")
+	router.HandleFunc("/shipping-zones/{id}", saveShippingZoneHandler(executor)).Methods("PUT")
+	router.HandleFunc("/exchange-rates", getExchangeRatesHandler(executor)).Methods("GET")
+	router.HandleFunc("/exchange-rates", saveExchangeRateHandler(executor)).Methods("POST")
+	router.HandleFunc("/customers", getCustomersHandler(executor)).Methods("GET")
+	router.HandleFunc("/customers", createCustomerHandler(executor)).Methods("POST")
+	router.HandleFunc("/customers/{id}", getCustomerHandler(executor)).Methods("GET")
+	router.HandleFunc("/customers/{id}", updateCustomerHandler(executor)).Methods("PUT", "PATCH")
+	router.HandleFunc("/customers/{id}", deleteCustomerHandler(executor)).Methods("DELETE")
+	router.HandleFunc("/customers/{id}/orders", getCustomerOrdersHandler(executor)).Methods("GET")
+	router.HandleFunc("/coupons", getCouponsHandler(executor)).Methods("GET")
+	router.HandleFunc("/coupons", createCouponHandler(executor)).Methods("POST")
+	router.HandleFunc("/coupons/{code}", getCouponHandler(executor)).Methods("GET")
+	router.HandleFunc("/coupons/{code}", updateCouponHandler(executor)).Methods("PUT")
+	router.HandleFunc("/coupons/{code}", deleteCouponHandler(executor)).Methods("DELETE")
+	router.HandleFunc("/carts", createCartHandler(executor)).Methods("POST")
+	router.HandleFunc("/carts/{id}", getCartHandler(executor)).Methods("GET")
+	router.HandleFunc("/carts/{id}/items", setCartItemsHandler(executor)).Methods("PUT")
+	router.HandleFunc("/carts/{id}/checkout", checkoutCartHandler(executor)).Methods("POST")
+	return router
+}
+
+// places an order through the API and returns the decoded response.
+func placeOrder(t *testing.T, router http.Handler, body string) OutgoingOrder {
+	rr := doJSON(router, "POST", "/order", body)
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var order OutgoingOrder
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&order))
+	return order
+}
+
+func TestTransitionOrderHandler_InMemory(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	order := placeOrder(t, router, `{"items":[{"product_id":1,"quantity":1}]}`)
+	assert.Equal(t, StatusPending, order.Status)
+
+	// only payments mark an order paid or refunded
+	for _, status := range []string{"paid", "refunded"} {
+		rr := doJSON(router, "POST", "/orders/"+order.OrderID+"/transitions", `{"status":"`+status+`"}`)
+		assert.Equal(t, http.StatusConflict, rr.Code, status)
+		assert.Equal(t, CodeInvalidTransition, errorCode(t, rr.Body.Bytes()), status)
+	}
+	createPayment(t, router, order.OrderID, `{"source":"tok_visa"}`)
+
+	rr := doJSON(router, "POST", "/orders/"+order.OrderID+"/transitions", `{"status":"fulfilled","note":"packed"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var updated OutgoingOrder
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&updated))
+	assert.Equal(t, StatusFulfilled, updated.Status)
+
+	rr = doJSON(router, "POST", "/orders/"+order.OrderID+"/transitions", `{"status":"delivered"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	stored, err := GetOrderByID(&InMemoryDB{store: store}, order.OrderID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusFulfilled, stored.Status)
+
+	rr = doJSON(router, "POST", "/orders/"+order.OrderID+"/transitions", `{"status":"lost"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = doJSON(router, "POST", "/orders/missing/transitions", `{"status":"fulfilled"}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = doJSON(router, "GET", "/orders/"+order.OrderID+"/transitions", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var history []OrderStatusChange
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&history))
+	if assert.Len(t, history, 3) {
+		assert.Equal(t, OrderStatus(""), history[0].FromStatus)
+		assert.Equal(t, StatusPending, history[0].ToStatus)
+		assert.Equal(t, StatusPending, history[1].FromStatus)
+		assert.Equal(t, StatusPaid, history[1].ToStatus)
+		assert.Equal(t, StatusPaid, history[2].FromStatus)
+		assert.Equal(t, StatusFulfilled, history[2].ToStatus)
+		assert.Equal(t, "packed", history[2].Note)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PaymentSignatureHeader carries the signature of a payment webhook:
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">". Several v1
+// entries may be sent while a secret is being rotated.
+const PaymentSignatureHeader = "Payment-Signature"
+
+// PaymentWebhookSecret is the secret shared with the payment provider to sign
+// webhooks; set from PAYMENT_WEBHOOK_SECRET in main. Without it every webhook
+// is rejected.
+var PaymentWebhookSecret = ""
+
+// PaymentWebhookTolerance is how far the signing time of a webhook may be from
+// ours; set from PAYMENT_WEBHOOK_TOLERANCE in main.
+var PaymentWebhookTolerance = 5 * time.Minute
+
+// the largest webhook body read.
+const maxPaymentWebhookBytes = 1 << 20
+
+// ErrInvalidSignature is returned for a webhook whose signature does not
+// match its body or is too old.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// PaymentEventType is what a payment webhook reports.
+type PaymentEventType string
+
+const (
+	PaymentEventCaptured PaymentEventType = "payment.captured"
+	PaymentEventFailed   PaymentEventType = "payment.failed"
+	PaymentEventRefunded PaymentEventType = "payment.refunded"
+)
+
+// PaymentEvent is the body of a payment webhook. Reference is the provider's
+// reference of the payment; RefundID identifies the refund of a refunded
+// event and Amount is the amount it refunded, decoded in the payment's
+// currency, all that is left when missing. Reason is why a payment failed.
+type PaymentEvent struct {
+	ID        string           `json:"id"`
+	Type      PaymentEventType `json:"type"`
+	Reference string           `json:"reference"`
+	RefundID  string           `json:"refund_id,omitempty"`
+	Amount    json.RawMessage  `json:"amount,omitempty"`
+	Reason    string           `json:"reason,omitempty"`
+}
+
+// PaymentEventResult is the response to a payment webhook. Status is
+// "applied", "duplicate" for an event received before, or "ignored" for an
+// event of another type, that changes nothing or that no longer applies to
+// its payment; Reason says why an event was ignored.
+type PaymentEventResult struct {
+	EventID string   `json:"event_id"`
+	Status  string   `json:"status"`
+	Reason  string   `json:"reason,omitempty"`
+	Payment *Payment `json:"payment,omitempty"`
+}
+
+// decodes the amount of a refunded event in currency; ok is false without one.
+func (e *PaymentEvent) amount(currency string) (amount Money, ok bool, err error) {
+	if len(e.Amount) == 0 || string(e.Amount) == "null" {
+		return Money{}, false, nil
+	}
+	amount = Money{Currency: currency}
+	if err := json.Unmarshal(e.Amount, &amount); err != nil {
+		return Money{}, false, err
+	}
+	return amount, true, nil
+}
+
+// the hex HMAC-SHA256 of "<timestamp>.<body>".
+func paymentWebhookMAC(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignPaymentWebhook returns the PaymentSignatureHeader of body signed at t.
+func SignPaymentWebhook(secret string, body []byte, t time.Time) string {
+	return fmt.Sprintf("t=%d,v1=%s", t.Unix(), paymentWebhookMAC(secret, t.Unix(), body))
+}
+
+// VerifyPaymentWebhook checks that header signs body with secret, at a time
+// within tolerance of now. Failures wrap ErrInvalidSignature.
+func VerifyPaymentWebhook(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	if secret == "" {
+		return fmt.Errorf("%w: no webhook secret is configured", ErrInvalidSignature)
+	}
+	var timestamp int64
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp <= 0 || len(signatures) == 0 {
+		return fmt.Errorf("%w: malformed %s header", ErrInvalidSignature, PaymentSignatureHeader)
+	}
+	if age := now.Sub(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: signed %s ago, outside the tolerance of %s", ErrInvalidSignature, age.Round(time.Second), tolerance)
+	}
+	expected := []byte(paymentWebhookMAC(secret, timestamp, body))
+	for _, signature := range signatures {
+		if hmac.Equal(expected, []byte(signature)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: signature does not match", ErrInvalidSignature)
+}
+
+// PaymentWebhookSender stands in for a payment provider delivering webhooks,
+// in tests and local runs: it signs events with the shared secret and posts
+// them to URL.
+type PaymentWebhookSender struct {
+	URL    string
+	Secret string
+	Client *http.Client     // http.DefaultClient if nil
+	Now    func() time.Time // time.Now if nil; an earlier time sends stale events
+}
+
+// Request returns the signed request delivering event, giving it an ID if it has none.
+func (s *PaymentWebhookSender) Request(event *PaymentEvent) (*http.Request, error) {
+	if event.ID == "" {
+		event.ID = "evt_" + uuid.New().String()
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(PaymentSignatureHeader, SignPaymentWebhook(s.Secret, body, now()))
+	return req, nil
+}
+
+// Send delivers event and returns the status code of the response.
+func (s *PaymentWebhookSender) Send(event *PaymentEvent) (int, error) {
+	req, err := s.Request(event)
+	if err != nil {
+		return 0, err
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	return res.StatusCode, nil
+}
+
+// --- Payment Event Database Functions ---
+
+// fetches the payment a provider knows by reference, locking it until the transaction ends.
+func GetPaymentByReferenceForUpdate(executor TxExecutor, provider, reference string) (*Payment, error) {
+	return getPayment(executor, "SELECT "+paymentColumns+" FROM payments WHERE provider = $1 AND reference = $2 FOR UPDATE", provider, reference)
+}
+
+// records an event received from a provider. It returns false, writing
+// nothing, if the event was received before.
+func InsertPaymentEvent(executor TxExecutor, provider string, event *PaymentEvent, paymentID int, now time.Time) (bool, error) {
+	var id interface{}
+	if paymentID != 0 {
+		id = paymentID
+	}
+	var eventID string
+	err := executor.QueryRow("INSERT INTO payment_events (provider, event_id, type, payment_id, received_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (provider, event_id) DO NOTHING RETURNING event_id",
+		provider, event.ID, string(event.Type), id, now).Scan(&eventID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to insert payment event: %w", err)
+	}
+	return true, nil
+}
+
+// ApplyPaymentEvent records event inside tx and applies it to its payment and
+// the payment's order. It returns the result sent back to the provider; the
+// payment of an event already received, or of another type, is left alone,
+// and so is that of a refund already recorded, by a refund made here or an
+// earlier event. An event the payment has moved past, such as the failure of
+// a payment since captured or a refund of more than is left, is recorded but
+// ignored, as delivering it again would not apply it either; only a refund of
+// a payment whose capture is not known yet fails, to be delivered again.
+func ApplyPaymentEvent(tx TxExecutor, provider string, event *PaymentEvent, now time.Time) (*PaymentEventResult, error) {
+	result := &PaymentEventResult{EventID: event.ID, Status: "applied"}
+	switch event.Type {
+	case PaymentEventCaptured, PaymentEventFailed, PaymentEventRefunded:
+	default:
+		result.Status = "ignored"
+		if inserted, err := InsertPaymentEvent(tx, provider, event, 0, now); err != nil || !inserted {
+			result.Status = "duplicate"
+			return result, err
+		}
+		return result, nil
+	}
+
+	payment, err := GetPaymentByReferenceForUpdate(tx, provider, event.Reference)
+	if err != nil {
+		return nil, err
+	}
+	result.Payment = payment
+	if inserted, err := InsertPaymentEvent(tx, provider, event, payment.ID, now); err != nil || !inserted {
+		result.Status = "duplicate"
+		return result, err
+	}
+
+	refunded := false
+	amount := payment.refundable()
+	if event.Type == PaymentEventRefunded {
+		if refunded, err = HasPaymentRefund(tx, payment.ID, event.RefundID); err != nil {
+			return nil, err
+		}
+		if a, ok, err := event.amount(payment.Amount.Currency); err != nil {
+			return nil, fmt.Errorf("%w: amount of event %s: %v", ErrInvalidPaymentState, event.ID, err)
+		} else if ok {
+			amount = a
+		}
+	}
+	switch {
+	case event.Type == PaymentEventCaptured && payment.Status == PaymentCaptured,
+		event.Type == PaymentEventFailed && payment.Status == PaymentFailed,
+		refunded:
+		// already known, from our own call to the provider or an earlier event
+		result.Status = "ignored"
+	case event.Type == PaymentEventRefunded && payment.Status == PaymentAuthorized:
+		return nil, fmt.Errorf("%w: payment %d is not captured yet", ErrInvalidPaymentState, payment.ID)
+	case event.Type != PaymentEventRefunded && payment.Status != PaymentAuthorized,
+		event.Type == PaymentEventRefunded && payment.Status != PaymentCaptured:
+		result.Status, result.Reason = "ignored", fmt.Sprintf("payment is %s", payment.Status)
+	case event.Type == PaymentEventRefunded && !payment.canRefund(amount):
+		result.Status, result.Reason = "ignored", fmt.Sprintf("cannot refund %s, %s is refundable", amount, payment.refundable())
+	case event.Type == PaymentEventCaptured:
+		err = RecordPaymentCapture(tx, payment, now)
+	case event.Type == PaymentEventFailed:
+		reason := event.Reason
+		if reason == "" {
+			reason = "failed at the provider"
+		}
+		err = RecordPaymentFailure(tx, payment, reason, now)
+	case event.Type == PaymentEventRefunded:
+		err = RecordPaymentRefund(tx, payment, event.RefundID, amount, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// --- Payment Webhook HTTP Handlers ---
+
+// POST /webhooks/payments receives the events of the payment provider. The
+// body must be signed with PaymentWebhookSecret within PaymentWebhookTolerance
+// (401 otherwise); the event is recorded and applied in one transaction, so a
+// failed delivery can be retried and a repeated one is answered "duplicate".
+// Only failures a later delivery may get past are answered with an error;
+// events that can never apply are answered "ignored".
+func paymentWebhookHandler(executor DBExecutor, provider PaymentProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPaymentWebhookBytes))
+		if err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		if err := VerifyPaymentWebhook(PaymentWebhookSecret, r.Header.Get(PaymentSignatureHeader), body, PaymentWebhookTolerance, time.Now()); err != nil {
+			writeError(w, r, NewAPIError(http.StatusUnauthorized, CodeInvalidSignature, "%s", err.Error()))
+			return
+		}
+
+		var event PaymentEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		var fields []FieldError
+		if event.ID == "" {
+			fields = append(fields, FieldError{Field: "id", Message: "is required"})
+		}
+		if event.Type == "" {
+			fields = append(fields, FieldError{Field: "type", Message: "is required"})
+		}
+		if event.Reference == "" && strings.HasPrefix(string(event.Type), "payment.") {
+			fields = append(fields, FieldError{Field: "reference", Message: "is required"})
+		}
+		if event.RefundID == "" && event.Type == PaymentEventRefunded {
+			fields = append(fields, FieldError{Field: "refund_id", Message: "is required"})
+		}
+		if _, _, err := event.amount(DefaultCurrency); err != nil {
+			fields = append(fields, FieldError{Field: "amount", Message: err.Error()})
+		}
+		if len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		result, err := ApplyPaymentEvent(tx, provider.Name(), &event, time.Now())
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				err = ErrNotFound("No %s payment with reference %s", provider.Name(), event.Reference)
+			}
+			writeError(w, r, paymentError(err))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// delivers event to router through sender and returns the response.
+func deliver(t *testing.T, router http.Handler, sender *PaymentWebhookSender, event PaymentEvent) *httptest.ResponseRecorder {
+	req, err := sender.Request(&event)
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// decodes the response to a webhook that was accepted.
+func eventResult(t *testing.T, rr *httptest.ResponseRecorder) PaymentEventResult {
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var result PaymentEventResult
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&result))
+	return result
+}
+
+func TestVerifyPaymentWebhook(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":"evt_1"}`)
+	header := SignPaymentWebhook(testWebhookSecret, body, now)
+	assert.NoError(t, VerifyPaymentWebhook(testWebhookSecret, header, body, time.Minute, now.Add(30*time.Second)))
+
+	// a rotated secret: either signature will do
+	rotated := header + ",v1=" + paymentWebhookMAC("whsec_new", now.Unix(), body)
+	assert.NoError(t, VerifyPaymentWebhook("whsec_new", rotated, body, time.Minute, now))
+
+	for name, err := range map[string]error{
+		"wrong secret":    VerifyPaymentWebhook("whsec_other", header, body, time.Minute, now),
+		"tampered body":   VerifyPaymentWebhook(testWebhookSecret, header, []byte(`{"id":"evt_2"}`), time.Minute, now),
+		"stale":           VerifyPaymentWebhook(testWebhookSecret, header, body, time.Minute, now.Add(2*time.Minute)),
+		"from the future": VerifyPaymentWebhook(testWebhookSecret, header, body, time.Minute, now.Add(-2*time.Minute)),
+		"malformed":       VerifyPaymentWebhook(testWebhookSecret, "v1=abc", body, time.Minute, now),
+		"no secret":       VerifyPaymentWebhook("", header, body, time.Minute, now),
+	} {
+		assert.ErrorIs(t, err, ErrInvalidSignature, name)
+	}
+}
+
+func TestPaymentWebhooks(t *testing.T) {
+	secret := PaymentWebhookSecret
+	PaymentWebhookSecret = testWebhookSecret
+	t.Cleanup(func() { PaymentWebhookSecret = secret })
+
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	sender := &PaymentWebhookSender{URL: "/webhooks/payments", Secret: testWebhookSecret}
+
+	order := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}]}`)
+	payment := createPayment(t, router, order.OrderID, `{"source":"tok_visa","capture":false}`)
+
+	// signatures are checked before anything else
+	stale := &PaymentWebhookSender{URL: sender.URL, Secret: testWebhookSecret, Now: func() time.Time { return time.Now().Add(-time.Hour) }}
+	forged := &PaymentWebhookSender{URL: sender.URL, Secret: "whsec_forged"}
+	for _, s := range []*PaymentWebhookSender{stale, forged} {
+		rr := deliver(t, router, s, PaymentEvent{Type: PaymentEventCaptured, Reference: payment.Reference})
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, CodeInvalidSignature, errorCode(t, rr.Body.Bytes()))
+	}
+	assert.Equal(t, StatusPending, orderStatus(t, router, order.OrderID))
+
+	captured := PaymentEvent{ID: "evt_captured", Type: PaymentEventCaptured, Reference: payment.Reference}
+	result := eventResult(t, deliver(t, router, sender, captured))
+	assert.Equal(t, "applied", result.Status)
+	require.NotNil(t, result.Payment)
+	assert.Equal(t, PaymentCaptured, result.Payment.Status)
+	assert.Equal(t, StatusPaid, orderStatus(t, router, order.OrderID))
+
+	// a redelivery is not applied again, nor is a capture already known
+	assert.Equal(t, "duplicate", eventResult(t, deliver(t, router, sender, captured)).Status)
+	assert.Equal(t, "ignored", eventResult(t, deliver(t, router, sender, PaymentEvent{Type: PaymentEventCaptured, Reference: payment.Reference})).Status)
+
+	// an event that can never apply is recorded and ignored, so it is not delivered again
+	tooMuch := PaymentEvent{ID: "evt_too_much", Type: PaymentEventRefunded, Reference: payment.Reference, RefundID: "re_0", Amount: json.RawMessage(`1000`)}
+	result = eventResult(t, deliver(t, router, sender, tooMuch))
+	assert.Equal(t, "ignored", result.Status)
+	assert.Contains(t, result.Reason, "cannot refund")
+	assert.Equal(t, "duplicate", eventResult(t, deliver(t, router, sender, tooMuch)).Status)
+	failed := PaymentEvent{Type: PaymentEventFailed, Reference: payment.Reference}
+	result = eventResult(t, deliver(t, router, sender, failed))
+	assert.Equal(t, "ignored", result.Status)
+	assert.Equal(t, PaymentCaptured, result.Payment.Status)
+	rr := deliver(t, router, sender, PaymentEvent{Type: PaymentEventRefunded, Reference: payment.Reference, RefundID: "re_x", Amount: json.RawMessage(`"ten"`)})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"amount"`)
+
+	partial := MustParseMoney("10.00", DefaultCurrency)
+	refund := PaymentEvent{ID: "evt_refund", Type: PaymentEventRefunded, Reference: payment.Reference, RefundID: "re_1", Amount: json.RawMessage(`10`)}
+	result = eventResult(t, deliver(t, router, sender, refund))
+	assert.Equal(t, "applied", result.Status)
+	assert.Equal(t, partial, result.Payment.Refunded)
+	assert.Equal(t, StatusPaid, orderStatus(t, router, order.OrderID))
+
+	// the same refund reported by another event is not counted twice
+	again := PaymentEvent{Type: PaymentEventRefunded, Reference: payment.Reference, RefundID: "re_1", Amount: json.RawMessage(`10`)}
+	assert.Equal(t, "ignored", eventResult(t, deliver(t, router, sender, again)).Status)
+
+	result = eventResult(t, deliver(t, router, sender, PaymentEvent{Type: PaymentEventRefunded, Reference: payment.Reference, RefundID: "re_2"}))
+	assert.Equal(t, PaymentRefunded, result.Payment.Status)
+	assert.Equal(t, payment.Amount, result.Payment.Refunded)
+	assert.Equal(t, StatusRefunded, orderStatus(t, router, order.OrderID))
+
+	// nor is a refund made through the API, when the provider reports it
+	other := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}]}`)
+	payment = createPayment(t, router, other.OrderID, `{"source":"tok_visa"}`)
+	rr = doJSON(router, "POST", fmt.Sprintf("/payments/%d/refund", payment.ID), `{"amount":10}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = doJSON(router, "GET", fmt.Sprintf("/payments/%d", payment.ID), "")
+	var refunded Payment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&refunded))
+	require.Len(t, refunded.Refunds, 1)
+	assert.Equal(t, partial, refunded.Refunds[0].Amount)
+	ownRefund := PaymentEvent{Type: PaymentEventRefunded, Reference: payment.Reference, RefundID: refunded.Refunds[0].RefundID, Amount: json.RawMessage(`10`)}
+	result = eventResult(t, deliver(t, router, sender, ownRefund))
+	assert.Equal(t, "ignored", result.Status)
+	assert.Equal(t, partial, result.Payment.Refunded)
+
+	// a failed authorization leaves the order awaiting payment; its refund
+	// may come before its capture, and fails until the capture is known
+	other = placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}]}`)
+	payment = createPayment(t, router, other.OrderID, `{"source":"tok_visa","capture":false}`)
+	rr = deliver(t, router, sender, PaymentEvent{Type: PaymentEventRefunded, Reference: payment.Reference, RefundID: "re_early"})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	result = eventResult(t, deliver(t, router, sender, PaymentEvent{Type: PaymentEventFailed, Reference: payment.Reference, Reason: "authorization expired"}))
+	assert.Equal(t, PaymentFailed, result.Payment.Status)
+	assert.Equal(t, "authorization expired", result.Payment.FailureReason)
+	assert.Equal(t, StatusPending, orderStatus(t, router, other.OrderID))
+
+	assert.Equal(t, "ignored", eventResult(t, deliver(t, router, sender, PaymentEvent{Type: "dispute.created"})).Status)
+	rr = deliver(t, router, sender, PaymentEvent{Type: PaymentEventCaptured, Reference: "fake_unknown"})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = deliver(t, router, sender, PaymentEvent{Type: PaymentEventCaptured})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"reference"`)
+	rr = deliver(t, router, sender, PaymentEvent{Type: PaymentEventRefunded, Reference: payment.Reference})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"refund_id"`)
+}
+
+func TestPaymentWebhooks_RefundInPaymentCurrency(t *testing.T) {
+	secret := PaymentWebhookSecret
+	PaymentWebhookSecret = testWebhookSecret
+	t.Cleanup(func() { PaymentWebhookSecret = secret })
+
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	sender := &PaymentWebhookSender{URL: "/webhooks/payments", Secret: testWebhookSecret}
+	rr := doJSON(router, "POST", "/exchange-rates", `{"currency":"USD","rate":1.08,"valid_from":"2020-01-01T00:00:00Z"}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+	order := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}],"currency":"USD"}`)
+	payment := createPayment(t, router, order.OrderID, `{"source":"tok_visa"}`)
+	result := eventResult(t, deliver(t, router, sender, PaymentEvent{Type: PaymentEventRefunded, Reference: payment.Reference, RefundID: "re_1", Amount: json.RawMessage(`10`)}))
+	assert.Equal(t, "applied", result.Status)
+	assert.Equal(t, MustParseMoney("10.00", "USD"), result.Payment.Refunded)
+
+	// an amount in another currency can never be refunded
+	result = eventResult(t, deliver(t, router, sender, PaymentEvent{Type: PaymentEventRefunded, Reference: payment.Reference, RefundID: "re_2", Amount: json.RawMessage(`{"amount":10,"currency":"EUR"}`)}))
+	assert.Equal(t, "ignored", result.Status)
+	assert.Equal(t, MustParseMoney("10.00", "USD"), result.Payment.Refunded)
+}
+
+func TestPaymentWebhookSender_Send(t *testing.T) {
+	secret := PaymentWebhookSecret
+	PaymentWebhookSecret = testWebhookSecret
+	t.Cleanup(func() { PaymentWebhookSecret = secret })
+
+	server := httptest.NewServer(newOrdersRouter(NewInMemoryStore()))
+	defer server.Close()
+	sender := &PaymentWebhookSender{URL: server.URL + "/webhooks/payments", Secret: testWebhookSecret}
+
+	event := PaymentEvent{Type: "dispute.created"}
+	status, err := sender.Send(&event)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, strings.HasPrefix(event.ID, "evt_"))
+}
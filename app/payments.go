@@ -0,0 +1,839 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// PaymentStatus is the state of a payment.
+type PaymentStatus string
+
+const (
+	PaymentAuthorized PaymentStatus = "authorized"
+	PaymentCaptured   PaymentStatus = "captured"
+	PaymentVoided     PaymentStatus = "voided"
+	PaymentRefunded   PaymentStatus = "refunded"
+	PaymentFailed     PaymentStatus = "failed"
+)
+
+// ErrPaymentDeclined is returned by a provider refusing an operation, such as
+// an authorization on a card without funds.
+var ErrPaymentDeclined = errors.New("payment declined")
+
+// ErrPaymentProvider wraps the other failures of a provider, such as an
+// unreachable gateway.
+var ErrPaymentProvider = errors.New("payment provider error")
+
+// ErrInvalidPaymentState is returned for an operation the status of a payment does not allow.
+var ErrInvalidPaymentState = errors.New("invalid payment status")
+
+// ErrOrderNotPayable is returned when a payment is started or captured for an
+// order no longer awaiting payment.
+var ErrOrderNotPayable = errors.New("order is not awaiting payment")
+
+// Payment is a row of the 'payments' table: an attempt to collect the gross of
+// an order through a provider. Captured and Refunded are the amounts moved so
+// far; a partly refunded payment stays captured.
+type Payment struct {
+	ID            int           `json:"id"`
+	OrderID       string        `json:"order_id"`
+	Provider      string        `json:"provider"`
+	Reference     string        `json:"reference,omitempty"`
+	Status        PaymentStatus `json:"status"`
+	Amount        Money         `json:"amount"`
+	Captured      Money         `json:"captured"`
+	Refunded      Money         `json:"refunded"`
+	FailureReason string        `json:"failure_reason,omitempty"`
+	CreatedAt     time.Time     `json:"created_at"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+	// the refunds recorded so far, listed by GET /payments/{id} only
+	Refunds []PaymentRefund `json:"refunds,omitempty"`
+}
+
+// PaymentRefund is a row of the 'payment_refunds' table: a refund of a
+// payment, known by the ID the provider gave it.
+type PaymentRefund struct {
+	RefundID  string    `json:"refund_id"`
+	Amount    Money     `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// the captured amount not refunded yet.
+func (p *Payment) refundable() Money {
+	return p.Captured.Sub(p.Refunded)
+}
+
+// reports whether amount is a positive part of what is left of the capture.
+func (p *Payment) canRefund(amount Money) bool {
+	return amount.Currency == p.Captured.Currency && !amount.IsNegative() && !amount.IsZero() && amount.Cmp(p.refundable()) <= 0
+}
+
+// PaymentRequest is the request body of POST /orders/{id}/payments.
+type PaymentRequest struct {
+	Source  string `json:"source"`  // what the provider charges, a card token for instance
+	Capture *bool  `json:"capture"` // false only authorizes the payment; it is captured at once by default
+}
+
+// RefundRequest is the request body of POST /payments/{id}/refund. Amount is
+// decoded in the payment's currency; without it what is left is refunded.
+type RefundRequest struct {
+	Amount json.RawMessage `json:"amount"`
+}
+
+// --- Payment Providers ---
+
+// AuthorizeRequest asks a provider to reserve the amount of an order.
+type AuthorizeRequest struct {
+	OrderID string
+	Amount  Money
+	Source  string
+}
+
+// PaymentProvider is a payment gateway. It knows a payment by the reference
+// Authorize returns, and moves amounts in the payment's currency. An operation
+// the gateway refuses fails with an error wrapping ErrPaymentDeclined.
+type PaymentProvider interface {
+	// Name identifies the provider in the payments table.
+	Name() string
+	// Authorize reserves req.Amount on req.Source.
+	Authorize(req AuthorizeRequest) (reference string, err error)
+	// Capture collects amount of an authorized payment.
+	Capture(reference string, amount Money) error
+	// Void releases an authorization that was not captured.
+	Void(reference string) error
+	// Refund gives back amount of a captured payment; the provider reports
+	// the refund again under refundID in its webhooks.
+	Refund(reference string, amount Money) (refundID string, err error)
+}
+
+// paymentProviders lists the providers PAYMENT_PROVIDER may name; real
+// gateways are added here.
+var paymentProviders = map[string]func() PaymentProvider{
+	"fake": func() PaymentProvider { return NewFakePaymentProvider() },
+}
+
+// NewPaymentProvider returns the provider called name, the fake one if name is empty.
+func NewPaymentProvider(name string) (PaymentProvider, error) {
+	if name == "" {
+		name = "fake"
+	}
+	newProvider, ok := paymentProviders[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown payment provider %q", name)
+	}
+	return newProvider(), nil
+}
+
+// FakeSourceDeclined is the source the fake provider declines.
+const FakeSourceDeclined = "tok_declined"
+
+// FakePaymentProvider is the provider of local and mock mode. It keeps its
+// payments in memory, authorizes every source but FakeSourceDeclined and
+// refuses the amounts and operations a real gateway would.
+type FakePaymentProvider struct {
+	mu       sync.Mutex
+	payments map[string]*fakePayment
+}
+
+type fakePayment struct {
+	amount, captured, refunded Money
+	voided                     bool
+}
+
+// NewFakePaymentProvider returns a fake provider without payments.
+func NewFakePaymentProvider() *FakePaymentProvider {
+	return &FakePaymentProvider{payments: make(map[string]*fakePayment)}
+}
+
+func (f *FakePaymentProvider) Name() string { return "fake" }
+
+func (f *FakePaymentProvider) Authorize(req AuthorizeRequest) (string, error) {
+	if req.Source == FakeSourceDeclined {
+		return "", fmt.Errorf("%w: card declined", ErrPaymentDeclined)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reference := "fake_" + uuid.New().String()
+	zero := NewMoney(0, req.Amount.Currency)
+	f.payments[reference] = &fakePayment{amount: req.Amount, captured: zero, refunded: zero}
+	return reference, nil
+}
+
+func (f *FakePaymentProvider) Capture(reference string, amount Money) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.payment(reference)
+	if err != nil {
+		return err
+	}
+	switch {
+	case p.voided:
+		return fmt.Errorf("%w: authorization %s was voided", ErrPaymentDeclined, reference)
+	case !p.captured.IsZero():
+		return fmt.Errorf("%w: %s is already captured", ErrPaymentDeclined, reference)
+	case amount.Currency != p.amount.Currency || amount.Cmp(p.amount) > 0:
+		return fmt.Errorf("%w: %s exceeds the authorized %s", ErrPaymentDeclined, amount, p.amount)
+	}
+	p.captured = amount
+	return nil
+}
+
+func (f *FakePaymentProvider) Void(reference string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.payment(reference)
+	if err != nil {
+		return err
+	}
+	if !p.captured.IsZero() {
+		return fmt.Errorf("%w: %s is captured", ErrPaymentDeclined, reference)
+	}
+	p.voided = true
+	return nil
+}
+
+func (f *FakePaymentProvider) Refund(reference string, amount Money) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.payment(reference)
+	if err != nil {
+		return "", err
+	}
+	if amount.Currency != p.captured.Currency || amount.Cmp(p.captured.Sub(p.refunded)) > 0 {
+		return "", fmt.Errorf("%w: %s exceeds the refundable %s", ErrPaymentDeclined, amount, p.captured.Sub(p.refunded))
+	}
+	p.refunded = p.refunded.Add(amount)
+	return "fake_refund_" + uuid.New().String(), nil
+}
+
+// looks a payment up; the caller holds f.mu.
+func (f *FakePaymentProvider) payment(reference string) (*fakePayment, error) {
+	p, ok := f.payments[reference]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown payment %s", ErrPaymentDeclined, reference)
+	}
+	return p, nil
+}
+
+// wraps a provider failure that is not a refusal in ErrPaymentProvider.
+func providerError(provider PaymentProvider, err error) error {
+	if err == nil || errors.Is(err, ErrPaymentDeclined) {
+		return err
+	}
+	return fmt.Errorf("%w: %s: %v", ErrPaymentProvider, provider.Name(), err)
+}
+
+// --- Payment Database Functions ---
+
+const paymentColumns = "id, order_id, provider, reference, status, amount, captured_amount, refunded_amount, currency, failure_reason, created_at, updated_at"
+
+// scans a row of paymentColumns, relabeling its amounts with its currency.
+func scanPayment(row RowLike) (*Payment, error) {
+	var p Payment
+	var status, currency string
+	if err := row.Scan(&p.ID, &p.OrderID, &p.Provider, &p.Reference, &status, &p.Amount, &p.Captured, &p.Refunded, &currency, &p.FailureReason, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	p.Status = PaymentStatus(status)
+	for _, m := range []*Money{&p.Amount, &p.Captured, &p.Refunded} {
+		relabeled, err := m.Relabel(currency)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read amount of payment %d: %w", p.ID, err)
+		}
+		*m = relabeled
+	}
+	return &p, nil
+}
+
+// inserts a payment and sets its ID.
+func InsertPayment(executor TxExecutor, p *Payment) error {
+	err := executor.QueryRow("INSERT INTO payments (order_id, provider, reference, status, amount, captured_amount, refunded_amount, currency, failure_reason, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id",
+		p.OrderID, p.Provider, p.Reference, string(p.Status), p.Amount, p.Captured, p.Refunded, p.Amount.Currency, p.FailureReason, p.CreatedAt, p.UpdatedAt).Scan(&p.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert payment: %w", err)
+	}
+	return nil
+}
+
+// writes the status, amounts and failure reason of a payment.
+func UpdatePayment(executor TxExecutor, p *Payment) error {
+	res, err := executor.Exec("UPDATE payments SET status = $1, captured_amount = $2, refunded_amount = $3, failure_reason = $4, updated_at = $5 WHERE id = $6",
+		string(p.Status), p.Captured, p.Refunded, p.FailureReason, p.UpdatedAt, p.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update payment: %w", err)
+	}
+	return requireRowAffected(res, "payment not found")
+}
+
+// fetches a payment by ID.
+func GetPaymentByID(executor Queryer, id int) (*Payment, error) {
+	return getPayment(executor, "SELECT "+paymentColumns+" FROM payments WHERE id = $1", id)
+}
+
+// fetches a payment by ID, locking it until the transaction ends.
+func GetPaymentForUpdate(executor TxExecutor, id int) (*Payment, error) {
+	return getPayment(executor, "SELECT "+paymentColumns+" FROM payments WHERE id = $1 FOR UPDATE", id)
+}
+
+func getPayment(executor Queryer, query string, args ...interface{}) (*Payment, error) {
+	p, err := scanPayment(executor.QueryRow(query, args...))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("payment not found: %w", sql.ErrNoRows)
+		}
+		return nil, fmt.Errorf("failed to scan payment: %w", err)
+	}
+	return p, nil
+}
+
+// fetches the payments of an order, oldest first.
+func GetOrderPayments(executor Queryer, orderID string) ([]Payment, error) {
+	rows, err := executor.Query("SELECT "+paymentColumns+" FROM payments WHERE order_id = $1 ORDER BY id", orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query payments: %w", err)
+	}
+	defer rows.Close()
+
+	payments := []Payment{}
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan payment row: %w", err)
+		}
+		payments = append(payments, *p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during payments iteration: %w", err)
+	}
+	return payments, nil
+}
+
+// fetches the refunds of a payment, oldest first.
+func GetPaymentRefunds(executor Queryer, p *Payment) ([]PaymentRefund, error) {
+	rows, err := executor.Query("SELECT refund_id, amount, created_at FROM payment_refunds WHERE payment_id = $1 ORDER BY created_at, refund_id", p.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query payment refunds: %w", err)
+	}
+	defer rows.Close()
+
+	refunds := []PaymentRefund{}
+	for rows.Next() {
+		var refund PaymentRefund
+		if err := rows.Scan(&refund.RefundID, &refund.Amount, &refund.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan payment refund row: %w", err)
+		}
+		if refund.Amount, err = refund.Amount.Relabel(p.Amount.Currency); err != nil {
+			return nil, fmt.Errorf("failed to read refund %s of payment %d: %w", refund.RefundID, p.ID, err)
+		}
+		refunds = append(refunds, refund)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during payment refunds iteration: %w", err)
+	}
+	return refunds, nil
+}
+
+// reports whether the refund the provider knows by refundID is recorded for a payment.
+func HasPaymentRefund(executor Queryer, paymentID int, refundID string) (bool, error) {
+	var count int
+	if err := executor.QueryRow("SELECT COUNT(*) FROM payment_refunds WHERE payment_id = $1 AND refund_id = $2", paymentID, refundID).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to look payment refund up: %w", err)
+	}
+	return count > 0, nil
+}
+
+// locks an order, which must still be awaiting payment.
+func lockPayableOrder(tx TxExecutor, orderID string) error {
+	status, err := GetOrderStatusForUpdate(tx, orderID)
+	if err != nil {
+		return err
+	}
+	if status != StatusPending {
+		return fmt.Errorf("%w: order %s is %s", ErrOrderNotPayable, orderID, status)
+	}
+	return nil
+}
+
+// RecordPaymentCapture marks an authorized payment captured inside tx and
+// moves its order from pending to paid. An order that left pending in the
+// meantime, which only a provider capturing on its own can cause, keeps its
+// status.
+func RecordPaymentCapture(tx TxExecutor, p *Payment, now time.Time) error {
+	if p.Status != PaymentAuthorized {
+		return fmt.Errorf("%w: payment %d is %s", ErrInvalidPaymentState, p.ID, p.Status)
+	}
+	p.Status, p.Captured, p.UpdatedAt = PaymentCaptured, p.Amount, now
+	if err := UpdatePayment(tx, p); err != nil {
+		return err
+	}
+
+	status, err := GetOrderStatusForUpdate(tx, p.OrderID)
+	if err != nil || status != StatusPending {
+		return err
+	}
+	_, err = TransitionOrder(tx, p.OrderID, StatusPaid, fmt.Sprintf("payment %d captured", p.ID), now)
+	return err
+}
+
+// RecordPaymentFailure marks an authorized payment failed inside tx.
+func RecordPaymentFailure(tx TxExecutor, p *Payment, reason string, now time.Time) error {
+	if p.Status != PaymentAuthorized {
+		return fmt.Errorf("%w: payment %d is %s", ErrInvalidPaymentState, p.ID, p.Status)
+	}
+	p.Status, p.FailureReason, p.UpdatedAt = PaymentFailed, reason, now
+	return UpdatePayment(tx, p)
+}
+
+// RecordPaymentVoid marks an authorized payment voided inside tx.
+func RecordPaymentVoid(tx TxExecutor, p *Payment, now time.Time) error {
+	if p.Status != PaymentAuthorized {
+		return fmt.Errorf("%w: payment %d is %s", ErrInvalidPaymentState, p.ID, p.Status)
+	}
+	p.Status, p.UpdatedAt = PaymentVoided, now
+	return UpdatePayment(tx, p)
+}
+
+// RecordPaymentRefund records the refund refundID of amount of a captured
+// payment inside tx and adds it to what the payment refunded. Once it is all
+// refunded the payment is refunded, and so is its order where the transition
+// table allows it.
+func RecordPaymentRefund(tx TxExecutor, p *Payment, refundID string, amount Money, now time.Time) error {
+	if p.Status != PaymentCaptured {
+		return fmt.Errorf("%w: payment %d is %s", ErrInvalidPaymentState, p.ID, p.Status)
+	}
+	if !p.canRefund(amount) {
+		return fmt.Errorf("%w: cannot refund %s of payment %d, %s is refundable", ErrInvalidPaymentState, amount, p.ID, p.refundable())
+	}
+	if _, err := tx.Exec("INSERT INTO payment_refunds (payment_id, refund_id, amount, created_at) VALUES ($1, $2, $3, $4)", p.ID, refundID, amount, now); err != nil {
+		return fmt.Errorf("failed to insert payment refund: %w", err)
+	}
+	p.Refunded, p.UpdatedAt = p.Refunded.Add(amount), now
+	if p.refundable().IsZero() {
+		p.Status = PaymentRefunded
+	}
+	if err := UpdatePayment(tx, p); err != nil {
+		return err
+	}
+	if p.Status != PaymentRefunded {
+		return nil
+	}
+
+	status, err := GetOrderStatusForUpdate(tx, p.OrderID)
+	if err != nil || !CanTransition(status, StatusRefunded) {
+		return err
+	}
+	_, err = TransitionOrder(tx, p.OrderID, StatusRefunded, fmt.Sprintf("payment %d refunded", p.ID), now)
+	return err
+}
+
+// ReleaseOrderPayments gives back what the payments of an order cancelled
+// by a committed transaction hold: an authorization is voided and a captured
+// payment refunded in full through provider, which refunds the order. Each
+// payment is released in a transaction of its own, after the provider has
+// done its part, so the provider is never asked to move money for a
+// cancellation the database does not know about. A payment that cannot be
+// released stays open, to be voided or refunded through its own routes; the
+// errors of all of them are returned together.
+func ReleaseOrderPayments(executor DBExecutor, provider PaymentProvider, orderID string, now time.Time) error {
+	payments, err := GetOrderPayments(executor, orderID)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, p := range payments {
+		if p.Status != PaymentAuthorized && p.Status != PaymentCaptured {
+			continue
+		}
+		if err := releasePayment(executor, provider, p.ID, now); err != nil {
+			errs = append(errs, fmt.Errorf("payment %d: %w", p.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// voids or refunds a payment of a cancelled order in a transaction of its own.
+func releasePayment(executor DBExecutor, provider PaymentProvider, id int, now time.Time) error {
+	tx, err := executor.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	p, err := GetPaymentForUpdate(tx, id)
+	if err != nil {
+		return err
+	}
+	if p.Provider != provider.Name() {
+		return fmt.Errorf("%w: payment %d was made with provider %s", ErrInvalidPaymentState, p.ID, p.Provider)
+	}
+	var unrecorded func()
+	switch amount := p.refundable(); {
+	case p.Status == PaymentAuthorized:
+		if err := providerError(provider, provider.Void(p.Reference)); err != nil {
+			return err
+		}
+		unrecorded = logUnrecordedPayment(p, "void")
+		err = RecordPaymentVoid(tx, p, now)
+	case p.Status == PaymentCaptured && !amount.IsZero():
+		refundID, refundErr := provider.Refund(p.Reference, amount)
+		if err := providerError(provider, refundErr); err != nil {
+			return err
+		}
+		unrecorded = logUnrecordedPayment(p, "refund")
+		err = RecordPaymentRefund(tx, p, refundID, amount, now)
+	default:
+		// released in the meantime
+		return nil
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		unrecorded()
+	}
+	return err
+}
+
+// --- Payment HTTP Handlers ---
+
+// parses the {id} route variable of the payment routes.
+func paymentIDFromRequest(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		return 0, ErrBadRequest("invalid payment ID %q", mux.Vars(r)["id"])
+	}
+	return id, nil
+}
+
+// maps a payment failure to the API error sent to the client.
+func paymentError(err error) error {
+	switch {
+	case errors.Is(err, ErrPaymentDeclined):
+		return NewAPIError(http.StatusPaymentRequired, CodePaymentDeclined, "%s", err.Error())
+	case errors.Is(err, ErrPaymentProvider):
+		return &APIError{Status: http.StatusBadGateway, Code: CodePaymentProvider, Message: "The payment provider failed", Cause: err}
+	case errors.Is(err, ErrInvalidPaymentState):
+		return ErrConflict(CodeInvalidPaymentState, "%s", err.Error())
+	case errors.Is(err, ErrOrderNotPayable):
+		return ErrConflict(CodeOrderNotPayable, "%s", err.Error())
+	}
+	return orderError(err)
+}
+
+// maps a payment lookup failure to the API error sent to the client.
+func paymentLookupError(err error, id int) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound("Payment with ID %d not found", id)
+	}
+	return err
+}
+
+// undoes at the provider a payment whose transaction did not commit, so no
+// money is held that the database does not know about.
+func compensatePayment(provider PaymentProvider, p *Payment) {
+	var err error
+	switch p.Status {
+	case PaymentAuthorized:
+		err = provider.Void(p.Reference)
+	case PaymentCaptured:
+		_, err = provider.Refund(p.Reference, p.Captured)
+	default:
+		return
+	}
+	if err != nil {
+		log.Printf("payment %s of order %s was not recorded and could not be undone: %v", p.Reference, p.OrderID, err)
+	}
+}
+
+// POST /orders/{id}/payments. The order must be pending without a payment
+// under way; its gross is authorized and, unless "capture" is false, captured,
+// which marks the order paid. A declined payment is recorded as failed and
+// answered with 402.
+func createPaymentHandler(executor DBExecutor, provider PaymentProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID := mux.Vars(r)["id"]
+
+		var req PaymentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		if req.Source = strings.TrimSpace(req.Source); req.Source == "" {
+			writeError(w, r, ErrValidation(FieldError{Field: "source", Message: "is required"}))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := lockPayableOrder(tx, orderID); err != nil {
+			writeError(w, r, paymentError(err))
+			return
+		}
+		payments, err := GetOrderPayments(tx, orderID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		for _, p := range payments {
+			if p.Status == PaymentAuthorized || p.Status == PaymentCaptured {
+				writeError(w, r, ErrConflict(CodeConflict, "Order %s already has payment %d %s", orderID, p.ID, p.Status).WithDetail("payment_id", p.ID))
+				return
+			}
+		}
+		order, err := GetOrderByID(tx, orderID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		now := time.Now()
+		zero := NewMoney(0, order.TotalGross.Currency)
+		payment := &Payment{OrderID: orderID, Provider: provider.Name(), Amount: order.TotalGross, Captured: zero, Refunded: zero, CreatedAt: now, UpdatedAt: now}
+		payment.Reference, err = provider.Authorize(AuthorizeRequest{OrderID: orderID, Amount: payment.Amount, Source: req.Source})
+		if err = providerError(provider, err); err != nil && !errors.Is(err, ErrPaymentDeclined) {
+			writeError(w, r, paymentError(err))
+			return
+		}
+		declined := err
+		if declined != nil {
+			payment.Status, payment.FailureReason = PaymentFailed, declined.Error()
+		} else {
+			payment.Status = PaymentAuthorized
+		}
+
+		committed := false
+		defer func() {
+			if !committed {
+				compensatePayment(provider, payment)
+			}
+		}()
+		if err := InsertPayment(tx, payment); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if declined == nil && (req.Capture == nil || *req.Capture) {
+			if declined = providerError(provider, provider.Capture(payment.Reference, payment.Amount)); declined == nil {
+				err = RecordPaymentCapture(tx, payment, now)
+			} else if errors.Is(declined, ErrPaymentDeclined) {
+				err = RecordPaymentFailure(tx, payment, declined.Error(), now)
+			} else {
+				err = declined
+			}
+			if err != nil {
+				writeError(w, r, paymentError(err))
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		committed = true
+
+		if declined != nil {
+			writeError(w, r, paymentError(declined).(*APIError).WithDetail("payment_id", payment.ID))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", fmt.Sprintf("/payments/%d", payment.ID))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(payment)
+	}
+}
+
+// GET /orders/{id}/payments
+func getOrderPaymentsHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID := mux.Vars(r)["id"]
+
+		if _, err := GetOrderByID(executor, orderID); err != nil {
+			writeError(w, r, orderError(err))
+			return
+		}
+
+		payments, err := GetOrderPayments(executor, orderID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(payments)
+	}
+}
+
+// GET /payments/{id}
+func getPaymentHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := paymentIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		payment, err := GetPaymentByID(executor, id)
+		if err != nil {
+			writeError(w, r, paymentLookupError(err, id))
+			return
+		}
+		if payment.Refunds, err = GetPaymentRefunds(executor, payment); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(payment)
+	}
+}
+
+// paymentOperation applies an operation to a payment locked inside tx. It
+// may record a refusal of the provider before returning it: the transaction
+// is committed all the same. Once the provider has done its part it returns
+// how to compensate for it, run if the transaction does not commit.
+type paymentOperation func(r *http.Request, tx TxExecutor, p *Payment, now time.Time) (compensate func(), err error)
+
+// serves the POST /payments/{id}/... routes, running op on the payment with
+// the provider it was made with.
+func paymentOperationHandler(executor DBExecutor, provider PaymentProvider, op paymentOperation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := paymentIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		payment, err := GetPaymentForUpdate(tx, id)
+		if err != nil {
+			writeError(w, r, paymentLookupError(err, id))
+			return
+		}
+		if payment.Provider != provider.Name() {
+			writeError(w, r, ErrConflict(CodeInvalidPaymentState, "Payment %d was made with provider %s", id, payment.Provider))
+			return
+		}
+		compensate, opErr := op(r, tx, payment, time.Now())
+		committed := false
+		defer func() {
+			if !committed && compensate != nil {
+				compensate()
+			}
+		}()
+		if opErr != nil && !errors.Is(opErr, ErrPaymentDeclined) {
+			writeError(w, r, paymentError(opErr))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		committed = true
+		if opErr != nil {
+			writeError(w, r, paymentError(opErr))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(payment)
+	}
+}
+
+// logs an operation the provider carried out on a payment whose transaction
+// did not commit, and which cannot be taken back.
+func logUnrecordedPayment(p *Payment, operation string) func() {
+	return func() {
+		log.Printf("%s of payment %d (%s) was done by the provider but not recorded", operation, p.ID, p.Reference)
+	}
+}
+
+// POST /payments/{id}/capture captures an authorized payment, which marks its
+// order paid. A declined capture fails the payment; a capture that is not
+// recorded is refunded.
+func capturePaymentHandler(executor DBExecutor, provider PaymentProvider) http.HandlerFunc {
+	return paymentOperationHandler(executor, provider, func(r *http.Request, tx TxExecutor, p *Payment, now time.Time) (func(), error) {
+		if p.Status != PaymentAuthorized {
+			return nil, fmt.Errorf("%w: payment %d is %s", ErrInvalidPaymentState, p.ID, p.Status)
+		}
+		if err := lockPayableOrder(tx, p.OrderID); err != nil {
+			return nil, err
+		}
+		err := providerError(provider, provider.Capture(p.Reference, p.Amount))
+		if errors.Is(err, ErrPaymentDeclined) {
+			if failErr := RecordPaymentFailure(tx, p, err.Error(), now); failErr != nil {
+				return nil, failErr
+			}
+			return nil, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		// RecordPaymentCapture marks p captured before writing anything
+		return func() { compensatePayment(provider, p) }, RecordPaymentCapture(tx, p, now)
+	})
+}
+
+// POST /payments/{id}/void releases an authorized payment. A void that is not
+// recorded leaves the payment authorized, and the provider refuses to capture it.
+func voidPaymentHandler(executor DBExecutor, provider PaymentProvider) http.HandlerFunc {
+	return paymentOperationHandler(executor, provider, func(r *http.Request, tx TxExecutor, p *Payment, now time.Time) (func(), error) {
+		if p.Status != PaymentAuthorized {
+			return nil, fmt.Errorf("%w: payment %d is %s", ErrInvalidPaymentState, p.ID, p.Status)
+		}
+		if err := providerError(provider, provider.Void(p.Reference)); err != nil {
+			return nil, err
+		}
+		return logUnrecordedPayment(p, "void"), RecordPaymentVoid(tx, p, now)
+	})
+}
+
+// POST /payments/{id}/refund gives back the "amount" of a captured payment,
+// by default all that is left; a payment refunded in full refunds its order.
+// A refund that is not recorded is recorded when the provider's webhook
+// reports it.
+func refundPaymentHandler(executor DBExecutor, provider PaymentProvider) http.HandlerFunc {
+	return paymentOperationHandler(executor, provider, func(r *http.Request, tx TxExecutor, p *Payment, now time.Time) (func(), error) {
+		var req RefundRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, ErrBadRequest("Invalid request body: %v", err)
+		}
+		amount := p.refundable()
+		if len(req.Amount) > 0 && string(req.Amount) != "null" {
+			amount = Money{Currency: p.Amount.Currency}
+			if err := json.Unmarshal(req.Amount, &amount); err != nil {
+				return nil, ErrValidation(FieldError{Field: "amount", Message: err.Error()})
+			}
+			if amount.Currency != p.Amount.Currency || amount.IsNegative() || amount.IsZero() {
+				return nil, ErrValidation(FieldError{Field: "amount", Message: fmt.Sprintf("must be a positive amount of %s", p.Amount.Currency)})
+			}
+		}
+		if p.Status != PaymentCaptured {
+			return nil, fmt.Errorf("%w: payment %d is %s", ErrInvalidPaymentState, p.ID, p.Status)
+		}
+		if amount.Cmp(p.refundable()) > 0 {
+			return nil, fmt.Errorf("%w: cannot refund %s of payment %d, %s is refundable", ErrInvalidPaymentState, amount, p.ID, p.refundable())
+		}
+		refundID, err := provider.Refund(p.Reference, amount)
+		if err = providerError(provider, err); err != nil {
+			return nil, err
+		}
+		return logUnrecordedPayment(p, "refund"), RecordPaymentRefund(tx, p, refundID, amount, now)
+	})
+}
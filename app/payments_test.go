@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// starts a payment through the API and returns the decoded response.
+func createPayment(t *testing.T, router http.Handler, orderID, body string) Payment {
+	rr := doJSON(router, "POST", "/orders/"+orderID+"/payments", body)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var payment Payment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&payment))
+	assert.Equal(t, fmt.Sprintf("/payments/%d", payment.ID), rr.Header().Get("Location"))
+	return payment
+}
+
+// fetches the status of an order through the API.
+func orderStatus(t *testing.T, router http.Handler, orderID string) OrderStatus {
+	rr := doJSON(router, "GET", "/orders/"+orderID, "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var order OutgoingOrder
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&order))
+	return order.Status
+}
+
+func TestFakePaymentProvider(t *testing.T) {
+	provider := NewFakePaymentProvider()
+	amount := MustParseMoney("100.00", DefaultCurrency)
+
+	_, err := provider.Authorize(AuthorizeRequest{OrderID: "o", Amount: amount, Source: FakeSourceDeclined})
+	assert.ErrorIs(t, err, ErrPaymentDeclined)
+
+	ref, err := provider.Authorize(AuthorizeRequest{OrderID: "o", Amount: amount, Source: "tok_visa"})
+	require.NoError(t, err)
+	assert.ErrorIs(t, provider.Capture(ref, MustParseMoney("100.01", DefaultCurrency)), ErrPaymentDeclined)
+	assert.ErrorIs(t, provider.Capture(ref, MustParseMoney("100.00", "USD")), ErrPaymentDeclined)
+	require.NoError(t, provider.Capture(ref, amount))
+	assert.ErrorIs(t, provider.Capture(ref, amount), ErrPaymentDeclined)
+	assert.ErrorIs(t, provider.Void(ref), ErrPaymentDeclined)
+	refundID, err := provider.Refund(ref, MustParseMoney("60.00", DefaultCurrency))
+	require.NoError(t, err)
+	assert.NotEmpty(t, refundID)
+	_, err = provider.Refund(ref, MustParseMoney("40.01", DefaultCurrency))
+	assert.ErrorIs(t, err, ErrPaymentDeclined)
+	otherID, err := provider.Refund(ref, MustParseMoney("40.00", DefaultCurrency))
+	require.NoError(t, err)
+	assert.NotEqual(t, refundID, otherID)
+
+	ref, err = provider.Authorize(AuthorizeRequest{OrderID: "o", Amount: amount, Source: "tok_visa"})
+	require.NoError(t, err)
+	require.NoError(t, provider.Void(ref))
+	assert.ErrorIs(t, provider.Capture(ref, amount), ErrPaymentDeclined)
+	assert.ErrorIs(t, provider.Void("fake_unknown"), ErrPaymentDeclined)
+
+	_, err = NewPaymentProvider("acme")
+	assert.Error(t, err)
+	provider2, err := NewPaymentProvider("")
+	require.NoError(t, err)
+	assert.Equal(t, "fake", provider2.Name())
+}
+
+func TestPayments_Capture(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	order := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}]}`)
+	payment := createPayment(t, router, order.OrderID, `{"source":"tok_visa"}`)
+	assert.Equal(t, PaymentCaptured, payment.Status)
+	assert.Equal(t, "fake", payment.Provider)
+	assert.NotEmpty(t, payment.Reference)
+	assert.Equal(t, order.TotalGross, payment.Amount)
+	assert.Equal(t, order.TotalGross, payment.Captured)
+	assert.Equal(t, StatusPaid, orderStatus(t, router, order.OrderID))
+
+	rr := doJSON(router, "GET", "/orders/"+order.OrderID+"/transitions", "")
+	var history []OrderStatusChange
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&history))
+	require.Len(t, history, 2)
+	assert.Equal(t, fmt.Sprintf("payment %d captured", payment.ID), history[1].Note)
+
+	// a paid order takes no further payments
+	rr = doJSON(router, "POST", "/orders/"+order.OrderID+"/payments", `{"source":"tok_visa"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, CodeOrderNotPayable, errorCode(t, rr.Body.Bytes()))
+
+	// authorized first, captured later
+	order = placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}]}`)
+	payment = createPayment(t, router, order.OrderID, `{"source":"tok_visa","capture":false}`)
+	assert.Equal(t, PaymentAuthorized, payment.Status)
+	assert.True(t, payment.Captured.IsZero())
+	assert.Equal(t, StatusPending, orderStatus(t, router, order.OrderID))
+	rr = doJSON(router, "POST", "/orders/"+order.OrderID+"/payments", `{"source":"tok_visa"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"payment_id"`)
+
+	path := fmt.Sprintf("/payments/%d", payment.ID)
+	rr = doJSON(router, "POST", path+"/capture", "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, StatusPaid, orderStatus(t, router, order.OrderID))
+	rr = doJSON(router, "POST", path+"/capture", "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, CodeInvalidPaymentState, errorCode(t, rr.Body.Bytes()))
+
+	rr = doJSON(router, "GET", "/orders/"+order.OrderID+"/payments", "")
+	var payments []Payment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&payments))
+	require.Len(t, payments, 1)
+	assert.Equal(t, PaymentCaptured, payments[0].Status)
+}
+
+func TestPayments_DeclinedAndVoided(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	order := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}]}`)
+
+	rr := doJSON(router, "POST", "/orders/"+order.OrderID+"/payments", `{"source":"`+FakeSourceDeclined+`"}`)
+	assert.Equal(t, http.StatusPaymentRequired, rr.Code)
+	assert.Equal(t, CodePaymentDeclined, errorCode(t, rr.Body.Bytes()))
+	assert.Contains(t, rr.Body.String(), `"payment_id":1`)
+	rr = doJSON(router, "GET", "/payments/1", "")
+	var failed Payment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&failed))
+	assert.Equal(t, PaymentFailed, failed.Status)
+	assert.Contains(t, failed.FailureReason, "card declined")
+	assert.Equal(t, StatusPending, orderStatus(t, router, order.OrderID))
+
+	// a voided authorization makes way for another payment
+	payment := createPayment(t, router, order.OrderID, `{"source":"tok_visa","capture":false}`)
+	rr = doJSON(router, "POST", fmt.Sprintf("/payments/%d/void", payment.ID), "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var voided Payment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&voided))
+	assert.Equal(t, PaymentVoided, voided.Status)
+	rr = doJSON(router, "POST", fmt.Sprintf("/payments/%d/capture", payment.ID), "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	createPayment(t, router, order.OrderID, `{"source":"tok_visa"}`)
+
+	// cancelling an order voids its authorization, and it cannot be paid again
+	cancelled := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}]}`)
+	payment = createPayment(t, router, cancelled.OrderID, `{"source":"tok_visa","capture":false}`)
+	rr = doJSON(router, "POST", "/orders/"+cancelled.OrderID+"/cancel", `{"reason":"changed mind"}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	rr = doJSON(router, "GET", fmt.Sprintf("/payments/%d", payment.ID), "")
+	voided = Payment{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&voided))
+	assert.Equal(t, PaymentVoided, voided.Status)
+	rr = doJSON(router, "POST", fmt.Sprintf("/payments/%d/capture", payment.ID), "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, CodeInvalidPaymentState, errorCode(t, rr.Body.Bytes()))
+	rr = doJSON(router, "POST", "/orders/"+cancelled.OrderID+"/payments", `{"source":"tok_visa"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, CodeOrderNotPayable, errorCode(t, rr.Body.Bytes()))
+
+	rr = doJSON(router, "POST", "/orders/"+order.OrderID+"/payments", `{"source":" "}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"source"`)
+	rr = doJSON(router, "POST", "/orders/missing/payments", `{"source":"tok_visa"}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = doJSON(router, "GET", "/orders/missing/payments", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = doJSON(router, "POST", "/payments/99/void", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestPayments_Refund(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	rr := doJSON(router, "POST", "/exchange-rates", `{"currency":"USD","rate":1.08,"valid_from":"2020-01-01T00:00:00Z"}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+	order := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}],"currency":"USD"}`)
+	payment := createPayment(t, router, order.OrderID, `{"source":"tok_visa"}`)
+	assert.Equal(t, "USD", payment.Amount.Currency)
+	path := fmt.Sprintf("/payments/%d/refund", payment.ID)
+
+	for _, body := range []string{`{"amount":0}`, `{"amount":{"amount":10,"currency":"EUR"}}`, `{"amount":"ten"}`} {
+		rr = doJSON(router, "POST", path, body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Contains(t, rr.Body.String(), `"field":"amount"`, body)
+	}
+	rr = doJSON(router, "POST", path, `{"amount":100000}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// a partial refund leaves the payment captured and the order paid
+	rr = doJSON(router, "POST", path, `{"amount":10}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var refunded Payment
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&refunded))
+	assert.Equal(t, PaymentCaptured, refunded.Status)
+	assert.Equal(t, MustParseMoney("10.00", "USD"), refunded.Refunded)
+	assert.Equal(t, StatusPaid, orderStatus(t, router, order.OrderID))
+
+	rr = doJSON(router, "POST", path, `{}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	refunded = Payment{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&refunded))
+	assert.Equal(t, PaymentRefunded, refunded.Status)
+	assert.Equal(t, payment.Amount, refunded.Refunded)
+	assert.Equal(t, StatusRefunded, orderStatus(t, router, order.OrderID))
+
+	rr = doJSON(router, "POST", path, `{}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// cancelling a paid order refunds what is left of its payment
+	order = placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}]}`)
+	payment = createPayment(t, router, order.OrderID, `{"source":"tok_visa"}`)
+	rr = doJSON(router, "POST", fmt.Sprintf("/payments/%d/refund", payment.ID), `{"amount":5}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = doJSON(router, "POST", "/orders/"+order.OrderID+"/cancel", `{"reason":"out of stock"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = doJSON(router, "GET", fmt.Sprintf("/payments/%d", payment.ID), "")
+	refunded = Payment{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&refunded))
+	assert.Equal(t, PaymentRefunded, refunded.Status)
+	assert.Equal(t, payment.Amount, refunded.Refunded)
+	assert.Equal(t, StatusRefunded, orderStatus(t, router, order.OrderID))
+}
+
+// an executor whose transactions never commit.
+type failingCommitDB struct{ *InMemoryDB }
+
+func (db failingCommitDB) Begin() (TxExecutor, error) {
+	tx, err := db.InMemoryDB.Begin()
+	return failingCommitTx{tx}, err
+}
+
+type failingCommitTx struct{ TxExecutor }
+
+func (failingCommitTx) Commit() error { return errors.New("connection reset") }
+
+func TestPayments_UnrecordedCaptureIsRefunded(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	executor := &InMemoryDB{store: store}
+	provider := NewFakePaymentProvider()
+	router := mux.NewRouter()
+	router.HandleFunc("/orders/{id}/payments", createPaymentHandler(executor, provider)).Methods("POST")
+	router.HandleFunc("/payments/{id}/capture", capturePaymentHandler(failingCommitDB{executor}, provider)).Methods("POST")
+
+	order := placeOrder(t, newOrdersRouter(store), `{"items":[{"product_id":2,"quantity":1}]}`)
+	payment := createPayment(t, router, order.OrderID, `{"source":"tok_visa","capture":false}`)
+	rr := doJSON(router, "POST", fmt.Sprintf("/payments/%d/capture", payment.ID), "")
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	// the database never heard of the capture, so the provider gave it back
+	recorded, err := GetPaymentByID(executor, payment.ID)
+	require.NoError(t, err)
+	assert.Equal(t, PaymentAuthorized, recorded.Status)
+	held := provider.payments[payment.Reference]
+	assert.Equal(t, payment.Amount, held.captured)
+	assert.Equal(t, payment.Amount, held.refunded)
+}
+
+func TestPayments_UncommittedCancelKeepsPayments(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	executor := &InMemoryDB{store: store}
+	provider := NewFakePaymentProvider()
+	router := mux.NewRouter()
+	router.HandleFunc("/orders/{id}/payments", createPaymentHandler(executor, provider)).Methods("POST")
+	router.HandleFunc("/orders/{id}/cancel", cancelOrderHandler(failingCommitDB{executor}, provider)).Methods("POST")
+
+	order := placeOrder(t, newOrdersRouter(store), `{"items":[{"product_id":2,"quantity":1}]}`)
+	authorized := createPayment(t, router, order.OrderID, `{"source":"tok_visa","capture":false}`)
+	rr := doJSON(router, "POST", "/orders/"+order.OrderID+"/cancel", `{"reason":"changed my mind"}`)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	// the cancellation never committed, so the provider was not asked to release anything
+	assert.Equal(t, StatusPending, orderStatus(t, newOrdersRouter(store), order.OrderID))
+	recorded, err := GetPaymentByID(executor, authorized.ID)
+	require.NoError(t, err)
+	assert.Equal(t, PaymentAuthorized, recorded.Status)
+	assert.False(t, provider.payments[authorized.Reference].voided)
+}
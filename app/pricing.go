@@ -0,0 +1,518 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Order Pricing ---
+
+// PriceMode tells whether catalog prices include VAT.
+type PriceMode string
+
+const (
+	PriceNet   PriceMode = "net"   // VAT is added on top of the price
+	PriceGross PriceMode = "gross" // the price includes VAT, which is extracted from it
+)
+
+// DefaultPriceMode applies to the products without a price mode of their own;
+// set from PRICE_MODE in main.
+var DefaultPriceMode = PriceNet
+
+// ParsePriceMode maps a configuration value to a PriceMode.
+func ParsePriceMode(s string) (PriceMode, error) {
+	switch mode := PriceMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case "":
+		return PriceNet, nil
+	case PriceNet, PriceGross:
+		return mode, nil
+	}
+	return PriceNet, fmt.Errorf("unknown price mode %q", s)
+}
+
+// VATRounding is the step at which VAT is rounded to the cent.
+type VATRounding string
+
+const (
+	VATPerUnit    VATRounding = "unit"    // the VAT of one unit is rounded, then multiplied by the quantity
+	VATPerLine    VATRounding = "line"    // the VAT of each line is rounded
+	VATPerInvoice VATRounding = "invoice" // the VAT of each rate is rounded once over the order
+)
+
+// DefaultVATRounding is the rounding policy of order VAT; set from
+// VAT_ROUNDING in main.
+var DefaultVATRounding = VATPerLine
+
+// ParseVATRounding maps a configuration value to a VATRounding.
+func ParseVATRounding(s string) (VATRounding, error) {
+	switch policy := VATRounding(strings.ToLower(strings.TrimSpace(s))); policy {
+	case "":
+		return VATPerLine, nil
+	case VATPerUnit, VATPerLine, VATPerInvoice:
+		return policy, nil
+	}
+	return VATPerLine, fmt.Errorf("unknown VAT rounding %q", s)
+}
+
+// PricedItem is an order line as priced by PriceOrder. UnitPrice and
+// LineTotal are catalog amounts, gross when PriceIncludesVAT. LineVAT is the
+// VAT of the whole line once discounted, and Net + LineVAT = Gross; ItemVAT
+// is the same amount as returned and stored on the item.
+type PricedItem struct {
+	ProductID        int
+	Category         string
+	Quantity         int
+	UnitPrice        Money
+	PriceIncludesVAT bool
+	VATRate          float64
+	TaxRuleID        int // 0 when the product's own rate applies
+	ItemVAT          Money
+	LineTotal        Money
+	Discount         Money
+	LineVAT          Money
+	Net              Money
+	Gross            Money
+
+	// the rate a gross price includes, which VATRate differs from under reverse charge
+	includedRate float64
+}
+
+// the line total less its discounts, in catalog terms.
+func (l *PricedItem) discounted() Money { return l.LineTotal.Sub(l.Discount) }
+
+// whether the VAT of the line is the VAT its gross price includes.
+func (l *PricedItem) extractsVAT() bool {
+	return l.PriceIncludesVAT && l.VATRate == l.includedRate
+}
+
+// the exact VAT of the line before rounding, in minor units: extracted from a
+// gross price, or charged on the net. Net must be set.
+func (l *PricedItem) exactVAT() *big.Rat {
+	if l.extractsVAT() {
+		return l.discounted().includedRat(l.includedRate)
+	}
+	return l.Net.rateRat(l.VATRate)
+}
+
+// the lines VAT is settled on: the items, then the shipping.
+func (p *PricedOrder) lines() []*PricedItem {
+	lines := make([]*PricedItem, 0, len(p.Items)+1)
+	for i := range p.Items {
+		lines = append(lines, &p.Items[i])
+	}
+	if p.Shipping != nil {
+		lines = append(lines, &p.Shipping.PricedItem)
+	}
+	return lines
+}
+
+// settles the net, VAT and gross of every line and the totals, with VAT
+// rounded by policy. A gross price is split at the rate it includes; when a
+// different rate is charged, as under reverse charge, the included VAT is
+// taken off the price and the VAT is charged on the net. Whatever the policy,
+// the line VATs add up to the order VAT.
+func (p *PricedOrder) settle(policy VATRounding, mode RoundingMode) error {
+	lines := p.lines()
+	exact := make([]*big.Rat, len(lines))
+	for i, line := range lines {
+		line.Net = line.discounted()
+		if line.PriceIncludesVAT && !line.extractsVAT() {
+			included, err := line.Net.IncludedVAT(line.includedRate, mode)
+			if err != nil {
+				return err
+			}
+			line.Net = line.Net.Sub(included)
+		}
+		exact[i] = line.exactVAT()
+	}
+
+	vat := make([]int64, len(lines))
+	switch policy {
+	case VATPerUnit:
+		for i, line := range lines {
+			unit := new(big.Rat).Quo(exact[i], big.NewRat(int64(line.Quantity), 1))
+			rounded, err := roundRat(unit, mode)
+			if err != nil {
+				return err
+			}
+			vat[i] = rounded * int64(line.Quantity)
+		}
+	case VATPerInvoice:
+		byRate := make(map[float64][]int)
+		for i, line := range lines {
+			byRate[line.VATRate] = append(byRate[line.VATRate], i)
+		}
+		for _, lines := range byRate {
+			if err := apportion(vat, exact, lines, mode); err != nil {
+				return err
+			}
+		}
+	default:
+		for i := range lines {
+			var err error
+			if vat[i], err = roundRat(exact[i], mode); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, line := range lines {
+		line.LineVAT = NewMoney(vat[i], line.Net.Currency)
+		if line.extractsVAT() {
+			line.Net = line.discounted().Sub(line.LineVAT)
+		}
+		line.ItemVAT = line.LineVAT
+		var err error
+		if line.Gross, err = line.Net.CheckedAdd(line.LineVAT); err != nil {
+			return err
+		}
+		if p.Total, err = p.Total.CheckedAdd(line.Net); err != nil {
+			return err
+		}
+		if p.VAT, err = p.VAT.CheckedAdd(line.LineVAT); err != nil {
+			return err
+		}
+		if p.Gross, err = p.Gross.CheckedAdd(line.Gross); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns ErrMoneyOverflow if an amount of the order is too large to be stored.
+func (p *PricedOrder) checkStorable() error {
+	amounts := []Money{p.Total, p.VAT, p.Gross}
+	for _, line := range p.lines() {
+		amounts = append(amounts, line.UnitPrice, line.LineTotal, line.LineVAT, line.Net, line.Gross)
+	}
+	for _, m := range amounts {
+		if err := m.CheckStorable(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rounds the sum of the exact VATs of lines once and splits it among them:
+// each line gets its VAT rounded down, and the cents left over go to the
+// lines with the largest remainders, the first one on ties.
+func apportion(vat []int64, exact []*big.Rat, lines []int, mode RoundingMode) error {
+	sum := new(big.Rat)
+	remainders := make([]*big.Rat, len(lines))
+	left := int64(0)
+	for j, i := range lines {
+		sum.Add(sum, exact[i])
+		floor := new(big.Int).Quo(exact[i].Num(), exact[i].Denom())
+		vat[i] = floor.Int64()
+		remainders[j] = new(big.Rat).Sub(exact[i], new(big.Rat).SetInt(floor))
+		left -= vat[i]
+	}
+	rounded, err := roundRat(sum, mode)
+	if err != nil {
+		return err
+	}
+	left += rounded
+	order := make([]int, len(lines))
+	for j := range order {
+		order[j] = j
+	}
+	sort.SliceStable(order, func(a, b int) bool { return remainders[order[a]].Cmp(remainders[order[b]]) > 0 })
+	for _, j := range order[:left] {
+		vat[lines[j]]++
+	}
+	return nil
+}
+
+// VATSummary is the taxable base and the VAT of one rate on an order, as
+// listed on invoices.
+type VATSummary struct {
+	Rate        float64 `json:"rate"`
+	TaxableBase Money   `json:"taxable_base"`
+	VAT         Money   `json:"vat"`
+}
+
+// groups the net and the VAT of the items and the shipping by rate, lowest
+// rate first. Items priced before net amounts were recorded are left out.
+func vatBreakdown(items []OutgoingOrderItem, shipping *ShippingLine) []VATSummary {
+	var breakdown []VATSummary
+	index := make(map[float64]int)
+	add := func(rate float64, net, vat Money) {
+		i, ok := index[rate]
+		if !ok {
+			i = len(breakdown)
+			index[rate] = i
+			// the zero amounts take the currency of the first line added
+			breakdown = append(breakdown, VATSummary{Rate: rate})
+		}
+		breakdown[i].TaxableBase = breakdown[i].TaxableBase.Add(net)
+		breakdown[i].VAT = breakdown[i].VAT.Add(vat)
+	}
+	for _, item := range items {
+		if item.VATRate != nil && item.LineNet != nil {
+			add(*item.VATRate, *item.LineNet, item.ItemVAT)
+		}
+	}
+	if shipping != nil {
+		add(shipping.VATRate, shipping.Net, shipping.VAT)
+	}
+	sort.Slice(breakdown, func(a, b int) bool { return breakdown[a].Rate < breakdown[b].Rate })
+	return breakdown
+}
+
+// PricedOrder is the outcome of PriceOrder, in Currency. Total is net of the
+// discounts and of VAT, Gross is Total + VAT; both include the shipping.
+type PricedOrder struct {
+	Items     []PricedItem
+	Shipping  *PricedShipping // nil when the order names no shipping method
+	Discounts []AppliedDiscount
+	Total     Money
+	VAT       Money
+	Gross     Money
+
+	Currency     string
+	ExchangeRate float64 // from DefaultCurrency, 1 when the order is in DefaultCurrency
+
+	BuyerVATID    string // normalized
+	ReverseCharge bool
+	VATNote       string
+}
+
+// OrderQuote is the response body of POST /orders/quote: what the order would
+// cost, in the shape of an order.
+type OrderQuote struct {
+	Currency        string              `json:"currency"`
+	ExchangeRate    float64             `json:"exchange_rate"`
+	Items           []OutgoingOrderItem `json:"items"`
+	Shipping        *ShippingLine       `json:"shipping,omitempty"`
+	Discounts       []AppliedDiscount   `json:"discounts,omitempty"`
+	TotalOrderPrice Money               `json:"order_price"`
+	VATAmount       Money               `json:"order_vat"`
+	TotalGross      Money               `json:"order_gross"`
+	VATBreakdown    []VATSummary        `json:"vat_breakdown,omitempty"`
+	ReverseCharge   bool                `json:"reverse_charge,omitempty"`
+	VATNote         string              `json:"vat_note,omitempty"`
+}
+
+// the country the order is delivered to: the one it names, else the country
+// of its shipping address, else DefaultCountry.
+func (o *IncomingOrder) destination() string {
+	if country := normalizeCountry(o.Country); country != "" {
+		return country
+	}
+	if o.ShippingAddress != nil {
+		return normalizeCountry(o.ShippingAddress.Country)
+	}
+	return DefaultCountry
+}
+
+// PriceOrder prices an order at now, in its currency and with the VAT of its
+// destination, without writing anything. Coupons apply in the order given,
+// shipping is priced by weight, and the totals add up the rounded lines.
+// It serves both order creation and quotes; failures are API errors.
+func PriceOrder(executor Queryer, order *IncomingOrder, now time.Time) (*PricedOrder, error) {
+	country := order.destination()
+	taxRules, err := GetTaxRuleSet(executor, country, now)
+	if err != nil {
+		return nil, err
+	}
+	currency := normalizeCurrency(order.Currency)
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	priced := &PricedOrder{
+		Items:        make([]PricedItem, 0, len(order.Items)),
+		Total:        NewMoney(0, currency),
+		VAT:          NewMoney(0, currency),
+		Gross:        NewMoney(0, currency),
+		Currency:     currency,
+		ExchangeRate: 1,
+	}
+	if currency != DefaultCurrency {
+		rate, err := GetExchangeRate(executor, currency, now)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrValidation(FieldError{Field: "currency", Message: fmt.Sprintf("no exchange rate to %s is in force", currency)})
+		} else if err != nil {
+			return nil, err
+		}
+		priced.ExchangeRate = rate.Rate
+	}
+	if order.VATID != "" {
+		buyer, err := ParseVATID(order.VATID)
+		if err != nil {
+			return nil, ErrValidation(FieldError{Field: "vat_id", Message: err.Error()})
+		}
+		priced.BuyerVATID = buyer.String()
+		if priced.ReverseCharge = reverseCharge(&buyer, country); priced.ReverseCharge {
+			priced.VATNote = ReverseChargeNote
+		}
+	}
+
+	subtotal := NewMoney(0, currency)
+	weight := 0
+	for i, item := range order.Items {
+		product, err := GetProductByID(executor, item.ProductID)
+		if err != nil {
+			return nil, productError(err, item.ProductID)
+		}
+
+		rate, ruleID := taxRules.ResolveVAT(product)
+		price, err := product.Price.Convert(currency, priced.ExchangeRate, DefaultRoundingMode)
+		if err != nil {
+			return nil, pricingError(err)
+		}
+		lineTotal, err := price.CheckedMul(int64(item.Quantity))
+		if err == nil {
+			err = lineTotal.CheckStorable()
+		}
+		if err != nil {
+			return nil, ErrValidation(FieldError{Field: fmt.Sprintf("items[%d].quantity", i), Message: "takes the line total out of range"})
+		}
+		line := PricedItem{
+			ProductID:        item.ProductID,
+			Category:         product.Category,
+			Quantity:         item.Quantity,
+			UnitPrice:        price,
+			PriceIncludesVAT: product.priceMode() == PriceGross,
+			VATRate:          rate,
+			TaxRuleID:        ruleID,
+			LineTotal:        lineTotal,
+			Discount:         NewMoney(0, currency),
+			includedRate:     rate,
+		}
+		if priced.ReverseCharge {
+			line.VATRate, line.TaxRuleID = 0, 0
+		}
+		if subtotal, err = subtotal.CheckedAdd(line.LineTotal); err != nil {
+			return nil, pricingError(err)
+		}
+		unit := product.shippingWeight()
+		if unit > 0 && item.Quantity > (math.MaxInt-weight)/unit {
+			return nil, ErrValidation(FieldError{Field: fmt.Sprintf("items[%d].quantity", i), Message: "takes the shipping weight out of range"})
+		}
+		weight += unit * item.Quantity
+		priced.Items = append(priced.Items, line)
+	}
+
+	for _, code := range order.Coupons {
+		code = normalizeCouponCode(code)
+		coupon, err := GetCouponByCode(executor, code)
+		if err != nil {
+			return nil, couponError(err, code)
+		}
+		if coupon.Amount, err = coupon.Amount.Convert(currency, priced.ExchangeRate, DefaultRoundingMode); err != nil {
+			return nil, pricingError(err)
+		}
+		if coupon.MinSpend, err = coupon.MinSpend.Convert(currency, priced.ExchangeRate, DefaultRoundingMode); err != nil {
+			return nil, pricingError(err)
+		}
+		if err := coupon.checkUsable(now, subtotal); err != nil {
+			return nil, couponError(err, code)
+		}
+		discount, err := coupon.apply(priced.Items)
+		if err != nil {
+			return nil, pricingError(couponError(err, code))
+		}
+		priced.Discounts = append(priced.Discounts, discount)
+	}
+	if order.ShippingMethod != "" {
+		if priced.Shipping, err = priceShipping(executor, order, priced, taxRules, weight); err != nil {
+			return nil, pricingError(err)
+		}
+	}
+
+	if err := priced.settle(DefaultVATRounding, DefaultRoundingMode); err != nil {
+		return nil, pricingError(err)
+	}
+	if err := priced.checkStorable(); err != nil {
+		return nil, pricingError(err)
+	}
+	return priced, nil
+}
+
+// maps an amount of the order that does not fit in Money to the API error
+// sent to the client.
+func pricingError(err error) error {
+	if errors.Is(err, ErrMoneyOverflow) {
+		return ErrValidation(FieldError{Field: "items", Message: "take the order total out of range"})
+	}
+	return err
+}
+
+// the priced lines in the shape of the order response.
+func (p *PricedOrder) outgoingItems() []OutgoingOrderItem {
+	items := make([]OutgoingOrderItem, 0, len(p.Items))
+	for _, line := range p.Items {
+		items = append(items, OutgoingOrderItem{
+			ProductID:        line.ProductID,
+			Quantity:         line.Quantity,
+			Price:            line.UnitPrice,
+			PriceIncludesVAT: line.PriceIncludesVAT,
+			ItemVAT:          line.ItemVAT,
+			VATRate:          &line.VATRate,
+			TaxRuleID:        line.TaxRuleID,
+			LineNet:          &line.Net,
+			LineGross:        &line.Gross,
+		})
+	}
+	return items
+}
+
+// the shipping in the shape of the order response, nil without shipping.
+func (p *PricedOrder) shippingLine() *ShippingLine {
+	if p.Shipping == nil {
+		return nil
+	}
+	return p.Shipping.line()
+}
+
+// POST /orders/quote prices an order like POST /order would, without
+// creating it or touching stock.
+func quoteOrderHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		var incomingOrder IncomingOrder
+		if err := json.Unmarshal(body, &incomingOrder); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		if fields := validateIncomingOrder(&incomingOrder); len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		priced, err := PriceOrder(executor, &incomingOrder, time.Now())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		items, shipping := priced.outgoingItems(), priced.shippingLine()
+		json.NewEncoder(w).Encode(OrderQuote{
+			Currency:        priced.Currency,
+			ExchangeRate:    priced.ExchangeRate,
+			Items:           items,
+			Shipping:        shipping,
+			Discounts:       priced.Discounts,
+			TotalOrderPrice: priced.Total,
+			VATAmount:       priced.VAT,
+			TotalGross:      priced.Gross,
+			VATBreakdown:    vatBreakdown(items, shipping),
+			ReverseCharge:   priced.ReverseCharge,
+			VATNote:         priced.VATNote,
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuoteOrder_MatchesCreatedOrder(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	body := `{"items":[{"product_id":1,"quantity":2},{"product_id":2,"quantity":3}]}`
+
+	rr := doJSON(router, "POST", "/orders/quote", body)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var quote OrderQuote
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&quote))
+	assert.Equal(t, MustParseMoney("3239.95", DefaultCurrency), quote.TotalOrderPrice)
+
+	// nothing was written
+	rr = doJSON(router, "GET", "/orders", "")
+	assert.JSONEq(t, `{"orders":[]}`, rr.Body.String())
+	assert.Equal(t, sampleStock, getStockLevel(t, router, "1").Stock)
+
+	order := placeOrder(t, router, body)
+	assert.Equal(t, order.TotalOrderPrice, quote.TotalOrderPrice)
+	assert.Equal(t, order.VATAmount, quote.VATAmount)
+	for i := range order.Items {
+		order.Items[i].Allocations = nil
+	}
+	assert.Equal(t, order.Items, quote.Items)
+}
+
+func TestQuoteOrder_Invalid(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	rr := doJSON(router, "POST", "/orders/quote", `{"items":[{"product_id":99,"quantity":1}]}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Product with ID 99 not found")
+
+	rr = doJSON(router, "POST", "/orders/quote", `{"items":[]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"items"`)
+
+	rr = doJSON(router, "POST", "/orders/quote", `{"items":`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// quantities that would take totals past what Money holds are refused
+	for _, quantity := range []string{"10001", "61489146912365", "9000000000000000"} {
+		rr = doJSON(router, "POST", "/orders/quote", `{"items":[{"product_id":1,"quantity":`+quantity+`}]}`)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, quantity)
+		assert.Contains(t, rr.Body.String(), `"field":"items[0].quantity","message":"must be at most 10000"`, quantity)
+	}
+
+	// and so are totals too large for the columns they are stored in
+	rr = doJSON(newProductsRouter(&InMemoryDB{store: store}), "POST", "/products", `{"name":"Yacht","price":"9999999999.99","vat_rate":0.22}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var yacht Product
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&yacht))
+	for _, quantity := range []string{"1", "2"} {
+		rr = doJSON(router, "POST", "/orders/quote", fmt.Sprintf(`{"items":[{"product_id":%d,"quantity":%s}]}`, yacht.ID, quantity))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, quantity)
+		assert.Contains(t, rr.Body.String(), `"field":"items`, quantity)
+	}
+
+	// and so are weights that do not add up within an int
+	rr = doJSON(newProductsRouter(&InMemoryDB{store: store}), "POST", "/products", `{"name":"Anvil","price":"10.00","vat_rate":0.22,"weight_grams":4611686018427387904}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var anvil Product
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&anvil))
+	rr = doJSON(router, "POST", "/orders/quote", fmt.Sprintf(`{"items":[{"product_id":%d,"quantity":2}]}`, anvil.ID))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"items[0].quantity"`)
+}
+
+func TestParsePriceMode(t *testing.T) {
+	for s, want := range map[string]PriceMode{"": PriceNet, "net": PriceNet, " Gross ": PriceGross} {
+		mode, err := ParsePriceMode(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, mode, s)
+	}
+	_, err := ParsePriceMode("inclusive")
+	assert.Error(t, err)
+}
+
+func TestPriceMode_GrossProduct(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	rr := doJSON(newProductsRouter(&InMemoryDB{store: store}), "PATCH", "/products/2", `{"price_mode":"Gross"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"price_mode":"gross"`)
+
+	// 3 x 79.99 VAT included, next to a net priced laptop
+	order := placeOrder(t, router, `{"items":[{"product_id":1,"quantity":1},{"product_id":2,"quantity":3}]}`)
+	laptop, mouse := order.Items[0], order.Items[1]
+	assert.False(t, laptop.PriceIncludesVAT)
+	assert.Equal(t, MustParseMoney("1499.99", DefaultCurrency), *laptop.LineNet)
+	assert.Equal(t, MustParseMoney("1829.99", DefaultCurrency), *laptop.LineGross)
+	assert.True(t, mouse.PriceIncludesVAT)
+	assert.Equal(t, MustParseMoney("79.99", DefaultCurrency), mouse.Price)
+	assert.Equal(t, MustParseMoney("43.27", DefaultCurrency), mouse.ItemVAT)
+	assert.Equal(t, MustParseMoney("196.70", DefaultCurrency), *mouse.LineNet)
+	assert.Equal(t, MustParseMoney("239.97", DefaultCurrency), *mouse.LineGross)
+
+	assert.Equal(t, MustParseMoney("1696.69", DefaultCurrency), order.TotalOrderPrice)
+	assert.Equal(t, MustParseMoney("373.27", DefaultCurrency), order.VATAmount)
+	assert.Equal(t, MustParseMoney("2069.96", DefaultCurrency), order.TotalGross)
+
+	rr = doJSON(router, "GET", "/orders/"+order.OrderID, "")
+	var stored OutgoingOrder
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stored))
+	assert.Equal(t, order.TotalGross, stored.TotalGross)
+	assert.True(t, stored.Items[1].PriceIncludesVAT)
+	assert.Equal(t, *mouse.LineNet, *stored.Items[1].LineNet)
+	assert.Equal(t, *mouse.LineGross, *stored.Items[1].LineGross)
+
+	// reverse charge invoices the net part of the gross price, without VAT
+	order = placeOrder(t, router, `{"items":[{"product_id":2,"quantity":3}],"country":"DE","vat_id":"DE136695976"}`)
+	assert.True(t, order.ReverseCharge)
+	assert.True(t, order.Items[0].ItemVAT.IsZero())
+	assert.Equal(t, MustParseMoney("196.70", DefaultCurrency), order.TotalOrderPrice)
+	assert.True(t, order.VATAmount.IsZero())
+	assert.Equal(t, MustParseMoney("196.70", DefaultCurrency), order.TotalGross)
+
+	rr = doJSON(newProductsRouter(&InMemoryDB{store: store}), "PATCH", "/products/2", `{"price_mode":"inclusive"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"price_mode"`)
+}
+
+func TestPriceMode_Global(t *testing.T) {
+	defer func(mode PriceMode) { DefaultPriceMode = mode }(DefaultPriceMode)
+	DefaultPriceMode = PriceGross
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	rr := doJSON(router, "POST", "/orders/quote", `{"items":[{"product_id":1,"quantity":1}]}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var quote OrderQuote
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&quote))
+	assert.True(t, quote.Items[0].PriceIncludesVAT)
+	assert.Equal(t, MustParseMoney("1229.50", DefaultCurrency), quote.TotalOrderPrice)
+	assert.Equal(t, MustParseMoney("270.49", DefaultCurrency), quote.VATAmount)
+	assert.Equal(t, MustParseMoney("1499.99", DefaultCurrency), quote.TotalGross)
+}
+
+func TestParseVATRounding(t *testing.T) {
+	for s, want := range map[string]VATRounding{"": VATPerLine, "unit": VATPerUnit, " Invoice ": VATPerInvoice} {
+		policy, err := ParseVATRounding(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, policy, s)
+	}
+	_, err := ParseVATRounding("order")
+	assert.Error(t, err)
+}
+
+func TestVATRounding_Policies(t *testing.T) {
+	defer func(policy VATRounding) { DefaultVATRounding = policy }(DefaultVATRounding)
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	// 3 x 79.99 and 3 x 129.99 at 22%: 52.7934 and 85.7934 of VAT
+	body := `{"items":[{"product_id":2,"quantity":3},{"product_id":3,"quantity":3}]}`
+
+	for policy, want := range map[VATRounding][2]string{
+		VATPerUnit:    {"52.80", "85.80"}, // 3 x 17.60 and 3 x 28.60
+		VATPerLine:    {"52.79", "85.79"},
+		VATPerInvoice: {"52.80", "85.79"}, // 138.5868 rounds to 138.59, the cent left goes to the first line
+	} {
+		DefaultVATRounding = policy
+		rr := doJSON(router, "POST", "/orders/quote", body)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var quote OrderQuote
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&quote))
+
+		vat := NewMoney(0, DefaultCurrency)
+		for i, item := range quote.Items {
+			assert.Equal(t, MustParseMoney(want[i], DefaultCurrency), item.ItemVAT, policy)
+			assert.Equal(t, item.LineNet.Add(item.ItemVAT), *item.LineGross, policy)
+			vat = vat.Add(item.ItemVAT)
+		}
+		assert.Equal(t, vat, quote.VATAmount, policy)
+		assert.Equal(t, quote.TotalOrderPrice.Add(quote.VATAmount), quote.TotalGross, policy)
+	}
+}
+
+func TestVATBreakdown(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	order := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":3},{"product_id":5,"quantity":1},{"product_id":3,"quantity":3}]}`)
+	want := []VATSummary{
+		{Rate: 0.15, TaxableBase: MustParseMoney("150.50", DefaultCurrency), VAT: MustParseMoney("22.58", DefaultCurrency)},
+		{Rate: 0.22, TaxableBase: MustParseMoney("629.94", DefaultCurrency), VAT: MustParseMoney("138.58", DefaultCurrency)},
+	}
+	assert.Equal(t, want, order.VATBreakdown)
+	assert.Equal(t, MustParseMoney("161.16", DefaultCurrency), order.VATAmount)
+
+	rr := doJSON(router, "GET", "/orders/"+order.OrderID, "")
+	var stored OutgoingOrder
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stored))
+	assert.Equal(t, want, stored.VATBreakdown)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ProductInput is the request body for creating and updating products.
+// Pointers tell a missing field apart from a zero value: POST and PUT require
+// name, price and VAT rate and default the rest, PATCH only applies the
+// fields that are present.
+type ProductInput struct {
+	Name    *string  `json:"name"`
+	Price   *Money   `json:"price"`
+	VATRate *float64 `json:"vat_rate"`
+
+	Category    *string `json:"category"`     // optional, scopes coupons
+	TaxCategory *string `json:"tax_category"` // optional, selects the tax rules
+	PriceMode   *string `json:"price_mode"`   // optional, net or gross; empty follows DefaultPriceMode
+
+	// optional, the shipping weight and packed size of one unit
+	WeightGrams *int `json:"weight_grams"`
+	LengthMM    *int `json:"length_mm"`
+	WidthMM     *int `json:"width_mm"`
+	HeightMM    *int `json:"height_mm"`
+}
+
+// applies the present fields of the input on top of p.
+func (in ProductInput) applyTo(p *DBProduct) {
+	if in.Name != nil {
+		p.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.Price != nil {
+		p.Price = *in.Price
+	}
+	if in.VATRate != nil {
+		p.VATRate = *in.VATRate
+	}
+	if in.Category != nil {
+		p.Category = strings.ToLower(strings.TrimSpace(*in.Category))
+	}
+	if in.TaxCategory != nil {
+		p.TaxCategory = strings.ToLower(strings.TrimSpace(*in.TaxCategory))
+	}
+	if in.PriceMode != nil {
+		p.PriceMode = PriceMode(strings.ToLower(strings.TrimSpace(*in.PriceMode)))
+	}
+	for _, f := range []struct {
+		in  *int
+		dst *int
+	}{{in.WeightGrams, &p.WeightGrams}, {in.LengthMM, &p.LengthMM}, {in.WidthMM, &p.WidthMM}, {in.HeightMM, &p.HeightMM}} {
+		if f.in != nil {
+			*f.dst = *f.in
+		}
+	}
+}
+
+// reports the missing fields, for full create/replace requests.
+func (in ProductInput) requireAll() []FieldError {
+	var fields []FieldError
+	if in.Name == nil {
+		fields = append(fields, FieldError{Field: "name", Message: "is required"})
+	}
+	if in.Price == nil {
+		fields = append(fields, FieldError{Field: "price", Message: "is required"})
+	}
+	if in.VATRate == nil {
+		fields = append(fields, FieldError{Field: "vat_rate", Message: "is required"})
+	}
+	return fields
+}
+
+// checks the catalog invariants of a product before it is written.
+func validateProduct(p *DBProduct) []FieldError {
+	var fields []FieldError
+	if strings.TrimSpace(p.Name) == "" {
+		fields = append(fields, FieldError{Field: "name", Message: "must not be empty"})
+	}
+	if p.Price.IsNegative() {
+		fields = append(fields, FieldError{Field: "price", Message: "must not be negative"})
+	}
+	fields = append(fields, checkCatalogAmount("price", p.Price)...)
+	if p.VATRate < 0 || p.VATRate > 1 {
+		fields = append(fields, FieldError{Field: "vat_rate", Message: "must be between 0 and 1"})
+	}
+	if p.TaxCategory == "" {
+		fields = append(fields, FieldError{Field: "tax_category", Message: "must not be empty"})
+	}
+	switch p.PriceMode {
+	case "", PriceNet, PriceGross:
+	default:
+		fields = append(fields, FieldError{Field: "price_mode", Message: "must be net or gross"})
+	}
+	for _, f := range []struct {
+		name  string
+		value int
+	}{{"weight_grams", p.WeightGrams}, {"length_mm", p.LengthMM}, {"width_mm", p.WidthMM}, {"height_mm", p.HeightMM}} {
+		if f.value < 0 {
+			fields = append(fields, FieldError{Field: f.name, Message: "must not be negative"})
+		}
+	}
+	return fields
+}
+
+func toPublicProduct(p DBProduct) Product {
+	return Product{
+		ID:          p.ID,
+		Name:        p.Name,
+		Price:       p.Price,
+		VATRate:     p.VATRate,
+		Category:    p.Category,
+		TaxCategory: p.TaxCategory,
+		PriceMode:   p.PriceMode,
+		WeightGrams: p.WeightGrams,
+		LengthMM:    p.LengthMM,
+		WidthMM:     p.WidthMM,
+		HeightMM:    p.HeightMM,
+	}
+}
+
+// whether the price of p includes VAT, the global mode unless p has its own.
+func (p *DBProduct) priceMode() PriceMode {
+	if p.PriceMode == "" {
+		return DefaultPriceMode
+	}
+	return p.PriceMode
+}
+
+// --- Product Database Functions ---
+
+// fetches a single product from the 'products' table by its ID
+func GetProductByID(executor Queryer, productID int) (*DBProduct, error) {
+	var product DBProduct
+	var mode string
+	row := executor.QueryRow("SELECT id, name, price, vat_rate, category, tax_category, price_mode, weight_grams, length_mm, width_mm, height_mm FROM products WHERE id = $1", productID)
+	err := row.Scan(&product.ID, &product.Name, &product.Price, &product.VATRate, &product.Category, &product.TaxCategory, &mode,
+		&product.WeightGrams, &product.LengthMM, &product.WidthMM, &product.HeightMM)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Wrapping the error is good practice to provide more context.
+			return nil, fmt.Errorf("product not found: %w", sql.ErrNoRows)
+		}
+		return nil, fmt.Errorf("failed to scan product: %w", err)
+	}
+	product.PriceMode = PriceMode(mode)
+	return &product, nil
+}
+
+// fetches all products from the 'products' table
+func GetAllProducts(executor DBExecutor) ([]DBProduct, error) {
+	rows, err := executor.Query("SELECT id, name, price, vat_rate, category, tax_category, price_mode, weight_grams, length_mm, width_mm, height_mm FROM products")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query products: %w", err)
+	}
+	defer rows.Close()
+
+	var products []DBProduct
+	for rows.Next() {
+		var product DBProduct
+		var mode string
+		if err := rows.Scan(&product.ID, &product.Name, &product.Price, &product.VATRate, &product.Category, &product.TaxCategory, &mode,
+			&product.WeightGrams, &product.LengthMM, &product.WidthMM, &product.HeightMM); err != nil {
+			return nil, fmt.Errorf("failed to scan product row: %w", err)
+		}
+		product.PriceMode = PriceMode(mode)
+		products = append(products, product)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during products iteration: %w", err)
+	}
+	return products, nil
+}
+
+// inserts a new product into the 'products' table and sets its generated ID.
+func InsertProduct(executor TxExecutor, product *DBProduct) error {
+	if product.TaxCategory == "" {
+		product.TaxCategory = DefaultTaxCategory
+	}
+	err := executor.QueryRow("INSERT INTO products (name, price, vat_rate, category, tax_category, price_mode, weight_grams, length_mm, width_mm, height_mm) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id",
+		product.Name, product.Price, product.VATRate, product.Category, product.TaxCategory, string(product.PriceMode),
+		product.WeightGrams, product.LengthMM, product.WidthMM, product.HeightMM).Scan(&product.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert product: %w", err)
+	}
+	return nil
+}
+
+// overwrites name, price, VAT rate, categories, price mode, weight and dimensions of an existing product.
+func UpdateProduct(executor TxExecutor, product *DBProduct) error {
+	res, err := executor.Exec("UPDATE products SET name = $1, price = $2, vat_rate = $3, category = $4, tax_category = $5, price_mode = $6, weight_grams = $7, length_mm = $8, width_mm = $9, height_mm = $10 WHERE id = $11",
+		product.Name, product.Price, product.VATRate, product.Category, product.TaxCategory, string(product.PriceMode),
+		product.WeightGrams, product.LengthMM, product.WidthMM, product.HeightMM, product.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update product: %w", err)
+	}
+	return requireRowAffected(res, "product not found")
+}
+
+// removes a product from the 'products' table.
+func DeleteProduct(executor TxExecutor, productID int) error {
+	res, err := executor.Exec("DELETE FROM products WHERE id = $1", productID)
+	if err != nil {
+		return fmt.Errorf("failed to delete product: %w", err)
+	}
+	return requireRowAffected(res, "product not found")
+}
+
+// turns an UPDATE/DELETE that matched nothing into a wrapped sql.ErrNoRows.
+func requireRowAffected(res sql.Result, msg string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", msg, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// --- Product HTTP Handlers ---
+
+// parses the {id} route variable of the product routes.
+func productIDFromRequest(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		return 0, ErrBadRequest("invalid product ID %q", mux.Vars(r)["id"])
+	}
+	return id, nil
+}
+
+// maps a product lookup or write failure to the API error sent to the client.
+func productError(err error, productID int) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound("Product with ID %d not found", productID)
+	}
+	return err
+}
+
+// returns an http.HandlerFunc that uses the provided DBExecutor. for manual tests
+func getProductsHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		products, err := GetAllProducts(executor)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		publicProducts := []Product{}
+		for _, p := range products {
+			publicProducts = append(publicProducts, toPublicProduct(p))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(publicProducts)
+	}
+}
+
+// GET /products/{id}
+func getProductHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, err := productIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		product, err := GetProductByID(executor, productID)
+		if err != nil {
+			writeError(w, r, productError(err, productID))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(toPublicProduct(*product))
+	}
+}
+
+// POST /products
+func createProductHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input ProductInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		if fields := input.requireAll(); len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		product := DBProduct{TaxCategory: DefaultTaxCategory}
+		input.applyTo(&product)
+		if fields := validateProduct(&product); len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := InsertProduct(tx, &product); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", fmt.Sprintf("/products/%d", product.ID))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(toPublicProduct(product))
+	}
+}
+
+// PUT and PATCH /products/{id}. PUT replaces the product: the optional fields
+// missing from the body go back to their defaults. PATCH merges the fields
+// present in the body into the stored product.
+func updateProductHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, err := productIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		var input ProductInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		if r.Method == http.MethodPut {
+			if fields := input.requireAll(); len(fields) > 0 {
+				writeError(w, r, ErrValidation(fields...))
+				return
+			}
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		product, err := GetProductByID(tx, productID)
+		if err != nil {
+			writeError(w, r, productError(err, productID))
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			*product = DBProduct{ID: product.ID, TaxCategory: DefaultTaxCategory}
+		}
+		input.applyTo(product)
+		if fields := validateProduct(product); len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		if err := UpdateProduct(tx, product); err != nil {
+			writeError(w, r, productError(err, productID))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(toPublicProduct(*product))
+	}
+}
+
+// DELETE /products/{id}
+func deleteProductHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, err := productIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := DeleteProduct(tx, productID); err != nil {
+			writeError(w, r, productError(err, productID))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
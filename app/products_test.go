@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func newProductsRouter(executor DBExecutor) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/products", getProductsHandler(executor)).Methods("GET")
+	router.HandleFunc("/products", createProductHandler(executor)).Methods("POST")
+	router.HandleFunc("/products/{id}", getProductHandler(executor)).Methods("GET")
+	router.HandleFunc("/products/{id}", updateProductHandler(executor)).Methods("PUT", "PATCH")
+	router.HandleFunc("/products/{id}", deleteProductHandler(executor)).Methods("DELETE")
+	return router
+}
+
+func doJSON(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestProductCRUD_InMemory(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newProductsRouter(&InMemoryDB{store: store})
+
+	rr := doJSON(router, "POST", "/products", `{"name":"USB Hub","price":"24.90","vat_rate":0.22}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var created Product
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+	assert.Equal(t, 6, created.ID)
+	assert.Equal(t, DefaultTaxCategory, created.TaxCategory)
+	assert.Equal(t, "/products/6", rr.Header().Get("Location"))
+
+	rr = doJSON(router, "PATCH", "/products/6", `{"price":19.90,"category":"accessories","tax_category":"reduced","price_mode":"gross","weight_grams":300}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = doJSON(router, "GET", "/products/6", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var fetched Product
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&fetched))
+	assert.Equal(t, "USB Hub", fetched.Name)
+	assert.Equal(t, MustParseMoney("19.90", DefaultCurrency), fetched.Price)
+	assert.Equal(t, "accessories", fetched.Category)
+	assert.Equal(t, 300, fetched.WeightGrams)
+
+	rr = doJSON(router, "PUT", "/products/6", `{"name":"USB-C Hub"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = doJSON(router, "PUT", "/products/6", `{"name":"USB-C Hub","price":29,"vat_rate":0.1}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	stored, err := GetProductByID(&InMemoryDB{store: store}, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, "USB-C Hub", stored.Name)
+	// a replacement resets the fields it leaves out
+	assert.Equal(t, "", stored.Category)
+	assert.Equal(t, DefaultTaxCategory, stored.TaxCategory)
+	assert.Equal(t, PriceMode(""), stored.PriceMode)
+	assert.Equal(t, 0, stored.WeightGrams)
+
+	rr = doJSON(router, "DELETE", "/products/6", "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	rr = doJSON(router, "GET", "/products/6", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = doJSON(router, "DELETE", "/products/6", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestCreateProductHandler_Validation(t *testing.T) {
+	store := NewInMemoryStore()
+	router := newProductsRouter(&InMemoryDB{store: store})
+
+	cases := map[string]string{
+		"blank name":     `{"name":"  ","price":1,"vat_rate":0.22}`,
+		"negative price": `{"name":"x","price":-1,"vat_rate":0.22}`,
+		"vat above 1":    `{"name":"x","price":1,"vat_rate":1.5}`,
+		"missing price":  `{"name":"x","vat_rate":0.22}`,
+		"sub-cent price": `{"name":"x","price":1.001,"vat_rate":0.22}`,
+		"huge price":     `{"name":"x","price":10000000000,"vat_rate":0.22}`,
+	}
+	for name, body := range cases {
+		rr := doJSON(router, "POST", "/products", body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, name)
+	}
+	assert.Equal(t, 0, countRows(t, store, "products"))
+}
+
+func TestGetProductHandler_InvalidID(t *testing.T) {
+	router := newProductsRouter(&MockDB{})
+	rr := doJSON(router, "GET", "/products/abc", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.True(t, strings.Contains(rr.Body.String(), "invalid product ID"))
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ShippingKind is how a shipping method is priced.
+type ShippingKind string
+
+const (
+	ShippingFlat   ShippingKind = "flat"   // one price whatever the weight
+	ShippingWeight ShippingKind = "weight" // the price of the lightest band the parcel fits in
+)
+
+// volumetricDivisor turns the packed volume of a unit in mm³ into the weight
+// in grams carriers charge it at, 5000 cm³ per kg.
+const volumetricDivisor = 5000
+
+// WeightBand is the price of a weight method for parcels up to UpToGrams.
+type WeightBand struct {
+	UpToGrams int   `json:"up_to_grams"`
+	Price     Money `json:"price"`
+}
+
+// ShippingMethod is a way of shipping to the countries of a zone, with its
+// rate table. Amounts are in the catalog currency and follow DefaultPriceMode.
+type ShippingMethod struct {
+	Code        string       `json:"code"`
+	Name        string       `json:"name"`
+	Kind        ShippingKind `json:"kind"`
+	Price       Money        `json:"price"`               // flat methods
+	Bands       []WeightBand `json:"bands,omitempty"`     // weight methods, lightest first
+	FreeOver    *Money       `json:"free_over,omitempty"` // shipping is free once the discounted items reach it
+	VATRate     float64      `json:"vat_rate"`            // where no tax rule applies
+	TaxCategory string       `json:"tax_category"`
+}
+
+// ShippingZone is a set of destination countries sharing shipping methods. A
+// country belongs to one zone at most; a zone without countries covers the
+// countries of no other zone.
+type ShippingZone struct {
+	ID        int              `json:"id"`
+	Name      string           `json:"name"`
+	Countries []string         `json:"countries"`
+	Methods   []ShippingMethod `json:"methods"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// the country keys the zone is stored under, an empty one for the rest of
+// the world.
+func (z *ShippingZone) countryKeys() []string {
+	if len(z.Countries) == 0 {
+		return []string{""}
+	}
+	return z.Countries
+}
+
+// returns the method with code, or nil.
+func (z *ShippingZone) method(code string) *ShippingMethod {
+	for i := range z.Methods {
+		if z.Methods[i].Code == code {
+			return &z.Methods[i]
+		}
+	}
+	return nil
+}
+
+// the price of a parcel of weight grams in the catalog currency, false when
+// it is heavier than every band of a weight method.
+func (m *ShippingMethod) priceFor(weight int) (Money, bool) {
+	if m.Kind == ShippingFlat {
+		return m.Price, true
+	}
+	for _, band := range m.Bands {
+		if weight <= band.UpToGrams {
+			return band.Price, true
+		}
+	}
+	return Money{}, false
+}
+
+// the weight a unit of p is charged at: its weight, or its volumetric weight
+// when that is more.
+func (p *DBProduct) shippingWeight() int {
+	volumetric := int64(p.LengthMM) * int64(p.WidthMM) * int64(p.HeightMM) / volumetricDivisor
+	return max(p.WeightGrams, int(volumetric))
+}
+
+// normalizes a shipping method code as sent by clients.
+func normalizeShippingMethod(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+// ShippingZoneInput is the request body for creating and replacing shipping
+// zones; a replacement replaces the countries and methods too.
+type ShippingZoneInput struct {
+	Name      string           `json:"name"`
+	Countries []string         `json:"countries"`
+	Methods   []ShippingMethod `json:"methods"`
+}
+
+// checks the input and turns it into the zone to write.
+func (in ShippingZoneInput) toShippingZone() (*ShippingZone, []FieldError) {
+	z := &ShippingZone{Name: strings.TrimSpace(in.Name), Countries: []string{}, Methods: []ShippingMethod{}}
+	var fields []FieldError
+	if z.Name == "" {
+		fields = append(fields, FieldError{Field: "name", Message: "is required"})
+	}
+
+	seen := make(map[string]bool)
+	for i, country := range in.Countries {
+		country = normalizeCountry(country)
+		switch {
+		case !countryPattern.MatchString(country):
+			fields = append(fields, FieldError{Field: fmt.Sprintf("countries[%d]", i), Message: "must be an ISO 3166-1 alpha-2 code"})
+		case seen[country]:
+			fields = append(fields, FieldError{Field: fmt.Sprintf("countries[%d]", i), Message: fmt.Sprintf("%s is given twice", country)})
+		}
+		seen[country] = true
+		z.Countries = append(z.Countries, country)
+	}
+	sort.Strings(z.Countries)
+
+	if len(in.Methods) == 0 {
+		fields = append(fields, FieldError{Field: "methods", Message: "must list at least one method"})
+	}
+	codes := make(map[string]bool)
+	for i, m := range in.Methods {
+		field := fmt.Sprintf("methods[%d]", i)
+		m.Code = normalizeShippingMethod(m.Code)
+		m.Name = strings.TrimSpace(m.Name)
+		m.TaxCategory = strings.ToLower(strings.TrimSpace(m.TaxCategory))
+		if m.TaxCategory == "" {
+			m.TaxCategory = DefaultTaxCategory
+		}
+		switch {
+		case m.Code == "":
+			fields = append(fields, FieldError{Field: field + ".code", Message: "is required"})
+		case codes[m.Code]:
+			fields = append(fields, FieldError{Field: field + ".code", Message: fmt.Sprintf("%s is given twice", m.Code)})
+		}
+		codes[m.Code] = true
+		if m.Name == "" {
+			fields = append(fields, FieldError{Field: field + ".name", Message: "is required"})
+		}
+		if m.VATRate < 0 || m.VATRate > 1 {
+			fields = append(fields, FieldError{Field: field + ".vat_rate", Message: "must be between 0 and 1"})
+		}
+		if m.FreeOver != nil {
+			if m.FreeOver.IsNegative() {
+				fields = append(fields, FieldError{Field: field + ".free_over", Message: "must not be negative"})
+			}
+			fields = append(fields, checkCatalogAmount(field+".free_over", *m.FreeOver)...)
+		}
+
+		switch m.Kind {
+		case ShippingFlat:
+			if m.Price.IsNegative() {
+				fields = append(fields, FieldError{Field: field + ".price", Message: "must not be negative"})
+			}
+			fields = append(fields, checkCatalogAmount(field+".price", m.Price)...)
+			if len(m.Bands) > 0 {
+				fields = append(fields, FieldError{Field: field + ".bands", Message: "are only used by weight methods"})
+			}
+		case ShippingWeight:
+			if len(m.Bands) == 0 {
+				fields = append(fields, FieldError{Field: field + ".bands", Message: "must list at least one band"})
+			}
+			sort.SliceStable(m.Bands, func(a, b int) bool { return m.Bands[a].UpToGrams < m.Bands[b].UpToGrams })
+			for j, band := range m.Bands {
+				bandField := fmt.Sprintf("%s.bands[%d]", field, j)
+				if band.UpToGrams <= 0 {
+					fields = append(fields, FieldError{Field: bandField + ".up_to_grams", Message: "must be positive"})
+				} else if j > 0 && band.UpToGrams == m.Bands[j-1].UpToGrams {
+					fields = append(fields, FieldError{Field: bandField + ".up_to_grams", Message: fmt.Sprintf("%d is given twice", band.UpToGrams)})
+				}
+				if band.Price.IsNegative() {
+					fields = append(fields, FieldError{Field: bandField + ".price", Message: "must not be negative"})
+				}
+				fields = append(fields, checkCatalogAmount(bandField+".price", band.Price)...)
+			}
+			m.Price = NewMoney(0, DefaultCurrency)
+		default:
+			fields = append(fields, FieldError{Field: field + ".kind", Message: "must be flat or weight"})
+		}
+		z.Methods = append(z.Methods, m)
+	}
+	return z, fields
+}
+
+// ShippingLine is the shipping of an order, priced like an item.
+type ShippingLine struct {
+	Method           string  `json:"method"`
+	Name             string  `json:"name"`
+	WeightGrams      int     `json:"weight_grams"` // the chargeable weight of the items
+	Price            Money   `json:"price"`        // gross when price_includes_vat, 0 when free
+	PriceIncludesVAT bool    `json:"price_includes_vat,omitempty"`
+	VATRate          float64 `json:"vat_rate"`
+	TaxRuleID        int     `json:"tax_rule_id,omitempty"` // missing when the method's own rate applied
+	VAT              Money   `json:"vat"`
+	Net              Money   `json:"net"`
+	Gross            Money   `json:"gross"`
+}
+
+// PricedShipping is the shipping line of a PricedOrder. Its VAT is settled
+// with the items.
+type PricedShipping struct {
+	PricedItem
+	Method      string
+	Name        string
+	WeightGrams int
+}
+
+// the shipping in the shape of the order response.
+func (s *PricedShipping) line() *ShippingLine {
+	return &ShippingLine{
+		Method:           s.Method,
+		Name:             s.Name,
+		WeightGrams:      s.WeightGrams,
+		Price:            s.UnitPrice,
+		PriceIncludesVAT: s.PriceIncludesVAT,
+		VATRate:          s.VATRate,
+		TaxRuleID:        s.TaxRuleID,
+		VAT:              s.LineVAT,
+		Net:              s.Net,
+		Gross:            s.Gross,
+	}
+}
+
+// prices the shipping of priced, whose items weigh weight grams, with the
+// method the order names in the zone covering the destination. The method is
+// free when the discounted items reach its free_over threshold. Failures are
+// returned as the API errors sent to the client.
+func priceShipping(executor Queryer, order *IncomingOrder, priced *PricedOrder, taxRules *TaxRuleSet, weight int) (*PricedShipping, error) {
+	code := normalizeShippingMethod(order.ShippingMethod)
+	country := order.destination()
+	zone, err := GetShippingZoneForCountry(executor, country)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrValidation(FieldError{Field: "shipping_method", Message: fmt.Sprintf("there is no shipping to %s", country)})
+	} else if err != nil {
+		return nil, err
+	}
+	method := zone.method(code)
+	if method == nil {
+		return nil, ErrValidation(FieldError{Field: "shipping_method", Message: fmt.Sprintf("%s does not ship to %s", code, country)})
+	}
+	price, ok := method.priceFor(weight)
+	if !ok {
+		return nil, ErrValidation(FieldError{Field: "shipping_method", Message: fmt.Sprintf("the items weigh %d g, more than %s takes", weight, code)})
+	}
+
+	currency := priced.Currency
+	if price, err = price.Convert(currency, priced.ExchangeRate, DefaultRoundingMode); err != nil {
+		return nil, err
+	}
+	if method.FreeOver != nil {
+		goods := NewMoney(0, currency)
+		for i := range priced.Items {
+			goods = goods.Add(priced.Items[i].discounted())
+		}
+		freeOver, err := method.FreeOver.Convert(currency, priced.ExchangeRate, DefaultRoundingMode)
+		if err != nil {
+			return nil, err
+		}
+		if goods.Cmp(freeOver) >= 0 {
+			price = NewMoney(0, currency)
+		}
+	}
+
+	rate, ruleID := taxRules.resolve(method.TaxCategory, method.VATRate)
+	shipping := &PricedShipping{
+		PricedItem: PricedItem{
+			Quantity:         1,
+			UnitPrice:        price,
+			PriceIncludesVAT: DefaultPriceMode == PriceGross,
+			VATRate:          rate,
+			TaxRuleID:        ruleID,
+			LineTotal:        price,
+			Discount:         NewMoney(0, currency),
+			includedRate:     rate,
+		},
+		Method:      method.Code,
+		Name:        method.Name,
+		WeightGrams: weight,
+	}
+	if priced.ReverseCharge {
+		shipping.VATRate, shipping.TaxRuleID = 0, 0
+	}
+	return shipping, nil
+}
+
+// --- Shipping Database Functions ---
+
+// fetches every shipping zone with its methods, ordered by ID.
+func GetShippingZones(executor Queryer) ([]ShippingZone, error) {
+	rows, err := executor.Query("SELECT id, name, created_at FROM shipping_zones ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query shipping zones: %w", err)
+	}
+	zones := []ShippingZone{}
+	for rows.Next() {
+		var z ShippingZone
+		if err := rows.Scan(&z.ID, &z.Name, &z.CreatedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan shipping zone row: %w", err)
+		}
+		zones = append(zones, z)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error during shipping zones iteration: %w", err)
+	}
+
+	for i := range zones {
+		if err := loadShippingZone(executor, &zones[i]); err != nil {
+			return nil, err
+		}
+	}
+	return zones, nil
+}
+
+// fetches a shipping zone with its methods by its ID.
+func GetShippingZoneByID(executor Queryer, id int) (*ShippingZone, error) {
+	var z ShippingZone
+	err := executor.QueryRow("SELECT id, name, created_at FROM shipping_zones WHERE id = $1", id).Scan(&z.ID, &z.Name, &z.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("shipping zone not found: %w", sql.ErrNoRows)
+		}
+		return nil, fmt.Errorf("failed to scan shipping zone: %w", err)
+	}
+	if err := loadShippingZone(executor, &z); err != nil {
+		return nil, err
+	}
+	return &z, nil
+}
+
+// fetches the zone covering country: the zone listing it, else the zone
+// without countries.
+func GetShippingZoneForCountry(executor Queryer, country string) (*ShippingZone, error) {
+	var id int
+	err := executor.QueryRow("SELECT zone_id FROM shipping_zone_countries WHERE country = $1 OR country = '' ORDER BY country DESC LIMIT 1", country).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("shipping zone not found: %w", sql.ErrNoRows)
+		}
+		return nil, fmt.Errorf("failed to look up shipping zone: %w", err)
+	}
+	return GetShippingZoneByID(executor, id)
+}
+
+// reads the countries, methods and bands of z.
+func loadShippingZone(executor Queryer, z *ShippingZone) error {
+	rows, err := executor.Query("SELECT country FROM shipping_zone_countries WHERE zone_id = $1 ORDER BY country", z.ID)
+	if err != nil {
+		return fmt.Errorf("failed to query shipping zone countries: %w", err)
+	}
+	defer rows.Close()
+	z.Countries = []string{}
+	for rows.Next() {
+		var country string
+		if err := rows.Scan(&country); err != nil {
+			return fmt.Errorf("failed to scan shipping zone country row: %w", err)
+		}
+		if country != "" {
+			z.Countries = append(z.Countries, country)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error during shipping zone countries iteration: %w", err)
+	}
+
+	methodRows, err := executor.Query("SELECT code, name, kind, price, free_over, vat_rate, tax_category FROM shipping_methods WHERE zone_id = $1 ORDER BY position", z.ID)
+	if err != nil {
+		return fmt.Errorf("failed to query shipping methods: %w", err)
+	}
+	defer methodRows.Close()
+	z.Methods = []ShippingMethod{}
+	for methodRows.Next() {
+		var m ShippingMethod
+		var kind string
+		var freeOver NullMoney
+		if err := methodRows.Scan(&m.Code, &m.Name, &kind, &m.Price, &freeOver, &m.VATRate, &m.TaxCategory); err != nil {
+			return fmt.Errorf("failed to scan shipping method row: %w", err)
+		}
+		m.Kind = ShippingKind(kind)
+		if freeOver.Valid {
+			m.FreeOver = &freeOver.Money
+		}
+		z.Methods = append(z.Methods, m)
+	}
+	if err := methodRows.Err(); err != nil {
+		return fmt.Errorf("error during shipping methods iteration: %w", err)
+	}
+
+	bandRows, err := executor.Query("SELECT code, up_to_grams, price FROM shipping_method_bands WHERE zone_id = $1 ORDER BY code, up_to_grams", z.ID)
+	if err != nil {
+		return fmt.Errorf("failed to query shipping method bands: %w", err)
+	}
+	defer bandRows.Close()
+	for bandRows.Next() {
+		var code string
+		var band WeightBand
+		if err := bandRows.Scan(&code, &band.UpToGrams, &band.Price); err != nil {
+			return fmt.Errorf("failed to scan shipping method band row: %w", err)
+		}
+		if m := z.method(code); m != nil {
+			m.Bands = append(m.Bands, band)
+		}
+	}
+	if err := bandRows.Err(); err != nil {
+		return fmt.Errorf("error during shipping method bands iteration: %w", err)
+	}
+	return nil
+}
+
+// returns the conflict writing z would cause, another zone with its name or
+// covering one of its countries, or nil.
+func shippingZoneConflict(executor Queryer, z *ShippingZone) error {
+	var id int
+	err := executor.QueryRow("SELECT id FROM shipping_zones WHERE name = $1 AND id <> $2", z.Name, z.ID).Scan(&id)
+	if err == nil {
+		return ErrConflict(CodeConflict, "A shipping zone named %s already exists", z.Name).WithDetail("shipping_zone_id", id)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to look up shipping zone name: %w", err)
+	}
+	for _, country := range z.countryKeys() {
+		err := executor.QueryRow("SELECT zone_id FROM shipping_zone_countries WHERE country = $1 AND zone_id <> $2", country, z.ID).Scan(&id)
+		if err == nil {
+			if country == "" {
+				country = "the countries of no other zone"
+			}
+			return ErrConflict(CodeConflict, "Shipping zone %d already covers %s", id, country).WithDetail("shipping_zone_id", id)
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to look up shipping zone country: %w", err)
+		}
+	}
+	return nil
+}
+
+// inserts a shipping zone, or replaces the zone with z's ID, with its
+// countries, methods and bands. Orders keep the shipping they were priced with.
+func SaveShippingZone(executor TxExecutor, z *ShippingZone, now time.Time) error {
+	if z.ID == 0 {
+		z.CreatedAt = now
+		if err := executor.QueryRow("INSERT INTO shipping_zones (name, created_at) VALUES ($1, $2) RETURNING id", z.Name, now).Scan(&z.ID); err != nil {
+			return fmt.Errorf("failed to insert shipping zone: %w", err)
+		}
+	} else {
+		res, err := executor.Exec("UPDATE shipping_zones SET name = $1 WHERE id = $2", z.Name, z.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update shipping zone: %w", err)
+		}
+		if err := requireRowAffected(res, "shipping zone not found"); err != nil {
+			return err
+		}
+		for _, table := range []string{"shipping_method_bands", "shipping_methods", "shipping_zone_countries"} {
+			if _, err := executor.Exec("DELETE FROM "+table+" WHERE zone_id = $1", z.ID); err != nil {
+				return fmt.Errorf("failed to clear %s: %w", table, err)
+			}
+		}
+	}
+
+	for _, country := range z.countryKeys() {
+		if _, err := executor.Exec("INSERT INTO shipping_zone_countries (country, zone_id) VALUES ($1, $2)", country, z.ID); err != nil {
+			return fmt.Errorf("failed to insert shipping zone country: %w", err)
+		}
+	}
+	for i, m := range z.Methods {
+		var freeOver interface{}
+		if m.FreeOver != nil {
+			freeOver = *m.FreeOver
+		}
+		_, err := executor.Exec("INSERT INTO shipping_methods (zone_id, code, name, kind, price, free_over, vat_rate, tax_category, position) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+			z.ID, m.Code, m.Name, string(m.Kind), m.Price, freeOver, m.VATRate, m.TaxCategory, i)
+		if err != nil {
+			return fmt.Errorf("failed to insert shipping method: %w", err)
+		}
+		for _, band := range m.Bands {
+			_, err := executor.Exec("INSERT INTO shipping_method_bands (zone_id, code, up_to_grams, price) VALUES ($1, $2, $3, $4)",
+				z.ID, m.Code, band.UpToGrams, band.Price)
+			if err != nil {
+				return fmt.Errorf("failed to insert shipping method band: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// records the shipping line of an order.
+func InsertOrderShipping(executor TxExecutor, orderID string, s *ShippingLine) error {
+	var ruleID interface{}
+	if s.TaxRuleID != 0 {
+		ruleID = s.TaxRuleID
+	}
+	_, err := executor.Exec("INSERT INTO order_shipping (order_id, method, name, weight_grams, price, price_includes_vat, vat_rate, tax_rule_id, vat, net, gross) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+		orderID, s.Method, s.Name, s.WeightGrams, s.Price, s.PriceIncludesVAT, s.VATRate, ruleID, s.VAT, s.Net, s.Gross)
+	if err != nil {
+		return fmt.Errorf("failed to insert order shipping: %w", err)
+	}
+	return nil
+}
+
+// fetches the shipping line of an order, nil for orders placed without one.
+func GetOrderShipping(executor Queryer, orderID string) (*ShippingLine, error) {
+	var s ShippingLine
+	var ruleID sql.NullInt64
+	err := executor.QueryRow("SELECT method, name, weight_grams, price, price_includes_vat, vat_rate, tax_rule_id, vat, net, gross FROM order_shipping WHERE order_id = $1", orderID).
+		Scan(&s.Method, &s.Name, &s.WeightGrams, &s.Price, &s.PriceIncludesVAT, &s.VATRate, &ruleID, &s.VAT, &s.Net, &s.Gross)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan order shipping: %w", err)
+	}
+	s.TaxRuleID = int(ruleID.Int64)
+	return &s, nil
+}
+
+// --- Shipping HTTP Handlers ---
+
+// parses the {id} route variable of the shipping zone routes.
+func shippingZoneIDFromRequest(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		return 0, ErrBadRequest("invalid shipping zone ID %q", mux.Vars(r)["id"])
+	}
+	return id, nil
+}
+
+// maps a shipping zone lookup failure to the API error sent to the client.
+func shippingZoneError(err error, id int) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound("Shipping zone with ID %d not found", id)
+	}
+	return err
+}
+
+// GET /shipping-zones
+func getShippingZonesHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		zones, err := GetShippingZones(executor)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(zones)
+	}
+}
+
+// GET /shipping-zones/{id}
+func getShippingZoneHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := shippingZoneIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		zone, err := GetShippingZoneByID(executor, id)
+		if err != nil {
+			writeError(w, r, shippingZoneError(err, id))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(zone)
+	}
+}
+
+// POST /shipping-zones and PUT /shipping-zones/{id}. A zone named like
+// another one or covering one of its countries is rejected with 409.
+func saveShippingZoneHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := 0
+		if r.Method == http.MethodPut {
+			var err error
+			if id, err = shippingZoneIDFromRequest(r); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+
+		var input ShippingZoneInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		zone, fields := input.toShippingZone()
+		if len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+		zone.ID = id
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := shippingZoneConflict(tx, zone); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := SaveShippingZone(tx, zone, time.Now()); err != nil {
+			writeError(w, r, shippingZoneError(err, id))
+			return
+		}
+		saved, err := GetShippingZoneByID(tx, zone.ID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if id == 0 {
+			w.Header().Set("Location", fmt.Sprintf("/shipping-zones/%d", saved.ID))
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(saved)
+	}
+}
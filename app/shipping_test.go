@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// creates a shipping zone through the API and returns the decoded response.
+func createShippingZone(t *testing.T, router http.Handler, body string) ShippingZone {
+	rr := doJSON(router, "POST", "/shipping-zones", body)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var zone ShippingZone
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&zone))
+	return zone
+}
+
+const italyZone = `{"name":"Italy","countries":["it"],"methods":[
+	{"code":"standard","name":"Standard","kind":"flat","price":6.90,"free_over":100,"vat_rate":0.22},
+	{"code":"Courier","name":"Courier","kind":"weight","vat_rate":0.22,"bands":[
+		{"up_to_grams":20000,"price":19},{"up_to_grams":1000,"price":5},{"up_to_grams":5000,"price":9}]}]}`
+
+func TestShippingWeight(t *testing.T) {
+	laptop := DBProduct{WeightGrams: 2200, LengthMM: 400, WidthMM: 300, HeightMM: 60}
+	assert.Equal(t, 2200, laptop.shippingWeight())
+	monitor := DBProduct{WeightGrams: 7500, LengthMM: 700, WidthMM: 480, HeightMM: 200}
+	assert.Equal(t, 13440, monitor.shippingWeight()) // volumetric
+	assert.Zero(t, (&DBProduct{}).shippingWeight())
+}
+
+func TestShippingZones(t *testing.T) {
+	store := NewInMemoryStore()
+	router := newOrdersRouter(store)
+
+	zone := createShippingZone(t, router, italyZone)
+	assert.Equal(t, []string{"IT"}, zone.Countries)
+	require.Len(t, zone.Methods, 2)
+	courier := zone.Methods[1]
+	assert.Equal(t, "courier", courier.Code)
+	assert.Equal(t, DefaultTaxCategory, courier.TaxCategory)
+	assert.Equal(t, []int{1000, 5000, 20000}, []int{courier.Bands[0].UpToGrams, courier.Bands[1].UpToGrams, courier.Bands[2].UpToGrams})
+	assert.Equal(t, MustParseMoney("100.00", DefaultCurrency), *zone.Methods[0].FreeOver)
+
+	rest := createShippingZone(t, router, `{"name":"World","methods":[{"code":"standard","name":"Standard","kind":"flat","price":25,"vat_rate":0.22}]}`)
+	assert.Empty(t, rest.Countries)
+
+	for body, message := range map[string]string{
+		`{"name":"Italia","countries":["DE","IT"],"methods":[{"code":"x","name":"X","kind":"flat","price":1}]}`: "already covers IT",
+		`{"name":"Elsewhere","methods":[{"code":"x","name":"X","kind":"flat","price":1}]}`:                      "already covers the countries of no other zone",
+		`{"name":"Italy","countries":["FR"],"methods":[{"code":"x","name":"X","kind":"flat","price":1}]}`:       "already exists",
+	} {
+		rr := doJSON(router, "POST", "/shipping-zones", body)
+		assert.Equal(t, http.StatusConflict, rr.Code, body)
+		assert.Contains(t, rr.Body.String(), message, body)
+	}
+
+	rr := doJSON(router, "POST", "/shipping-zones", `{"name":"","countries":["ITA","FR","FR"],"methods":[
+		{"code":"a","name":"A","kind":"weight","bands":[{"up_to_grams":0,"price":1}]},
+		{"code":"A","name":"","kind":"pigeon","vat_rate":2}]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	for _, field := range []string{"name", "countries[0]", "countries[2]", "methods[0].bands[0].up_to_grams",
+		"methods[1].code", "methods[1].name", "methods[1].kind", "methods[1].vat_rate"} {
+		assert.Contains(t, rr.Body.String(), `"field":"`+field+`"`)
+	}
+
+	// a replacement replaces the countries and methods
+	path := fmt.Sprintf("/shipping-zones/%d", zone.ID)
+	rr = doJSON(router, "PUT", path, `{"name":"Italy and San Marino","countries":["IT","SM"],"methods":[{"code":"standard","name":"Standard","kind":"flat","price":7.90,"vat_rate":0.22}]}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = doJSON(router, "GET", path, "")
+	var replaced ShippingZone
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&replaced))
+	assert.Equal(t, []string{"IT", "SM"}, replaced.Countries)
+	require.Len(t, replaced.Methods, 1)
+	assert.Nil(t, replaced.Methods[0].FreeOver)
+
+	rr = doJSON(router, "GET", "/shipping-zones", "")
+	var zones []ShippingZone
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&zones))
+	assert.Len(t, zones, 2)
+	rr = doJSON(router, "GET", "/shipping-zones/99", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestShippingOrders(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	createShippingZone(t, router, italyZone)
+	createShippingZone(t, router, `{"name":"World","methods":[{"code":"standard","name":"Standard","kind":"flat","price":25,"vat_rate":0.22}]}`)
+
+	// a mouse: 79.99 of goods, below the free shipping threshold
+	order := placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}],"shipping_method":"standard"}`)
+	require.NotNil(t, order.Shipping)
+	assert.Equal(t, "standard", order.Shipping.Method)
+	assert.Equal(t, 150, order.Shipping.WeightGrams)
+	assert.Equal(t, MustParseMoney("6.90", DefaultCurrency), order.Shipping.Net)
+	assert.Equal(t, MustParseMoney("1.52", DefaultCurrency), order.Shipping.VAT)
+	assert.Equal(t, MustParseMoney("86.89", DefaultCurrency), order.TotalOrderPrice)
+	assert.Equal(t, MustParseMoney("19.12", DefaultCurrency), order.VATAmount)
+	assert.Equal(t, MustParseMoney("106.01", DefaultCurrency), order.TotalGross)
+	assert.Equal(t, []VATSummary{{Rate: 0.22, TaxableBase: order.TotalOrderPrice, VAT: order.VATAmount}}, order.VATBreakdown)
+
+	rr := doJSON(router, "GET", "/orders/"+order.OrderID, "")
+	var stored OutgoingOrder
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stored))
+	assert.Equal(t, order.Shipping, stored.Shipping)
+	assert.Equal(t, order.VATBreakdown, stored.VATBreakdown)
+
+	// two mice reach the threshold
+	order = placeOrder(t, router, `{"items":[{"product_id":2,"quantity":2}],"shipping_method":"standard"}`)
+	assert.True(t, order.Shipping.Gross.IsZero())
+	assert.Equal(t, MustParseMoney("159.98", DefaultCurrency), order.TotalOrderPrice)
+
+	// weight bands, with the volumetric weight of the 4K monitor
+	for body, price := range map[string]string{
+		`{"items":[{"product_id":2,"quantity":1}],"shipping_method":"courier"}`: "5.00",
+		`{"items":[{"product_id":3,"quantity":1}],"shipping_method":"courier"}`: "9.00",
+		`{"items":[{"product_id":4,"quantity":1}],"shipping_method":"courier"}`: "19.00",
+	} {
+		rr := doJSON(router, "POST", "/orders/quote", body)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var quote OrderQuote
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&quote))
+		require.NotNil(t, quote.Shipping, body)
+		assert.Equal(t, MustParseMoney(price, DefaultCurrency), quote.Shipping.Price, body)
+	}
+
+	// the zone without countries covers the rest, and reverse charge covers shipping too
+	order = placeOrder(t, router, `{"items":[{"product_id":2,"quantity":1}],"shipping_method":"standard","country":"DE","vat_id":"DE136695976"}`)
+	assert.Equal(t, MustParseMoney("25.00", DefaultCurrency), order.Shipping.Net)
+	assert.True(t, order.Shipping.VAT.IsZero())
+	assert.Equal(t, MustParseMoney("104.99", DefaultCurrency), order.TotalOrderPrice)
+
+	for body, message := range map[string]string{
+		`{"items":[{"product_id":5,"quantity":3}],"shipping_method":"courier"}`:                "the items weigh 20160 g",
+		`{"items":[{"product_id":2,"quantity":1}],"shipping_method":"courier","country":"DE"}`: "courier does not ship to DE",
+	} {
+		rr := doJSON(router, "POST", "/order", body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Contains(t, rr.Body.String(), `"field":"shipping_method"`, body)
+		assert.Contains(t, rr.Body.String(), message, body)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DefaultCountry is the destination of orders that do not name one; set from
+// DEFAULT_COUNTRY in main.
+var DefaultCountry = "IT"
+
+// DefaultTaxCategory is the tax category of products that do not name one.
+const DefaultTaxCategory = "standard"
+
+// countryPattern matches ISO 3166-1 alpha-2 codes once upper-cased.
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// normalizes a country code as sent by clients.
+func normalizeCountry(country string) string {
+	return strings.ToUpper(strings.TrimSpace(country))
+}
+
+// TaxRule is the VAT rate of a tax category in a destination country over a
+// period. A rule without a country applies to the destinations that have no
+// rule of their own for the category; a rate of 0 is an exemption. Rules of the
+// same category and country never overlap in time.
+type TaxRule struct {
+	ID          int        `json:"id"`
+	TaxCategory string     `json:"tax_category"`
+	Country     string     `json:"country,omitempty"`
+	Rate        float64    `json:"rate"`
+	Description string     `json:"description,omitempty"`
+	ValidFrom   time.Time  `json:"valid_from"`
+	ValidUntil  *time.Time `json:"valid_until,omitempty"` // exclusive, open-ended when missing
+}
+
+// reports whether two rules for the same category and country are in force
+// at the same time.
+func (r *TaxRule) overlaps(other *TaxRule) bool {
+	if r.TaxCategory != other.TaxCategory || r.Country != other.Country {
+		return false
+	}
+	endsAfter := func(until *time.Time, from time.Time) bool { return until == nil || until.After(from) }
+	return endsAfter(r.ValidUntil, other.ValidFrom) && endsAfter(other.ValidUntil, r.ValidFrom)
+}
+
+// TaxRuleInput is the request body for creating and replacing tax rules.
+type TaxRuleInput struct {
+	TaxCategory string     `json:"tax_category"`
+	Country     string     `json:"country"`
+	Rate        *float64   `json:"rate"`
+	Description string     `json:"description"`
+	ValidFrom   *time.Time `json:"valid_from"` // defaults to now
+	ValidUntil  *time.Time `json:"valid_until"`
+}
+
+// checks the input and turns it into the rule to write.
+func (in TaxRuleInput) toTaxRule(now time.Time) (*TaxRule, []FieldError) {
+	r := &TaxRule{
+		TaxCategory: strings.ToLower(strings.TrimSpace(in.TaxCategory)),
+		Country:     normalizeCountry(in.Country),
+		Description: strings.TrimSpace(in.Description),
+		ValidFrom:   now,
+		ValidUntil:  in.ValidUntil,
+	}
+	if in.ValidFrom != nil {
+		r.ValidFrom = *in.ValidFrom
+	}
+	var fields []FieldError
+	if r.TaxCategory == "" {
+		fields = append(fields, FieldError{Field: "tax_category", Message: "is required"})
+	}
+	if r.Country != "" && !countryPattern.MatchString(r.Country) {
+		fields = append(fields, FieldError{Field: "country", Message: "must be an ISO 3166-1 alpha-2 code"})
+	}
+	if in.Rate == nil {
+		fields = append(fields, FieldError{Field: "rate", Message: "is required"})
+	} else if r.Rate = *in.Rate; r.Rate < 0 || r.Rate > 1 {
+		fields = append(fields, FieldError{Field: "rate", Message: "must be between 0 and 1"})
+	}
+	if r.ValidUntil != nil && !r.ValidUntil.After(r.ValidFrom) {
+		fields = append(fields, FieldError{Field: "valid_until", Message: "must be after valid_from"})
+	}
+	return r, fields
+}
+
+// TaxRuleSet holds the rules in force for one destination at one time.
+type TaxRuleSet struct {
+	Country string
+	rules   []TaxRule
+}
+
+// ResolveVAT returns the VAT rate of a product in the set's destination and
+// the ID of the rule it comes from. A rule for the country wins over one for
+// any country; without either the product's own rate applies, with rule ID 0.
+func (s *TaxRuleSet) ResolveVAT(product *DBProduct) (float64, int) {
+	return s.resolve(product.TaxCategory, product.VATRate)
+}
+
+// returns the rate of category and the ID of the rule it comes from, or
+// ownRate and 0 when no rule covers the category.
+func (s *TaxRuleSet) resolve(category string, ownRate float64) (float64, int) {
+	var fallback *TaxRule
+	for i := range s.rules {
+		r := &s.rules[i]
+		if r.TaxCategory != category {
+			continue
+		}
+		if r.Country == s.Country {
+			return r.Rate, r.ID
+		}
+		fallback = r
+	}
+	if fallback != nil {
+		return fallback.Rate, fallback.ID
+	}
+	return ownRate, 0
+}
+
+// --- Tax Rule Database Functions ---
+
+const selectTaxRuleSQL = "SELECT id, tax_category, country, rate, description, valid_from, valid_until FROM tax_rules"
+
+func scanTaxRule(row RowLike) (*TaxRule, error) {
+	var r TaxRule
+	var until sql.NullTime
+	if err := row.Scan(&r.ID, &r.TaxCategory, &r.Country, &r.Rate, &r.Description, &r.ValidFrom, &until); err != nil {
+		return nil, err
+	}
+	if until.Valid {
+		r.ValidUntil = &until.Time
+	}
+	return &r, nil
+}
+
+// reads the rules matching a query.
+func queryTaxRules(executor Queryer, query string, args ...interface{}) ([]TaxRule, error) {
+	rows, err := executor.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tax rules: %w", err)
+	}
+	defer rows.Close()
+
+	rules := []TaxRule{}
+	for rows.Next() {
+		r, err := scanTaxRule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan tax rule row: %w", err)
+		}
+		rules = append(rules, *r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during tax rules iteration: %w", err)
+	}
+	return rules, nil
+}
+
+// fetches the rules in force at at for orders shipped to country.
+func GetTaxRuleSet(executor Queryer, country string, at time.Time) (*TaxRuleSet, error) {
+	rules, err := queryTaxRules(executor, selectTaxRuleSQL+" WHERE country IN ($1, '') AND valid_from <= $2 AND (valid_until IS NULL OR valid_until > $2) ORDER BY id", country, at)
+	if err != nil {
+		return nil, err
+	}
+	return &TaxRuleSet{Country: country, rules: rules}, nil
+}
+
+// fetches every tax rule, ordered by category, country and start.
+func GetTaxRules(executor Queryer) ([]TaxRule, error) {
+	return queryTaxRules(executor, selectTaxRuleSQL+" ORDER BY tax_category, country, valid_from")
+}
+
+// fetches a tax rule by its ID.
+func GetTaxRuleByID(executor Queryer, id int) (*TaxRule, error) {
+	r, err := scanTaxRule(executor.QueryRow(selectTaxRuleSQL+" WHERE id = $1", id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("tax rule not found: %w", sql.ErrNoRows)
+		}
+		return nil, fmt.Errorf("failed to scan tax rule: %w", err)
+	}
+	return r, nil
+}
+
+// returns a rule of the same category and country, other than r itself,
+// that overlaps r in time, or nil.
+func overlappingTaxRule(executor Queryer, r *TaxRule) (*TaxRule, error) {
+	rules, err := queryTaxRules(executor, selectTaxRuleSQL+" WHERE tax_category = $1 AND country = $2 AND id <> $3 ORDER BY valid_from", r.TaxCategory, r.Country, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].overlaps(r) {
+			return &rules[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// inserts a tax rule and sets its generated ID.
+func InsertTaxRule(executor TxExecutor, r *TaxRule) error {
+	err := executor.QueryRow("INSERT INTO tax_rules (tax_category, country, rate, description, valid_from, valid_until) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		r.TaxCategory, r.Country, r.Rate, r.Description, r.ValidFrom, nullTime(r.ValidUntil)).Scan(&r.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert tax rule: %w", err)
+	}
+	return nil
+}
+
+// overwrites every field of a tax rule. Orders keep the rate they were priced with.
+func UpdateTaxRule(executor TxExecutor, r *TaxRule) error {
+	res, err := executor.Exec("UPDATE tax_rules SET tax_category = $1, country = $2, rate = $3, description = $4, valid_from = $5, valid_until = $6 WHERE id = $7",
+		r.TaxCategory, r.Country, r.Rate, r.Description, r.ValidFrom, nullTime(r.ValidUntil), r.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update tax rule: %w", err)
+	}
+	return requireRowAffected(res, "tax rule not found")
+}
+
+// --- Tax Rule HTTP Handlers ---
+
+// parses the {id} route variable of the tax rule routes.
+func taxRuleIDFromRequest(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		return 0, ErrBadRequest("invalid tax rule ID %q", mux.Vars(r)["id"])
+	}
+	return id, nil
+}
+
+// maps a tax rule lookup failure to the API error sent to the client.
+func taxRuleError(err error, id int) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound("Tax rule with ID %d not found", id)
+	}
+	return err
+}
+
+// the conflict reported when a rule would overlap an existing one.
+func taxRuleOverlapError(existing *TaxRule) error {
+	country := existing.Country
+	if country == "" {
+		country = "any country"
+	}
+	return ErrConflict(CodeConflict, "Tax rule %d already covers %s in %s from %s", existing.ID, existing.TaxCategory, country, existing.ValidFrom.Format(time.RFC3339)).
+		WithDetail("tax_rule_id", existing.ID)
+}
+
+// GET /tax-rules
+func getTaxRulesHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules, err := GetTaxRules(executor)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rules)
+	}
+}
+
+// GET /tax-rules/{id}
+func getTaxRuleHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := taxRuleIDFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		rule, err := GetTaxRuleByID(executor, id)
+		if err != nil {
+			writeError(w, r, taxRuleError(err, id))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rule)
+	}
+}
+
+// POST /tax-rules and PUT /tax-rules/{id}. A rule overlapping another one of
+// the same category and country is rejected with 409.
+func saveTaxRuleHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := 0
+		if r.Method == http.MethodPut {
+			var err error
+			if id, err = taxRuleIDFromRequest(r); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+
+		var input TaxRuleInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		rule, fields := input.toTaxRule(time.Now())
+		if len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+		rule.ID = id
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		existing, err := overlappingTaxRule(tx, rule)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if existing != nil {
+			writeError(w, r, taxRuleOverlapError(existing))
+			return
+		}
+		if id == 0 {
+			err = InsertTaxRule(tx, rule)
+		} else {
+			err = UpdateTaxRule(tx, rule)
+		}
+		if err != nil {
+			writeError(w, r, taxRuleError(err, id))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if id == 0 {
+			w.Header().Set("Location", fmt.Sprintf("/tax-rules/%d", rule.ID))
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(rule)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// creates a tax rule through the API.
+func createTaxRule(t *testing.T, router http.Handler, body string) TaxRule {
+	t.Helper()
+	rr := doJSON(router, "POST", "/tax-rules", body)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var rule TaxRule
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&rule))
+	return rule
+}
+
+func TestTaxRules_ResolvedPerLine(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	de := createTaxRule(t, router, `{"tax_category":"standard","country":"de","rate":0.19,"valid_from":"2020-01-01T00:00:00Z"}`)
+	reduced := createTaxRule(t, router, `{"tax_category":"reduced","country":"DE","rate":0.07,"valid_from":"2020-01-01T00:00:00Z"}`)
+	anywhere := createTaxRule(t, router, `{"tax_category":"reduced","rate":0.05,"valid_from":"2020-01-01T00:00:00Z"}`)
+	rr := doJSON(newProductsRouter(&InMemoryDB{store: store}), "PATCH", "/products/3", `{"tax_category":"Reduced"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	order := placeOrder(t, router, `{"items":[{"product_id":1,"quantity":1},{"product_id":3,"quantity":1}],"country":"DE"}`)
+	require.Len(t, order.Items, 2)
+	assert.Equal(t, 0.19, *order.Items[0].VATRate)
+	assert.Equal(t, de.ID, order.Items[0].TaxRuleID)
+	assert.Equal(t, MustParseMoney("285.00", DefaultCurrency), order.Items[0].ItemVAT)
+	assert.Equal(t, 0.07, *order.Items[1].VATRate)
+	assert.Equal(t, reduced.ID, order.Items[1].TaxRuleID)
+	assert.Equal(t, MustParseMoney("294.10", DefaultCurrency), order.VATAmount)
+
+	rr = doJSON(router, "GET", "/orders/"+order.OrderID, "")
+	var stored OutgoingOrder
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stored))
+	assert.Equal(t, order.Items, stored.Items)
+
+	// Italy has no rule of its own: the rule for any country, or the product's rate
+	order = placeOrder(t, router, `{"items":[{"product_id":1,"quantity":1},{"product_id":3,"quantity":1}]}`)
+	assert.Equal(t, 0.22, *order.Items[0].VATRate)
+	assert.Zero(t, order.Items[0].TaxRuleID)
+	assert.Equal(t, 0.05, *order.Items[1].VATRate)
+	assert.Equal(t, anywhere.ID, order.Items[1].TaxRuleID)
+
+	rr = doJSON(router, "POST", "/orders/quote", `{"items":[{"product_id":1,"quantity":1}],"country":"Germany"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"country"`)
+}
+
+func TestTaxRules_EffectiveDates(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+	now := time.Now().UTC()
+	at := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+
+	old := createTaxRule(t, router, `{"tax_category":"standard","country":"IT","rate":0.21,"valid_from":"2020-01-01T00:00:00Z","valid_until":"`+at(-time.Hour)+`"}`)
+	current := createTaxRule(t, router, `{"tax_category":"standard","country":"IT","rate":0.22,"valid_from":"`+at(-time.Hour)+`","valid_until":"`+at(time.Hour)+`"}`)
+	createTaxRule(t, router, `{"tax_category":"standard","country":"IT","rate":0,"description":"tax holiday","valid_from":"`+at(time.Hour)+`"}`)
+
+	rr := doJSON(router, "POST", "/tax-rules", `{"tax_category":"standard","country":"IT","rate":0.23,"valid_from":"`+at(30*time.Minute)+`"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "already covers standard in IT")
+
+	rr = doJSON(router, "POST", "/orders/quote", `{"items":[{"product_id":1,"quantity":1}]}`)
+	var quote OrderQuote
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&quote))
+	assert.Equal(t, current.ID, quote.Items[0].TaxRuleID)
+
+	// replacing a rule may not make it overlap its successor either
+	rr = doJSON(router, "PUT", "/tax-rules/"+strconv.Itoa(old.ID), `{"tax_category":"standard","country":"IT","rate":0.21,"valid_from":"2020-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	rr = doJSON(router, "PUT", "/tax-rules/"+strconv.Itoa(old.ID), `{"tax_category":"standard","country":"IT","rate":0.2,"valid_from":"2020-01-01T00:00:00Z","valid_until":"`+at(-time.Hour)+`"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = doJSON(router, "GET", "/tax-rules/"+strconv.Itoa(old.ID), "")
+	var rule TaxRule
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&rule))
+	assert.Equal(t, 0.2, rule.Rate)
+
+	rr = doJSON(router, "GET", "/tax-rules", "")
+	var rules []TaxRule
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&rules))
+	assert.Len(t, rules, 3)
+}
+
+func TestTaxRules_Invalid(t *testing.T) {
+	store := NewInMemoryStore()
+	router := newOrdersRouter(store)
+
+	for body, field := range map[string]string{
+		`{"country":"IT","rate":0.1}`:                            "tax_category",
+		`{"tax_category":"standard","country":"ITA","rate":0.1}`: "country",
+		`{"tax_category":"standard"}`:                            "rate",
+		`{"tax_category":"standard","rate":1.2}`:                 "rate",
+		`{"tax_category":"standard","rate":0.1,"valid_from":"2030-01-01T00:00:00Z","valid_until":"2029-01-01T00:00:00Z"}`: "valid_until",
+	} {
+		rr := doJSON(router, "POST", "/tax-rules", body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Contains(t, rr.Body.String(), `"field":"`+field+`"`, body)
+	}
+	rr := doJSON(router, "GET", "/tax-rules/7", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = doJSON(router, "PUT", "/tax-rules/7", `{"tax_category":"standard","rate":0.1}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SellerCountry is the EU member state the shop invoices from; set from
+// SELLER_COUNTRY in main.
+var SellerCountry = "IT"
+
+// ReverseChargeNote is printed on orders invoiced with reverse charge.
+const ReverseChargeNote = "Reverse charge: VAT to be accounted for by the recipient (Art. 196 Council Directive 2006/112/EC)"
+
+// ErrInvalidVATID is wrapped by the errors of ParseVATID.
+var ErrInvalidVATID = errors.New("invalid VAT number")
+
+// euCountries are the EU member states by ISO 3166-1 alpha-2 code.
+var euCountries = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "CY": true, "CZ": true, "DE": true, "DK": true,
+	"EE": true, "ES": true, "FI": true, "FR": true, "GR": true, "HR": true, "HU": true,
+	"IE": true, "IT": true, "LT": true, "LU": true, "LV": true, "MT": true, "NL": true,
+	"PL": true, "PT": true, "RO": true, "SE": true, "SI": true, "SK": true,
+}
+
+// vatIDFormats is the shape of the national part of the VAT number of each
+// member state, by VAT prefix; Greece uses EL rather than its ISO code.
+var vatIDFormats = map[string]*regexp.Regexp{
+	"AT": regexp.MustCompile(`^U\d{8}$`),
+	"BE": regexp.MustCompile(`^[01]\d{9}$`),
+	"BG": regexp.MustCompile(`^\d{9,10}$`),
+	"CY": regexp.MustCompile(`^\d{8}[A-Z]$`),
+	"CZ": regexp.MustCompile(`^\d{8,10}$`),
+	"DE": regexp.MustCompile(`^\d{9}$`),
+	"DK": regexp.MustCompile(`^\d{8}$`),
+	"EE": regexp.MustCompile(`^\d{9}$`),
+	"EL": regexp.MustCompile(`^\d{9}$`),
+	"ES": regexp.MustCompile(`^[A-Z0-9]\d{7}[A-Z0-9]$`),
+	"FI": regexp.MustCompile(`^\d{8}$`),
+	"FR": regexp.MustCompile(`^[A-HJ-NP-Z0-9]{2}\d{9}$`),
+	"HR": regexp.MustCompile(`^\d{11}$`),
+	"HU": regexp.MustCompile(`^\d{8}$`),
+	"IE": regexp.MustCompile(`^(\d{7}[A-W][A-I]?|\d[A-Z+*]\d{5}[A-W])$`),
+	"IT": regexp.MustCompile(`^\d{11}$`),
+	"LT": regexp.MustCompile(`^(\d{9}|\d{12})$`),
+	"LU": regexp.MustCompile(`^\d{8}$`),
+	"LV": regexp.MustCompile(`^\d{11}$`),
+	"MT": regexp.MustCompile(`^\d{8}$`),
+	"NL": regexp.MustCompile(`^\d{9}B\d{2}$`),
+	"PL": regexp.MustCompile(`^\d{10}$`),
+	"PT": regexp.MustCompile(`^\d{9}$`),
+	"RO": regexp.MustCompile(`^[1-9]\d{1,9}$`),
+	"SE": regexp.MustCompile(`^\d{10}01$`),
+	"SI": regexp.MustCompile(`^\d{8}$`),
+	"SK": regexp.MustCompile(`^\d{10}$`),
+}
+
+// vatIDChecksums verify the check digits of the member states whose
+// algorithm is public and stable; the others are only checked for shape.
+var vatIDChecksums = map[string]func(number string) bool{
+	"AT": checkATVATID,
+	"BE": checkBEVATID,
+	"DE": checkDEVATID,
+	"DK": func(n string) bool { return weightedSum(n, 2, 7, 6, 5, 4, 3, 2, 1)%11 == 0 },
+	"EL": checkELVATID,
+	"FI": checkFIVATID,
+	"FR": checkFRVATID,
+	"IT": luhnValid,
+	"LU": func(n string) bool { return atoi(n[:6])%89 == atoi(n[6:]) },
+	"NL": checkNLVATID,
+	"PL": func(n string) bool { return weightedSum(n, 6, 5, 7, 2, 3, 4, 5, 6, 7)%11 == digit(n, 9) },
+	"PT": checkPTVATID,
+	"SE": func(n string) bool { return luhnValid(n[:10]) },
+}
+
+// VATID is an EU VAT identification number.
+type VATID struct {
+	Prefix string // the VAT prefix, EL for Greece
+	Number string // the national part, without separators
+}
+
+func (v VATID) String() string { return v.Prefix + v.Number }
+
+// Country is the ISO 3166-1 code of the member state that issued the number.
+func (v VATID) Country() string {
+	if v.Prefix == "EL" {
+		return "GR"
+	}
+	return v.Prefix
+}
+
+// ParseVATID checks an EU VAT number offline, its shape and, for the member
+// states that have one, its check digits. Spaces, dots and dashes are ignored.
+// It does not tell whether the number has been issued: that takes VIES.
+func ParseVATID(s string) (VATID, error) {
+	s = strings.ToUpper(strings.NewReplacer(" ", "", ".", "", "-", "").Replace(s))
+	if len(s) < 3 {
+		return VATID{}, fmt.Errorf("%w: too short", ErrInvalidVATID)
+	}
+	v := VATID{Prefix: s[:2], Number: s[2:]}
+	format, ok := vatIDFormats[v.Prefix]
+	if !ok {
+		return VATID{}, fmt.Errorf("%w: %s is not the prefix of an EU member state", ErrInvalidVATID, v.Prefix)
+	}
+	if !format.MatchString(v.Number) {
+		return VATID{}, fmt.Errorf("%w: not the format of %s numbers", ErrInvalidVATID, v.Prefix)
+	}
+	if check, ok := vatIDChecksums[v.Prefix]; ok && !check(v.Number) {
+		return VATID{}, fmt.Errorf("%w: wrong check digits", ErrInvalidVATID)
+	}
+	return v, nil
+}
+
+// reverseCharge reports whether an order shipped to destination for the
+// holder of buyer is invoiced with reverse charge: a business registered in
+// another member state, receiving the goods in another member state.
+func reverseCharge(buyer *VATID, destination string) bool {
+	return buyer != nil && buyer.Country() != SellerCountry &&
+		euCountries[destination] && destination != SellerCountry
+}
+
+// --- Check digits ---
+
+func digit(s string, i int) int { return int(s[i] - '0') }
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// the sum of the leading digits of s times the weights.
+func weightedSum(s string, weights ...int) int {
+	sum := 0
+	for i, w := range weights {
+		sum += digit(s, i) * w
+	}
+	return sum
+}
+
+// reports whether s passes the Luhn check.
+func luhnValid(s string) bool {
+	sum := 0
+	for i := len(s) - 1; i >= 0; i-- {
+		d := digit(s, i)
+		if (len(s)-i)%2 == 0 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// the remainder of the decimal number s divided by m, for numbers too long
+// for an int.
+func mod(s string, m int) int {
+	r := 0
+	for i := range s {
+		r = (r*10 + digit(s, i)) % m
+	}
+	return r
+}
+
+func checkATVATID(n string) bool {
+	sum := 0
+	for i := 1; i < 8; i++ {
+		d := digit(n, i)
+		if i%2 == 0 {
+			d = d/5 + d*2%10
+		}
+		sum += d
+	}
+	return (10-(sum+4)%10)%10 == digit(n, 8)
+}
+
+func checkBEVATID(n string) bool {
+	return 97-mod(n[:8], 97) == atoi(n[8:])
+}
+
+// ISO 7064 MOD 11,10.
+func checkDEVATID(n string) bool {
+	product := 10
+	for i := 0; i < 8; i++ {
+		sum := (digit(n, i) + product) % 10
+		if sum == 0 {
+			sum = 10
+		}
+		product = 2 * sum % 11
+	}
+	return (11-product)%10 == digit(n, 8)
+}
+
+func checkELVATID(n string) bool {
+	sum := 0
+	for i := 0; i < 8; i++ {
+		sum += digit(n, i) << (8 - i)
+	}
+	return sum%11%10 == digit(n, 8)
+}
+
+func checkFIVATID(n string) bool {
+	check := 11 - weightedSum(n, 7, 9, 10, 5, 8, 4, 2)%11
+	if check == 11 {
+		check = 0
+	}
+	return check == digit(n, 7)
+}
+
+// the numeric key of a French number is derived from the SIREN; keys with
+// letters have no published algorithm.
+func checkFRVATID(n string) bool {
+	key, err := strconv.Atoi(n[:2])
+	if err != nil {
+		return true
+	}
+	return key == (12+3*mod(n[2:], 97))%97
+}
+
+// the 11-test of the original numbers, or the ISO 7064 MOD 97-10 check of
+// the numbers issued to sole proprietors since 2020.
+func checkNLVATID(n string) bool {
+	if weightedSum(n, 9, 8, 7, 6, 5, 4, 3, 2)%11 == digit(n, 8) {
+		return true
+	}
+	// NL is 2321 once its letters are turned into numbers, B is 11
+	return mod("2321"+n[:9]+"11"+n[10:], 97) == 1
+}
+
+func checkPTVATID(n string) bool {
+	check := 11 - weightedSum(n, 9, 8, 7, 6, 5, 4, 3, 2)%11
+	if check >= 10 {
+		check = 0
+	}
+	return check == digit(n, 8)
+}
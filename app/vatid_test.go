@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVATID(t *testing.T) {
+	for _, s := range []string{
+		"ATU13585627", "BE0403019261", "DE136695976", "DK13585628", "EL094259216",
+		"FI20774740", "FR40303265045", "FRK7399859412", "IT00743110157", "LU15027442",
+		"NL004495445B01", "NL000099998B57", "PL8567346215", "PT501964843", "SE123456789701",
+		"ESB58378431", "IE6433435F",
+	} {
+		v, err := ParseVATID(s)
+		if assert.NoError(t, err, s) {
+			assert.Equal(t, s, v.String())
+		}
+	}
+
+	v, err := ParseVATID(" de 136.695-976 ")
+	require.NoError(t, err)
+	assert.Equal(t, VATID{Prefix: "DE", Number: "136695976"}, v)
+	assert.Equal(t, "GR", VATID{Prefix: "EL", Number: "094259216"}.Country())
+
+	for s, reason := range map[string]string{
+		"DE136695977":    "check digits",
+		"IT00743110158":  "check digits",
+		"FR41303265045":  "check digits",
+		"NL004495446B01": "check digits",
+		"ATU13585628":    "check digits",
+		"DE13669597":     "format",
+		"GB123456789":    "member state",
+		"GR094259216":    "member state",
+		"D":              "too short",
+	} {
+		_, err := ParseVATID(s)
+		assert.ErrorIs(t, err, ErrInvalidVATID, s)
+		assert.ErrorContains(t, err, reason, s)
+	}
+}
+
+func TestReverseCharge(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	// a German business receiving the goods in Germany
+	order := placeOrder(t, router, `{"items":[{"product_id":1,"quantity":1}],"country":"DE","vat_id":"de 136 695 976"}`)
+	assert.True(t, order.ReverseCharge)
+	assert.Equal(t, ReverseChargeNote, order.VATNote)
+	assert.Equal(t, "DE136695976", order.BuyerVATID)
+	assert.True(t, order.VATAmount.IsZero())
+	assert.Zero(t, *order.Items[0].VATRate)
+	assert.True(t, order.Items[0].ItemVAT.IsZero())
+
+	rr := doJSON(router, "GET", "/orders/"+order.OrderID, "")
+	var stored OutgoingOrder
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stored))
+	assert.True(t, stored.ReverseCharge)
+	assert.Equal(t, order.VATNote, stored.VATNote)
+	assert.Equal(t, order.BuyerVATID, stored.BuyerVATID)
+
+	// an Italian business, or goods staying in Italy, pay VAT as usual
+	for _, body := range []string{
+		`{"items":[{"product_id":1,"quantity":1}],"country":"DE","vat_id":"IT00743110157"}`,
+		`{"items":[{"product_id":1,"quantity":1}],"vat_id":"DE136695976"}`,
+	} {
+		order = placeOrder(t, router, body)
+		assert.False(t, order.ReverseCharge, body)
+		assert.Empty(t, order.VATNote, body)
+		assert.Equal(t, MustParseMoney("330.00", DefaultCurrency), order.VATAmount, body)
+	}
+
+	rr = doJSON(router, "POST", "/orders/quote", `{"items":[{"product_id":1,"quantity":1}],"country":"FR","vat_id":"FR40303265045"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var quote OrderQuote
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&quote))
+	assert.True(t, quote.ReverseCharge)
+
+	rr = doJSON(router, "POST", "/order", `{"items":[{"product_id":1,"quantity":1}],"country":"DE","vat_id":"DE136695977"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field":"vat_id"`)
+	assert.Contains(t, rr.Body.String(), "wrong check digits")
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// GeoPoint is a position in decimal degrees.
+type GeoPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// validates a position, reporting errors under the given field name.
+func (p *GeoPoint) validate(field string) []FieldError {
+	var fields []FieldError
+	if p.Latitude < -90 || p.Latitude > 90 {
+		fields = append(fields, FieldError{Field: field + ".latitude", Message: "must be between -90 and 90"})
+	}
+	if p.Longitude < -180 || p.Longitude > 180 {
+		fields = append(fields, FieldError{Field: field + ".longitude", Message: "must be between -180 and 180"})
+	}
+	return fields
+}
+
+// great-circle distance to q in kilometres.
+func (p GeoPoint) distanceKm(q GeoPoint) float64 {
+	const earthRadiusKm = 6371.0
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLon := rad(q.Latitude-p.Latitude), rad(q.Longitude-p.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rad(p.Latitude))*math.Cos(rad(q.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// Warehouse is a row of the 'warehouses' table. UnitCost is what shipping one
+// unit from it costs, used by the lowest-cost allocation strategy.
+type Warehouse struct {
+	ID       int       `json:"id"`
+	Code     string    `json:"code"`
+	Name     string    `json:"name"`
+	Country  string    `json:"country,omitempty"`
+	Location *GeoPoint `json:"location,omitempty"`
+	UnitCost Money     `json:"unit_cost"`
+	Active   bool      `json:"active"`
+}
+
+// WarehouseInput is the request body of POST /warehouses.
+type WarehouseInput struct {
+	Code     string    `json:"code"`
+	Name     string    `json:"name"`
+	Country  string    `json:"country"`
+	Location *GeoPoint `json:"location"`
+	UnitCost *Money    `json:"unit_cost"`
+	Active   *bool     `json:"active"`
+}
+
+// checks the input and turns it into the warehouse to insert.
+func (in WarehouseInput) toWarehouse() (*Warehouse, []FieldError) {
+	w := &Warehouse{
+		Code:     strings.ToUpper(strings.TrimSpace(in.Code)),
+		Name:     strings.TrimSpace(in.Name),
+		Country:  strings.ToUpper(strings.TrimSpace(in.Country)),
+		Location: in.Location,
+		UnitCost: NewMoney(0, DefaultCurrency),
+		Active:   in.Active == nil || *in.Active,
+	}
+	var fields []FieldError
+	if w.Code == "" {
+		fields = append(fields, FieldError{Field: "code", Message: "is required"})
+	}
+	if w.Name == "" {
+		fields = append(fields, FieldError{Field: "name", Message: "is required"})
+	}
+	if w.Location != nil {
+		fields = append(fields, w.Location.validate("location")...)
+	}
+	if in.UnitCost != nil {
+		if in.UnitCost.IsNegative() {
+			fields = append(fields, FieldError{Field: "unit_cost", Message: "must not be negative"})
+		}
+		fields = append(fields, checkCatalogAmount("unit_cost", *in.UnitCost)...)
+		w.UnitCost = *in.UnitCost
+	}
+	return w, fields
+}
+
+// --- Allocation Strategies ---
+
+// Allocation is the quantity of a product shipped from one warehouse.
+type Allocation struct {
+	ProductID   int `json:"-"`
+	WarehouseID int `json:"warehouse_id"`
+	Quantity    int `json:"quantity"`
+}
+
+// AllocationRequest is what a strategy decides on: the ordered quantities, by
+// product ID, and the stock of every active warehouse, by product ID then
+// warehouse ID. The stock always covers the quantities.
+type AllocationRequest struct {
+	Quantities  map[int]int
+	Warehouses  []Warehouse // sorted by ID
+	Stock       map[int]map[int]int
+	Destination *GeoPoint // where the order ships, if known
+}
+
+// AllocationStrategy picks the warehouses an order is shipped from.
+type AllocationStrategy interface {
+	Name() string
+	Allocate(req AllocationRequest) ([]Allocation, error)
+}
+
+// SingleSourceStrategy ships from as few warehouses as possible: from a single
+// one when it can, otherwise it keeps taking the warehouse that covers the
+// most of what is left. Ties go to the lowest ID.
+type SingleSourceStrategy struct{}
+
+func (SingleSourceStrategy) Name() string { return "single-source" }
+
+func (SingleSourceStrategy) Allocate(req AllocationRequest) ([]Allocation, error) {
+	remaining := maps.Clone(req.Quantities)
+	stock := make(map[int]map[int]int, len(req.Stock))
+	for productID, levels := range req.Stock {
+		stock[productID] = maps.Clone(levels)
+	}
+	covered := func(warehouseID int) int {
+		units := 0
+		for productID, qty := range remaining {
+			units += min(qty, stock[productID][warehouseID])
+		}
+		return units
+	}
+
+	var allocations []Allocation
+	for len(remaining) > 0 {
+		best, bestUnits := 0, 0
+		for _, w := range req.Warehouses {
+			if units := covered(w.ID); units > bestUnits {
+				best, bestUnits = w.ID, units
+			}
+		}
+		if bestUnits == 0 {
+			return nil, fmt.Errorf("no warehouse holds the remaining units")
+		}
+		for _, productID := range slices.Sorted(maps.Keys(remaining)) {
+			take := min(remaining[productID], stock[productID][best])
+			if take == 0 {
+				continue
+			}
+			allocations = append(allocations, Allocation{ProductID: productID, WarehouseID: best, Quantity: take})
+			stock[productID][best] -= take
+			if remaining[productID] -= take; remaining[productID] == 0 {
+				delete(remaining, productID)
+			}
+		}
+	}
+	return allocations, nil
+}
+
+// NearestStrategy takes each product from the warehouses closest to the
+// destination first. Warehouses without a location come last, and without a
+// destination the order is by ID.
+type NearestStrategy struct{}
+
+func (NearestStrategy) Name() string { return "nearest" }
+
+func (NearestStrategy) Allocate(req AllocationRequest) ([]Allocation, error) {
+	distance := func(w Warehouse) float64 {
+		if req.Destination == nil || w.Location == nil {
+			return math.Inf(1)
+		}
+		return w.Location.distanceKm(*req.Destination)
+	}
+	ranked := slices.Clone(req.Warehouses)
+	slices.SortStableFunc(ranked, func(a, b Warehouse) int { return cmp.Compare(distance(a), distance(b)) })
+	return allocateInOrder(req, ranked)
+}
+
+// LowestCostStrategy takes each product from the warehouses with the lowest
+// unit cost first.
+type LowestCostStrategy struct{}
+
+func (LowestCostStrategy) Name() string { return "lowest-cost" }
+
+func (LowestCostStrategy) Allocate(req AllocationRequest) ([]Allocation, error) {
+	ranked := slices.Clone(req.Warehouses)
+	slices.SortStableFunc(ranked, func(a, b Warehouse) int { return a.UnitCost.Cmp(b.UnitCost) })
+	return allocateInOrder(req, ranked)
+}
+
+// takes each product from the ranked warehouses in turn until it is covered.
+func allocateInOrder(req AllocationRequest, ranked []Warehouse) ([]Allocation, error) {
+	var allocations []Allocation
+	for _, productID := range slices.Sorted(maps.Keys(req.Quantities)) {
+		need := req.Quantities[productID]
+		for _, w := range ranked {
+			if need == 0 {
+				break
+			}
+			if take := min(need, req.Stock[productID][w.ID]); take > 0 {
+				allocations = append(allocations, Allocation{ProductID: productID, WarehouseID: w.ID, Quantity: take})
+				need -= take
+			}
+		}
+		if need > 0 {
+			return nil, fmt.Errorf("no warehouse holds the remaining units of product %d", productID)
+		}
+	}
+	return allocations, nil
+}
+
+// the strategies ALLOCATION_STRATEGY can name.
+var allocationStrategies = map[string]AllocationStrategy{
+	"single-source": SingleSourceStrategy{},
+	"nearest":       NearestStrategy{},
+	"lowest-cost":   LowestCostStrategy{},
+}
+
+// DefaultAllocationStrategy is used by the order pipeline; set from ALLOCATION_STRATEGY in main.
+var DefaultAllocationStrategy AllocationStrategy = SingleSourceStrategy{}
+
+// ParseAllocationStrategy maps a configuration value to a strategy.
+func ParseAllocationStrategy(s string) (AllocationStrategy, error) {
+	name := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(s)), "_", "-")
+	if name == "" {
+		return SingleSourceStrategy{}, nil
+	}
+	if strategy, ok := allocationStrategies[name]; ok {
+		return strategy, nil
+	}
+	return SingleSourceStrategy{}, fmt.Errorf("unknown allocation strategy %q: use %s", s, strings.Join(slices.Sorted(maps.Keys(allocationStrategies)), ", "))
+}
+
+// checks that a strategy allocated exactly the ordered quantities out of the
+// available stock, so a faulty strategy cannot oversell.
+func checkAllocations(req AllocationRequest, allocations []Allocation) error {
+	allocated := make(map[int]int)
+	used := make(map[[2]int]int)
+	for _, a := range allocations {
+		if a.Quantity <= 0 {
+			return fmt.Errorf("non-positive quantity %d for product %d", a.Quantity, a.ProductID)
+		}
+		key := [2]int{a.ProductID, a.WarehouseID}
+		if _, twice := used[key]; twice {
+			return fmt.Errorf("product %d allocated twice to warehouse %d", a.ProductID, a.WarehouseID)
+		}
+		if a.Quantity > req.Stock[a.ProductID][a.WarehouseID] {
+			return fmt.Errorf("warehouse %d does not hold %d units of product %d", a.WarehouseID, a.Quantity, a.ProductID)
+		}
+		used[key] = a.Quantity
+		allocated[a.ProductID] += a.Quantity
+	}
+	if !maps.Equal(allocated, req.Quantities) {
+		return fmt.Errorf("allocated %v, ordered %v", allocated, req.Quantities)
+	}
+	return nil
+}
+
+// hands the allocations of each product out to the order lines of that
+// product, in line order, filling their Allocations sorted by warehouse ID.
+func splitAllocations(items []*OrderItemRecord, allocations []Allocation) {
+	byProduct := make(map[int][]Allocation)
+	for _, a := range allocations {
+		byProduct[a.ProductID] = append(byProduct[a.ProductID], a)
+	}
+	for _, item := range items {
+		need := item.Quantity
+		pending := byProduct[item.ProductID]
+		for need > 0 && len(pending) > 0 {
+			take := min(need, pending[0].Quantity)
+			item.Allocations = append(item.Allocations, Allocation{ProductID: item.ProductID, WarehouseID: pending[0].WarehouseID, Quantity: take})
+			need -= take
+			if pending[0].Quantity -= take; pending[0].Quantity == 0 {
+				pending = pending[1:]
+			}
+		}
+		byProduct[item.ProductID] = pending
+		slices.SortFunc(item.Allocations, func(a, b Allocation) int { return cmp.Compare(a.WarehouseID, b.WarehouseID) })
+	}
+}
+
+// --- Warehouse Database Functions ---
+
+const selectWarehouseSQL = "SELECT id, code, name, country, latitude, longitude, unit_cost, active FROM warehouses"
+
+func scanWarehouse(row RowLike) (Warehouse, error) {
+	var w Warehouse
+	var lat, lon sql.NullFloat64
+	if err := row.Scan(&w.ID, &w.Code, &w.Name, &w.Country, &lat, &lon, &w.UnitCost, &w.Active); err != nil {
+		return w, err
+	}
+	if lat.Valid && lon.Valid {
+		w.Location = &GeoPoint{Latitude: lat.Float64, Longitude: lon.Float64}
+	}
+	return w, nil
+}
+
+// fetches a single warehouse by its ID.
+func GetWarehouseByID(executor Queryer, warehouseID int) (*Warehouse, error) {
+	w, err := scanWarehouse(executor.QueryRow(selectWarehouseSQL+" WHERE id = $1", warehouseID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("warehouse not found: %w", sql.ErrNoRows)
+		}
+		return nil, fmt.Errorf("failed to scan warehouse: %w", err)
+	}
+	return &w, nil
+}
+
+// fetches the warehouses by ID, only the active ones if activeOnly is set.
+func GetWarehouses(executor Queryer, activeOnly bool) ([]Warehouse, error) {
+	rows, err := executor.Query(selectWarehouseSQL+" WHERE active OR NOT $1 ORDER BY id", activeOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query warehouses: %w", err)
+	}
+	defer rows.Close()
+
+	warehouses := []Warehouse{}
+	for rows.Next() {
+		w, err := scanWarehouse(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan warehouse row: %w", err)
+		}
+		warehouses = append(warehouses, w)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during warehouses iteration: %w", err)
+	}
+	return warehouses, nil
+}
+
+// the ID of the warehouse that stock without a warehouse belongs to: the
+// oldest one, created by the migration that introduced warehouses.
+func mainWarehouseID(executor Queryer) (int, error) {
+	var id int
+	if err := executor.QueryRow("SELECT MIN(id) FROM warehouses").Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to find the main warehouse: %w", err)
+	}
+	return id, nil
+}
+
+// inserts a warehouse and sets its generated ID. It returns a wrapped
+// sql.ErrNoRows if the code is taken.
+func InsertWarehouse(executor TxExecutor, w *Warehouse) error {
+	var lat, lon sql.NullFloat64
+	if w.Location != nil {
+		lat = sql.NullFloat64{Float64: w.Location.Latitude, Valid: true}
+		lon = sql.NullFloat64{Float64: w.Location.Longitude, Valid: true}
+	}
+	err := executor.QueryRow("INSERT INTO warehouses (code, name, country, latitude, longitude, unit_cost, active) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (code) DO NOTHING RETURNING id",
+		w.Code, w.Name, w.Country, lat, lon, w.UnitCost, w.Active).Scan(&w.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("warehouse code %s is taken: %w", w.Code, sql.ErrNoRows)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert warehouse: %w", err)
+	}
+	return nil
+}
+
+// --- Warehouse HTTP Handlers ---
+
+// maps a warehouse lookup failure to the API error sent to the client.
+func warehouseError(err error, warehouseID int) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound("Warehouse with ID %d not found", warehouseID)
+	}
+	return err
+}
+
+// GET /warehouses
+func getWarehousesHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		warehouses, err := GetWarehouses(executor, false)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(warehouses)
+	}
+}
+
+// POST /warehouses
+func createWarehouseHandler(executor DBExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input WarehouseInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, r, ErrBadRequest("Invalid request body: %v", err))
+			return
+		}
+		warehouse, fields := input.toWarehouse()
+		if len(fields) > 0 {
+			writeError(w, r, ErrValidation(fields...))
+			return
+		}
+
+		tx, err := executor.Begin()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := InsertWarehouse(tx, warehouse); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				err = ErrConflict(CodeConflict, "A warehouse with code %s already exists", warehouse.Code)
+			}
+			writeError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(warehouse)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// three warehouses: MAIN without a location, one in Milan and one in Rome.
+func testAllocationRequest(quantities map[int]int, destination *GeoPoint) AllocationRequest {
+	return AllocationRequest{
+		Quantities: quantities,
+		Warehouses: []Warehouse{
+			{ID: 1, Code: "MAIN", UnitCost: MustParseMoney("0.00", DefaultCurrency)},
+			{ID: 2, Code: "MIL", Location: &GeoPoint{Latitude: 45.46, Longitude: 9.19}, UnitCost: MustParseMoney("3.00", DefaultCurrency)},
+			{ID: 3, Code: "ROM", Location: &GeoPoint{Latitude: 41.90, Longitude: 12.50}, UnitCost: MustParseMoney("1.00", DefaultCurrency)},
+		},
+		Stock: map[int]map[int]int{
+			1: {1: 2, 2: 5, 3: 1},
+			2: {2: 1, 3: 4},
+		},
+		Destination: destination,
+	}
+}
+
+func TestAllocationStrategies(t *testing.T) {
+	naples := &GeoPoint{Latitude: 40.85, Longitude: 14.27}
+	tests := []struct {
+		name     string
+		strategy AllocationStrategy
+		req      AllocationRequest
+		want     []Allocation
+	}{
+		{"single source when one warehouse has everything", SingleSourceStrategy{},
+			testAllocationRequest(map[int]int{1: 3, 2: 1}, nil),
+			[]Allocation{{1, 2, 3}, {2, 2, 1}}},
+		{"fewest warehouses otherwise", SingleSourceStrategy{},
+			testAllocationRequest(map[int]int{1: 7, 2: 1}, nil),
+			[]Allocation{{1, 2, 5}, {2, 2, 1}, {1, 1, 2}}},
+		{"nearest to the destination first", NearestStrategy{},
+			testAllocationRequest(map[int]int{1: 3, 2: 1}, naples),
+			[]Allocation{{1, 3, 1}, {1, 2, 2}, {2, 3, 1}}},
+		{"by ID without a destination", NearestStrategy{},
+			testAllocationRequest(map[int]int{1: 3, 2: 1}, nil),
+			[]Allocation{{1, 1, 2}, {1, 2, 1}, {2, 2, 1}}},
+		{"cheapest first", LowestCostStrategy{},
+			testAllocationRequest(map[int]int{1: 3, 2: 1}, nil),
+			[]Allocation{{1, 1, 2}, {1, 3, 1}, {2, 3, 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.strategy.Allocate(tt.req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.NoError(t, checkAllocations(tt.req, got))
+		})
+	}
+}
+
+func TestCheckAllocations(t *testing.T) {
+	req := testAllocationRequest(map[int]int{1: 3}, nil)
+	assert.NoError(t, checkAllocations(req, []Allocation{{1, 1, 2}, {1, 3, 1}}))
+	assert.ErrorContains(t, checkAllocations(req, []Allocation{{1, 3, 3}}), "does not hold")
+	assert.ErrorContains(t, checkAllocations(req, []Allocation{{1, 2, 2}}), "allocated")
+	assert.ErrorContains(t, checkAllocations(req, []Allocation{{1, 2, 1}, {1, 2, 2}}), "twice")
+}
+
+func TestParseAllocationStrategy(t *testing.T) {
+	for in, want := range map[string]string{"": "single-source", "nearest": "nearest", "LOWEST_COST": "lowest-cost"} {
+		strategy, err := ParseAllocationStrategy(in)
+		require.NoError(t, err)
+		assert.Equal(t, want, strategy.Name())
+	}
+	_, err := ParseAllocationStrategy("random")
+	assert.ErrorContains(t, err, "lowest-cost, nearest, single-source")
+}
+
+func TestSplitAllocations(t *testing.T) {
+	items := []*OrderItemRecord{{ProductID: 1, Quantity: 2}, {ProductID: 2, Quantity: 1}, {ProductID: 1, Quantity: 3}}
+	splitAllocations(items, []Allocation{{1, 1, 4}, {1, 2, 1}, {2, 2, 1}})
+	assert.Equal(t, []Allocation{{1, 1, 2}}, items[0].Allocations)
+	assert.Equal(t, []Allocation{{2, 2, 1}}, items[1].Allocations)
+	assert.Equal(t, []Allocation{{1, 1, 2}, {1, 2, 1}}, items[2].Allocations)
+}
+
+func TestCreateOrder_AllocatesAcrossWarehouses(t *testing.T) {
+	store := NewInMemoryStore()
+	store.Populate()
+	router := newOrdersRouter(store)
+
+	rr := doJSON(router, "POST", "/warehouses", `{"code":"rom","name":"Rome","location":{"latitude":41.9,"longitude":12.5},"unit_cost":"1.50"}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var rome Warehouse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&rome))
+	assert.Equal(t, "ROM", rome.Code)
+	assert.True(t, rome.Active)
+
+	rr = doJSON(router, "PUT", "/products/1/stock", `{"stock":3,"note":"recount"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = doJSON(router, "PUT", "/products/1/stock", `{"warehouse_id":2,"stock":4,"note":"delivery"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	level := getStockLevel(t, router, "1")
+	assert.Equal(t, 7, level.Stock)
+	assert.Equal(t, []WarehouseStock{{1, "MAIN", 3}, {2, "ROM", 4}}, level.Warehouses)
+
+	// neither warehouse holds 5 units: the order is split, across the lines too
+	order := placeOrder(t, router, `{"items":[{"product_id":1,"quantity":2},{"product_id":1,"quantity":3}]}`)
+	require.Len(t, order.Items, 2)
+	assert.Equal(t, []Allocation{{WarehouseID: 2, Quantity: 2}}, order.Items[0].Allocations)
+	assert.Equal(t, []Allocation{{WarehouseID: 1, Quantity: 1}, {WarehouseID: 2, Quantity: 2}}, order.Items[1].Allocations)
+
+	rr = doJSON(router, "GET", "/orders/"+order.OrderID, "")
+	var stored OutgoingOrder
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stored))
+	assert.Equal(t, order.Items, stored.Items)
+	assert.Equal(t, []WarehouseStock{{1, "MAIN", 2}, {2, "ROM", 0}}, getStockLevel(t, router, "1").Warehouses)
+
+	// cancelling returns each unit to its warehouse
+	rr = doJSON(router, "POST", "/orders/"+order.OrderID+"/cancel", `{"reason":"changed mind"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, []WarehouseStock{{1, "MAIN", 3}, {2, "ROM", 4}}, getStockLevel(t, router, "1").Warehouses)
+}
+
+func TestCreateWarehouseHandler_Invalid(t *testing.T) {
+	store := NewInMemoryStore()
+	router := newOrdersRouter(store)
+
+	rr := doJSON(router, "POST", "/warehouses", `{"code":"main","name":"Another main"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	for body, field := range map[string]string{
+		`{"name":"x"}`:                           "code",
+		`{"code":"x"}`:                           "name",
+		`{"code":"x","name":"x","unit_cost":-1}`: "unit_cost",
+		`{"code":"x","name":"x","location":{"latitude":91,"longitude":0}}`: "location.latitude",
+	} {
+		rr = doJSON(router, "POST", "/warehouses", body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Contains(t, rr.Body.String(), `"field":"`+field+`"`, body)
+	}
+
+	rr = doJSON(router, "PUT", "/products/1/stock", `{"warehouse_id":9,"stock":1,"note":"x"}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Warehouse with ID 9 not found")
+
+	rr = doJSON(router, "GET", "/warehouses", "")
+	var warehouses []Warehouse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&warehouses))
+	require.Len(t, warehouses, 1)
+	assert.Equal(t, "MAIN", warehouses[0].Code)
+}